@@ -17,7 +17,7 @@ readonly SCRIPT_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" && pwd )"
 cd "$SCRIPT_DIR/.."
 
 # Install test dependencies
-go test -i
+go test -i ./...
 
 # Set the verbose flag so we get log output even if the tests pass
-go test -v -timeout "$TEST_TIMEOUT" -parallel "$TEST_PARALLELISM"
\ No newline at end of file
+go test -v -timeout "$TEST_TIMEOUT" -parallel "$TEST_PARALLELISM" ./...
\ No newline at end of file
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/mitchellh/cli"
+)
+
+const DEFAULT_ALARM_STATISTIC = cloudwatch.StatisticSum
+const DEFAULT_ALARM_PERIOD = 24 * time.Hour
+const DEFAULT_ALARM_EVALUATION_PERIODS = 1
+const DEFAULT_ALARM_THRESHOLD = 1
+const DEFAULT_ALARM_COMPARISON_OPERATOR = cloudwatch.ComparisonOperatorLessThanThreshold
+const DEFAULT_ALARM_TREAT_MISSING_DATA = "breaching"
+
+// The values PutMetricAlarm accepts for TreatMissingData
+var treatMissingDataValues = []string{"breaching", "notBreaching", "ignore", "missing"}
+
+type AlarmCommand struct {
+	Ui                 cli.Ui
+	AwsRegion          string
+	AlarmName          string
+	Namespace          string
+	MetricName         string
+	Dimensions         dimensionsFlag
+	Statistic          string
+	Period             time.Duration
+	EvaluationPeriods  int64
+	Threshold          float64
+	ComparisonOperator string
+	TreatMissingData   string
+	SnsTopicArns       string
+	NotifyOnOk         bool
+	Delete             bool
+	Aws                AwsOptions
+}
+
+// descriptions for args
+var alarmDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
+var alarmDscrAlarmName = "The name of the alarm (e.g. MyEc2BackupMissed)."
+var alarmDscrNamespace = "The CloudWatch namespace of the metric to watch (e.g. MyCustomMetrics)."
+var alarmDscrMetricName = "The name of the metric to watch (e.g. MyEC2Backup)."
+var alarmDscrDimension = "A dimension of the metric in the format Name=Value (e.g. InstanceName=web-1). Repeat for several dimensions. Must match the dimensions the metric is reported with."
+var alarmDscrStatistic = fmt.Sprintf("The statistic of the metric to compare to the threshold (%s). Defaults to %s.", strings.Join(cloudwatch.Statistic_Values(), ", "), DEFAULT_ALARM_STATISTIC)
+var alarmDscrPeriod = fmt.Sprintf("The period over which the statistic is computed, e.g. 1h. Must be 10s, 30s or a multiple of 60s. Defaults to %s.", DEFAULT_ALARM_PERIOD)
+var alarmDscrEvaluationPeriods = fmt.Sprintf("The number of consecutive periods that must breach the threshold for the alarm to fire. Defaults to %d.", DEFAULT_ALARM_EVALUATION_PERIODS)
+var alarmDscrThreshold = fmt.Sprintf("The value to compare the statistic to. Defaults to %d.", DEFAULT_ALARM_THRESHOLD)
+var alarmDscrComparisonOperator = fmt.Sprintf("How to compare the statistic to the threshold (%s). Defaults to %s.", strings.Join(cloudwatch.ComparisonOperator_Values(), ", "), DEFAULT_ALARM_COMPARISON_OPERATOR)
+var alarmDscrTreatMissingData = fmt.Sprintf("How to treat periods without data (%s). Defaults to %s, so the alarm fires when no backup was reported at all.", strings.Join(treatMissingDataValues, ", "), DEFAULT_ALARM_TREAT_MISSING_DATA)
+var alarmDscrSnsTopicArns = "The ARN of an SNS topic to notify when the alarm fires. Separate multiple ARNs with commas."
+var alarmDscrNotifyOnOk = "If true, also notify the SNS topics when the alarm returns to OK."
+var alarmDscrDelete = "If true, delete the alarm instead of creating or updating it. Only '--region' and '--alarm-name' are needed."
+
+func (c *AlarmCommand) Help() string {
+	return `ec2-snapper alarm <args> [--help]
+
+Create or update a CloudWatch alarm that fires when a backup metric (e.g. one
+written by the report command) shows that backups are missing, or delete it.
+
+Available args are:
+--region      		` + alarmDscrAwsRegion + `
+--alarm-name      	` + alarmDscrAlarmName + `
+--namespace      	` + alarmDscrNamespace + `
+--metric-name      	` + alarmDscrMetricName + `
+--dimension      	` + alarmDscrDimension + `
+--statistic      	` + alarmDscrStatistic + `
+--period      		` + alarmDscrPeriod + `
+--evaluation-periods	` + alarmDscrEvaluationPeriods + `
+--threshold      	` + alarmDscrThreshold + `
+--comparison-operator	` + alarmDscrComparisonOperator + `
+--treat-missing-data	` + alarmDscrTreatMissingData + `
+--sns-topic-arn      	` + alarmDscrSnsTopicArns + `
+--notify-on-ok      	` + alarmDscrNotifyOnOk + `
+--delete      		` + alarmDscrDelete + awsArgsHelp()
+}
+
+func (c *AlarmCommand) Synopsis() string {
+	return "Create, update or delete a CloudWatch alarm for missed backups"
+}
+
+// Define the args of the alarm command
+func (c *AlarmCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("alarm", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.AwsRegion, "region", "", alarmDscrAwsRegion)
+	cmdFlags.StringVar(&c.AlarmName, "alarm-name", "", alarmDscrAlarmName)
+	cmdFlags.StringVar(&c.Namespace, "namespace", "", alarmDscrNamespace)
+	cmdFlags.StringVar(&c.MetricName, "metric-name", "", alarmDscrMetricName)
+	cmdFlags.Var(&c.Dimensions, "dimension", alarmDscrDimension)
+	cmdFlags.StringVar(&c.Statistic, "statistic", DEFAULT_ALARM_STATISTIC, alarmDscrStatistic)
+	cmdFlags.DurationVar(&c.Period, "period", DEFAULT_ALARM_PERIOD, alarmDscrPeriod)
+	cmdFlags.Int64Var(&c.EvaluationPeriods, "evaluation-periods", DEFAULT_ALARM_EVALUATION_PERIODS, alarmDscrEvaluationPeriods)
+	cmdFlags.Float64Var(&c.Threshold, "threshold", DEFAULT_ALARM_THRESHOLD, alarmDscrThreshold)
+	cmdFlags.StringVar(&c.ComparisonOperator, "comparison-operator", DEFAULT_ALARM_COMPARISON_OPERATOR, alarmDscrComparisonOperator)
+	cmdFlags.StringVar(&c.TreatMissingData, "treat-missing-data", DEFAULT_ALARM_TREAT_MISSING_DATA, alarmDscrTreatMissingData)
+	cmdFlags.StringVar(&c.SnsTopicArns, "sns-topic-arn", "", alarmDscrSnsTopicArns)
+	cmdFlags.BoolVar(&c.NotifyOnOk, "notify-on-ok", false, alarmDscrNotifyOnOk)
+	cmdFlags.BoolVar(&c.Delete, "delete", false, alarmDscrDelete)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *AlarmCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+
+	if err := alarm(ctx, *c); err != nil {
+		err = explainCancellation(ctx, explainAwsError(err))
+		c.Ui.Error(err.Error())
+		return failureExitCode(err)
+	}
+
+	return 0
+}
+
+func alarm(ctx context.Context, c AlarmCommand) error {
+	if err := validateAlarmArgs(c); err != nil {
+		return err
+	}
+
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return err
+	}
+	svc := cloudwatch.New(session)
+
+	exists, err := alarmExists(ctx, c.AlarmName, svc)
+	if err != nil {
+		return err
+	}
+
+	if c.Delete {
+		if !exists {
+			c.Ui.Info("==> NO ACTION TAKEN. There is no alarm named \"" + c.AlarmName + "\".")
+			return nil
+		}
+
+		c.Ui.Output("==> Deleting alarm \"" + c.AlarmName + "\"...")
+		if _, err := svc.DeleteAlarmsWithContext(ctx, &cloudwatch.DeleteAlarmsInput{AlarmNames: []*string{aws.String(c.AlarmName)}}); err != nil {
+			return err
+		}
+		c.Ui.Info("==> Success! Deleted alarm \"" + c.AlarmName + "\".")
+		return nil
+	}
+
+	input, err := buildMetricAlarmInput(c)
+	if err != nil {
+		return err
+	}
+
+	// PutMetricAlarm overwrites an existing alarm of the same name, so running this again with the same args is safe
+	if exists {
+		c.Ui.Output("==> Updating alarm \"" + c.AlarmName + "\"...")
+	} else {
+		c.Ui.Output("==> Creating alarm \"" + c.AlarmName + "\"...")
+	}
+	if _, err := svc.PutMetricAlarmWithContext(ctx, input); err != nil {
+		return err
+	}
+
+	c.Ui.Info("==> Success! Alarm \"" + c.AlarmName + "\" fires when the " + c.Statistic + " of " + c.Namespace + "/" + c.MetricName + " is " + c.ComparisonOperator + " " + strconv.FormatFloat(c.Threshold, 'f', -1, 64) + " for " + strconv.FormatInt(c.EvaluationPeriods, 10) + " period(s) of " + c.Period.String() + ", with missing data treated as " + c.TreatMissingData + ".")
+	return nil
+}
+
+func alarmExists(ctx context.Context, alarmName string, svc *cloudwatch.CloudWatch) (bool, error) {
+	resp, err := svc.DescribeAlarmsWithContext(ctx, &cloudwatch.DescribeAlarmsInput{AlarmNames: []*string{aws.String(alarmName)}})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.MetricAlarms) > 0, nil
+}
+
+func buildMetricAlarmInput(c AlarmCommand) (*cloudwatch.PutMetricAlarmInput, error) {
+	dimensions, err := parseDimensions(c.Dimensions)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &cloudwatch.PutMetricAlarmInput{
+		AlarmName: aws.String(c.AlarmName),
+		AlarmDescription: aws.String("Created by ec2-snapper. Fires when backups reported to " + c.Namespace + "/" + c.MetricName + " are missing."),
+		Namespace: aws.String(c.Namespace),
+		MetricName: aws.String(c.MetricName),
+		Dimensions: toCloudWatchDimensions(dimensions),
+		Statistic: aws.String(c.Statistic),
+		Period: aws.Int64(int64(c.Period.Seconds())),
+		EvaluationPeriods: aws.Int64(c.EvaluationPeriods),
+		Threshold: aws.Float64(c.Threshold),
+		ComparisonOperator: aws.String(c.ComparisonOperator),
+		TreatMissingData: aws.String(c.TreatMissingData),
+		ActionsEnabled: aws.Bool(true),
+	}
+
+	topicArns := aws.StringSlice(splitList(c.SnsTopicArns))
+	input.AlarmActions = topicArns
+	if c.NotifyOnOk {
+		input.OKActions = topicArns
+	}
+
+	return input, nil
+}
+
+func validateAlarmArgs(c AlarmCommand) error {
+	if c.AwsRegion == "" {
+		return errors.New("ERROR: The argument '--region' is required.")
+	}
+
+	if c.AlarmName == "" {
+		return errors.New("ERROR: The argument '--alarm-name' is required.")
+	}
+
+	if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+		return err
+	}
+
+	if c.Delete {
+		return validateAwsOptions(c.Aws)
+	}
+
+	if c.Namespace == "" {
+		return errors.New("ERROR: The argument '--namespace' is required.")
+	}
+
+	if c.MetricName == "" {
+		return errors.New("ERROR: The argument '--metric-name' is required.")
+	}
+
+	if _, err := parseDimensions(c.Dimensions); err != nil {
+		return err
+	}
+
+	if !containsString(cloudwatch.Statistic_Values(), c.Statistic) {
+		return fmt.Errorf("ERROR: The argument '--statistic' must be one of %s.", strings.Join(cloudwatch.Statistic_Values(), ", "))
+	}
+
+	if err := validateAlarmPeriod(c.Period, c.EvaluationPeriods); err != nil {
+		return err
+	}
+
+	if !containsString(cloudwatch.ComparisonOperator_Values(), c.ComparisonOperator) {
+		return fmt.Errorf("ERROR: The argument '--comparison-operator' must be one of %s.", strings.Join(cloudwatch.ComparisonOperator_Values(), ", "))
+	}
+
+	if !containsString(treatMissingDataValues, c.TreatMissingData) {
+		return fmt.Errorf("ERROR: The argument '--treat-missing-data' must be one of %s.", strings.Join(treatMissingDataValues, ", "))
+	}
+
+	for _, topicArn := range splitList(c.SnsTopicArns) {
+		if !strings.HasPrefix(topicArn, "arn:") || !strings.Contains(topicArn, ":sns:") {
+			return fmt.Errorf("ERROR: '%s' is not the ARN of an SNS topic.", topicArn)
+		}
+	}
+
+	return validateAwsOptions(c.Aws)
+}
+
+// CloudWatch only accepts periods of 10s, 30s or a multiple of 60s, and evaluates at most one day of data, or seven days
+// for periods of an hour or longer
+func validateAlarmPeriod(period time.Duration, evaluationPeriods int64) error {
+	if period != 10 * time.Second && period != 30 * time.Second && (period <= 0 || period % time.Minute != 0) {
+		return errors.New("ERROR: The argument '--period' must be 10s, 30s or a multiple of 60s.")
+	}
+
+	if evaluationPeriods < 1 {
+		return errors.New("ERROR: The argument '--evaluation-periods' must be at least 1.")
+	}
+
+	maxEvaluationTime := 24 * time.Hour
+	if period >= time.Hour {
+		maxEvaluationTime = 7 * 24 * time.Hour
+	}
+	if period * time.Duration(evaluationPeriods) > maxEvaluationTime {
+		return fmt.Errorf("ERROR: '--period' times '--evaluation-periods' must be at most %s for a period of %s.", maxEvaluationTime, period)
+	}
+
+	return nil
+}
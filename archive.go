@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/retention"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+// Snapshots in the archive tier are billed for at least this long, even if they are deleted or restored earlier
+const MIN_ARCHIVE_PERIOD = 90 * 24 * time.Hour
+
+// DescribeSnapshotTierStatus accepts at most this many values per filter
+const MAX_SNAPSHOT_IDS_PER_TIER_STATUS_REQUEST = 200
+
+// The outcome of archiving, or deciding not to archive, a single snapshot of an old AMI
+type snapshotArchiveResult struct {
+	ImageId    string
+	SnapshotId string
+	// The tier the snapshot was in before, e.g. standard or archive
+	Tier string
+	// What happened, e.g. "archiving" or "already archived"
+	Action string
+	Err    error
+}
+
+// Return the tiering status of the given snapshots, by snapshot id. Snapshots that were never moved between tiers may
+// have no status.
+func findSnapshotTierStatuses(ctx context.Context, snapshotIds []string, svc *ec2.EC2) (map[string]*ec2.SnapshotTierStatus, error) {
+	statuses := map[string]*ec2.SnapshotTierStatus{}
+
+	for start := 0; start < len(snapshotIds); start += MAX_SNAPSHOT_IDS_PER_TIER_STATUS_REQUEST {
+		end := start + MAX_SNAPSHOT_IDS_PER_TIER_STATUS_REQUEST
+		if end > len(snapshotIds) {
+			end = len(snapshotIds)
+		}
+
+		err := svc.DescribeSnapshotTierStatusPagesWithContext(ctx, &ec2.DescribeSnapshotTierStatusInput{
+			Filters: []*ec2.Filter{
+				&ec2.Filter{Name: aws.String("snapshot-id"), Values: aws.StringSlice(snapshotIds[start:end])},
+			},
+		}, func(page *ec2.DescribeSnapshotTierStatusOutput, lastPage bool) bool {
+			for _, status := range page.SnapshotTierStatuses {
+				statuses[aws.StringValue(status.SnapshotId)] = status
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return statuses, nil
+}
+
+// Return when the snapshot was archived if it is archived, or the zero time otherwise
+func archivalTime(status *ec2.SnapshotTierStatus) time.Time {
+	if status == nil || aws.StringValue(status.StorageTier) != ec2.StorageTierArchive {
+		return time.Time{}
+	}
+	if status.ArchivalCompleteTime != nil {
+		return *status.ArchivalCompleteTime
+	}
+	return aws.TimeValue(status.LastTieringStartTime)
+}
+
+// Remove the AMIs with a snapshot that was archived less than MIN_ARCHIVE_PERIOD ago from the given AMIs, since
+// deleting them now would still be billed for the rest of the period. They are deleted by a later run instead.
+func excludeRecentlyArchivedAmis(ctx context.Context, amis []*ec2.Image, snapshots []*ec2.Snapshot, svc *ec2.EC2, now time.Time, ui cli.Ui) ([]*ec2.Image, error) {
+	var archivedSnapshotIds []string
+	for _, ami := range amis {
+		for _, snapshot := range snapper.SnapshotsOfImage(*ami.ImageId, snapshots) {
+			if aws.StringValue(snapshot.StorageTier) == ec2.StorageTierArchive {
+				archivedSnapshotIds = append(archivedSnapshotIds, *snapshot.SnapshotId)
+			}
+		}
+	}
+
+	// Only look up the tier status if there are archived snapshots, so delete doesn't need the permission otherwise
+	if len(archivedSnapshotIds) == 0 {
+		return amis, nil
+	}
+
+	statuses, err := findSnapshotTierStatuses(ctx, archivedSnapshotIds, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterRecentlyArchivedAmis(amis, snapshots, statuses, now, ui), nil
+}
+
+func filterRecentlyArchivedAmis(amis []*ec2.Image, snapshots []*ec2.Snapshot, statuses map[string]*ec2.SnapshotTierStatus, now time.Time, ui cli.Ui) []*ec2.Image {
+	var deletable []*ec2.Image
+
+	for _, ami := range amis {
+		keep := false
+		for _, snapshot := range snapper.SnapshotsOfImage(*ami.ImageId, snapshots) {
+			archivedAt := archivalTime(statuses[*snapshot.SnapshotId])
+			if !archivedAt.IsZero() && now.Sub(archivedAt) < MIN_ARCHIVE_PERIOD {
+				ui.Warn(fmt.Sprintf("%s: Not deleting the AMI yet. Its snapshot %s was archived at %s, and archived snapshots are billed for at least %d days.", *ami.ImageId, *snapshot.SnapshotId, archivedAt.Format(time.RFC3339), int(MIN_ARCHIVE_PERIOD.Hours() / 24)))
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			deletable = append(deletable, ami)
+		}
+	}
+
+	return deletable
+}
+
+// Decide what to do with a snapshot of an AMI that is old enough to archive. Snapshots that are already archived or
+// on their way there are left alone, and so are restored snapshots, since someone restored them on purpose.
+func archiveAction(snapshot *ec2.Snapshot, status *ec2.SnapshotTierStatus) string {
+	if aws.StringValue(snapshot.StorageTier) == ec2.StorageTierArchive {
+		return "already archived"
+	}
+	if aws.StringValue(snapshot.State) != ec2.SnapshotStateCompleted {
+		return "skipped: not completed"
+	}
+
+	if status != nil {
+		switch operation := aws.StringValue(status.LastTieringOperationStatus); {
+		case operation == ec2.TieringOperationStatusArchivalInProgress:
+			return "archival in progress"
+		case strings.Contains(operation, "restore"):
+			return "skipped: restored"
+		}
+	}
+
+	return "archive"
+}
+
+// Move the snapshots of the AMIs of the instance that are older than --archive-older-than to the archive tier, except
+// for the given AMIs, which were just deleted. Prints a table with the tier of every snapshot of those AMIs.
+func archiveOldSnapshots(ctx context.Context, c DeleteCommand, deletedAmiIds []string, svc *ec2.EC2) error {
+	images, err := snapper.FindImages(ctx, c.InstanceId, svc)
+	if err != nil || len(images) == 0 {
+		return err
+	}
+
+	hours, err := retention.ParseHours(c.ArchiveOlderThan)
+	if err != nil {
+		return err
+	}
+
+	deleteHours, err := retention.ParseHours(c.OlderThan)
+	if err != nil {
+		return err
+	}
+	if time.Duration((deleteHours - hours) * float64(time.Hour)) < MIN_ARCHIVE_PERIOD {
+		c.Ui.Warn(fmt.Sprintf("WARNING: '--older-than' is less than %d days after '--archive-older-than', so archived AMIs will be kept until they have been archived that long.", int(MIN_ARCHIVE_PERIOD.Hours() / 24)))
+	}
+
+	oldAmis, err := retention.FilterOlderThan(images, hours, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var amis []*ec2.Image
+	for _, ami := range oldAmis {
+		if !containsString(deletedAmiIds, *ami.ImageId) && *ami.State == ec2.ImageStateAvailable {
+			amis = append(amis, ami)
+		}
+	}
+	c.Ui.Output("==> Found " + strconv.Itoa(len(amis)) + " AMI(s) older than --archive-older-than=" + c.ArchiveOlderThan + " to archive.")
+	if len(amis) == 0 {
+		return nil
+	}
+
+	snapshots, err := snapper.FindSnapshots(ctx, *images[0].OwnerId, svc)
+	if err != nil {
+		return err
+	}
+
+	var snapshotIds []string
+	for _, ami := range amis {
+		for _, snapshot := range snapper.SnapshotsOfImage(*ami.ImageId, snapshots) {
+			snapshotIds = append(snapshotIds, *snapshot.SnapshotId)
+		}
+	}
+	statuses, err := findSnapshotTierStatuses(ctx, snapshotIds, svc)
+	if err != nil {
+		return err
+	}
+
+	var results []snapshotArchiveResult
+	numFailed := 0
+	for _, ami := range amis {
+		if err := cancellationError(ctx); err != nil {
+			printSnapshotArchiveResults(results, c.Ui)
+			return err
+		}
+
+		for _, snapshot := range snapper.SnapshotsOfImage(*ami.ImageId, snapshots) {
+			result := snapshotArchiveResult{ImageId: *ami.ImageId, SnapshotId: *snapshot.SnapshotId, Tier: aws.StringValue(snapshot.StorageTier)}
+			result.Action = archiveAction(snapshot, statuses[*snapshot.SnapshotId])
+
+			if result.Action == "archive" {
+				_, err := svc.ModifySnapshotTierWithContext(ctx, &ec2.ModifySnapshotTierInput{
+					SnapshotId: snapshot.SnapshotId,
+					StorageTier: aws.String(ec2.TargetStorageTierArchive),
+					DryRun: aws.Bool(c.DryRun),
+				})
+				if err := snapper.CheckDryRunError(err, c.DryRun, "ec2:ModifySnapshotTier"); err != nil {
+					result.Err = err
+					numFailed++
+				} else if c.DryRun {
+					result.Action = "would archive"
+				} else {
+					result.Action = "archiving"
+				}
+			}
+			results = append(results, result)
+		}
+	}
+
+	printSnapshotArchiveResults(results, c.Ui)
+
+	if numFailed > 0 {
+		return fmt.Errorf("ERROR: Failed to archive %d snapshot(s).", numFailed)
+	}
+	return nil
+}
+
+func printSnapshotArchiveResults(results []snapshotArchiveResult, ui cli.Ui) {
+	if len(results) == 0 {
+		return
+	}
+
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "AMI\tSNAPSHOT\tTIER\tRESULT")
+	for _, result := range results {
+		status := result.Action
+		if result.Err != nil {
+			status = "FAILED: " + result.Err.Error()
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", result.ImageId, result.SnapshotId, result.Tier, status)
+	}
+	writer.Flush()
+
+	ui.Output("")
+	ui.Output(strings.TrimRight(out.String(), "\n"))
+}
+
+// Check that --archive-older-than leaves AMIs in the archive tier for a while before --older-than deletes them
+func validateArchiveOlderThan(archiveOlderThan string, olderThan string, snapshotSets bool) error {
+	if snapshotSets {
+		return errors.New("ERROR: The argument '--archive-older-than' can't be used with '--snapshot-sets'.")
+	}
+
+	archiveHours, err := retention.ParseHours(archiveOlderThan)
+	if err != nil {
+		return fmt.Errorf("ERROR: Invalid value '%s' for '--archive-older-than': %s", archiveOlderThan, err.Error())
+	}
+
+	deleteHours, err := retention.ParseHours(olderThan)
+	if err != nil {
+		return fmt.Errorf("ERROR: Invalid value '%s' for '--older-than': %s", olderThan, err.Error())
+	}
+
+	if archiveHours >= deleteHours {
+		return errors.New("ERROR: The argument '--archive-older-than' must be less than '--older-than', or the AMIs would be deleted before they are archived.")
+	}
+
+	return nil
+}
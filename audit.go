@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/mitchellh/cli"
+)
+
+// The results of an audited API call
+const AUDIT_RESULT_SUCCESS = "success"
+const AUDIT_RESULT_FAILURE = "failure"
+const AUDIT_RESULT_DRY_RUN = "dry-run"
+
+// Sending the audit records to CloudWatch Logs and S3 gets its own time limit, so the records of an interrupted or
+// timed out run are still sent
+const AUDIT_UPLOAD_TIMEOUT = 30 * time.Second
+
+// CloudWatch Logs accepts at most 10,000 events per PutLogEvents call, of at most 1,048,576 bytes, where each event
+// counts as the size of its message plus 26 bytes, and spanning at most 24 hours
+const MAX_AUDIT_LOG_EVENTS_PER_CALL = 10000
+const MAX_AUDIT_LOG_BYTES_PER_CALL = 1048576
+const AUDIT_LOG_EVENT_OVERHEAD_BYTES = 26
+const MAX_AUDIT_LOG_SPAN_PER_CALL = 24 * time.Hour
+
+// The EC2 API calls that create, change or delete backups. Every call of these that create and delete make is recorded
+// in the audit log, whether it succeeds or not.
+var auditedOperations = []string{
+	"CreateImage", "CreateSnapshots", "CopyImage", "CreateTags", "DeleteTags", "ModifyImageAttribute",
+	"EnableImageDeprecation", "DisableImageDeprecation", "ModifySnapshotTier", "DeregisterImage", "DeleteSnapshot",
+}
+
+// Where create and delete record the API calls that change backups
+type AuditOptions struct {
+	File                string
+	CloudWatchLogGroup  string
+	CloudWatchLogStream string
+	S3Uri               string
+}
+
+// descriptions for args
+var auditDscrFile = "Append a record of every " + strings.Join(auditedOperations, ", ") + " call, with the caller identity, the retention rule that caused it and its result, to this JSON Lines file. Query it with the 'audit' command."
+var auditDscrCloudWatchLogGroup = "Also send the audit records to this existing CloudWatch Logs log group, in the first region of '--region'. Requires '--audit-log'."
+var auditDscrCloudWatchLogStream = "The log stream of '--audit-cloudwatch-log-group' to send the audit records to; it is created if it doesn't exist. Defaults to ec2-snapper-<hostname>."
+var auditDscrS3Uri = "Also upload the audit records of each run as a new object under this S3 URI, e.g. s3://my-bucket/audit/. The bucket must be in the first region of '--region'. Requires '--audit-log'."
+
+// The help text for the audit args, to be appended to the help text of create and delete
+func auditArgsHelp() string {
+	return `
+--audit-log      	` + auditDscrFile + `
+--audit-cloudwatch-log-group	` + auditDscrCloudWatchLogGroup + `
+--audit-cloudwatch-log-stream	` + auditDscrCloudWatchLogStream + `
+--audit-s3-uri      	` + auditDscrS3Uri
+}
+
+func addAuditFlags(cmdFlags *flag.FlagSet, options *AuditOptions) {
+	cmdFlags.StringVar(&options.File, "audit-log", "", auditDscrFile)
+	cmdFlags.StringVar(&options.CloudWatchLogGroup, "audit-cloudwatch-log-group", "", auditDscrCloudWatchLogGroup)
+	cmdFlags.StringVar(&options.CloudWatchLogStream, "audit-cloudwatch-log-stream", "", auditDscrCloudWatchLogStream)
+	cmdFlags.StringVar(&options.S3Uri, "audit-s3-uri", "", auditDscrS3Uri)
+}
+
+func validateAuditOptions(options AuditOptions) error {
+	if options.File == "" && (options.CloudWatchLogGroup != "" || options.CloudWatchLogStream != "" || options.S3Uri != "") {
+		return errors.New("ERROR: The arguments '--audit-cloudwatch-log-group', '--audit-cloudwatch-log-stream' and '--audit-s3-uri' can only be used with '--audit-log'.")
+	}
+
+	if options.CloudWatchLogStream != "" && options.CloudWatchLogGroup == "" {
+		return errors.New("ERROR: The argument '--audit-cloudwatch-log-stream' can only be used with '--audit-cloudwatch-log-group'.")
+	}
+
+	if options.S3Uri != "" {
+		if _, _, err := parseS3Uri(options.S3Uri); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parse an S3 URI like s3://my-bucket/audit/ into the bucket and the key prefix
+func parseS3Uri(uri string) (string, string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "s3" || parsed.Host == "" {
+		return "", "", fmt.Errorf("ERROR: The argument '--audit-s3-uri' must be an S3 URI like s3://my-bucket/audit/, but was '%s'.", uri)
+	}
+	return parsed.Host, strings.TrimPrefix(parsed.Path, "/"), nil
+}
+
+// A single API call in the audit log
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Command     string    `json:"command"`
+	Action      string    `json:"action"`
+	DryRun      bool      `json:"dryRun"`
+	Region      string    `json:"region"`
+	AccountId   string    `json:"accountId"`
+	Caller      string    `json:"caller"`
+	InstanceId  string    `json:"instanceId"`
+	ResourceIds []string  `json:"resourceIds"`
+	Rule        string    `json:"rule"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+	RequestId   string    `json:"requestId"`
+}
+
+// Writes the audit log of a run of create or delete. A nil auditor records nothing, so create and delete don't have to
+// check whether auditing is enabled.
+type auditor struct {
+	command             string
+	file                *os.File
+	cloudWatchLogGroup  string
+	cloudWatchLogStream string
+	s3Uri               string
+	region              string
+	aws                 AwsOptions
+	sessions            *awsSessions
+	ui                  cli.Ui
+	now                 func() time.Time
+
+	mutex sync.Mutex
+	// Kept to send them to CloudWatch Logs and S3 once the run is done
+	records []auditRecord
+	// The identities of the callers, by the role they assumed, or "" for none
+	callers map[string]*sts.GetCallerIdentityOutput
+}
+
+// Open the audit log of a run of the given command. The records are sent to CloudWatch Logs and S3 in the first of the
+// given regions, with the credentials the command starts with, i.e. in the account the command is run from rather than
+// any account it assumes a role in.
+func newAuditor(command string, options AuditOptions, awsRegion string, awsOptions AwsOptions, sessions *awsSessions, ui cli.Ui) (*auditor, error) {
+	if options.File == "" {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(options.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Could not open the audit log '%s': %s", options.File, err.Error())
+	}
+
+	stream := options.CloudWatchLogStream
+	if stream == "" {
+		hostname, _ := os.Hostname()
+		stream = "ec2-snapper-" + hostname
+	}
+
+	awsOptions.RoleArn = ""
+	awsOptions.OrganizationalUnit = ""
+
+	region := ""
+	if regions := splitList(awsRegion); len(regions) > 0 {
+		region = regions[0]
+	}
+
+	return &auditor{
+		command: command,
+		file: file,
+		cloudWatchLogGroup: options.CloudWatchLogGroup,
+		cloudWatchLogStream: stream,
+		s3Uri: options.S3Uri,
+		region: region,
+		aws: awsOptions,
+		sessions: sessions,
+		ui: ui,
+		now: time.Now,
+		callers: map[string]*sts.GetCallerIdentityOutput{},
+	}, nil
+}
+
+// What the audited API calls made with a context are about
+type auditScope struct {
+	auditor    *auditor
+	InstanceId string
+	Rule       string
+	AccountId  string
+	Caller     string
+}
+
+type auditorKey struct{}
+type auditScopeKey struct{}
+
+// Return a context whose audited API calls are recorded by the given auditor, once auditInstance says what they are
+// about
+func withAuditor(ctx context.Context, a *auditor) context.Context {
+	if a == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, auditorKey{}, a)
+}
+
+// Return a context whose audited API calls are recorded as calls about the given instance, caused by the given
+// retention rule and made by the caller the given STS client authenticates as. Fails if the caller can't be identified,
+// so that no call is made that can't be audited. Returns ctx unchanged if auditing is disabled.
+func auditInstance(ctx context.Context, instanceId string, rule string, roleArn string, svc *sts.STS) (context.Context, error) {
+	a, ok := ctx.Value(auditorKey{}).(*auditor)
+	if !ok {
+		return ctx, nil
+	}
+
+	identity, err := a.callerIdentity(ctx, roleArn, svc)
+	if err != nil {
+		return ctx, fmt.Errorf("ERROR: Could not get the caller identity for the audit log: %s", err.Error())
+	}
+
+	return context.WithValue(ctx, auditScopeKey{}, &auditScope{
+		auditor: a,
+		InstanceId: instanceId,
+		Rule: rule,
+		AccountId: aws.StringValue(identity.Account),
+		Caller: aws.StringValue(identity.Arn),
+	}), nil
+}
+
+// Return a context whose audited API calls are recorded as caused by the given rule instead of the rule of ctx
+func withAuditRule(ctx context.Context, rule string) context.Context {
+	scope, ok := ctx.Value(auditScopeKey{}).(*auditScope)
+	if !ok {
+		return ctx
+	}
+
+	ruleScope := *scope
+	ruleScope.Rule = rule
+	return context.WithValue(ctx, auditScopeKey{}, &ruleScope)
+}
+
+// Identities don't change during a run, so each is only looked up once per role
+func (a *auditor) callerIdentity(ctx context.Context, roleArn string, svc *sts.STS) (*sts.GetCallerIdentityOutput, error) {
+	a.mutex.Lock()
+	identity, ok := a.callers[roleArn]
+	a.mutex.Unlock()
+	if ok {
+		return identity, nil
+	}
+
+	identity, err := svc.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	a.callers[roleArn] = identity
+	a.mutex.Unlock()
+	return identity, nil
+}
+
+// Record the given API call in the audit log if it is one of the auditedOperations and was made with a context from
+// auditInstance. newSession adds this to the handlers of every session.
+func auditAwsCall(r *request.Request) {
+	scope, ok := r.Context().Value(auditScopeKey{}).(*auditScope)
+	if !ok || r.ClientInfo.ServiceName != ec2.ServiceName || !containsString(auditedOperations, r.Operation.Name) {
+		return
+	}
+
+	record := auditRecord{
+		Time: scope.auditor.now().UTC(),
+		Command: scope.auditor.command,
+		Action: "ec2:" + r.Operation.Name,
+		DryRun: awsDryRun(r.Params),
+		Region: aws.StringValue(r.Config.Region),
+		AccountId: scope.AccountId,
+		Caller: scope.Caller,
+		InstanceId: scope.InstanceId,
+		ResourceIds: awsResourceIds(r.Params),
+		Rule: scope.Rule,
+		Result: AUDIT_RESULT_SUCCESS,
+		RequestId: r.RequestID,
+	}
+
+	// With DryRun set, EC2 reports that a call would have succeeded as the error DryRunOperation
+	if r.Error != nil {
+		if awsErr, ok := r.Error.(awserr.Error); ok && awsErr.Code() == "DryRunOperation" {
+			record.Result = AUDIT_RESULT_DRY_RUN
+		} else {
+			record.Result = AUDIT_RESULT_FAILURE
+			record.Error = r.Error.Error()
+		}
+	}
+
+	scope.auditor.record(record)
+}
+
+// Return true if the params of an AWS API call have DryRun set
+func awsDryRun(params interface{}) bool {
+	value := reflect.Indirect(reflect.ValueOf(params))
+	if value.Kind() != reflect.Struct {
+		return false
+	}
+
+	field := value.FieldByName("DryRun")
+	if !field.IsValid() {
+		return false
+	}
+	dryRun, ok := field.Interface().(*bool)
+	return ok && aws.BoolValue(dryRun)
+}
+
+// Append the record to the audit log right away, so it survives even if the process doesn't
+func (a *auditor) record(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		a.ui.Error("ERROR: Could not encode the audit record of " + record.Action + ": " + err.Error())
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		a.ui.Error("ERROR: Could not write the audit record of " + record.Action + " to " + a.file.Name() + ": " + err.Error())
+	}
+	a.records = append(a.records, record)
+}
+
+// Send the records of the run to CloudWatch Logs and S3, if enabled, and close the audit log. Returns an error if the
+// records could not be sent.
+func (a *auditor) close() error {
+	if a == nil {
+		return nil
+	}
+	defer a.file.Close()
+
+	if len(a.records) == 0 || (a.cloudWatchLogGroup == "" && a.s3Uri == "") {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AUDIT_UPLOAD_TIMEOUT)
+	defer cancel()
+
+	session, err := a.sessions.get(a.region, a.aws, a.ui)
+	if err != nil {
+		return err
+	}
+
+	if a.cloudWatchLogGroup != "" {
+		if err := putAuditLogEvents(ctx, a.records, a.cloudWatchLogGroup, a.cloudWatchLogStream, cloudwatchlogs.New(session)); err != nil {
+			return fmt.Errorf("ERROR: Could not send the audit records to the CloudWatch Logs log group %s: %s", a.cloudWatchLogGroup, explainAwsError(err).Error())
+		}
+	}
+
+	if a.s3Uri != "" {
+		if err := putAuditObject(ctx, a.records, a.command, a.s3Uri, a.now(), s3.New(session)); err != nil {
+			return fmt.Errorf("ERROR: Could not upload the audit records to %s: %s", a.s3Uri, explainAwsError(err).Error())
+		}
+	}
+
+	return nil
+}
+
+// Send the records as events to the given log stream, creating the stream if it doesn't exist yet
+func putAuditLogEvents(ctx context.Context, records []auditRecord, logGroup string, logStream string, svc *cloudwatchlogs.CloudWatchLogs) error {
+	_, err := svc.CreateLogStreamWithContext(ctx, &cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName: aws.String(logGroup),
+		LogStreamName: aws.String(logStream),
+	})
+	if awsErr, ok := err.(awserr.Error); err != nil && !(ok && awsErr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException) {
+		return err
+	}
+
+	// The events of a call must be in chronological order
+	events := []*cloudwatchlogs.InputLogEvent{}
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		events = append(events, &cloudwatchlogs.InputLogEvent{
+			Message: aws.String(string(line)),
+			Timestamp: aws.Int64(record.Time.UnixNano() / int64(time.Millisecond)),
+		})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return *events[i].Timestamp < *events[j].Timestamp })
+
+	for _, batch := range batchAuditLogEvents(events) {
+		_, err := svc.PutLogEventsWithContext(ctx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName: aws.String(logGroup),
+			LogStreamName: aws.String(logStream),
+			LogEvents: batch,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Split the given events, which are in chronological order, into batches that each fit into a single PutLogEvents
+// call: at most MAX_AUDIT_LOG_EVENTS_PER_CALL events of at most MAX_AUDIT_LOG_BYTES_PER_CALL bytes in total, spanning
+// at most MAX_AUDIT_LOG_SPAN_PER_CALL
+func batchAuditLogEvents(events []*cloudwatchlogs.InputLogEvent) [][]*cloudwatchlogs.InputLogEvent {
+	maxSpanMs := int64(MAX_AUDIT_LOG_SPAN_PER_CALL / time.Millisecond)
+
+	var batches [][]*cloudwatchlogs.InputLogEvent
+	var batch []*cloudwatchlogs.InputLogEvent
+	batchBytes := 0
+	for _, event := range events {
+		eventBytes := len(*event.Message) + AUDIT_LOG_EVENT_OVERHEAD_BYTES
+		if len(batch) > 0 && (len(batch) == MAX_AUDIT_LOG_EVENTS_PER_CALL || batchBytes+eventBytes > MAX_AUDIT_LOG_BYTES_PER_CALL || *event.Timestamp-*batch[0].Timestamp > maxSpanMs) {
+			batches = append(batches, batch)
+			batch = nil
+			batchBytes = 0
+		}
+		batch = append(batch, event)
+		batchBytes += eventBytes
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// Upload the records as a JSON Lines object under the given S3 URI, named after the command and the time of the run so
+// runs never overwrite each other
+func putAuditObject(ctx context.Context, records []auditRecord, command string, s3Uri string, now time.Time, svc *s3.S3) error {
+	bucket, prefix, err := parseS3Uri(s3Uri)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key: aws.String(auditObjectKey(prefix, command, now)),
+		Body: bytes.NewReader(body.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	return err
+}
+
+func auditObjectKey(prefix string, command string, now time.Time) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return fmt.Sprintf("%sec2-snapper-%s-%s-%s.jsonl", prefix, command, now.UTC().Format("20060102T150405Z"), UniqueId())
+}
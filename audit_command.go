@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/josh-padnick/ec2-snapper/retention"
+	"github.com/mitchellh/cli"
+)
+
+const AUDIT_FORMAT_TABLE = "table"
+const AUDIT_FORMAT_JSON = "json"
+
+var auditFormats = []string{AUDIT_FORMAT_TABLE, AUDIT_FORMAT_JSON}
+
+// A record of the audit log can be at most this long
+const MAX_AUDIT_RECORD_SIZE = 1024 * 1024
+
+type AuditCommand struct {
+	Ui         cli.Ui
+	File       string
+	InstanceId string
+	Since      string
+	Until      string
+	Format     string
+}
+
+// descriptions for args
+var auditCmdDscrFile = "The path of the audit log written by create and delete with '--audit-log'."
+var auditCmdDscrInstanceId = "Only show the records of the instance with this id. Separate multiple ids with commas."
+var auditCmdDscrSince = "Only show the records from this time on: a date (e.g. 2016-09-14), a time in RFC 3339 format (e.g. 2016-09-14T08:00:00Z), or an age like '30d' or '12h'."
+var auditCmdDscrUntil = "Only show the records before this time, in the same formats as '--since'. A date includes the whole day."
+var auditCmdDscrFormat = "The output format (" + strings.Join(auditFormats, ", ") + "). Defaults to " + AUDIT_FORMAT_TABLE + "."
+
+func (c *AuditCommand) Help() string {
+	return `ec2-snapper audit <args> [--help]
+
+Show the AMIs and snapshots create and delete created, tagged, de-registered and deleted, who did it and why, from
+the audit log they write with '--audit-log'.
+
+Available args are:
+--audit-log      	` + auditCmdDscrFile + `
+--instance-id      	` + auditCmdDscrInstanceId + `
+--since      		` + auditCmdDscrSince + `
+--until      		` + auditCmdDscrUntil + `
+--format      		` + auditCmdDscrFormat
+}
+
+func (c *AuditCommand) Synopsis() string {
+	return "Show the audit log of create and delete"
+}
+
+// Define the args of the audit command
+func (c *AuditCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("audit", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.File, "audit-log", "", auditCmdDscrFile)
+	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", auditCmdDscrInstanceId)
+	cmdFlags.StringVar(&c.Since, "since", "", auditCmdDscrSince)
+	cmdFlags.StringVar(&c.Until, "until", "", auditCmdDscrUntil)
+	cmdFlags.StringVar(&c.Format, "format", AUDIT_FORMAT_TABLE, auditCmdDscrFormat)
+
+	return cmdFlags
+}
+
+func (c *AuditCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if err := audit(*c, time.Now()); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// Print the records of the audit log that match the args
+func audit(c AuditCommand, now time.Time) error {
+	if err := validateAuditArgs(c); err != nil {
+		return err
+	}
+
+	since, err := parseAuditTime(c.Since, now, false)
+	if err != nil {
+		return fmt.Errorf("ERROR: Invalid value for '--since'. %s", err.Error())
+	}
+	until, err := parseAuditTime(c.Until, now, true)
+	if err != nil {
+		return fmt.Errorf("ERROR: Invalid value for '--until'. %s", err.Error())
+	}
+
+	records, err := readAuditLog(c.File)
+	if err != nil {
+		return err
+	}
+
+	records = filterAuditRecords(records, splitList(c.InstanceId), since, until)
+
+	if c.Format == AUDIT_FORMAT_JSON {
+		bytes, err := json.MarshalIndent(records, "", "    ")
+		if err != nil {
+			return err
+		}
+		outputResult(c.Ui, string(bytes))
+		return nil
+	}
+
+	if len(records) == 0 {
+		c.Ui.Info("==> No audit records match.")
+		return nil
+	}
+	outputResult(c.Ui, formatAuditTable(records))
+	return nil
+}
+
+func validateAuditArgs(c AuditCommand) error {
+	if c.File == "" {
+		return errors.New("ERROR: The argument '--audit-log' is required.")
+	}
+
+	if !containsString(auditFormats, c.Format) {
+		return fmt.Errorf("ERROR: The argument '--format' must be one of %s.", strings.Join(auditFormats, ", "))
+	}
+
+	return nil
+}
+
+// Parse the value of --since or --until. Returns the zero time for an empty value, which matches every record. For
+// --until, a date means the end of that day.
+func parseAuditTime(value string, now time.Time, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+
+	hours, err := retention.ParseHours(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is not a date, an RFC 3339 time or an age like '30d'.", value)
+	}
+	return now.Add(-time.Duration(hours * float64(time.Hour))), nil
+}
+
+// Read every record of the audit log at the given path, in the order they were written
+func readAuditLog(path string) ([]auditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Could not open the audit log '%s': %s", path, err.Error())
+	}
+	defer file.Close()
+
+	records := []auditRecord{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), MAX_AUDIT_RECORD_SIZE)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var record auditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("ERROR: Line %d of the audit log '%s' is not a valid record: %s", lineNumber, path, err.Error())
+		}
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ERROR: Could not read the audit log '%s': %s", path, err.Error())
+	}
+	return records, nil
+}
+
+// Return the records of any of the given instances, or of all instances if none are given, from since (inclusive) to
+// until (exclusive). A zero since or until doesn't limit the records.
+func filterAuditRecords(records []auditRecord, instanceIds []string, since time.Time, until time.Time) []auditRecord {
+	filtered := []auditRecord{}
+	for _, record := range records {
+		if len(instanceIds) > 0 && !containsString(instanceIds, record.InstanceId) {
+			continue
+		}
+		if !since.IsZero() && record.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !record.Time.Before(until) {
+			continue
+		}
+		filtered = append(filtered, record)
+	}
+	return filtered
+}
+
+func formatAuditTable(records []auditRecord) string {
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tACTION\tINSTANCE\tRESOURCES\tCALLER\tRULE\tRESULT")
+	for _, record := range records {
+		result := record.Result
+		if record.Error != "" {
+			result += ": " + strings.Replace(record.Error, "\n", " ", -1)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.Time.Format(time.RFC3339), record.Action, record.InstanceId, strings.Join(record.ResourceIds, ","), record.Caller, record.Rule, result)
+	}
+	writer.Flush()
+	return strings.TrimRight(out.String(), "\n")
+}
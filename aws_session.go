@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/mitchellh/cli"
+)
+
+const NO_CREDENTIALS_MESSAGE = "ERROR: No AWS credentials were found.  Either set the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, use '--profile' to pick a profile from your AWS config files, or run this program on an EC2 instance that has an IAM Role with the appropriate permissions."
+
+// How ec2-snapper authenticates to AWS, retries failed calls and times out. Every command that calls AWS accepts these
+// args.
+type AwsOptions struct {
+	Profile         string
+	RoleArn         string
+	ExternalId      string
+	MfaSerial       string
+	SessionDuration time.Duration
+	Retry           RetryPolicy
+	Timeout         time.Duration
+
+	// Where to send API calls instead of the public AWS endpoints, e.g. LocalStack or VPC interface endpoints
+	EndpointUrl           string
+	Ec2EndpointUrl        string
+	CloudWatchEndpointUrl string
+	CaBundle              string
+
+	// Only set for the commands that fan out across accounts; see addTargetFlags
+	OrganizationalUnit string
+	RoleName           string
+}
+
+// descriptions for args
+var awsDscrProfile = "The name of a profile in your AWS config files to take credentials and settings from."
+var awsDscrRoleArn = "The ARN of an IAM role to assume, e.g. to back up instances in another AWS account. The create and delete commands accept several ARNs separated by commas and run in each account."
+var awsDscrExternalId = "The external id to pass when assuming '--role-arn', if its trust policy requires one."
+var awsDscrMfaSerial = "The serial number or ARN of the MFA device to use when assuming '--role-arn'. The token code is read from stdin."
+var awsDscrSessionDuration = "How long the credentials of the assumed '--role-arn' are valid, e.g. 1h. Defaults to 15m."
+var awsDscrEndpointUrl = "The URL to send all AWS API calls to instead of the public AWS endpoints, e.g. http://localhost:4566 for LocalStack."
+var awsDscrEc2EndpointUrl = "The URL to send EC2 API calls to, e.g. a VPC interface endpoint. Overrides '--endpoint-url' for EC2."
+var awsDscrCloudWatchEndpointUrl = "The URL to send CloudWatch API calls to, e.g. a VPC interface endpoint. Overrides '--endpoint-url' for CloudWatch."
+var awsDscrTimeout = "Abort the command if it hasn't finished after this long, e.g. 30m, including any AWS API call that hangs. Defaults to no timeout."
+var awsDscrCaBundle = "The path to a PEM file with the CA certificates to trust when connecting to AWS, e.g. for a TLS-intercepting proxy. Overrides the AWS_CA_BUNDLE environment variable."
+
+// The help text for the AWS args, to be appended to the help text of every command that calls AWS
+func awsArgsHelp() string {
+	return `
+--profile      		` + awsDscrProfile + `
+--role-arn      	` + awsDscrRoleArn + `
+--external-id      	` + awsDscrExternalId + `
+--mfa-serial      	` + awsDscrMfaSerial + `
+--session-duration	` + awsDscrSessionDuration + `
+--endpoint-url      	` + awsDscrEndpointUrl + `
+--ec2-endpoint-url	` + awsDscrEc2EndpointUrl + `
+--cloudwatch-endpoint-url	` + awsDscrCloudWatchEndpointUrl + `
+--ca-bundle      	` + awsDscrCaBundle + `
+--timeout      		` + awsDscrTimeout + retryArgsHelp()
+}
+
+func addAwsFlags(cmdFlags *flag.FlagSet, options *AwsOptions) {
+	cmdFlags.StringVar(&options.Profile, "profile", "", awsDscrProfile)
+	cmdFlags.StringVar(&options.RoleArn, "role-arn", "", awsDscrRoleArn)
+	cmdFlags.StringVar(&options.ExternalId, "external-id", "", awsDscrExternalId)
+	cmdFlags.StringVar(&options.MfaSerial, "mfa-serial", "", awsDscrMfaSerial)
+	cmdFlags.DurationVar(&options.SessionDuration, "session-duration", 0, awsDscrSessionDuration)
+	cmdFlags.StringVar(&options.EndpointUrl, "endpoint-url", "", awsDscrEndpointUrl)
+	cmdFlags.StringVar(&options.Ec2EndpointUrl, "ec2-endpoint-url", "", awsDscrEc2EndpointUrl)
+	cmdFlags.StringVar(&options.CloudWatchEndpointUrl, "cloudwatch-endpoint-url", "", awsDscrCloudWatchEndpointUrl)
+	cmdFlags.StringVar(&options.CaBundle, "ca-bundle", "", awsDscrCaBundle)
+	cmdFlags.DurationVar(&options.Timeout, "timeout", 0, awsDscrTimeout)
+	addRetryFlags(cmdFlags, &options.Retry)
+}
+
+func validateAwsOptions(options AwsOptions) error {
+	if options.RoleArn == "" && options.OrganizationalUnit == "" && (options.ExternalId != "" || options.MfaSerial != "" || options.SessionDuration != 0) {
+		return errors.New("ERROR: The arguments '--external-id', '--mfa-serial' and '--session-duration' can only be used when assuming a role.")
+	}
+
+	if options.SessionDuration < 0 {
+		return errors.New("ERROR: The argument '--session-duration' must not be negative.")
+	}
+
+	if options.Timeout < 0 {
+		return errors.New("ERROR: The argument '--timeout' must not be negative.")
+	}
+
+	endpointArgs := map[string]string{
+		"endpoint-url": options.EndpointUrl,
+		"ec2-endpoint-url": options.Ec2EndpointUrl,
+		"cloudwatch-endpoint-url": options.CloudWatchEndpointUrl,
+	}
+	for arg, value := range endpointArgs {
+		if err := validateEndpointUrl(arg, value); err != nil {
+			return err
+		}
+	}
+
+	return validateRetryPolicy(options.Retry)
+}
+
+// An endpoint URL must be absolute, e.g. https://ec2.us-east-1.amazonaws.com or http://localhost:4566
+func validateEndpointUrl(arg string, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("ERROR: The argument '--%s' must be an http or https URL, but was '%s'.", arg, value)
+	}
+	return nil
+}
+
+// Resolve the endpoint of every AWS service to the per-service override or the general endpoint URL, if one is set,
+// and to the public AWS endpoint otherwise. Requests are still signed for the session's region.
+func newEndpointResolver(options AwsOptions) endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service string, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		endpointUrl := options.EndpointUrl
+		switch {
+		case service == endpoints.Ec2ServiceID && options.Ec2EndpointUrl != "":
+			endpointUrl = options.Ec2EndpointUrl
+		case service == endpoints.MonitoringServiceID && options.CloudWatchEndpointUrl != "":
+			endpointUrl = options.CloudWatchEndpointUrl
+		}
+
+		if endpointUrl == "" {
+			return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+		}
+		return endpoints.ResolvedEndpoint{URL: endpointUrl, SigningRegion: region}, nil
+	})
+}
+
+// Create an AWS session for the given region. Credentials come from the given profile (or the default credential
+// chain), and if a role ARN is given, that role is assumed with them. API calls are retried according to the retry
+// policy, and every call that needed retries is reported to the given Ui; at --log-level=debug, every call is logged
+// too. Calls that change backups are recorded in the audit log if their context is set up for it; see auditInstance.
+// This and awsSessions are the only places sessions are created, so every command honors the same credential,
+// endpoint, retry and log args.
+func newSession(region string, options AwsOptions, ui cli.Ui) (*session.Session, error) {
+	session, err := newBaseSession(region, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.RoleArn != "" {
+		session.Config.Credentials = assumeRoleCredentials(session, options.RoleArn, options)
+	}
+
+	addSessionHandlers(session, ui)
+	return session, nil
+}
+
+// Create a session with the credentials of the given profile (or the default credential chain), without assuming a
+// role or reporting to a Ui yet
+func newBaseSession(region string, options AwsOptions) (*session.Session, error) {
+	policy := options.Retry.withDefaults()
+
+	config := &aws.Config{Region: &region, EndpointResolver: newEndpointResolver(options)}
+	sessionOptions := session.Options{
+		Config: *request.WithRetryer(config, newBackoffRetryer(policy)),
+		Profile: options.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	}
+
+	if options.CaBundle != "" {
+		caBundle, err := os.Open(options.CaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: Could not open the CA bundle '%s': %s", options.CaBundle, err.Error())
+		}
+		defer caBundle.Close()
+		sessionOptions.CustomCABundle = caBundle
+	}
+
+	session, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, explainAwsError(err)
+	}
+	return session, nil
+}
+
+// Return the credentials of the given role, assumed with the credentials of the given session. They are only
+// requested, and an MFA token only read, once they are first used.
+func assumeRoleCredentials(session *session.Session, roleArn string, options AwsOptions) *credentials.Credentials {
+	return stscreds.NewCredentials(session, roleArn, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = fmt.Sprintf("ec2-snapper-%d", time.Now().Unix())
+		if options.ExternalId != "" {
+			provider.ExternalID = aws.String(options.ExternalId)
+		}
+		if options.MfaSerial != "" {
+			provider.SerialNumber = aws.String(options.MfaSerial)
+			provider.TokenProvider = stscreds.StdinTokenProvider
+		}
+		if options.SessionDuration != 0 {
+			provider.Duration = options.SessionDuration
+		}
+	})
+}
+
+// Report retries to the given Ui, log every call and audit the calls that change backups
+func addSessionHandlers(session *session.Session, ui cli.Ui) {
+	session.Handlers.Complete.PushBack(func(r *request.Request) {
+		if r.RetryCount == 0 {
+			return
+		}
+		if r.Error != nil {
+			ui.Warn(fmt.Sprintf("==> %s failed after %d retries.", r.Operation.Name, r.RetryCount))
+		} else {
+			ui.Warn(fmt.Sprintf("==> %s succeeded after %d retries.", r.Operation.Name, r.RetryCount))
+		}
+	})
+
+	logAwsCalls(&session.Handlers, ui)
+	session.Handlers.Complete.PushBack(auditAwsCall)
+}
+
+// The credentials of a command that runs in several accounts, regions or instances, shared by all of them: the
+// profile is loaded and each role assumed only once, so an MFA token is read from stdin at most once per role rather
+// than once per instance, and concurrent instances don't race for it. A nil awsSessions creates a new session every
+// time, like newSession.
+type awsSessions struct {
+	options AwsOptions
+
+	mutex sync.Mutex
+	base  *session.Session
+	roles map[string]*credentials.Credentials
+}
+
+// Share the credentials of the given options. The role ARNs come from the targets rather than the options.
+func newAwsSessions(options AwsOptions) *awsSessions {
+	options.RoleArn = ""
+	options.OrganizationalUnit = ""
+	return &awsSessions{options: options, roles: map[string]*credentials.Credentials{}}
+}
+
+// Return a session for the given region that assumes the role of the given options, or uses the credentials the
+// command starts with if there is none, and reports to the given Ui. Only the role ARN of the options is used; the
+// rest must be the options the sessions were created with.
+func (s *awsSessions) get(region string, options AwsOptions, ui cli.Ui) (*session.Session, error) {
+	if s == nil {
+		return newSession(region, options, ui)
+	}
+	roleArn := options.RoleArn
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.base == nil {
+		base, err := newBaseSession(region, s.options)
+		if err != nil {
+			return nil, err
+		}
+		s.base = base
+	}
+
+	config := &aws.Config{Region: aws.String(region)}
+	if roleArn != "" {
+		if _, ok := s.roles[roleArn]; !ok {
+			s.roles[roleArn] = assumeRoleCredentials(s.base, roleArn, s.options)
+		}
+		config.Credentials = s.roles[roleArn]
+	}
+
+	session := s.base.Copy(config)
+	addSessionHandlers(session, ui)
+	return session, nil
+}
+
+// Replace the errors the AWS SDK returns for missing, invalid or expired credentials with an explanation of how to fix
+// them. All other errors are returned unchanged.
+func explainAwsError(err error) error {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+
+	switch awsErr.Code() {
+	case "NoCredentialProviders":
+		return errors.New(NO_CREDENTIALS_MESSAGE)
+	case "SharedConfigProfileNotExistsError", "SharedConfigLoadError", "SharedCredsLoad":
+		return fmt.Errorf("ERROR: Could not load the AWS profile. Check the '--profile' argument and your AWS config files (~/.aws/config and ~/.aws/credentials). %s", awsErr.Message())
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired":
+		return fmt.Errorf("ERROR: The AWS credentials have expired. Refresh them, or use a longer '--session-duration' when assuming a role. %s", awsErr.Message())
+	case "InvalidClientTokenId", "UnrecognizedClientException", "AuthFailure", "SignatureDoesNotMatch":
+		return fmt.Errorf("ERROR: The AWS credentials are not valid. Check your access key id and secret access key. %s", awsErr.Message())
+	case "LoadCustomCABundleError":
+		return fmt.Errorf("ERROR: Could not load the CA bundle. Check the '--ca-bundle' argument or the AWS_CA_BUNDLE environment variable. %s", awsErr.Message())
+	case "AssumeRoleTokenProviderNotSetError":
+		return fmt.Errorf("ERROR: The AWS profile requires an MFA token, but none can be read. %s", awsErr.Message())
+	}
+
+	return err
+}
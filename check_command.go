@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/metrics"
+	"github.com/josh-padnick/ec2-snapper/retention"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+// The exit codes monitoring systems like Nagios expect from a check
+const NAGIOS_OK = 0
+const NAGIOS_WARNING = 1
+const NAGIOS_CRITICAL = 2
+const NAGIOS_UNKNOWN = 3
+
+var nagiosStatusNames = map[int]string{
+	NAGIOS_OK: "OK",
+	NAGIOS_WARNING: "WARNING",
+	NAGIOS_CRITICAL: "CRITICAL",
+	NAGIOS_UNKNOWN: "UNKNOWN",
+}
+
+// When several instances are checked, the status of the check is the most severe status of any instance, in this order
+var nagiosStatusSeverity = []int{NAGIOS_CRITICAL, NAGIOS_WARNING, NAGIOS_UNKNOWN, NAGIOS_OK}
+
+type CheckCommand struct {
+	Ui              cli.Ui
+	AwsRegion       string
+	InstanceId      string
+	InstanceName    string
+	Tag             string
+	MaxAge          string
+	WarningAge      string
+	MetricNamespace string
+	Aws             AwsOptions
+}
+
+// descriptions for args
+var checkDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
+var checkDscrInstanceId = "The id of the instance whose AMIs to check. Separate multiple ids with commas."
+var checkDscrInstanceName = "The name (from tags) of the instance whose AMIs to check. Separate multiple names with commas."
+var checkDscrTag = "Check every instance that isn't terminated and has this tag, in the format Key=Value (e.g. Backup=nightly)."
+var checkDscrMaxAge = "The check is CRITICAL if the newest available AMI of an instance is older than this, or if there is none; accepts formats like '26h' or '2d'."
+var checkDscrWarningAge = "The check is WARNING if the newest available AMI of an instance is older than this; accepts formats like '25h'. Must be less than '--max-age'."
+var checkDscrMetricNamespace = "If set, also publish the age of the newest available AMI of every instance as the metric " + metrics.METRIC_NAME_NEWEST_AMI_AGE + " to this CloudWatch namespace."
+
+func (c *CheckCommand) Help() string {
+	return `ec2-snapper check <args> [--help]
+
+Check that the newest available AMI of each given instance is younger than a
+maximum age. Prints a status line with perfdata and exits with the codes
+monitoring systems like Nagios expect: 0 (OK), 1 (WARNING), 2 (CRITICAL) or
+3 (UNKNOWN).
+
+Available args are:
+--region      		` + checkDscrAwsRegion + `
+--instance-id      	` + checkDscrInstanceId + `
+--instance-name      	` + checkDscrInstanceName + `
+--tag      		` + checkDscrTag + `
+--max-age      		` + checkDscrMaxAge + `
+--warning-age      	` + checkDscrWarningAge + `
+--metric-namespace	` + checkDscrMetricNamespace + awsArgsHelp()
+}
+
+func (c *CheckCommand) Synopsis() string {
+	return "Check that the newest AMI of each instance is recent enough"
+}
+
+// Define the args of the check command
+func (c *CheckCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("check", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.AwsRegion, "region", "", checkDscrAwsRegion)
+	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", checkDscrInstanceId)
+	cmdFlags.StringVar(&c.InstanceName, "instance-name", "", checkDscrInstanceName)
+	cmdFlags.StringVar(&c.Tag, "tag", "", checkDscrTag)
+	cmdFlags.StringVar(&c.MaxAge, "max-age", "", checkDscrMaxAge)
+	cmdFlags.StringVar(&c.WarningAge, "warning-age", "", checkDscrWarningAge)
+	cmdFlags.StringVar(&c.MetricNamespace, "metric-namespace", "", checkDscrMetricNamespace)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *CheckCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return NAGIOS_UNKNOWN
+	}
+
+	return check(*c)
+}
+
+// The outcome of checking the AMIs of a single instance
+type freshnessResult struct {
+	Instance instanceRef
+	// The age of the newest available AMI, or a negative value if there is none or it could not be determined
+	Age     time.Duration
+	Status  int
+	Message string
+}
+
+// Check the given instances and return the exit code of the command. Monitoring systems read the first line of stdout,
+// so everything else is either discarded or written to stderr.
+func check(c CheckCommand) int {
+	if err := validateCheckArgs(c); err != nil {
+		outputResult(c.Ui, "EC2-SNAPPER UNKNOWN - " + err.Error())
+		return NAGIOS_UNKNOWN
+	}
+
+	// Already validated above
+	maxAgeHours, _ := retention.ParseHours(c.MaxAge)
+	warningAgeHours := math.Inf(1)
+	if c.WarningAge != "" {
+		warningAgeHours, _ = retention.ParseHours(c.WarningAge)
+	}
+
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		outputResult(c.Ui, "EC2-SNAPPER UNKNOWN - " + explainAwsError(err).Error())
+		return NAGIOS_UNKNOWN
+	}
+	svc := ec2.New(session)
+
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+
+	refs, err := findInstances(ctx, c.InstanceId, c.InstanceName, c.Tag, svc)
+	if err != nil {
+		outputResult(c.Ui, "EC2-SNAPPER UNKNOWN - " + explainCancellation(ctx, explainAwsError(err)).Error())
+		return NAGIOS_UNKNOWN
+	}
+
+	now := time.Now()
+	var results []freshnessResult
+	for _, ref := range refs {
+		result := checkInstanceFreshness(ctx, ref, svc, maxAgeHours, warningAgeHours, now)
+		results = append(results, result)
+
+		if c.MetricNamespace != "" && result.Age >= 0 {
+			recorder := metrics.NewRecorder("check", c.MetricNamespace, "", false)
+			recorder.Record(metrics.METRIC_NAME_NEWEST_AMI_AGE, result.Age.Seconds(), cloudwatch.StandardUnitSeconds)
+			if err := recorder.Publish(ctx, ref.Id, ref.Name, session); err != nil {
+				c.Ui.Warn("WARNING: " + ref.String() + ": " + err.Error())
+			}
+		}
+	}
+
+	status := worstNagiosStatus(results)
+	outputResult(c.Ui, formatCheckOutput(status, results, maxAgeHours, warningAgeHours))
+	return status
+}
+
+// Return the instances given by id, by name or by tag. Instances given by name are looked up, so each ref has an id.
+func findInstances(ctx context.Context, instanceIds string, instanceNames string, tag string, svc *ec2.EC2) ([]instanceRef, error) {
+	if tag != "" {
+		return findInstancesByTag(ctx, tag, svc)
+	}
+
+	refs := parseInstanceRefs(instanceIds, instanceNames)
+
+	// The lookup reports its progress to the Ui, which would break the status line
+	quietUi := &cli.BasicUi{Writer: ioutil.Discard, ErrorWriter: ioutil.Discard}
+	for i := range refs {
+		if refs[i].Id == "" {
+			instanceId, err := snapper.FindInstanceIdByName(ctx, refs[i].Name, svc, quietUi)
+			if err != nil {
+				return nil, err
+			}
+			refs[i].Id = instanceId
+		}
+	}
+
+	return refs, nil
+}
+
+// Return every instance that isn't terminated and has the given Key=Value tag
+func findInstancesByTag(ctx context.Context, tag string, svc *ec2.EC2) ([]instanceRef, error) {
+	parts := strings.SplitN(tag, "=", 2)
+
+	var refs []instanceRef
+	err := svc.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{Name: aws.String("tag:" + parts[0]), Values: []*string{aws.String(parts[1])}},
+			&ec2.Filter{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"})},
+		},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				ref := instanceRef{Id: *instance.InstanceId}
+				for _, instanceTag := range instance.Tags {
+					if *instanceTag.Key == "Name" {
+						ref.Name = *instanceTag.Value
+					}
+				}
+				refs = append(refs, ref)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("Found no instances with tag %s", tag)
+	}
+	return refs, nil
+}
+
+func checkInstanceFreshness(ctx context.Context, ref instanceRef, svc *ec2.EC2, maxAgeHours float64, warningAgeHours float64, now time.Time) freshnessResult {
+	images, err := snapper.FindImages(ctx, ref.Id, svc)
+	if err != nil {
+		return freshnessResult{Instance: ref, Age: -1, Status: NAGIOS_UNKNOWN, Message: explainCancellation(ctx, explainAwsError(err)).Error()}
+	}
+	return evaluateFreshness(ref, images, maxAgeHours, warningAgeHours, now)
+}
+
+// Compare the age of the newest available image to the thresholds. Pending and failed images don't count as backups.
+func evaluateFreshness(ref instanceRef, images []*ec2.Image, maxAgeHours float64, warningAgeHours float64, now time.Time) freshnessResult {
+	var availableImages []*ec2.Image
+	for _, image := range images {
+		if *image.State == ec2.ImageStateAvailable {
+			availableImages = append(availableImages, image)
+		}
+	}
+
+	newestImage, err := retention.NewestImageWithinHours(availableImages, math.Inf(1), now)
+	if err != nil {
+		return freshnessResult{Instance: ref, Age: -1, Status: NAGIOS_UNKNOWN, Message: err.Error()}
+	}
+	if newestImage == nil {
+		return freshnessResult{Instance: ref, Age: -1, Status: NAGIOS_CRITICAL, Message: "no available AMI"}
+	}
+
+	creationDate, err := time.Parse(time.RFC3339Nano, *newestImage.CreationDate)
+	if err != nil {
+		return freshnessResult{Instance: ref, Age: -1, Status: NAGIOS_UNKNOWN, Message: err.Error()}
+	}
+
+	age := now.Sub(creationDate)
+	result := freshnessResult{Instance: ref, Age: age, Status: NAGIOS_OK}
+	result.Message = fmt.Sprintf("newest AMI %s is %.1fh old", *newestImage.ImageId, age.Hours())
+
+	if age.Hours() > maxAgeHours {
+		result.Status = NAGIOS_CRITICAL
+	} else if age.Hours() > warningAgeHours {
+		result.Status = NAGIOS_WARNING
+	}
+	return result
+}
+
+func worstNagiosStatus(results []freshnessResult) int {
+	for _, status := range nagiosStatusSeverity {
+		for _, result := range results {
+			if result.Status == status {
+				return status
+			}
+		}
+	}
+	return NAGIOS_OK
+}
+
+// Format the status line, e.g.
+// EC2-SNAPPER CRITICAL - web-1: newest AMI ami-1234 is 30.2h old | 'web-1'=108720s;;93600;0;
+func formatCheckOutput(status int, results []freshnessResult, maxAgeHours float64, warningAgeHours float64) string {
+	var messages []string
+	var perfdata []string
+
+	warning := ""
+	if !math.IsInf(warningAgeHours, 1) {
+		warning = fmt.Sprintf("%.0f", warningAgeHours * 3600)
+	}
+	critical := fmt.Sprintf("%.0f", maxAgeHours * 3600)
+
+	for _, result := range results {
+		messages = append(messages, result.Instance.String() + ": " + result.Message)
+		if result.Age >= 0 {
+			perfdata = append(perfdata, fmt.Sprintf("'%s'=%.0fs;%s;%s;0;", result.Instance.String(), result.Age.Seconds(), warning, critical))
+		}
+	}
+
+	output := "EC2-SNAPPER " + nagiosStatusNames[status] + " - " + strings.Join(messages, "; ")
+	if len(perfdata) > 0 {
+		output += " | " + strings.Join(perfdata, " ")
+	}
+	return output
+}
+
+func validateCheckArgs(c CheckCommand) error {
+	if c.AwsRegion == "" {
+		return errors.New("ERROR: The argument '--region' is required.")
+	}
+
+	if err := validateInstanceSelectors(c.InstanceId, c.InstanceName, c.Tag); err != nil {
+		return err
+	}
+
+	if c.MaxAge == "" {
+		return errors.New("ERROR: The argument '--max-age' is required.")
+	}
+	maxAgeHours, err := retention.ParseHours(c.MaxAge)
+	if err != nil {
+		return err
+	}
+
+	if c.WarningAge != "" {
+		warningAgeHours, err := retention.ParseHours(c.WarningAge)
+		if err != nil {
+			return err
+		}
+		if warningAgeHours >= maxAgeHours {
+			return errors.New("ERROR: The argument '--warning-age' must be less than '--max-age'.")
+		}
+	}
+
+	if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+		return err
+	}
+
+	return validateAwsOptions(c.Aws)
+}
+
+// Exactly one way of selecting instances must be given, and a tag must be in the format Key=Value
+func validateInstanceSelectors(instanceId string, instanceName string, tag string) error {
+	numSelectors := 0
+	for _, selector := range []string{instanceId, instanceName, tag} {
+		if selector != "" {
+			numSelectors++
+		}
+	}
+	if numSelectors != 1 {
+		return errors.New("ERROR: You must specify exactly one of '--instance-id', '--instance-name' or '--tag'.")
+	}
+
+	if tag != "" {
+		if parts := strings.SplitN(tag, "=", 2); len(parts) != 2 || parts[0] == "" {
+			return errors.New("ERROR: The argument '--tag' must be in the format Key=Value.")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ebs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/retention"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+// The on-demand prices of EBS snapshots in us-east-1, in USD per GiB-month
+const DEFAULT_STANDARD_SNAPSHOT_PRICE = 0.05
+const DEFAULT_ARCHIVE_SNAPSHOT_PRICE = 0.0125
+
+const DEFAULT_BACKUP_INTERVAL = "1d"
+
+const COST_FORMAT_TABLE = "table"
+const COST_FORMAT_JSON = "json"
+const COST_FORMAT_CSV = "csv"
+
+var costFormats = []string{COST_FORMAT_TABLE, COST_FORMAT_JSON, COST_FORMAT_CSV}
+
+const BYTES_PER_GIB = 1024 * 1024 * 1024
+
+// The tier of an AMI whose snapshots are in different storage tiers
+const COST_TIER_MIXED = "mixed"
+
+type CostCommand struct {
+	Ui               cli.Ui
+	AwsRegion        string
+	InstanceId       string
+	InstanceName     string
+	Tag              string
+	StandardPrice    float64
+	ArchivePrice     float64
+	Incremental      bool
+	OlderThan        string
+	RequireAtLeast   int
+	ArchiveOlderThan string
+	Interval         string
+	Format           string
+	Aws              AwsOptions
+}
+
+// descriptions for args
+var costDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
+var costDscrInstanceId = "The id of the instance whose AMIs to estimate the cost of. Separate multiple ids with commas."
+var costDscrInstanceName = "The name (from tags) of the instance whose AMIs to estimate the cost of. Separate multiple names with commas."
+var costDscrTag = "Estimate the cost of the AMIs of every instance that isn't terminated and has this tag, in the format Key=Value (e.g. Backup=nightly)."
+var costDscrStandardPrice = fmt.Sprintf("The price of snapshots in the standard tier per GiB-month. Defaults to %g, the price in us-east-1.", DEFAULT_STANDARD_SNAPSHOT_PRICE)
+var costDscrArchivePrice = fmt.Sprintf("The price of snapshots in the archive tier per GiB-month. Defaults to %g, the price in us-east-1.", DEFAULT_ARCHIVE_SNAPSHOT_PRICE)
+var costDscrIncremental = "If true, use the EBS direct APIs to count the blocks that changed since the previous snapshot of each volume, which is what the standard tier bills for. Makes many API calls. Without it, the full size of every volume is used, which is an upper bound."
+var costDscrOlderThan = "If set, also project the monthly cost of each instance once the retention policy '--older-than' of the delete command applies; accepts formats like '30d'."
+var costDscrRequireAtLeast = "The '--require-at-least' of the retention policy to project."
+var costDscrArchiveOlderThan = "The '--archive-older-than' of the retention policy to project; accepts formats like '7d'."
+var costDscrInterval = "How often AMIs are created, for the projection; accepts formats like '1d' or '12h'. Defaults to " + DEFAULT_BACKUP_INTERVAL + "."
+var costDscrFormat = "The output format (" + strings.Join(costFormats, ", ") + "). Defaults to " + COST_FORMAT_TABLE + "."
+
+func (c *CostCommand) Help() string {
+	return `ec2-snapper cost <args> [--help]
+
+Estimate the storage and monthly cost of the AMIs of the given instances, per
+AMI and per instance, and optionally project it under a retention policy.
+Prices are in the currency of the prices given, USD by default.
+
+Available args are:
+--region      		` + costDscrAwsRegion + `
+--instance-id      	` + costDscrInstanceId + `
+--instance-name      	` + costDscrInstanceName + `
+--tag      		` + costDscrTag + `
+--standard-price      	` + costDscrStandardPrice + `
+--archive-price      	` + costDscrArchivePrice + `
+--incremental      	` + costDscrIncremental + `
+--older-than      	` + costDscrOlderThan + `
+--require-at-least      ` + costDscrRequireAtLeast + `
+--archive-older-than	` + costDscrArchiveOlderThan + `
+--interval      	` + costDscrInterval + `
+--format      		` + costDscrFormat + awsArgsHelp()
+}
+
+func (c *CostCommand) Synopsis() string {
+	return "Estimate the storage and monthly cost of AMIs"
+}
+
+// Define the args of the cost command
+func (c *CostCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("cost", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.AwsRegion, "region", "", costDscrAwsRegion)
+	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", costDscrInstanceId)
+	cmdFlags.StringVar(&c.InstanceName, "instance-name", "", costDscrInstanceName)
+	cmdFlags.StringVar(&c.Tag, "tag", "", costDscrTag)
+	cmdFlags.Float64Var(&c.StandardPrice, "standard-price", DEFAULT_STANDARD_SNAPSHOT_PRICE, costDscrStandardPrice)
+	cmdFlags.Float64Var(&c.ArchivePrice, "archive-price", DEFAULT_ARCHIVE_SNAPSHOT_PRICE, costDscrArchivePrice)
+	cmdFlags.BoolVar(&c.Incremental, "incremental", false, costDscrIncremental)
+	cmdFlags.StringVar(&c.OlderThan, "older-than", "", costDscrOlderThan)
+	cmdFlags.IntVar(&c.RequireAtLeast, "require-at-least", 0, costDscrRequireAtLeast)
+	cmdFlags.StringVar(&c.ArchiveOlderThan, "archive-older-than", "", costDscrArchiveOlderThan)
+	cmdFlags.StringVar(&c.Interval, "interval", DEFAULT_BACKUP_INTERVAL, costDscrInterval)
+	cmdFlags.StringVar(&c.Format, "format", COST_FORMAT_TABLE, costDscrFormat)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *CostCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+
+	if err := cost(ctx, *c); err != nil {
+		err = explainCancellation(ctx, explainAwsError(err))
+		c.Ui.Error(err.Error())
+		return failureExitCode(err)
+	}
+
+	return 0
+}
+
+// The storage and monthly cost of a single AMI
+type amiCost struct {
+	ImageId      string `json:"amiId"`
+	Name         string `json:"name"`
+	CreationDate string `json:"created"`
+	// The storage tier of the snapshots of the AMI; see amiStorageTier
+	Tier         string `json:"tier"`
+	Snapshots    int    `json:"snapshots"`
+	StandardGiB  int64  `json:"standardGiB"`
+	ArchiveGiB   int64  `json:"archiveGiB"`
+	// The GiB that changed since the previous snapshot of each volume, or nil if not measured
+	IncrementalGiB *float64 `json:"incrementalGiB,omitempty"`
+	MonthlyCost    float64  `json:"monthlyCost"`
+}
+
+// The storage and monthly cost of the AMIs of a single instance
+type instanceCost struct {
+	InstanceId     string         `json:"instanceId"`
+	InstanceName   string         `json:"instanceName,omitempty"`
+	Amis           []amiCost      `json:"amis"`
+	StandardGiB    int64          `json:"standardGiB"`
+	ArchiveGiB     int64          `json:"archiveGiB"`
+	IncrementalGiB *float64       `json:"incrementalGiB,omitempty"`
+	MonthlyCost    float64        `json:"monthlyCost"`
+	Projected      *projectedCost `json:"projected,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// The storage and monthly cost of the AMIs of a single instance once a retention policy applies
+type projectedCost struct {
+	Amis         int     `json:"amis"`
+	StandardAmis int     `json:"standardAmis"`
+	ArchivedAmis int     `json:"archivedAmis"`
+	StandardGiB  float64 `json:"standardGiB"`
+	ArchiveGiB   float64 `json:"archiveGiB"`
+	MonthlyCost  float64 `json:"monthlyCost"`
+}
+
+// A retention policy, as given to the delete command, and how often AMIs are created
+type costPolicy struct {
+	OlderThanHours        float64 `json:"olderThanHours"`
+	RequireAtLeast        int     `json:"requireAtLeast"`
+	ArchiveOlderThanHours float64 `json:"archiveOlderThanHours,omitempty"`
+	IntervalHours         float64 `json:"intervalHours"`
+}
+
+type snapshotPrices struct {
+	Standard float64 `json:"standardPerGiBMonth"`
+	Archive  float64 `json:"archivePerGiBMonth"`
+}
+
+type costReport struct {
+	Region               string         `json:"region"`
+	Prices               snapshotPrices `json:"prices"`
+	Policy               *costPolicy    `json:"policy,omitempty"`
+	Instances            []instanceCost `json:"instances"`
+	MonthlyCost          float64        `json:"monthlyCost"`
+	ProjectedMonthlyCost *float64       `json:"projectedMonthlyCost,omitempty"`
+}
+
+func cost(ctx context.Context, c CostCommand) error {
+	if err := validateCostArgs(c); err != nil {
+		return err
+	}
+
+	policy, err := parseCostPolicy(c)
+	if err != nil {
+		return err
+	}
+	prices := snapshotPrices{Standard: c.StandardPrice, Archive: c.ArchivePrice}
+
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return err
+	}
+	svc := ec2.New(session)
+	var ebsSvc *ebs.EBS
+	if c.Incremental {
+		ebsSvc = ebs.New(session)
+	}
+
+	refs, err := findInstances(ctx, c.InstanceId, c.InstanceName, c.Tag, svc)
+	if err != nil {
+		return err
+	}
+
+	report := costReport{Region: c.AwsRegion, Prices: prices, Policy: policy}
+	snapshotsByOwner := map[string][]*ec2.Snapshot{}
+	numFailed := 0
+
+	for _, ref := range refs {
+		if err := cancellationError(ctx); err != nil {
+			return err
+		}
+
+		result, err := estimateInstanceCost(ctx, ref, svc, ebsSvc, snapshotsByOwner, prices, c.Ui)
+		if err != nil {
+			result.Error = explainAwsError(err).Error()
+			numFailed++
+		} else if policy != nil {
+			result.Projected = projectCost(result, *policy, prices)
+		}
+		report.Instances = append(report.Instances, result)
+	}
+	summarizeCostReport(&report)
+
+	output, err := formatCostReport(report, c.Format)
+	if err != nil {
+		return err
+	}
+	outputResult(c.Ui, output)
+
+	if numFailed > 0 {
+		return fmt.Errorf("ERROR: Failed to estimate the cost of %d of %d instance(s).", numFailed, len(refs))
+	}
+	return nil
+}
+
+// Add up the size and cost of the snapshots of every AMI of the given instance. The snapshots of the account are
+// cached in snapshotsByOwner, since every instance of an account needs them.
+func estimateInstanceCost(ctx context.Context, ref instanceRef, svc *ec2.EC2, ebsSvc *ebs.EBS, snapshotsByOwner map[string][]*ec2.Snapshot, prices snapshotPrices, ui cli.Ui) (instanceCost, error) {
+	result := instanceCost{InstanceId: ref.Id, InstanceName: ref.Name}
+
+	images, err := snapper.FindImages(ctx, ref.Id, svc)
+	if err != nil || len(images) == 0 {
+		return result, err
+	}
+
+	ownerId := *images[0].OwnerId
+	if _, ok := snapshotsByOwner[ownerId]; !ok {
+		if snapshotsByOwner[ownerId], err = snapper.FindSnapshots(ctx, ownerId, svc); err != nil {
+			return result, err
+		}
+	}
+	snapshots := snapshotsByOwner[ownerId]
+
+	// Oldest first, so that the projection can tell the oldest AMI apart
+	for _, image := range retention.SortOldestFirst(images) {
+		ami := amiCost{ImageId: *image.ImageId, Name: aws.StringValue(image.Name), CreationDate: aws.StringValue(image.CreationDate)}
+		amiSnapshots := snapper.SnapshotsOfImage(*image.ImageId, snapshots)
+		ami.Snapshots = len(amiSnapshots)
+		ami.Tier = amiStorageTier(amiSnapshots)
+
+		var incrementalGiB float64
+		measured := ebsSvc != nil
+		for _, snapshot := range amiSnapshots {
+			if aws.StringValue(snapshot.StorageTier) == ec2.StorageTierArchive {
+				ami.ArchiveGiB += aws.Int64Value(snapshot.VolumeSize)
+				continue
+			}
+			ami.StandardGiB += aws.Int64Value(snapshot.VolumeSize)
+
+			if measured {
+				changedGiB, err := measureChangedGiB(ctx, snapshot, previousSnapshotOfVolume(snapshot, snapshots), ebsSvc)
+				if err != nil {
+					ui.Warn(fmt.Sprintf("WARNING: Could not count the changed blocks of snapshot %s, so the full size of AMI %s is used: %s", *snapshot.SnapshotId, ami.ImageId, err.Error()))
+					measured = false
+				}
+				incrementalGiB += changedGiB
+			}
+		}
+		if measured {
+			ami.IncrementalGiB = aws.Float64(incrementalGiB)
+		}
+
+		ami.MonthlyCost = amiMonthlyCost(ami, prices)
+		result.Amis = append(result.Amis, ami)
+	}
+
+	addUpInstanceCost(&result)
+	return result, nil
+}
+
+// Return the storage tier of the given snapshots of an AMI: standard or archive if they are all in the same tier,
+// mixed while they are being archived or restored, and empty if there are none
+func amiStorageTier(snapshots []*ec2.Snapshot) string {
+	tier := ""
+	for _, snapshot := range snapshots {
+		snapshotTier := aws.StringValue(snapshot.StorageTier)
+		if snapshotTier == "" {
+			snapshotTier = ec2.StorageTierStandard
+		}
+		if tier != "" && tier != snapshotTier {
+			return COST_TIER_MIXED
+		}
+		tier = snapshotTier
+	}
+	return tier
+}
+
+// Return the snapshot of the same volume that was started last before the given one, or nil if there is none. Copied
+// snapshots all have the same placeholder volume id, so they have no previous snapshot.
+func previousSnapshotOfVolume(snapshot *ec2.Snapshot, snapshots []*ec2.Snapshot) *ec2.Snapshot {
+	var previous *ec2.Snapshot
+	volumeId := aws.StringValue(snapshot.VolumeId)
+	if volumeId == "" || volumeId == "vol-ffffffff" {
+		return nil
+	}
+
+	startTime := aws.TimeValue(snapshot.StartTime)
+	for _, candidate := range snapshots {
+		candidateStartTime := aws.TimeValue(candidate.StartTime)
+		if aws.StringValue(candidate.VolumeId) != volumeId || !candidateStartTime.Before(startTime) {
+			continue
+		}
+		if aws.StringValue(candidate.State) != ec2.SnapshotStateCompleted || aws.StringValue(candidate.StorageTier) == ec2.StorageTierArchive {
+			continue
+		}
+		if previous == nil || candidateStartTime.After(aws.TimeValue(previous.StartTime)) {
+			previous = candidate
+		}
+	}
+	return previous
+}
+
+// Count the GiB of the blocks that changed between the previous snapshot and the given one, or of all the blocks of
+// the given snapshot if there is no previous one
+func measureChangedGiB(ctx context.Context, snapshot *ec2.Snapshot, previous *ec2.Snapshot, svc *ebs.EBS) (float64, error) {
+	var numBlocks, blockSize int64
+
+	if previous == nil {
+		err := svc.ListSnapshotBlocksPagesWithContext(ctx, &ebs.ListSnapshotBlocksInput{SnapshotId: snapshot.SnapshotId}, func(page *ebs.ListSnapshotBlocksOutput, lastPage bool) bool {
+			numBlocks += int64(len(page.Blocks))
+			blockSize = aws.Int64Value(page.BlockSize)
+			return true
+		})
+		return blocksToGiB(numBlocks, blockSize), err
+	}
+
+	err := svc.ListChangedBlocksPagesWithContext(ctx, &ebs.ListChangedBlocksInput{
+		FirstSnapshotId: previous.SnapshotId,
+		SecondSnapshotId: snapshot.SnapshotId,
+	}, func(page *ebs.ListChangedBlocksOutput, lastPage bool) bool {
+		numBlocks += int64(len(page.ChangedBlocks))
+		blockSize = aws.Int64Value(page.BlockSize)
+		return true
+	})
+	return blocksToGiB(numBlocks, blockSize), err
+}
+
+func blocksToGiB(numBlocks int64, blockSize int64) float64 {
+	return float64(numBlocks * blockSize) / BYTES_PER_GIB
+}
+
+// The standard tier bills for the blocks that changed since the previous snapshot if they were measured, and the
+// archive tier for the full snapshot
+func amiMonthlyCost(ami amiCost, prices snapshotPrices) float64 {
+	standardGiB := float64(ami.StandardGiB)
+	if ami.IncrementalGiB != nil {
+		standardGiB = *ami.IncrementalGiB
+	}
+	return standardGiB * prices.Standard + float64(ami.ArchiveGiB) * prices.Archive
+}
+
+func addUpInstanceCost(result *instanceCost) {
+	incrementalGiB := 0.0
+	measured := len(result.Amis) > 0
+	for _, ami := range result.Amis {
+		result.StandardGiB += ami.StandardGiB
+		result.ArchiveGiB += ami.ArchiveGiB
+		result.MonthlyCost += ami.MonthlyCost
+		if ami.IncrementalGiB == nil {
+			measured = false
+		} else {
+			incrementalGiB += *ami.IncrementalGiB
+		}
+	}
+	if measured {
+		result.IncrementalGiB = aws.Float64(incrementalGiB)
+	}
+}
+
+// Return the number of AMIs a retention policy keeps in the long run: those younger than --older-than, but at least
+// --require-at-least
+func projectNumAmis(policy costPolicy) int {
+	numAmis := int(math.Ceil(policy.OlderThanHours / policy.IntervalHours))
+	numAmis += retention.NumToKeep(numAmis, 0, policy.RequireAtLeast)
+	return numAmis
+}
+
+// Project the monthly cost of the AMIs of an instance once the given policy applies, assuming future AMIs are like the
+// current ones. The oldest AMI in the standard tier holds a full copy of the volumes, and every later one only the
+// changed blocks, while every archived AMI holds a full copy.
+func projectCost(current instanceCost, policy costPolicy, prices snapshotPrices) *projectedCost {
+	if len(current.Amis) == 0 {
+		return nil
+	}
+
+	var fullGiB, changedGiB float64
+	numChanged := 0
+	for i, ami := range current.Amis {
+		fullGiB += float64(ami.StandardGiB + ami.ArchiveGiB)
+		// The oldest measured AMI counts every block, not just the changed ones
+		if i > 0 && ami.IncrementalGiB != nil {
+			changedGiB += *ami.IncrementalGiB
+			numChanged++
+		}
+	}
+	fullGiB /= float64(len(current.Amis))
+	if numChanged > 0 {
+		changedGiB /= float64(numChanged)
+	} else {
+		changedGiB = fullGiB
+	}
+
+	projected := &projectedCost{Amis: projectNumAmis(policy)}
+	projected.StandardAmis = projected.Amis
+	if policy.ArchiveOlderThanHours > 0 {
+		projected.StandardAmis = int(math.Min(float64(projected.Amis), math.Ceil(policy.ArchiveOlderThanHours / policy.IntervalHours)))
+	}
+	projected.ArchivedAmis = projected.Amis - projected.StandardAmis
+
+	if projected.StandardAmis > 0 {
+		projected.StandardGiB = fullGiB + float64(projected.StandardAmis - 1) * changedGiB
+	}
+	projected.ArchiveGiB = float64(projected.ArchivedAmis) * fullGiB
+	projected.MonthlyCost = projected.StandardGiB * prices.Standard + projected.ArchiveGiB * prices.Archive
+
+	return projected
+}
+
+func summarizeCostReport(report *costReport) {
+	var projectedMonthlyCost float64
+	for _, instance := range report.Instances {
+		report.MonthlyCost += instance.MonthlyCost
+		if instance.Projected != nil {
+			projectedMonthlyCost += instance.Projected.MonthlyCost
+		}
+	}
+	if report.Policy != nil {
+		report.ProjectedMonthlyCost = aws.Float64(projectedMonthlyCost)
+	}
+}
+
+func formatCostReport(report costReport, format string) (string, error) {
+	switch format {
+	case COST_FORMAT_JSON:
+		bytes, err := json.MarshalIndent(report, "", "    ")
+		return string(bytes), err
+	case COST_FORMAT_CSV:
+		return formatCostCsv(report)
+	default:
+		return formatCostTable(report), nil
+	}
+}
+
+// One row per AMI, per instance total and per projection, told apart by the first column
+func costRows(report costReport) [][]string {
+	var rows [][]string
+	for _, instance := range report.Instances {
+		for _, ami := range instance.Amis {
+			rows = append(rows, []string{"ami", instance.InstanceId, instance.InstanceName, ami.ImageId, ami.CreationDate, ami.Tier, strconv.Itoa(ami.Snapshots), strconv.FormatInt(ami.StandardGiB, 10), strconv.FormatInt(ami.ArchiveGiB, 10), formatOptionalGiB(ami.IncrementalGiB), formatCost(ami.MonthlyCost), ""})
+		}
+		rows = append(rows, []string{"total", instance.InstanceId, instance.InstanceName, "", "", "", strconv.Itoa(len(instance.Amis)), strconv.FormatInt(instance.StandardGiB, 10), strconv.FormatInt(instance.ArchiveGiB, 10), formatOptionalGiB(instance.IncrementalGiB), formatCost(instance.MonthlyCost), instance.Error})
+		if projected := instance.Projected; projected != nil {
+			rows = append(rows, []string{"projected", instance.InstanceId, instance.InstanceName, "", "", "", strconv.Itoa(projected.Amis), strconv.FormatFloat(projected.StandardGiB, 'f', 1, 64), strconv.FormatFloat(projected.ArchiveGiB, 'f', 1, 64), "", formatCost(projected.MonthlyCost), ""})
+		}
+	}
+	return rows
+}
+
+var costColumns = []string{"row", "instance_id", "instance_name", "ami_id", "created", "tier", "amis_or_snapshots", "standard_gib", "archive_gib", "incremental_gib", "monthly_cost", "error"}
+
+func formatCostCsv(report costReport) (string, error) {
+	var out bytes.Buffer
+	writer := csv.NewWriter(&out)
+	writer.Write(costColumns)
+	writer.WriteAll(costRows(report))
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+func formatCostTable(report costReport) string {
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ROW\tINSTANCE\tAMI\tCREATED\tTIER\tCOUNT\tSTANDARD GIB\tARCHIVE GIB\tINCREMENTAL GIB\tMONTHLY COST\tERROR")
+	for _, row := range costRows(report) {
+		instance := row[1]
+		if row[2] != "" {
+			instance += " (" + row[2] + ")"
+		}
+		fmt.Fprintln(writer, strings.Join(append([]string{row[0], instance}, row[3:]...), "\t"))
+	}
+	writer.Flush()
+
+	summary := "Total monthly cost: " + formatCost(report.MonthlyCost)
+	if report.ProjectedMonthlyCost != nil {
+		summary += ", projected under the retention policy: " + formatCost(*report.ProjectedMonthlyCost)
+	}
+	return out.String() + "\n" + summary
+}
+
+func formatOptionalGiB(gib *float64) string {
+	if gib == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*gib, 'f', 1, 64)
+}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 2, 64)
+}
+
+// Parse the retention policy to project, or return nil if there is none
+func parseCostPolicy(c CostCommand) (*costPolicy, error) {
+	if c.OlderThan == "" {
+		return nil, nil
+	}
+
+	policy := &costPolicy{RequireAtLeast: c.RequireAtLeast}
+	var err error
+	if policy.OlderThanHours, err = retention.ParseHours(c.OlderThan); err != nil {
+		return nil, err
+	}
+	if policy.IntervalHours, err = retention.ParseHours(c.Interval); err != nil {
+		return nil, err
+	}
+	if policy.IntervalHours <= 0 {
+		return nil, errors.New("ERROR: The argument '--interval' must be positive.")
+	}
+	if c.ArchiveOlderThan != "" {
+		if err := validateArchiveOlderThan(c.ArchiveOlderThan, c.OlderThan, false); err != nil {
+			return nil, err
+		}
+		policy.ArchiveOlderThanHours, _ = retention.ParseHours(c.ArchiveOlderThan)
+	}
+	return policy, nil
+}
+
+// Check for required command-line args
+func validateCostArgs(c CostCommand) error {
+	if c.AwsRegion == "" {
+		return errors.New("ERROR: The argument '--region' is required.")
+	}
+
+	if err := validateInstanceSelectors(c.InstanceId, c.InstanceName, c.Tag); err != nil {
+		return err
+	}
+
+	if c.StandardPrice < 0 || c.ArchivePrice < 0 {
+		return errors.New("ERROR: The arguments '--standard-price' and '--archive-price' must not be negative.")
+	}
+
+	if c.RequireAtLeast < 0 {
+		return errors.New("ERROR: The argument '--require-at-least' must be a positive integer.")
+	}
+
+	if (c.RequireAtLeast != 0 || c.ArchiveOlderThan != "") && c.OlderThan == "" {
+		return errors.New("ERROR: The arguments '--require-at-least' and '--archive-older-than' can only be used with '--older-than'.")
+	}
+
+	if !containsString(costFormats, c.Format) {
+		return fmt.Errorf("ERROR: Unknown format '%s'. Valid formats are: %s.", c.Format, strings.Join(costFormats, ", "))
+	}
+
+	if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+		return err
+	}
+
+	return validateAwsOptions(c.Aws)
+}
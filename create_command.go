@@ -1,36 +1,51 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"time"
-	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/josh-padnick/ec2-snapper/metrics"
+	"github.com/josh-padnick/ec2-snapper/retention"
+	"github.com/josh-padnick/ec2-snapper/snapper"
 	"github.com/mitchellh/cli"
 	"errors"
-	"fmt"
 )
 
 type CreateCommand struct {
-	Ui           cli.Ui
-	AwsRegion    string
-	InstanceId   string
-	InstanceName string
-	AmiName      string
-	DryRun       bool
-	NoReboot     bool
+	Ui               cli.Ui
+	AwsRegion        string
+	InstanceId       string
+	InstanceName     string
+	AmiName          string
+	DryRun           bool
+	NoReboot         bool
+	MinInterval      string
+	Parallelism      int
+	MetricNamespace  string
+	PushgatewayUrl   string
+	Notify           NotifyOptions
+	Audit            AuditOptions
+	KmsKeyId         string
+	RequireEncrypted bool
+	Aws              AwsOptions
+
+	// Shared by every instance of a run; see awsSessions
+	sessions *awsSessions
 }
 
-const EC2_SNAPPER_INSTANCE_ID_TAG = "ec2-snapper-instance-id"
-
 // descriptions for args
-var createDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
-var createDscrInstanceId = "The id of the instance from which to create the AMI"
-var createDscrInstanceName = "The name (from tags) of the instance from which to create the AMI"
+var createDscrAwsRegion = "The AWS region to use (e.g. us-west-2). Separate multiple regions with commas."
+var createDscrInstanceId = "The id of the instance from which to create the AMI. Separate multiple ids with commas."
+var createDscrInstanceName = "The name (from tags) of the instance from which to create the AMI. Separate multiple names with commas."
 var createDscrAmiName = "The name of the AMI; the current timestamp will be automatically appended"
 var createDscrDryRun = "Execute a simulated run"
+var createDscrMinInterval = "Do not create a new AMI if a pending or available AMI of the instance was created within this interval; accepts formats like '6h' or '1d'. Useful for making retries of a cron job safe: CreateImage takes no idempotency token, so this is the only guard against a retry creating a second AMI."
+var createDscrKmsKeyId = "The id, ARN or alias (e.g. alias/backups) of a KMS key to encrypt the snapshots of the AMI with. The AMI is created unencrypted, copied with encryption, and the unencrypted AMI and its snapshots are deleted."
+var createDscrRequireEncrypted = "If true, fail if any snapshot of the resulting AMI is not encrypted."
 var createDscrNoReboot = "If true, do not reboot the instance before creating the AMI. It is preferable to reboot the instance to guarantee a consistent filesystem when taking the snapshot, but the likelihood of an inconsistent snapshot is very low."
 
 func (c *CreateCommand) Help() string {
@@ -44,16 +59,21 @@ Available args are:
 --instance-name ` + createDscrInstanceName + `
 --ami-name      ` + createDscrAmiName + `
 --dry-run       ` + createDscrDryRun + `
---no-reboot     ` + createDscrNoReboot
+--no-reboot     ` + createDscrNoReboot + `
+--min-interval  ` + createDscrMinInterval + `
+--parallelism   ` + dscrParallelism + `
+--kms-key-id    ` + createDscrKmsKeyId + `
+--require-encrypted	` + createDscrRequireEncrypted + `
+--metric-namespace	` + dscrMetricNamespace + `
+--pushgateway-url	` + dscrPushgatewayUrl + notifyArgsHelp() + auditArgsHelp() + awsArgsHelp() + targetArgsHelp()
 }
 
 func (c *CreateCommand) Synopsis() string {
 	return "Create an AMI of the given EC2 instance"
 }
 
-func (c *CreateCommand) Run(args []string) int {
-
-	// Handle the command-line args
+// Define the args of the create command
+func (c *CreateCommand) flags() *flag.FlagSet {
 	cmdFlags := flag.NewFlagSet("create", flag.ExitOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 
@@ -63,117 +83,209 @@ func (c *CreateCommand) Run(args []string) int {
 	cmdFlags.StringVar(&c.AmiName, "ami-name", "", createDscrAmiName)
 	cmdFlags.BoolVar(&c.DryRun, "dry-run", false, createDscrDryRun)
 	cmdFlags.BoolVar(&c.NoReboot, "no-reboot", true, createDscrNoReboot)
+	cmdFlags.StringVar(&c.MinInterval, "min-interval", "", createDscrMinInterval)
+	cmdFlags.IntVar(&c.Parallelism, "parallelism", 1, dscrParallelism)
+	cmdFlags.StringVar(&c.KmsKeyId, "kms-key-id", "", createDscrKmsKeyId)
+	cmdFlags.BoolVar(&c.RequireEncrypted, "require-encrypted", false, createDscrRequireEncrypted)
+	cmdFlags.StringVar(&c.MetricNamespace, "metric-namespace", "", dscrMetricNamespace)
+	cmdFlags.StringVar(&c.PushgatewayUrl, "pushgateway-url", "", dscrPushgatewayUrl)
+	addNotifyFlags(cmdFlags, &c.Notify)
+	addAuditFlags(cmdFlags, &c.Audit)
+	addAwsFlags(cmdFlags, &c.Aws)
+	addTargetFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *CreateCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	if _, err := create(*c); err != nil {
+	return createAll(*c)
+}
+
+// Create an AMI of every instance given on the command line and return the exit code of the command
+func createAll(c CreateCommand) int {
+	if err := validateCreateArgs(c); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if err := validateParallelism(c.Parallelism); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if err := validateTargetOptions(c.Aws); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	// Every instance in every account and region shares the credentials, so an MFA token is only read once
+	c.sessions = newAwsSessions(c.Aws)
+
+	notifier, err := newNotifier(c.Notify, c.Aws, c.sessions, c.Ui)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	auditor, err := newAuditor("create", c.Audit, c.AwsRegion, c.Aws, c.sessions, c.Ui)
+	if err != nil {
 		c.Ui.Error(err.Error())
 		return 1
 	}
 
-	return 0
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+	ctx = withAuditor(ctx, auditor)
+
+	targets, err := resolveTargets(ctx, c.AwsRegion, c.Aws, c.sessions, c.Ui)
+	if err != nil {
+		err = explainCancellation(ctx, explainAwsError(err))
+		c.Ui.Error(err.Error())
+		auditor.close()
+		notifier.notify(buildNotification("create", c.DryRun, nil, 1, err, time.Now()))
+		return 1
+	}
+
+	refs := parseInstanceRefs(c.InstanceId, c.InstanceName)
+	results := forEachTarget(targets, c.Ui, func(target awsTarget) []instanceResult {
+		return forEachInstance(ctx, refs, c.Parallelism, c.Ui, func(ref instanceRef, ui cli.Ui) ([]string, error) {
+			instanceCmd := c
+			instanceCmd.Ui = ui
+			instanceCmd.AwsRegion = target.Region
+			instanceCmd.Aws.RoleArn = target.RoleArn
+			instanceCmd.InstanceId = ref.Id
+			instanceCmd.InstanceName = ref.Name
+
+			// AMI names must be unique, and AMIs of different instances created in the same second would otherwise collide
+			if len(refs) > 1 {
+				instanceCmd.AmiName = c.AmiName + "-" + ref.String()
+			}
+
+			amiId, err := create(ctx, instanceCmd)
+			if amiId == "" || c.DryRun {
+				return nil, err
+			}
+			return []string{amiId}, err
+		})
+	})
+
+	exitCode := summarizeInstanceResults(results, c.Ui)
+	if err := auditor.close(); err != nil {
+		c.Ui.Error(err.Error())
+		if exitCode == 0 {
+			exitCode = 1
+		}
+	}
+	notifier.notify(buildNotification("create", c.DryRun, results, exitCode, nil, time.Now()))
+	return exitCode
 }
 
-func create(c CreateCommand) (string, error) {
+func create(ctx context.Context, c CreateCommand) (string, error) {
 	snapshotId := ""
 
 	if err := validateCreateArgs(c); err != nil {
 		return snapshotId, err
 	}
 
-	session := session.New(&aws.Config{Region: &c.AwsRegion})
+	session, err := c.sessions.get(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return snapshotId, err
+	}
 	svc := ec2.New(session)
+	recorder := metrics.NewRecorder("create", c.MetricNamespace, c.PushgatewayUrl, c.DryRun)
 
 	if c.InstanceId == "" {
-		instanceId, err := getInstanceIdByName(c.InstanceName, svc, c.Ui)
+		c.InstanceId, err = snapper.FindInstanceIdByName(ctx, c.InstanceName, svc, c.Ui)
+	}
+	if err == nil {
+		ctx, err = auditInstance(ctx, c.InstanceId, createAuditRule(c), c.Aws.RoleArn, sts.New(session))
+	}
+	if err == nil {
+		snapshotId, err = createAmi(ctx, c, svc, recorder)
+	}
+
+	return snapshotId, publishInstanceMetrics(recorder, c.InstanceId, c.InstanceName, err, session, c.Ui)
+}
+
+// Create an AMI of the instance with the given id and return its id, unless --min-interval says there is a recent
+// enough one already, in which case the id is empty, since no AMI was created. Once CreateImage was called, the AMI and
+// its snapshots are tagged even if the command is interrupted, so delete finds them later; only the waits are cut short.
+func createAmi(ctx context.Context, c CreateCommand, svc *ec2.EC2, recorder *metrics.Recorder) (string, error) {
+	snapshotId := ""
+
+	if c.MinInterval != "" {
+		recentImage, err := findRecentImage(ctx, c.InstanceId, c.MinInterval, svc)
 		if err != nil {
 			return snapshotId, err
 		}
-		c.InstanceId = instanceId
+		if recentImage != nil {
+			c.Ui.Info("==> NO ACTION TAKEN. AMI " + *recentImage.ImageId + " named \"" + *recentImage.Name + "\" was created at " + *recentImage.CreationDate + ", which is within --min-interval=" + c.MinInterval + ".")
+			return snapshotId, nil
+		}
 	}
 
-	// Generate a nicely formatted timestamp for right now
-	const dateLayoutForAmiName = "2006-01-02 at 15_04_05 (MST)"
 	t := time.Now()
-
-	// Create the AMI Snapshot
-	name := c.AmiName + " - " + t.Format(dateLayoutForAmiName)
-
-	c.Ui.Output("==> Creating AMI for " + c.InstanceId + "...")
-
-	resp, err := svc.CreateImage(&ec2.CreateImageInput{
-		Name: &name,
-		InstanceId: &c.InstanceId,
-		DryRun: &c.DryRun,
-		NoReboot: &c.NoReboot })
-	if err != nil && strings.Contains(err.Error(), "NoCredentialProviders") {
-		return snapshotId, errors.New("ERROR: No AWS credentials were found.  Either set the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or run this program on an EC2 instance that has an IAM Role with the appropriate permissions.")
-	} else if err != nil {
-		return snapshotId, err
+	imageRequest := snapper.ImageRequest{
+		InstanceId: c.InstanceId,
+		AmiName: c.AmiName,
+		Name: snapper.ImageName(c.AmiName, t),
+		NoReboot: c.NoReboot,
+		DryRun: c.DryRun,
 	}
-
-	// Sleep here to give time for AMI to get found
-	time.Sleep(3000 * time.Millisecond)
-
-	// Assign tags to this AMI.  We'll use these when it comes time to delete the AMI
-	snapshotId = *resp.ImageId
-	c.Ui.Output("==> Adding tags to AMI " + snapshotId + "...")
-
-	_, tagsErr := svc.CreateTags(&ec2.CreateTagsInput{
-		Resources: []*string{&snapshotId},
-		Tags: []*ec2.Tag{
-			&ec2.Tag{ Key: aws.String(EC2_SNAPPER_INSTANCE_ID_TAG), Value: &c.InstanceId },
-			&ec2.Tag{ Key: aws.String("Name"), Value: &c.AmiName },
-		},
-	})
-
-	if tagsErr != nil {
-		return snapshotId, tagsErr
+	name := imageRequest.Name
+
+	// The AMI we create is only an intermediate that is copied with encryption. Its snapshots are tagged too, so a
+	// policy scoped by tag allows deleting them, and so delete cleans them up should that fail here.
+	if c.KmsKeyId != "" {
+		imageRequest.Name = name + INTERMEDIATE_AMI_NAME_SUFFIX
+		imageRequest.TagSnapshots = true
+		imageRequest.Replace = func(imageId string) (string, error) {
+			return copyImageEncrypted(ctx, imageId, name, c.AwsRegion, c.KmsKeyId, snapper.ImageTags(c.InstanceId, c.AmiName), svc, c.Ui)
+		}
 	}
 
-	// Check the status of the AMI
-	respDscrImages, err := svc.DescribeImages(&ec2.DescribeImagesInput{
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name: aws.String("image-id"),
-				Values: []*string{&snapshotId},
-			},
-		},
-	})
-	if err != nil {
-		return snapshotId, err
+	if c.RequireEncrypted {
+		imageRequest.Check = checkImageEncrypted
 	}
 
-	// If no AMI at all was found, throw an error
-	if len(respDscrImages.Images) == 0 {
-		return snapshotId, errors.New("ERROR: Could not find the AMI just created.")
+	// Measuring how long creating the AMI took means waiting for it to become available, which is only worth it if the
+	// duration is published
+	if recorder != nil {
+		imageRequest.Created = func(imageId string) error {
+			c.Ui.Output("==> Waiting for AMI " + imageId + " to become available...")
+			if err := snapper.WaitUntilImageAvailable(ctx, imageId, svc); err != nil {
+				return err
+			}
+			recorder.Record(metrics.METRIC_NAME_AMI_CREATION_DURATION, time.Since(t).Seconds(), cloudwatch.StandardUnitSeconds)
+			return nil
+		}
 	}
 
-	ami := *respDscrImages.Images[0]
-
-	// If the AMI's status is failed throw an error
-	if *ami.State == ec2.ImageStateFailed {
-		return snapshotId, errors.New("ERROR: AMI was created but entered a state of 'failed'. This is an AWS issue. Please re-run this command.  Note that you will need to manually de-register the AMI in the AWS console or via the API.")
+	// An AMI that was started must be tagged, so it isn't started at all once the command was interrupted
+	if err := cancellationError(ctx); err != nil {
+		return snapshotId, err
 	}
 
-	// Tag each volume for the AMI as well so we can find them later
-	for _, blockDeviceMapping := range ami.BlockDeviceMappings {
-		if blockDeviceMapping != nil && blockDeviceMapping.Ebs != nil {
-			c.Ui.Output("==> Adding tags to EBS Volume Snapshot " + *blockDeviceMapping.Ebs.SnapshotId + " (" + *blockDeviceMapping.DeviceName + ") of AMI " + *ami.Name + "...")
-			_, err := svc.CreateTags(&ec2.CreateTagsInput{
-				Resources: []*string{blockDeviceMapping.Ebs.SnapshotId},
-				Tags: []*ec2.Tag{
-					&ec2.Tag{ Key: aws.String(EC2_SNAPPER_INSTANCE_ID_TAG), Value: &c.InstanceId },
-					&ec2.Tag{ Key: aws.String("Name"), Value: aws.String(c.AmiName + "-" + *blockDeviceMapping.DeviceName) },
-				},
-			})
+	creation, err := snapper.Create(uninterruptible(ctx), imageRequest, svc, c.Ui)
+	snapshotId = creation.ImageId
+	if err != nil {
+		return snapshotId, err
+	}
 
-			if err != nil {
-				return snapshotId, err
-			}
+	if c.DryRun {
+		c.Ui.Info("==> DRY RUN. Would create AMI named \"" + name + "\" of instance " + c.InstanceId + ", and tag it and its EBS volume snapshots.")
+		if c.KmsKeyId != "" {
+			c.Ui.Warn("WARNING: A dry run can't check the permissions to copy the AMI with encryption, since the copy needs an existing AMI.")
 		}
+		return snapshotId, nil
 	}
 
 	// Announce success
@@ -194,34 +306,47 @@ func validateCreateArgs(c CreateCommand) error {
 		return errors.New("ERROR: The argument '--name' is required.")
 	}
 
-	return nil
-}
-
-func getInstanceIdByName(instanceName string, svc *ec2.EC2, ui cli.Ui) (string, error) {
-	ui.Output(fmt.Sprintf("Looking up id for instance named %s", instanceName))
-
-	nameTagFilter := ec2.Filter{
-		Name: aws.String("tag:Name"),
-		Values: []*string{aws.String(instanceName)},
+	if c.MinInterval != "" {
+		if _, err := retention.ParseHours(c.MinInterval); err != nil {
+			return err
+		}
 	}
 
-	result, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{Filters: []*ec2.Filter{&nameTagFilter}})
-	if err != nil {
-		return "", err
+	if err := validatePushgatewayUrl(c.PushgatewayUrl); err != nil {
+		return err
 	}
 
-	if len(result.Reservations) != 1 {
-		return "", errors.New(fmt.Sprintf("Expected to find one result for instance name %s, but found %d", instanceName, len(result.Reservations)))
+	if err := validateAuditOptions(c.Audit); err != nil {
+		return err
 	}
 
-	reservation := result.Reservations[0]
+	return validateAwsOptions(c.Aws)
+}
 
-	if len(reservation.Instances) != 1 {
-		return "", errors.New(fmt.Sprintf("Expected to find one instance with instance name %s, but found %d", instanceName, len(reservation.Instances)))
+// The rule the audit log gives for the AMIs create makes: the args that decide whether and how an AMI is created
+func createAuditRule(c CreateCommand) string {
+	rule := "create --ami-name=" + c.AmiName
+	if c.MinInterval != "" {
+		rule += " --min-interval=" + c.MinInterval
+	}
+	if c.KmsKeyId != "" {
+		rule += " --kms-key-id=" + c.KmsKeyId
 	}
+	return rule
+}
 
-	instance := reservation.Instances[0]
-	ui.Output(fmt.Sprintf("Found id %s for instance named %s", *instance.InstanceId, instanceName))
+// Find the newest AMI of the given instance that was created within the given interval and has not failed, or nil if
+// there is no such AMI
+func findRecentImage(ctx context.Context, instanceId string, minInterval string, svc *ec2.EC2) (*ec2.Image, error) {
+	hours, err := retention.ParseHours(minInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := snapper.FindImages(ctx, instanceId, svc)
+	if err != nil {
+		return nil, err
+	}
 
-	return *instance.InstanceId, nil
+	return retention.NewestImageWithinHours(images, hours, time.Now())
 }
\ No newline at end of file
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
-	"regexp"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/josh-padnick/ec2-snapper/metrics"
+	"github.com/josh-padnick/ec2-snapper/retention"
+	"github.com/josh-padnick/ec2-snapper/snapper"
 	"github.com/mitchellh/cli"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"math"
+	"github.com/aws/aws-sdk-go/service/recyclebin"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"errors"
 	"fmt"
 )
@@ -23,16 +27,35 @@ type DeleteCommand struct {
 	InstanceName 		string
 	OlderThan 		string
 	RequireAtLeast		int
+	ArchiveOlderThan	string
+	SoftDelete		bool
+	RecycleBinRetentionDays	int64
+	SnapshotSets		bool
 	DryRun			bool
+	Parallelism		int
+	AmiParallelism		int
+	MetricNamespace		string
+	PushgatewayUrl		string
+	Notify			NotifyOptions
+	Audit			AuditOptions
+	Aws			AwsOptions
+
+	// Shared by every instance of a run; see awsSessions
+	sessions		*awsSessions
 }
 
 // descriptions for args
-var deleteDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
-var deleteDscrInstanceId = "The ID of the EC2 instance from which the AMIs to be deleted were originally created."
-var deleteDscrInstanceName = "The name (from tags) of the EC2 instance from which the AMIs to be deleted were originally created."
+var deleteDscrAwsRegion = "The AWS region to use (e.g. us-west-2). Separate multiple regions with commas."
+var deleteDscrInstanceId = "The ID of the EC2 instance from which the AMIs to be deleted were originally created. Separate multiple ids with commas."
+var deleteDscrInstanceName = "The name (from tags) of the EC2 instance from which the AMIs to be deleted were originally created. Separate multiple names with commas."
 var deleteOlderThan = "Delete AMIs older than the specified time; accepts formats like '30d' or '4h'."
 var requireAtLeast = "Never delete AMIs such that fewer than this number of AMIs will remain. E.g. require at least 3 AMIs remain."
-var deleteDscrDryRun = "Execute a simulated run. Lists AMIs to be deleted, but does not actually delete them."
+var deleteDscrArchiveOlderThan = "Move the snapshots of AMIs older than the specified time, but not old enough to delete, to the EBS Snapshots Archive tier; accepts formats like '90d'. Must be less than '--older-than'."
+var deleteDscrSoftDelete = "If true, deprecate each AMI before de-registering it and make sure that Recycle Bin rules retain the AMIs and their snapshots, so the 'undelete' command can restore them."
+var deleteDscrRecycleBinRetentionDays = "With '--soft-delete', create Recycle Bin rules that retain deleted AMIs and snapshots for this many days if there are none yet. Without it, '--soft-delete' fails if the rules are missing."
+var deleteDscrSnapshotSets = "Delete the standalone EBS snapshot sets created by the 'snapshot' command instead of AMIs. Each set is treated as a single backup by --older-than and --require-at-least."
+var deleteDscrAmiParallelism = "The maximum number of AMIs of each instance to delete concurrently, so that at most '--parallelism' times this many AMIs are deleted at once. Defaults to 1."
+var deleteDscrDryRun = "Execute a simulated run. Lists AMIs and snapshots to be deleted and checks that you have permission to delete them, but does not actually delete them."
 
 func (c *DeleteCommand) Help() string {
 	return `ec2-snapper create <args> [--help]
@@ -45,16 +68,23 @@ Available args are:
 --instance-name      	` + deleteDscrInstanceName + `
 --older-than    	` + deleteOlderThan + `
 --require-at-least      ` + requireAtLeast + `
---dry-run       	` + deleteDscrDryRun
+--archive-older-than	` + deleteDscrArchiveOlderThan + `
+--soft-delete      	` + deleteDscrSoftDelete + `
+--recycle-bin-retention-days	` + deleteDscrRecycleBinRetentionDays + `
+--snapshot-sets      	` + deleteDscrSnapshotSets + `
+--dry-run       	` + deleteDscrDryRun + `
+--parallelism       	` + dscrParallelism + `
+--ami-parallelism      	` + deleteDscrAmiParallelism + `
+--metric-namespace	` + dscrMetricNamespace + `
+--pushgateway-url	` + dscrPushgatewayUrl + notifyArgsHelp() + auditArgsHelp() + awsArgsHelp() + targetArgsHelp()
 }
 
 func (c *DeleteCommand) Synopsis() string {
 	return "Delete the specified AMIs"
 }
 
-func (c *DeleteCommand) Run(args []string) int {
-
-	// Handle the command-line args
+// Define the args of the delete command
+func (c *DeleteCommand) flags() *flag.FlagSet {
 	cmdFlags := flag.NewFlagSet("delete", flag.ExitOnError)
 	cmdFlags.Usage = func() {
 		c.Ui.Output(c.Help())
@@ -62,66 +92,185 @@ func (c *DeleteCommand) Run(args []string) int {
 
 	cmdFlags.StringVar(&c.AwsRegion, "region", "", deleteDscrAwsRegion)
 	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", deleteDscrInstanceId)
-	cmdFlags.StringVar(&c.InstanceName, "instance-name", "", deleteDscrInstanceId)
+	cmdFlags.StringVar(&c.InstanceName, "instance-name", "", deleteDscrInstanceName)
 	cmdFlags.StringVar(&c.OlderThan, "older-than", "", deleteOlderThan)
 	cmdFlags.IntVar(&c.RequireAtLeast, "require-at-least", 0, requireAtLeast)
+	cmdFlags.StringVar(&c.ArchiveOlderThan, "archive-older-than", "", deleteDscrArchiveOlderThan)
+	cmdFlags.BoolVar(&c.SoftDelete, "soft-delete", false, deleteDscrSoftDelete)
+	cmdFlags.Int64Var(&c.RecycleBinRetentionDays, "recycle-bin-retention-days", 0, deleteDscrRecycleBinRetentionDays)
+	cmdFlags.BoolVar(&c.SnapshotSets, "snapshot-sets", false, deleteDscrSnapshotSets)
 	cmdFlags.BoolVar(&c.DryRun, "dry-run", false, deleteDscrDryRun)
+	cmdFlags.IntVar(&c.Parallelism, "parallelism", 1, dscrParallelism)
+	cmdFlags.IntVar(&c.AmiParallelism, "ami-parallelism", 1, deleteDscrAmiParallelism)
+	cmdFlags.StringVar(&c.MetricNamespace, "metric-namespace", "", dscrMetricNamespace)
+	cmdFlags.StringVar(&c.PushgatewayUrl, "pushgateway-url", "", dscrPushgatewayUrl)
+	addNotifyFlags(cmdFlags, &c.Notify)
+	addAuditFlags(cmdFlags, &c.Audit)
+	addAwsFlags(cmdFlags, &c.Aws)
+	addTargetFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *DeleteCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	if err := deleteSnapshots(*c); err != nil {
+	return deleteAll(*c)
+}
+
+// Delete the old AMIs of every instance given on the command line and return the exit code of the command
+func deleteAll(c DeleteCommand) int {
+	if err := validateDeleteArgs(c); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if err := validateParallelism(c.Parallelism); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if c.AmiParallelism < 1 {
+		c.Ui.Error("ERROR: The argument '--ami-parallelism' must be at least 1.")
+		return 1
+	}
+
+	if err := validateTargetOptions(c.Aws); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	// Every instance in every account and region shares the credentials, so an MFA token is only read once
+	c.sessions = newAwsSessions(c.Aws)
+
+	notifier, err := newNotifier(c.Notify, c.Aws, c.sessions, c.Ui)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	auditor, err := newAuditor("delete", c.Audit, c.AwsRegion, c.Aws, c.sessions, c.Ui)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+	ctx = withAuditor(ctx, auditor)
+
+	targets, err := resolveTargets(ctx, c.AwsRegion, c.Aws, c.sessions, c.Ui)
+	if err != nil {
+		err = explainCancellation(ctx, explainAwsError(err))
 		c.Ui.Error(err.Error())
+		auditor.close()
+		notifier.notify(buildNotification("delete", c.DryRun, nil, 1, err, time.Now()))
 		return 1
 	}
 
-	return 0
+	refs := parseInstanceRefs(c.InstanceId, c.InstanceName)
+	results := forEachTarget(targets, c.Ui, func(target awsTarget) []instanceResult {
+		return forEachInstance(ctx, refs, c.Parallelism, c.Ui, func(ref instanceRef, ui cli.Ui) ([]string, error) {
+			instanceCmd := c
+			instanceCmd.Ui = ui
+			instanceCmd.AwsRegion = target.Region
+			instanceCmd.Aws.RoleArn = target.RoleArn
+			instanceCmd.InstanceId = ref.Id
+			instanceCmd.InstanceName = ref.Name
+
+			return deleteSnapshots(ctx, instanceCmd)
+		})
+	})
+
+	exitCode := summarizeInstanceResults(results, c.Ui)
+	if err := auditor.close(); err != nil {
+		c.Ui.Error(err.Error())
+		if exitCode == 0 {
+			exitCode = 1
+		}
+	}
+	notifier.notify(buildNotification("delete", c.DryRun, results, exitCode, nil, time.Now()))
+	return exitCode
 }
 
-func deleteSnapshots(c DeleteCommand) error {
+// Delete the old AMIs or snapshot sets of a single instance and return the ids of the AMIs that were deregistered
+func deleteSnapshots(ctx context.Context, c DeleteCommand) ([]string, error) {
 	if err := validateDeleteArgs(c); err != nil {
-		return err
+		return nil, err
 	}
 
 	if c.DryRun {
-		c.Ui.Warn("WARNING: This is a dry run, and no actions will be taken, despite what any output may say!")
+		c.Ui.Warn("WARNING: This is a dry run. Nothing will be deleted, but EC2 will check that you have permission to delete each AMI and snapshot.")
 	}
 
-	session := session.New(&aws.Config{Region: &c.AwsRegion})
+	session, err := c.sessions.get(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return nil, err
+	}
 	svc := ec2.New(session)
+	recorder := metrics.NewRecorder("delete", c.MetricNamespace, c.PushgatewayUrl, c.DryRun)
 
 	if c.InstanceId == "" {
-		instanceId, err := getInstanceIdByName(c.InstanceName, svc, c.Ui)
-		if err != nil {
-			return err
-		}
-		c.InstanceId = instanceId
+		c.InstanceId, err = snapper.FindInstanceIdByName(ctx, c.InstanceName, svc, c.Ui)
 	} else {
-		result, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(c.InstanceId)}})
-		if err != nil {
-			return err
-		}
-		if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
-			return fmt.Errorf("Could not find an instance with id %s", c.InstanceId)
+		err = snapper.CheckInstanceExists(ctx, c.InstanceId, svc)
+	}
+	if err == nil {
+		ctx, err = auditInstance(ctx, c.InstanceId, deleteAuditRule(c), c.Aws.RoleArn, sts.New(session))
+	}
+
+	var deletedAmiIds []string
+	if err == nil {
+		if c.SnapshotSets {
+			err = deleteSnapshotSets(ctx, c, svc)
+		} else {
+			if c.SoftDelete {
+				err = ensureRecycleBinRules(ctx, c.InstanceId, c.RecycleBinRetentionDays, c.DryRun, recyclebin.New(session), c.Ui)
+			}
+
+			var results []snapper.ImageDeletion
+			if err == nil {
+				results, err = deleteOldAmis(ctx, c, svc)
+			}
+			recorder.RecordImageDeletions(results)
+			deletedAmiIds = snapper.DeregisteredImageIds(results, c.DryRun)
+
+			// There is no point in archiving once the command was interrupted, since every call would fail
+			if c.ArchiveOlderThan != "" && ctx.Err() == nil {
+				if archiveErr := archiveOldSnapshots(ctx, c, deletedAmiIds, svc); err == nil {
+					err = archiveErr
+				}
+			}
 		}
 	}
 
-	images, err := findImages(c.InstanceId, svc)
+	return deletedAmiIds, publishInstanceMetrics(recorder, c.InstanceId, c.InstanceName, err, session, c.Ui)
+}
+
+// Delete the AMIs of the instance with the given id that are older than --older-than, honoring --require-at-least.
+// Returns one result per AMI that was processed.
+func deleteOldAmis(ctx context.Context, c DeleteCommand, svc *ec2.EC2) ([]snapper.ImageDeletion, error) {
+	images, err := snapper.FindImages(ctx, c.InstanceId, svc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(images) == 0 {
 		c.Ui.Info("NO ACTION TAKEN. There are no existing snapshots of instance " + c.InstanceId + " to delete.")
-		return nil
+		return nil, nil
 	}
 
 	// Check that at least the --require-at-least number of AMIs exists
 	// - Note that even if this passes, we still want to avoid deleting so many AMIs that we go below the threshold
 	if len(images) <= c.RequireAtLeast {
 		c.Ui.Info("NO ACTION TAKEN. There are currently " + strconv.Itoa(len(images)) + " AMIs, and --require-at-least=" + strconv.Itoa(c.RequireAtLeast) + " so no further action can be taken.")
-		return nil
+		return nil, nil
 	}
 
 	// Get the AWS Account ID of the current AWS account
@@ -129,66 +278,67 @@ func deleteSnapshots(c DeleteCommand) error {
 	awsAccountId := *images[0].OwnerId
 	c.Ui.Output("==> Identified current AWS Account Id as " + awsAccountId)
 
-	hours, err := parseOlderThanToHours(c.OlderThan)
+	hours, err := retention.ParseHours(c.OlderThan)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	filteredAmis, err := filterImagesByDateRange(images, hours)
+	// Sort the AMIs oldest first, so the newest old ones are kept to honor --require-at-least, like simulate does
+	filteredAmis, err := retention.FilterOlderThan(retention.SortOldestFirst(images), hours, time.Now())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c.Ui.Output("==> Found " + strconv.Itoa(len(filteredAmis)) + " total AMI(s) for deletion.")
 
 	if len(filteredAmis) == 0 {
 		c.Ui.Warn("No AMIs to delete.")
-		return nil
+		return nil, nil
 	}
 
-	allSnapshots, err := getAllSnapshots(awsAccountId, svc)
+	allSnapshots, err := snapper.FindSnapshots(ctx, awsAccountId, svc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c.Ui.Output("==> Found " + strconv.Itoa(len(allSnapshots)) + " total snapshots in this account.")
 
-	var numAmisToRemoveFromFiltered = computeNumAmisToRemove(images, filteredAmis, c.RequireAtLeast)
-	if numAmisToRemoveFromFiltered > 0.0 {
-		c.Ui.Output("==> Only deleting " + strconv.Itoa(len(filteredAmis) - int(numAmisToRemoveFromFiltered)) + " total AMIs to honor '--require-at-least=" + strconv.Itoa(c.RequireAtLeast) + "'.")
+	filteredAmis, err = excludeRecentlyArchivedAmis(ctx, filteredAmis, allSnapshots, svc, time.Now(), c.Ui)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := deleteAmis(filteredAmis, allSnapshots, numAmisToRemoveFromFiltered, svc, c.DryRun, c.Ui); err != nil {
-		return err
+	// Compute whether we should delete fewer AMIs to adhere to our --require-at-least requirement
+	numToKeep := retention.NumToKeep(len(images), len(filteredAmis), c.RequireAtLeast)
+	if numToKeep > 0 {
+		c.Ui.Output("==> Only deleting " + strconv.Itoa(len(filteredAmis) - numToKeep) + " total AMIs to honor '--require-at-least=" + strconv.Itoa(c.RequireAtLeast) + "'.")
 	}
 
-	if c.DryRun {
-		c.Ui.Info("==> DRY RUN. Had this not been a dry run, " + strconv.Itoa(len(filteredAmis)) + " AMI's and their corresponding snapshots would have been deleted.")
-	} else {
-		c.Ui.Info("==> Success! Deleted " + strconv.Itoa(len(filteredAmis) - int(numAmisToRemoveFromFiltered)) + " AMI's and their corresponding snapshots.")
-	}
-	return nil
-}
+	amisToDelete := filteredAmis[:len(filteredAmis) - numToKeep]
+	results := deleteAmis(ctx, amisToDelete, allSnapshots, svc, c.DryRun, c.SoftDelete, c.AmiParallelism, c.Ui)
+	printAmiDeletionResults(results, c.DryRun, c.Ui)
 
-// Get a list of every single snapshot in our account
-// (I wasn't able to find a better way to filter these, but suggestions welcome!)
-func getAllSnapshots(awsAccountId string, svc *ec2.EC2) ([]*ec2.Snapshot, error) {
-	var noSnapshots []*ec2.Snapshot
+	numDeleted, numFailed := snapper.CountDeletions(results)
 
-	respDscrSnapshots, err := svc.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
-		OwnerIds: []*string{&awsAccountId},
-	})
-	if err != nil {
-		return noSnapshots, err
+	if err := cancellationError(ctx); err != nil {
+		summary := fmt.Sprintf("==> Stopped early: %d of %d AMI(s) done, %d failed and %d not started.", numDeleted, len(amisToDelete), numFailed, len(amisToDelete) - len(results))
+		if uninterruptible(ctx).Err() == nil {
+			summary += " Every AMI that was started was finished, so none was left half deleted."
+		}
+		c.Ui.Error(summary)
+		return results, err
 	}
 
-	return respDscrSnapshots.Snapshots, nil
-}
+	if c.DryRun {
+		c.Ui.Info("==> DRY RUN. Had this not been a dry run, " + strconv.Itoa(numDeleted) + " AMI's and their corresponding snapshots would have been deleted.")
+	} else if numFailed == 0 {
+		c.Ui.Info("==> Success! Deleted " + strconv.Itoa(numDeleted) + " AMI's and their corresponding snapshots.")
+	}
 
-// Compute whether we should delete fewer AMIs to adhere to our --require-at-least requirement
-func computeNumAmisToRemove(images []*ec2.Image, filteredAmis []*ec2.Image, requireAtLeast int) float64 {
-	var numTotalAmis = len(images)
-	var numFilteredAmis = len(filteredAmis)
-	var numAmisToRemainAfterDelete = numTotalAmis - numFilteredAmis
-	return math.Max(0.0, float64(requireAtLeast - numAmisToRemainAfterDelete))
+	if numFailed > 0 && numDeleted > 0 {
+		return results, &partialFailureError{NumSucceeded: numDeleted, NumFailed: numFailed}
+	} else if numFailed > 0 {
+		return results, fmt.Errorf("ERROR: Failed to delete all %d AMI(s).", numFailed)
+	}
+	return results, nil
 }
 
 // Check for required command-line args
@@ -209,123 +359,256 @@ func validateDeleteArgs(c DeleteCommand) error {
 		return errors.New("ERROR: The argument '--require-at-least' must be a positive integer.")
 	}
 
-	return nil
-}
+	if c.SoftDelete && c.SnapshotSets {
+		return errors.New("ERROR: The argument '--soft-delete' can't be used with '--snapshot-sets'.")
+	}
 
-// Now filter the AMIs to only include those within our date range
-func filterImagesByDateRange(images []*ec2.Image, olderThanHours float64) ([]*ec2.Image, error) {
-	var filteredAmis[]*ec2.Image
+	if c.RecycleBinRetentionDays != 0 && !c.SoftDelete {
+		return errors.New("ERROR: The argument '--recycle-bin-retention-days' can only be used with '--soft-delete'.")
+	}
 
-	for i := 0; i < len(images); i++ {
-		now := time.Now()
-		creationDate, err := time.Parse(time.RFC3339Nano, *images[i].CreationDate)
-		if err != nil {
-			return filteredAmis, err
+	if err := validateRecycleBinRetentionDays(c.RecycleBinRetentionDays); err != nil {
+		return err
+	}
+
+	if c.ArchiveOlderThan != "" {
+		if err := validateArchiveOlderThan(c.ArchiveOlderThan, c.OlderThan, c.SnapshotSets); err != nil {
+			return err
 		}
+	}
 
-		duration := now.Sub(creationDate)
+	if err := validatePushgatewayUrl(c.PushgatewayUrl); err != nil {
+		return err
+	}
 
-		if duration.Hours() > olderThanHours {
-			filteredAmis = append(filteredAmis, images[i])
-		}
+	if err := validateAuditOptions(c.Audit); err != nil {
+		return err
 	}
 
-	return filteredAmis, nil
+	return validateAwsOptions(c.Aws)
 }
 
-// Get a list of the existing AMIs that were created for the given EC2 instance
-func findImages(instanceId string, svc *ec2.EC2) ([]*ec2.Image, error) {
-	var noImages []*ec2.Image
-
-	// Get a list of the existing AMIs that were created for the given EC2 instance
-	resp, err := svc.DescribeImages(&ec2.DescribeImagesInput{
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name: aws.String(fmt.Sprintf("tag:%s", EC2_SNAPPER_INSTANCE_ID_TAG)),
-				Values: []*string{&instanceId},
-			},
-		},
-	})
-	if err != nil && strings.Contains(err.Error(), "NoCredentialProviders") {
-		return noImages, errors.New("ERROR: No AWS credentials were found.  Either set the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or run this program on an EC2 instance that has an IAM Role with the appropriate permissions.")
-	} else if err != nil {
-		return noImages, err
+// The retention rule the audit log gives for the AMIs and snapshots delete deletes
+func deleteAuditRule(c DeleteCommand) string {
+	rule := "delete --older-than=" + c.OlderThan + " --require-at-least=" + strconv.Itoa(c.RequireAtLeast)
+	if c.SnapshotSets {
+		rule += " --snapshot-sets"
+	}
+	if c.SoftDelete {
+		rule += " --soft-delete"
 	}
+	return rule
+}
+
+// Deregister the AMIs and delete their snapshots, processing up to parallelism AMIs at a time. A failure for one AMI
+// does not stop the others. Once ctx is done, no further AMI is started, but the AMIs in progress are finished unless
+// the command times out. Returns one result per AMI that was started, in the order of the given AMIs.
+func deleteAmis(ctx context.Context, amis []*ec2.Image, snapshots []*ec2.Snapshot, svc *ec2.EC2, dryRun bool, softDelete bool, parallelism int, ui cli.Ui) []snapper.ImageDeletion {
+	results := make([]snapper.ImageDeletion, len(amis))
+	started := make([]bool, len(amis))
+
+	runInParallel(len(results), parallelism, func(i int) {
+		if ctx.Err() != nil {
+			return
+		}
+		started[i] = true
 
-	return resp.Images, nil
+		results[i] = snapper.DeleteImage(uninterruptible(ctx), amis[i], snapshots, dryRun, softDelete, svc, ui)
+		if results[i].Err != nil {
+			ui.Error(*amis[i].ImageId + ": " + results[i].Err.Error())
+		}
+	})
+
+	var startedResults []snapper.ImageDeletion
+	for i, result := range results {
+		if started[i] {
+			startedResults = append(startedResults, result)
+		}
+	}
+	return startedResults
 }
 
-func deleteAmis(amis []*ec2.Image, snapshots []*ec2.Snapshot, numAmisToRemoveFromFiltered float64, svc *ec2.EC2, dryRun bool, ui cli.Ui) error {
-	for i := 0; i < len(amis) - int(numAmisToRemoveFromFiltered); i++ {
-		// Step 1: De-register the AMI
-		ui.Output(*amis[i].ImageId + ": De-registering AMI named \"" + *amis[i].Name + "\"...")
-		_, err := svc.DeregisterImage(&ec2.DeregisterImageInput{
-			DryRun: &dryRun,
-			ImageId: amis[i].ImageId,
-		})
-		if err != nil {
-			if ! strings.Contains(err.Error(), "DryRunOperation") {
-				return err
-			}
+// Print a table with the outcome for every AMI. For a dry run, the table shows what would have been deleted.
+func printAmiDeletionResults(results []snapper.ImageDeletion, dryRun bool, ui cli.Ui) {
+	if len(results) == 0 {
+		return
+	}
+
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	if dryRun {
+		fmt.Fprintln(writer, "AMI\tNAME\tWOULD DEREGISTER\tSNAPSHOTS WOULD DELETE\tRESULT")
+	} else {
+		fmt.Fprintln(writer, "AMI\tNAME\tDEREGISTERED\tSNAPSHOTS DELETED\tRESULT")
+	}
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = "FAILED: " + result.Err.Error()
 		}
+		fmt.Fprintf(writer, "%s\t%s\t%t\t%d/%d\t%s\n", result.ImageId, result.Name, result.Deregistered, result.SnapshotsDeleted, result.SnapshotsFound, status)
+	}
+	writer.Flush()
 
-		// Step 2: Delete the corresponding AMI snapshot
-		// Look at the "description" for each Snapshot to see if it contains our AMI id
-		var snapshotIds []string
-		for _, snapshot := range snapshots {
-			if strings.Contains(*snapshot.Description, *amis[i].ImageId) {
-				snapshotIds = append(snapshotIds, *snapshot.SnapshotId)
-			}
+	ui.Output("")
+	ui.Output(strings.TrimRight(out.String(), "\n"))
+}
+
+// Delete the standalone snapshot sets of the given instance, oldest first, honoring --older-than and --require-at-least
+func deleteSnapshotSets(ctx context.Context, c DeleteCommand, svc *ec2.EC2) error {
+	sets, err := findSnapshotSets(ctx, c.InstanceId, svc)
+	if err != nil {
+		return err
+	}
+
+	if len(sets) == 0 {
+		c.Ui.Info("NO ACTION TAKEN. There are no existing snapshot sets of instance " + c.InstanceId + " to delete.")
+		return nil
+	}
+
+	if len(sets) <= c.RequireAtLeast {
+		c.Ui.Info("NO ACTION TAKEN. There are currently " + strconv.Itoa(len(sets)) + " snapshot sets, and --require-at-least=" + strconv.Itoa(c.RequireAtLeast) + " so no further action can be taken.")
+		return nil
+	}
+
+	hours, err := retention.ParseHours(c.OlderThan)
+	if err != nil {
+		return err
+	}
+
+	filteredSets := filterSnapshotSetsByDateRange(sets, hours)
+	c.Ui.Output("==> Found " + strconv.Itoa(len(filteredSets)) + " total snapshot set(s) for deletion.")
+
+	if len(filteredSets) == 0 {
+		c.Ui.Warn("No snapshot sets to delete.")
+		return nil
+	}
+
+	numSetsToDelete := len(filteredSets) - retention.NumToKeep(len(sets), len(filteredSets), c.RequireAtLeast)
+	if numSetsToDelete < len(filteredSets) {
+		c.Ui.Output("==> Only deleting " + strconv.Itoa(numSetsToDelete) + " total snapshot sets to honor '--require-at-least=" + strconv.Itoa(c.RequireAtLeast) + "'.")
+	}
+
+	// The sets are sorted oldest first, so we always keep the newest ones. A failure for one set does not stop the
+	// others. Once the command is interrupted, no further set is started, but the set in progress is finished.
+	setsToDelete := filteredSets[:numSetsToDelete]
+	var results []snapshotSetDeletion
+	for _, set := range setsToDelete {
+		if ctx.Err() != nil {
+			break
 		}
 
-		// Delete all snapshots that were found
-		ui.Output(*amis[i].ImageId + ": Found " + strconv.Itoa(len(snapshotIds)) + " snapshot(s) to delete")
-		for _, snapshotId := range snapshotIds {
-			ui.Output(*amis[i].ImageId + ": Deleting snapshot " + snapshotId + "...")
-			_, deleteErr := svc.DeleteSnapshot(&ec2.DeleteSnapshotInput{
-				DryRun: &dryRun,
-				SnapshotId: &snapshotId,
-			})
-
-			if deleteErr != nil {
-				return deleteErr
-			}
+		result := deleteSnapshotSet(uninterruptible(ctx), set, c.DryRun, svc, c.Ui)
+		if result.Err != nil {
+			c.Ui.Error(result.BatchId + ": " + result.Err.Error())
 		}
+		results = append(results, result)
+	}
+	printSnapshotSetDeletionResults(results, c.DryRun, c.Ui)
+
+	numDeleted, numFailed := countSnapshotSetDeletions(results)
 
-		ui.Output(*amis[i].ImageId + ": Done!")
-		ui.Output("")
+	if err := cancellationError(ctx); err != nil {
+		c.Ui.Error(fmt.Sprintf("==> Stopped early: %d of %d snapshot set(s) done, %d failed and %d not started.", numDeleted, len(setsToDelete), numFailed, len(setsToDelete) - len(results)))
+		return err
 	}
 
+	if c.DryRun {
+		c.Ui.Info("==> DRY RUN. Had this not been a dry run, " + strconv.Itoa(numDeleted) + " snapshot sets would have been deleted.")
+	} else if numFailed == 0 {
+		c.Ui.Info("==> Success! Deleted " + strconv.Itoa(numDeleted) + " snapshot sets.")
+	}
+
+	if numFailed > 0 && numDeleted > 0 {
+		return &partialFailureError{NumSucceeded: numDeleted, NumFailed: numFailed}
+	} else if numFailed > 0 {
+		return fmt.Errorf("ERROR: Failed to delete all %d snapshot set(s).", numFailed)
+	}
 	return nil
 }
 
-// TODO: convert this to use Go's time.ParseDuration
-func parseOlderThanToHours(olderThan string) (float64, error) {
-	var minutes float64
-	var hours float64
+// The outcome of deleting a single snapshot set
+type snapshotSetDeletion struct {
+	BatchId          string
+	StartTime        time.Time
+	SnapshotsFound   int
+	SnapshotsDeleted int
+	Err              error
+}
+
+// Delete every snapshot of the given set. If a snapshot can't be deleted, we still try to delete the others.
+func deleteSnapshotSet(ctx context.Context, set *snapshotSet, dryRun bool, svc *ec2.EC2, ui cli.Ui) snapshotSetDeletion {
+	result := snapshotSetDeletion{BatchId: set.BatchId, StartTime: set.StartTime, SnapshotsFound: len(set.Snapshots)}
+
+	ui.Output(set.BatchId + ": Found " + strconv.Itoa(len(set.Snapshots)) + " snapshot(s) to delete")
+	var failedSnapshotIds []string
+	var lastErr error
+	for _, snapshot := range set.Snapshots {
+		if dryRun {
+			ui.Output(set.BatchId + ": Would delete snapshot " + *snapshot.SnapshotId)
+		} else {
+			ui.Output(set.BatchId + ": Deleting snapshot " + *snapshot.SnapshotId + "...")
+		}
+		_, err := svc.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{
+			DryRun: &dryRun,
+			SnapshotId: snapshot.SnapshotId,
+		})
+		if err := snapper.CheckDryRunError(err, dryRun, "ec2:DeleteSnapshot"); err != nil {
+			ui.Error(set.BatchId + ": Failed to delete snapshot " + *snapshot.SnapshotId + ": " + err.Error())
+			failedSnapshotIds = append(failedSnapshotIds, *snapshot.SnapshotId)
+			lastErr = err
+		} else {
+			result.SnapshotsDeleted++
+		}
+	}
+
+	if len(failedSnapshotIds) > 0 {
+		result.Err = fmt.Errorf("Failed to delete snapshot(s) %s: %s", strings.Join(failedSnapshotIds, ", "), lastErr.Error())
+		return result
+	}
 
-	// Parse our date range
-	match, _ := regexp.MatchString("^[0-9]*(h|d|m)$", olderThan)
-	if ! match {
-		return hours, errors.New("The --older-than value of \"" + olderThan + "\" is not formatted properly.  Use formats like 30d or 24h")
+	if !dryRun {
+		ui.Output(set.BatchId + ": Done!")
 	}
+	return result
+}
 
-	// We were given a time like "12h"
-	if match, _ := regexp.MatchString("^[0-9]*(h)$", olderThan); match {
-		hours, _ = strconv.ParseFloat(olderThan[0:len(olderThan)-1], 64)
+// Return the number of snapshot sets that were deleted completely and the number of sets for which something failed
+func countSnapshotSetDeletions(results []snapshotSetDeletion) (int, int) {
+	numDeleted := 0
+	numFailed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			numFailed++
+		} else {
+			numDeleted++
+		}
 	}
+	return numDeleted, numFailed
+}
 
-	// We were given a time like "15d"
-	if match, _ := regexp.MatchString("^[0-9]*(d)$", olderThan); match {
-		hours, _ = strconv.ParseFloat(olderThan[0:len(olderThan)-1], 64)
-		hours *= 24
+// Print a table with the outcome for every snapshot set. For a dry run, the table shows what would have been deleted.
+func printSnapshotSetDeletionResults(results []snapshotSetDeletion, dryRun bool, ui cli.Ui) {
+	if len(results) == 0 {
+		return
 	}
 
-	// We were given a time like "5m"
-	if match, _ := regexp.MatchString("^[0-9]*(m)$", olderThan); match {
-		minutes, _ = strconv.ParseFloat(olderThan[0:len(olderThan)-1], 64)
-		hours = minutes/60
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	if dryRun {
+		fmt.Fprintln(writer, "SNAPSHOT SET\tSTARTED\tSNAPSHOTS WOULD DELETE\tRESULT")
+	} else {
+		fmt.Fprintln(writer, "SNAPSHOT SET\tSTARTED\tSNAPSHOTS DELETED\tRESULT")
+	}
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = "FAILED: " + result.Err.Error()
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d/%d\t%s\n", result.BatchId, result.StartTime.UTC().Format(time.RFC3339), result.SnapshotsDeleted, result.SnapshotsFound, status)
 	}
+	writer.Flush()
 
-	return hours, nil
+	ui.Output("")
+	ui.Output(strings.TrimRight(out.String(), "\n"))
 }
\ No newline at end of file
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+type DoctorCommand struct {
+	Ui         cli.Ui
+	AwsRegion  string
+	InstanceId string
+	Features   string
+	Aws        AwsOptions
+}
+
+// descriptions for args
+var doctorDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
+var doctorDscrInstanceId = "The id of an instance to back up. If set, creating an AMI and snapshots of it is checked with a dry run."
+var doctorDscrFeatures = "A comma-separated list of the features to check permissions for (" + strings.Join(allFeatures(), ", ") + "). Defaults to all of them."
+
+func (c *DoctorCommand) Help() string {
+	return `ec2-snapper doctor <args> [--help]
+
+Check that ec2-snapper can find AWS credentials, that the region is valid, and
+that the credentials have every IAM permission the given features need.
+Permissions are checked by simulating the IAM policies of the caller, which
+requires iam:SimulatePrincipalPolicy, and by making EC2 calls with DryRun set.
+
+Available args are:
+--region      		` + doctorDscrAwsRegion + `
+--instance-id   	` + doctorDscrInstanceId + `
+--features      	` + doctorDscrFeatures + awsArgsHelp()
+}
+
+func (c *DoctorCommand) Synopsis() string {
+	return "Check AWS credentials, region and IAM permissions"
+}
+
+// Define the args of the doctor command
+func (c *DoctorCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.AwsRegion, "region", "", doctorDscrAwsRegion)
+	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", doctorDscrInstanceId)
+	cmdFlags.StringVar(&c.Features, "features", "", doctorDscrFeatures)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *DoctorCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+
+	if err := doctor(ctx, *c); err != nil {
+		err = explainCancellation(ctx, err)
+		c.Ui.Error(err.Error())
+		return failureExitCode(err)
+	}
+
+	return 0
+}
+
+// The outcome of checking a single IAM action
+type permissionCheck struct {
+	Action     string
+	Simulation string
+	DryRun     string
+	Missing    bool
+}
+
+func doctor(ctx context.Context, c DoctorCommand) error {
+	if err := validateDoctorArgs(c); err != nil {
+		return err
+	}
+
+	features, err := parseFeatures(c.Features)
+	if err != nil {
+		return err
+	}
+
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return err
+	}
+
+	// Step 1: Check the credentials
+	identity, err := sts.New(session).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return explainAwsError(err)
+	}
+	c.Ui.Info("==> Credentials OK. Authenticated as " + *identity.Arn + " in account " + *identity.Account + ".")
+
+	// Step 2: Check the region
+	svc := ec2.New(session)
+	if _, err := svc.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{RegionNames: []*string{&c.AwsRegion}}); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("ERROR: The region '%s' is not valid or not enabled for this account: %s", c.AwsRegion, err.Error())
+	}
+	c.Ui.Info("==> Region OK. Using region " + c.AwsRegion + ".")
+
+	// Step 3: Check the permissions
+	actions := actionsForFeatures(features)
+	simulations, err := simulatePermissions(ctx, principalArnForSimulation(*identity.Arn), actions, iam.New(session))
+	if err != nil {
+		c.Ui.Warn("WARNING: Could not simulate the IAM policies of " + *identity.Arn + ", so only dry runs will be used: " + err.Error())
+	}
+
+	var checks []permissionCheck
+	for _, action := range actions {
+		if err := cancellationError(ctx); err != nil {
+			return err
+		}
+
+		check := permissionCheck{Action: action, Simulation: "unknown"}
+		if decision, ok := simulations[action]; ok {
+			check.Simulation = decision
+			check.Missing = decision != iam.PolicyEvaluationDecisionTypeAllowed
+		}
+
+		checked, dryRunErr := dryRunPermission(ctx, action, c.InstanceId, svc)
+		if !checked {
+			check.DryRun = "n/a"
+		} else if dryRunErr != nil {
+			check.DryRun = "FAILED: " + dryRunErr.Error()
+			check.Missing = true
+		} else {
+			check.DryRun = "ok"
+		}
+
+		checks = append(checks, check)
+	}
+
+	printPermissionChecks(checks, c.Ui)
+
+	numMissing := 0
+	for _, check := range checks {
+		if check.Missing {
+			numMissing++
+		}
+	}
+	if numMissing > 0 {
+		return fmt.Errorf("ERROR: %d of %d IAM permission(s) are missing or could not be used. Run 'ec2-snapper iam-policy' to print the policy ec2-snapper needs.", numMissing, len(checks))
+	}
+
+	c.Ui.Info("==> Success! All the IAM permissions needed for " + strings.Join(features, ", ") + " are in place.")
+	return nil
+}
+
+func validateDoctorArgs(c DoctorCommand) error {
+	if c.AwsRegion == "" {
+		return errors.New("ERROR: The argument '--region' is required.")
+	}
+
+	if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+		return err
+	}
+
+	return validateAwsOptions(c.Aws)
+}
+
+// Return the decision ("allowed", "explicitDeny" or "implicitDeny") of the IAM policies of the given principal for
+// each of the given actions
+func simulatePermissions(ctx context.Context, principalArn string, actions []string, svc *iam.IAM) (map[string]string, error) {
+	decisions := map[string]string{}
+
+	err := svc.SimulatePrincipalPolicyPagesWithContext(ctx, &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principalArn),
+		ActionNames: aws.StringSlice(actions),
+	}, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+		for _, result := range page.EvaluationResults {
+			decisions[*result.EvalActionName] = *result.EvalDecision
+		}
+		return true
+	})
+
+	return decisions, err
+}
+
+var assumedRoleArnRegex = regexp.MustCompile(`^arn:([^:]+):sts::([0-9]+):assumed-role/([^/]+)/.+$`)
+
+// IAM can only simulate the policies of users, groups and roles, so convert the ARN of an assumed role session (e.g.
+// from an EC2 instance profile) to the ARN of its role. Any other ARN is returned unchanged.
+func principalArnForSimulation(callerArn string) string {
+	matches := assumedRoleArnRegex.FindStringSubmatch(callerArn)
+	if matches == nil {
+		return callerArn
+	}
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", matches[1], matches[2], matches[3])
+}
+
+// Check the given action by making the corresponding EC2 call with DryRun set. Returns false if the action can't be
+// checked this way, e.g. because it is not an EC2 action or because it needs an instance id we don't have.
+func dryRunPermission(ctx context.Context, action string, instanceId string, svc *ec2.EC2) (bool, error) {
+	var err error
+
+	switch action {
+	case "ec2:DescribeImages":
+		_, err = svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{DryRun: aws.Bool(true), Owners: []*string{aws.String("self")}})
+	case "ec2:DescribeInstances":
+		_, err = svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{DryRun: aws.Bool(true)})
+	case "ec2:DescribeSnapshots":
+		_, err = svc.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{DryRun: aws.Bool(true), OwnerIds: []*string{aws.String("self")}})
+	case "ec2:CreateImage":
+		if instanceId == "" {
+			return false, nil
+		}
+		_, err = svc.CreateImageWithContext(ctx, &ec2.CreateImageInput{
+			DryRun: aws.Bool(true),
+			InstanceId: aws.String(instanceId),
+			Name: aws.String("ec2-snapper-doctor"),
+			NoReboot: aws.Bool(true),
+		})
+	case "ec2:CreateSnapshots":
+		if instanceId == "" {
+			return false, nil
+		}
+		_, err = svc.CreateSnapshotsWithContext(ctx, &ec2.CreateSnapshotsInput{
+			DryRun: aws.Bool(true),
+			InstanceSpecification: &ec2.InstanceSpecification{InstanceId: aws.String(instanceId)},
+		})
+	default:
+		return false, nil
+	}
+
+	return true, snapper.CheckDryRunError(err, true, action)
+}
+
+// Print a table with the outcome of every permission check
+func printPermissionChecks(checks []permissionCheck, ui cli.Ui) {
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ACTION\tSIMULATION\tDRY RUN")
+	for _, check := range checks {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", check.Action, check.Simulation, check.DryRun)
+	}
+	writer.Flush()
+
+	ui.Output("")
+	ui.Output(strings.TrimRight(out.String(), "\n"))
+	ui.Output("")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+// AMI names must be unique, so the unencrypted intermediate AMI gets this suffix and its encrypted copy the real name
+const INTERMEDIATE_AMI_NAME_SUFFIX = " (unencrypted)"
+
+// Copy the given AMI with encryption under the given KMS key, wait for the copy to become available and delete the
+// unencrypted AMI and its snapshots. Returns the id of the encrypted copy.
+//
+// The snapshots of the copy have descriptions like "Copied for DestinationAmi ami-... from SourceAmi ...", so delete
+// finds them by the id of the copy just like the snapshots of an AMI created directly.
+//
+// If the command is interrupted, it stops waiting, but a copy that was started is still tagged, and an intermediate AMI
+// that was deregistered still has its snapshots deleted.
+func copyImageEncrypted(ctx context.Context, imageId string, name string, region string, kmsKeyId string, tags []*ec2.Tag, svc *ec2.EC2, ui cli.Ui) (string, error) {
+	// Only available AMIs can be copied
+	ui.Output("==> Waiting for AMI " + imageId + " to become available before encrypting it...")
+	if err := snapper.WaitUntilImageAvailable(ctx, imageId, svc); err != nil {
+		return imageId, err
+	}
+
+	ui.Output("==> Copying AMI " + imageId + " with encryption under KMS key " + kmsKeyId + "...")
+	resp, err := svc.CopyImageWithContext(uninterruptible(ctx), &ec2.CopyImageInput{
+		SourceImageId: aws.String(imageId),
+		SourceRegion: aws.String(region),
+		Name: aws.String(name),
+		Encrypted: aws.Bool(true),
+		KmsKeyId: aws.String(kmsKeyId),
+	})
+	if err != nil {
+		// Leave the intermediate AMI in place. It is tagged, so it is still a backup that delete cleans up eventually.
+		return imageId, fmt.Errorf("ERROR: Failed to copy AMI %s with encryption: %s. The unencrypted AMI %s was kept.", imageId, err.Error(), imageId)
+	}
+	encryptedImageId := *resp.ImageId
+
+	// CopyImage can't tag on creation
+	_, err = svc.CreateTagsWithContext(uninterruptible(ctx), &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(encryptedImageId)},
+		Tags: tags,
+	}, snapper.WithRetryableErrorCodes("InvalidAMIID.NotFound"))
+	if err != nil {
+		return encryptedImageId, err
+	}
+
+	// The snapshots of a copy only show up in its block device mappings once it is available
+	ui.Output("==> Waiting for encrypted AMI " + encryptedImageId + " to become available...")
+	if err := snapper.WaitUntilImageAvailable(ctx, encryptedImageId, svc); err != nil {
+		return encryptedImageId, err
+	}
+
+	intermediateCtx := withAuditRule(uninterruptible(ctx), "create --kms-key-id=" + kmsKeyId + ": the unencrypted AMI was replaced by its encrypted copy " + encryptedImageId)
+	if err := deleteIntermediateImage(intermediateCtx, imageId, svc, ui); err != nil {
+		ui.Warn("WARNING: Failed to delete the unencrypted AMI " + imageId + ": " + err.Error() + ". It is tagged, so delete will clean it up, or you can delete it manually.")
+	}
+
+	return encryptedImageId, nil
+}
+
+// Deregister the unencrypted intermediate AMI and delete its snapshots
+func deleteIntermediateImage(ctx context.Context, imageId string, svc *ec2.EC2, ui cli.Ui) error {
+	resp, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: []*string{aws.String(imageId)}})
+	if err != nil {
+		return err
+	}
+	if len(resp.Images) == 0 {
+		return fmt.Errorf("Could not find AMI %s", imageId)
+	}
+
+	ui.Output("==> De-registering the unencrypted AMI " + imageId + "...")
+	if _, err := svc.DeregisterImageWithContext(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(imageId)}); err != nil {
+		return err
+	}
+
+	for _, snapshotId := range imageSnapshotIds(resp.Images[0]) {
+		ui.Output("==> Deleting unencrypted snapshot " + snapshotId + "...")
+		if _, err := svc.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotId)}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func imageSnapshotIds(image *ec2.Image) []string {
+	var snapshotIds []string
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping != nil && mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+			snapshotIds = append(snapshotIds, *mapping.Ebs.SnapshotId)
+		}
+	}
+	return snapshotIds
+}
+
+// Return an error naming every snapshot of the AMI that is not encrypted, for --require-encrypted
+func checkImageEncrypted(image *ec2.Image) error {
+	var unencrypted []string
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping != nil && mapping.Ebs != nil && !aws.BoolValue(mapping.Ebs.Encrypted) {
+			unencrypted = append(unencrypted, aws.StringValue(mapping.Ebs.SnapshotId) + " (" + aws.StringValue(mapping.DeviceName) + ")")
+		}
+	}
+
+	if len(unencrypted) > 0 {
+		return fmt.Errorf("ERROR: '--require-encrypted' is set, but the snapshot(s) %s of AMI %s are not encrypted. Use '--kms-key-id' to encrypt them. The AMI was kept.", strings.Join(unencrypted, ", "), aws.StringValue(image.ImageId))
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/metrics"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+const DEFAULT_EXPORTER_LISTEN_ADDRESS = ":9706"
+const DEFAULT_EXPORTER_REFRESH_INTERVAL = 5 * time.Minute
+
+// DescribeImages is cheap, but refreshing more often than this gains nothing, since AMIs take minutes to create
+const MIN_EXPORTER_REFRESH_INTERVAL = 30 * time.Second
+
+type ExporterCommand struct {
+	Ui              cli.Ui
+	AwsRegion       string
+	InstanceId      string
+	InstanceName    string
+	Tag             string
+	ListenAddress   string
+	RefreshInterval time.Duration
+	Aws             AwsOptions
+}
+
+// descriptions for args
+var exporterDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
+var exporterDscrInstanceId = "The id of the instance whose AMIs to export metrics about. Separate multiple ids with commas."
+var exporterDscrInstanceName = "The name (from tags) of the instance whose AMIs to export metrics about. Separate multiple names with commas."
+var exporterDscrTag = "Export metrics about every instance that isn't terminated and has this tag, in the format Key=Value (e.g. Backup=nightly). Instances are looked up again on every refresh."
+var exporterDscrListenAddress = "The address to serve /metrics on. Defaults to " + DEFAULT_EXPORTER_LISTEN_ADDRESS + "."
+var exporterDscrRefreshInterval = "How often to query EC2 for the AMIs of every instance, e.g. 5m. Defaults to " + DEFAULT_EXPORTER_REFRESH_INTERVAL.String() + "."
+
+func (c *ExporterCommand) Help() string {
+	return `ec2-snapper exporter <args> [--help]
+
+Serve Prometheus metrics about the AMIs of the given instances on /metrics.
+The AMIs are queried when the exporter starts and then on every refresh
+interval, so scrapes never call AWS.
+
+Available args are:
+--region      		` + exporterDscrAwsRegion + `
+--instance-id      	` + exporterDscrInstanceId + `
+--instance-name      	` + exporterDscrInstanceName + `
+--tag      		` + exporterDscrTag + `
+--listen-address	` + exporterDscrListenAddress + `
+--refresh-interval	` + exporterDscrRefreshInterval + awsArgsHelp()
+}
+
+func (c *ExporterCommand) Synopsis() string {
+	return "Serve Prometheus metrics about the AMIs of EC2 instances"
+}
+
+// Define the args of the exporter command
+func (c *ExporterCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("exporter", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.AwsRegion, "region", "", exporterDscrAwsRegion)
+	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", exporterDscrInstanceId)
+	cmdFlags.StringVar(&c.InstanceName, "instance-name", "", exporterDscrInstanceName)
+	cmdFlags.StringVar(&c.Tag, "tag", "", exporterDscrTag)
+	cmdFlags.StringVar(&c.ListenAddress, "listen-address", DEFAULT_EXPORTER_LISTEN_ADDRESS, exporterDscrListenAddress)
+	cmdFlags.DurationVar(&c.RefreshInterval, "refresh-interval", DEFAULT_EXPORTER_REFRESH_INTERVAL, exporterDscrRefreshInterval)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *ExporterCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	// The exporter runs until it is stopped, so --timeout applies to every refresh instead
+	ctx, stop := newCommandContext(0, c.Ui)
+	defer stop()
+
+	if err := serveExporter(ctx, *c); err != nil {
+		c.Ui.Error(explainAwsError(err).Error())
+		return 1
+	}
+
+	return 0
+}
+
+// Refresh the metrics on every interval and serve them until the HTTP server fails or ctx is done
+func serveExporter(ctx context.Context, c ExporterCommand) error {
+	if err := validateExporterArgs(c); err != nil {
+		return err
+	}
+
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return err
+	}
+	svc := ec2.New(session)
+
+	exporter := newAmiExporter()
+	refreshExporter(ctx, c, exporter, svc)
+
+	go func() {
+		ticker := time.NewTicker(c.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				refreshExporter(ctx, c, exporter, svc)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title>ec2-snapper exporter</title></head><body><a href="/metrics">Metrics</a></body></html>`))
+	})
+
+	server := &http.Server{Addr: c.ListenAddress, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	c.Ui.Info("==> Serving metrics on " + c.ListenAddress + "/metrics, refreshed every " + c.RefreshInterval.String())
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	c.Ui.Info("==> Stopped serving metrics.")
+	return nil
+}
+
+// Query the AMIs of every instance and update the exporter. Errors are reported and counted, but never stop the
+// exporter, so the metrics of the other instances stay current. With --timeout, the refresh is aborted after that long.
+func refreshExporter(ctx context.Context, c ExporterCommand, exporter *amiExporter, svc *ec2.EC2) {
+	if c.Aws.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Aws.Timeout)
+		defer cancel()
+	}
+
+	refs, err := findInstances(ctx, c.InstanceId, c.InstanceName, c.Tag, svc)
+	if err != nil {
+		c.Ui.Error("ERROR: Failed to find the instances to export metrics about: " + explainAwsError(err).Error())
+		exporter.recordRefreshError()
+		return
+	}
+
+	for _, ref := range refs {
+		images, err := snapper.FindImages(ctx, ref.Id, svc)
+		if err != nil {
+			c.Ui.Error("ERROR: Failed to find the AMIs of " + ref.String() + ": " + explainAwsError(err).Error())
+			exporter.recordRefreshError()
+			continue
+		}
+		exporter.update(ref, images, time.Now())
+	}
+
+	exporter.retain(refs, time.Now())
+}
+
+// The state of the AMIs of a single instance as of the last refresh
+type exportedInstance struct {
+	Ref instanceRef
+	// The state of every AMI of the instance, by AMI id
+	ImageStates     map[string]string
+	Amis            float64
+	NewestAmiAge    time.Duration
+	SnapshotGiB     float64
+	AmisCreatedOk   float64
+	AmisCreatedFail float64
+	AmisDeleted     float64
+}
+
+// Keeps the metrics of every instance between refreshes and serves them in the Prometheus text format. The counters
+// are derived from how the AMIs of an instance change between refreshes, so AMIs created or deleted by any run of
+// create or delete are counted, wherever it ran.
+type amiExporter struct {
+	mutex         sync.Mutex
+	instances     map[string]*exportedInstance
+	refreshErrors float64
+	lastRefresh   time.Time
+}
+
+func newAmiExporter() *amiExporter {
+	return &amiExporter{instances: map[string]*exportedInstance{}}
+}
+
+// Update the metrics of the given instance from its current AMIs. An AMI counts as created when it first shows up as
+// available or failed, either directly or after being pending, and as deleted when it is gone. Nothing is counted on
+// the first refresh of an instance, since its existing AMIs weren't created while the exporter was watching.
+func (e *amiExporter) update(ref instanceRef, images []*ec2.Image, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	instance, known := e.instances[ref.Id]
+	if !known {
+		instance = &exportedInstance{}
+		e.instances[ref.Id] = instance
+	}
+
+	imageStates := map[string]string{}
+	instance.Amis = 0
+	instance.SnapshotGiB = 0
+
+	for _, image := range images {
+		state := aws.StringValue(image.State)
+		imageStates[*image.ImageId] = state
+
+		if known {
+			previousState, existed := instance.ImageStates[*image.ImageId]
+			wasPending := !existed || previousState == ec2.ImageStatePending
+			if wasPending && state == ec2.ImageStateAvailable {
+				instance.AmisCreatedOk++
+			}
+			if wasPending && state == ec2.ImageStateFailed {
+				instance.AmisCreatedFail++
+			}
+		}
+
+		if state == ec2.ImageStateAvailable {
+			instance.Amis++
+		}
+		if state != ec2.ImageStateFailed {
+			for _, mapping := range image.BlockDeviceMappings {
+				if mapping.Ebs != nil {
+					instance.SnapshotGiB += float64(aws.Int64Value(mapping.Ebs.VolumeSize))
+				}
+			}
+		}
+	}
+
+	if known {
+		for imageId := range instance.ImageStates {
+			if _, ok := imageStates[imageId]; !ok {
+				instance.AmisDeleted++
+			}
+		}
+	}
+
+	instance.Ref = ref
+	instance.ImageStates = imageStates
+	instance.NewestAmiAge = evaluateFreshness(ref, images, math.Inf(1), math.Inf(1), now).Age
+}
+
+// Forget the instances that were not found on this refresh, e.g. because they lost their tag, and mark the refresh
+// as done
+func (e *amiExporter) retain(refs []instanceRef, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	found := map[string]bool{}
+	for _, ref := range refs {
+		found[ref.Id] = true
+	}
+	for instanceId := range e.instances {
+		if !found[instanceId] {
+			delete(e.instances, instanceId)
+		}
+	}
+
+	e.lastRefresh = now
+}
+
+func (e *amiExporter) recordRefreshError() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.refreshErrors++
+}
+
+// Return the current metrics, with the samples of every metric ordered by instance id
+func (e *amiExporter) metrics() []metrics.PrometheusMetric {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var instanceIds []string
+	for instanceId := range e.instances {
+		instanceIds = append(instanceIds, instanceId)
+	}
+	sort.Strings(instanceIds)
+
+	amis := metrics.PrometheusMetric{Name: "ec2_snapper_amis", Help: "The number of available AMIs of the instance.", Type: "gauge"}
+	newestAmiAge := metrics.PrometheusMetric{Name: "ec2_snapper_newest_ami_age_seconds", Help: "The age of the newest available AMI of the instance.", Type: "gauge"}
+	snapshotGiB := metrics.PrometheusMetric{Name: "ec2_snapper_snapshot_size_gibibytes", Help: "The total size of the volumes of the snapshots of all pending and available AMIs of the instance.", Type: "gauge"}
+	amisCreated := metrics.PrometheusMetric{Name: "ec2_snapper_amis_created_total", Help: "The number of AMIs of the instance that became available (outcome=success) or failed (outcome=failure) while the exporter was running.", Type: "counter"}
+	amisDeleted := metrics.PrometheusMetric{Name: "ec2_snapper_amis_deleted_total", Help: "The number of AMIs of the instance that were deregistered while the exporter was running.", Type: "counter"}
+
+	for _, instanceId := range instanceIds {
+		instance := e.instances[instanceId]
+		labels := map[string]string{"instance_id": instance.Ref.Id, "instance_name": instance.Ref.Name}
+
+		amis.Samples = append(amis.Samples, metrics.PrometheusSample{Labels: labels, Value: instance.Amis})
+		snapshotGiB.Samples = append(snapshotGiB.Samples, metrics.PrometheusSample{Labels: labels, Value: instance.SnapshotGiB})
+		// An instance without any available AMI has no age, which alerts can detect with absent()
+		if instance.NewestAmiAge >= 0 {
+			newestAmiAge.Samples = append(newestAmiAge.Samples, metrics.PrometheusSample{Labels: labels, Value: instance.NewestAmiAge.Seconds()})
+		}
+		amisCreated.Samples = append(amisCreated.Samples,
+			metrics.PrometheusSample{Labels: withLabel(labels, "outcome", "success"), Value: instance.AmisCreatedOk},
+			metrics.PrometheusSample{Labels: withLabel(labels, "outcome", "failure"), Value: instance.AmisCreatedFail},
+		)
+		amisDeleted.Samples = append(amisDeleted.Samples, metrics.PrometheusSample{Labels: labels, Value: instance.AmisDeleted})
+	}
+
+	refreshErrors := metrics.PrometheusMetric{Name: "ec2_snapper_refresh_errors_total", Help: "The number of failed queries to EC2.", Type: "counter",
+		Samples: []metrics.PrometheusSample{metrics.PrometheusSample{Value: e.refreshErrors}}}
+	lastRefresh := metrics.PrometheusMetric{Name: "ec2_snapper_last_refresh_timestamp_seconds", Help: "The time of the last refresh, in seconds since the Unix epoch.", Type: "gauge"}
+	if !e.lastRefresh.IsZero() {
+		lastRefresh.Samples = []metrics.PrometheusSample{metrics.PrometheusSample{Value: float64(e.lastRefresh.Unix())}}
+	}
+
+	return []metrics.PrometheusMetric{amis, newestAmiAge, snapshotGiB, amisCreated, amisDeleted, refreshErrors, lastRefresh}
+}
+
+func (e *amiExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := metrics.FormatPrometheus(e.metrics())
+	w.Header().Set("Content-Type", metrics.PROMETHEUS_CONTENT_TYPE)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write([]byte(body))
+}
+
+// Return a copy of the given labels with one more label
+func withLabel(labels map[string]string, name string, value string) map[string]string {
+	copied := map[string]string{name: value}
+	for labelName, labelValue := range labels {
+		copied[labelName] = labelValue
+	}
+	return copied
+}
+
+func validateExporterArgs(c ExporterCommand) error {
+	if c.AwsRegion == "" {
+		return errors.New("ERROR: The argument '--region' is required.")
+	}
+
+	if err := validateInstanceSelectors(c.InstanceId, c.InstanceName, c.Tag); err != nil {
+		return err
+	}
+
+	if c.ListenAddress == "" {
+		return errors.New("ERROR: The argument '--listen-address' must not be empty.")
+	}
+
+	if c.RefreshInterval < MIN_EXPORTER_REFRESH_INTERVAL {
+		return errors.New("ERROR: The argument '--refresh-interval' must be at least " + MIN_EXPORTER_REFRESH_INTERVAL.String() + ".")
+	}
+
+	if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+		return err
+	}
+
+	return validateAwsOptions(c.Aws)
+}
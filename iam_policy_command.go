@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+type IamPolicyCommand struct {
+	Ui         cli.Ui
+	Features   string
+	ScopeByTag bool
+}
+
+// descriptions for args
+var iamPolicyDscrFeatures = "A comma-separated list of the features to generate the policy for (" + strings.Join(allFeatures(), ", ") + "). Defaults to all of them."
+var iamPolicyDscrScopeByTag = "If true, only allow de-registering AMIs and deleting snapshots that are tagged with '" + snapper.INSTANCE_ID_TAG + "'."
+
+func (c *IamPolicyCommand) Help() string {
+	return `ec2-snapper iam-policy <args> [--help]
+
+Print the least-privilege IAM policy that ec2-snapper needs for the given
+features.
+
+Available args are:
+--features      	` + iamPolicyDscrFeatures + `
+--scope-by-tag  	` + iamPolicyDscrScopeByTag
+}
+
+func (c *IamPolicyCommand) Synopsis() string {
+	return "Print the IAM policy ec2-snapper needs"
+}
+
+// Define the args of the iam-policy command
+func (c *IamPolicyCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("iam-policy", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.Features, "features", "", iamPolicyDscrFeatures)
+	cmdFlags.BoolVar(&c.ScopeByTag, "scope-by-tag", false, iamPolicyDscrScopeByTag)
+
+	return cmdFlags
+}
+
+func (c *IamPolicyCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	features, err := parseFeatures(c.Features)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	policy, err := formatIamPolicy(buildIamPolicy(features, c.ScopeByTag))
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	outputResult(c.Ui, policy)
+	return 0
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"testing"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/josh-padnick/ec2-snapper/snapper"
 	"github.com/mitchellh/cli"
 	"os"
 	"fmt"
@@ -16,6 +18,10 @@ import (
 const AWS_REGION_FOR_TESTING = "us-east-1"
 const AMAZON_LINUX_AMI_ID = "ami-08111162"
 
+// Set this environment variable (e.g. to http://localhost:4566) to run the integration tests against a local emulator
+// such as LocalStack instead of a real AWS account
+const ENDPOINT_URL_ENV_VAR_FOR_TESTING = "EC2_SNAPPER_TEST_ENDPOINT_URL"
+
 const TEST_FILE_PATH = "/home/ec2-user/test-file"
 const USER_DATA_TEMPLATE =
 `#!/bin/bash
@@ -28,8 +34,7 @@ func TestCreateAndDelete(t *testing.T) {
 	t.Parallel()
 
 	logger, ui := createLoggerAndUi("TestCreateAndDelete")
-	session := session.New(&aws.Config{Region: aws.String(AWS_REGION_FOR_TESTING)})
-	svc := ec2.New(session)
+	svc := ec2.New(createTestSession(ui, t))
 
 	instance, instanceName := launchInstance(svc, logger, t)
 	defer terminateInstance(instance, svc, logger, t)
@@ -46,8 +51,7 @@ func TestDeleteRespectsOlderThan(t *testing.T) {
 	t.Parallel()
 
 	logger, ui := createLoggerAndUi("TestDeleteRespectsOlderThan")
-	session := session.New(&aws.Config{Region: aws.String(AWS_REGION_FOR_TESTING)})
-	svc := ec2.New(session)
+	svc := ec2.New(createTestSession(ui, t))
 
 	instance, instanceName := launchInstance(svc, logger, t)
 	defer terminateInstance(instance, svc, logger, t)
@@ -70,8 +74,7 @@ func TestDeleteRespectsAtLeast(t *testing.T) {
 	t.Parallel()
 
 	logger, ui := createLoggerAndUi("TestDeleteRespectsAtLeast")
-	session := session.New(&aws.Config{Region: aws.String(AWS_REGION_FOR_TESTING)})
-	svc := ec2.New(session)
+	svc := ec2.New(createTestSession(ui, t))
 
 	instance, instanceName := launchInstance(svc, logger, t)
 	defer terminateInstance(instance, svc, logger, t)
@@ -93,8 +96,7 @@ func TestDeleteHandlesNoSnapshots(t *testing.T) {
 	t.Parallel()
 
 	logger, ui := createLoggerAndUi("TestDeleteHandlesNoSnapshots")
-	session := session.New(&aws.Config{Region: aws.String(AWS_REGION_FOR_TESTING)})
-	svc := ec2.New(session)
+	svc := ec2.New(createTestSession(ui, t))
 
 	instance, instanceName := launchInstance(svc, logger, t)
 	defer terminateInstance(instance, svc, logger, t)
@@ -110,11 +112,12 @@ func TestCreateWithInvalidInstanceName(t *testing.T) {
 	cmd := CreateCommand{
 		Ui: ui,
 		AwsRegion: AWS_REGION_FOR_TESTING,
+		Aws: createTestAwsOptions(),
 		InstanceName: "not-a-valid-instance-name",
 		AmiName: "this-ami-should-not-be-created",
 	}
 
-	_, err := create(cmd)
+	_, err := create(context.Background(), cmd)
 
 	if err == nil {
 		t.Fatalf("Expected an error when creating a snapshot of an instance name that doesn't exist, but instead got nil")
@@ -128,11 +131,12 @@ func TestCreateWithInvalidInstanceId(t *testing.T) {
 	cmd := CreateCommand{
 		Ui: ui,
 		AwsRegion: AWS_REGION_FOR_TESTING,
+		Aws: createTestAwsOptions(),
 		InstanceId: "not-a-valid-instance-id",
 		AmiName: "this-ami-should-not-be-created",
 	}
 
-	_, err := create(cmd)
+	_, err := create(context.Background(), cmd)
 
 	if err == nil {
 		t.Fatalf("Expected an error when creating a snapshot of an instance id that doesn't exist, but instead got nil")
@@ -146,12 +150,13 @@ func TestDeleteWithInvalidInstanceName(t *testing.T) {
 	cmd := DeleteCommand{
 		Ui: ui,
 		AwsRegion: AWS_REGION_FOR_TESTING,
+		Aws: createTestAwsOptions(),
 		InstanceName: "not-a-valid-instance-name",
 		OlderThan: "0h",
 		RequireAtLeast: 0,
 	}
 
-	err := deleteSnapshots(cmd)
+	_, err := deleteSnapshots(context.Background(), cmd)
 
 	if err == nil {
 		t.Fatalf("Expected an error when deleting a snapshot of an instance name that doesn't exist, but instead got nil")
@@ -165,12 +170,13 @@ func TestDeleteWithInvalidInstanceId(t *testing.T) {
 	cmd := DeleteCommand{
 		Ui: ui,
 		AwsRegion: AWS_REGION_FOR_TESTING,
+		Aws: createTestAwsOptions(),
 		InstanceId: "not-a-valid-instance-id",
 		OlderThan: "0h",
 		RequireAtLeast: 0,
 	}
 
-	err := deleteSnapshots(cmd)
+	_, err := deleteSnapshots(context.Background(), cmd)
 
 	if err == nil {
 		t.Fatalf("Expected an error when deleting a snapshot of an instance id that doesn't exist, but instead got nil")
@@ -252,11 +258,12 @@ func takeSnapshot(instanceName string, ui cli.Ui, logger *log.Logger, t *testing
 	cmd := CreateCommand{
 		Ui: ui,
 		AwsRegion: AWS_REGION_FOR_TESTING,
+		Aws: createTestAwsOptions(),
 		InstanceName: instanceName,
 		AmiName: instanceName,
 	}
 
-	snapshotId, err := create(cmd)
+	snapshotId, err := create(context.Background(), cmd)
 
 	if err != nil {
 		t.Fatal(err)
@@ -306,7 +313,7 @@ func waitForSnapshotToBeAvailable(instanceId string, svc *ec2.EC2, logger *log.L
 	logger.Printf("Waiting for snapshot for instance %s to become available", instanceId)
 
 	instanceIdTagFilter := &ec2.Filter{
-		Name: aws.String(fmt.Sprintf("tag:%s", EC2_SNAPPER_INSTANCE_ID_TAG)),
+		Name: aws.String(fmt.Sprintf("tag:%s", snapper.INSTANCE_ID_TAG)),
 		Values: []*string{aws.String(instanceId)},
 	}
 
@@ -328,12 +335,13 @@ func deleteSnapshotForInstance(instanceName string, olderThan string, requireAtL
 	deleteCmd := DeleteCommand{
 		Ui: ui,
 		AwsRegion: AWS_REGION_FOR_TESTING,
+		Aws: createTestAwsOptions(),
 		InstanceName: instanceName,
 		OlderThan: olderThan,
 		RequireAtLeast: requireAtLeast,
 	}
 
-	if err := deleteSnapshots(deleteCmd); err != nil {
+	if _, err := deleteSnapshots(context.Background(), deleteCmd); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -353,6 +361,18 @@ func deleteSnapshotWithVerification(instanceName string, snapshotId string, ui c
 	verifySnapshotIsDeleted(snapshotId, svc, logger, t)
 }
 
+func createTestAwsOptions() AwsOptions {
+	return AwsOptions{EndpointUrl: os.Getenv(ENDPOINT_URL_ENV_VAR_FOR_TESTING)}
+}
+
+func createTestSession(ui cli.Ui, t *testing.T) *session.Session {
+	session, err := newSession(AWS_REGION_FOR_TESTING, createTestAwsOptions(), ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
 func createLoggerAndUi(testName string) (*log.Logger, cli.Ui) {
 	logger := log.New(os.Stdout, testName + " ", log.LstdFlags)
 
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/mitchellh/cli"
+)
+
+// The exit code of a command that was interrupted by SIGINT or SIGTERM, the same a shell reports for SIGINT
+const EXIT_CODE_INTERRUPTED = 130
+
+// How the context of a single run of a command was cancelled
+type cancellation struct {
+	timeout time.Duration
+	// Only done once the command times out or is interrupted a second time; see uninterruptible
+	work   context.Context
+	mutex  sync.Mutex
+	signal os.Signal
+}
+
+type cancellationKey struct{}
+
+// Returned for the work a command stopped or never started because it was interrupted
+type interruptedError struct {
+	Signal os.Signal
+}
+
+func (err *interruptedError) Error() string {
+	return fmt.Sprintf("ERROR: Interrupted by %s before finishing.", signalName(err.Signal))
+}
+
+// Return the context to run a command with and a function to call once the command is done. The context is done once
+// the timeout expires, if it isn't 0, or the process receives SIGINT or SIGTERM. Commands stop starting new work once
+// it is done, but finish the work that must not be left half done; see uninterruptible. A second signal aborts that
+// work too.
+func newCommandContext(timeout time.Duration, ui cli.Ui) (context.Context, func()) {
+	work, cancelWork := context.WithCancel(context.Background())
+	if timeout > 0 {
+		work, cancelWork = context.WithTimeout(context.Background(), timeout)
+	}
+
+	c := &cancellation{timeout: timeout, work: work}
+	ctx, cancel := context.WithCancel(context.WithValue(work, cancellationKey{}, c))
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case received := <-signals:
+			c.mutex.Lock()
+			c.signal = received
+			c.mutex.Unlock()
+			ui.Warn(fmt.Sprintf("==> Received %s. Finishing the work in progress and starting nothing new; send it again to abort it.", signalName(received)))
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case received := <-signals:
+			ui.Warn(fmt.Sprintf("==> Received %s again. Aborting the work in progress.", signalName(received)))
+			cancelWork()
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+		cancelWork()
+	}
+}
+
+// Return a context for work that must not be left half done, such as deregistering an AMI and deleting its snapshots.
+// Unlike the context of the command it's derived from, it isn't done when the command is interrupted the first time,
+// but it is when the command times out. It has the same values, e.g. the scope of the audit log.
+func uninterruptible(ctx context.Context) context.Context {
+	if c, ok := ctx.Value(cancellationKey{}).(*cancellation); ok {
+		return valuesContext{Context: c.work, values: ctx}
+	}
+	return ctx
+}
+
+// A context that is done when the embedded context is done, but has the values of another context
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (ctx valuesContext) Value(key interface{}) interface{} {
+	return ctx.values.Value(key)
+}
+
+// Return why the given context of a command is done: an *interruptedError if the command was interrupted, or an error
+// that names the --timeout if it timed out. Returns nil if the context isn't done.
+func cancellationError(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+
+	if c, ok := ctx.Value(cancellationKey{}).(*cancellation); ok {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.signal != nil {
+			return &interruptedError{Signal: c.signal}
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("ERROR: Timed out after --timeout=%s.", c.timeout)
+		}
+	}
+	return ctx.Err()
+}
+
+// Replace the error of an AWS call or other operation that failed because the context of the command is done with the
+// reason the context is done. All other errors are returned unchanged.
+func explainCancellation(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == request.CanceledErrorCode {
+		return cancellationError(ctx)
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return cancellationError(ctx)
+	}
+	return err
+}
+
+func signalName(sig os.Signal) string {
+	switch sig {
+	case os.Interrupt:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	}
+	return sig.String()
+}
+
+// Return the exit code of a command that failed with the given error: EXIT_CODE_INTERRUPTED if it was interrupted, and
+// 1 otherwise
+func failureExitCode(err error) int {
+	if _, ok := err.(*interruptedError); ok {
+		return EXIT_CODE_INTERRUPTED
+	}
+	return 1
+}
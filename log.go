@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/mitchellh/cli"
+)
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+const LOG_FORMAT_LOGFMT = "logfmt"
+
+const DEFAULT_LOG_LEVEL = "info"
+const DEFAULT_LOG_MAX_SIZE_MB = 100
+const DEFAULT_LOG_MAX_BACKUPS = 5
+
+const LOG_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+type logLevel int
+
+const (
+	logLevelDebug logLevel = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level logLevel) String() string {
+	return logLevelNames[level]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.ToLower(name) == levelName {
+			return logLevel(i), nil
+		}
+	}
+	return logLevelInfo, fmt.Errorf("ERROR: The argument '--log-level' must be one of %s, but was '%s'.", strings.Join(logLevelNames, ", "), name)
+}
+
+// How every command logs. Unlike all other args, these are accepted before or after the name of any command; see
+// extractLogFlags.
+type LogOptions struct {
+	Level      string
+	Format     string
+	File       string
+	MaxSizeMb  int
+	MaxBackups int
+}
+
+// descriptions for args
+var logDscrLevel = "Only show and log messages of this level or higher: debug, info, warn or error. At debug, every AWS API call is logged with its request id, the ids of the resources it acts on and how long it took. Defaults to info."
+var logDscrFormat = "The format of log records: text, json or logfmt. json and logfmt records have a timestamp and a level. Without '--log-file', they replace the colored output. Defaults to text."
+var logDscrFile = "The path of a file to append log records to, in addition to the colored output. The file is rotated once it reaches '--log-max-size'."
+var logDscrMaxSize = fmt.Sprintf("The size in megabytes at which '--log-file' is rotated, or 0 to never rotate it. Defaults to %d.", DEFAULT_LOG_MAX_SIZE_MB)
+var logDscrMaxBackups = fmt.Sprintf("How many rotated log files to keep, as <log-file>.1 (the newest) to <log-file>.N. Defaults to %d.", DEFAULT_LOG_MAX_BACKUPS)
+
+// The help text for the log args, to be appended to the help text of ec2-snapper
+func logArgsHelp() string {
+	return `
+--log-level      	` + logDscrLevel + `
+--log-format      	` + logDscrFormat + `
+--log-file      	` + logDscrFile + `
+--log-max-size      	` + logDscrMaxSize + `
+--log-max-backups	` + logDscrMaxBackups
+}
+
+func addLogFlags(cmdFlags *flag.FlagSet, options *LogOptions) {
+	cmdFlags.StringVar(&options.Level, "log-level", DEFAULT_LOG_LEVEL, logDscrLevel)
+	cmdFlags.StringVar(&options.Format, "log-format", LOG_FORMAT_TEXT, logDscrFormat)
+	cmdFlags.StringVar(&options.File, "log-file", "", logDscrFile)
+	cmdFlags.IntVar(&options.MaxSizeMb, "log-max-size", DEFAULT_LOG_MAX_SIZE_MB, logDscrMaxSize)
+	cmdFlags.IntVar(&options.MaxBackups, "log-max-backups", DEFAULT_LOG_MAX_BACKUPS, logDscrMaxBackups)
+}
+
+// A command whose args can be defined without running it, so the log args can be told apart from the values of its own
+// args
+type flagsCommand interface {
+	flags() *flag.FlagSet
+}
+
+// Take the log args out of the given command line args, wherever they are, and return them along with the remaining
+// args. This is how the log args work with every command without each command having to declare them. commandFlags
+// returns the args of the named command, or nil if there is no such command; a log arg that is the value of one of
+// them, as in '--ami-name --log-level', is left to the command.
+func extractLogFlags(args []string, commandFlags func(name string) *flag.FlagSet) (LogOptions, []string, error) {
+	var options LogOptions
+	cmdFlags := flag.NewFlagSet("log", flag.ContinueOnError)
+	cmdFlags.SetOutput(ioutil.Discard)
+	addLogFlags(cmdFlags, &options)
+
+	var ownFlags *flag.FlagSet
+	logArgs := []string{}
+	remaining := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			remaining = append(remaining, args[i:]...)
+			break
+		}
+
+		// The first arg that isn't a flag is the name of the command
+		if !strings.HasPrefix(arg, "-") {
+			if ownFlags == nil {
+				ownFlags = commandFlags(arg)
+			}
+			remaining = append(remaining, arg)
+			continue
+		}
+
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if cmdFlags.Lookup(name) == nil {
+			remaining = append(remaining, arg)
+			if !strings.Contains(arg, "=") && takesValue(ownFlags, name) && i+1 < len(args) {
+				i++
+				remaining = append(remaining, args[i])
+			}
+			continue
+		}
+
+		logArgs = append(logArgs, arg)
+		if !strings.Contains(arg, "=") && i+1 < len(args) {
+			i++
+			logArgs = append(logArgs, args[i])
+		}
+	}
+
+	if err := cmdFlags.Parse(logArgs); err != nil {
+		return options, args, fmt.Errorf("ERROR: Invalid log argument. %s", err.Error())
+	}
+	return options, remaining, validateLogOptions(options)
+}
+
+// Whether the named flag of the given flag set takes the next arg as its value, the way the flag package parses it
+func takesValue(cmdFlags *flag.FlagSet, name string) bool {
+	if cmdFlags == nil {
+		return false
+	}
+	f := cmdFlags.Lookup(name)
+	if f == nil {
+		return false
+	}
+	boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return !ok || !boolFlag.IsBoolFlag()
+}
+
+func validateLogOptions(options LogOptions) error {
+	if _, err := parseLogLevel(options.Level); err != nil {
+		return err
+	}
+
+	if options.Format != LOG_FORMAT_TEXT && options.Format != LOG_FORMAT_JSON && options.Format != LOG_FORMAT_LOGFMT {
+		return fmt.Errorf("ERROR: The argument '--log-format' must be text, json or logfmt, but was '%s'.", options.Format)
+	}
+
+	if options.MaxSizeMb < 0 {
+		return errors.New("ERROR: The argument '--log-max-size' must not be negative.")
+	}
+
+	if options.MaxBackups < 0 {
+		return errors.New("ERROR: The argument '--log-max-backups' must not be negative.")
+	}
+
+	return nil
+}
+
+// Create the Ui every command writes to. With the text format and no log file, that's the colored output ec2-snapper
+// has always had. Otherwise, messages are also, or instead, written as log records. The returned function closes the
+// log file, if there is one.
+func newCommandUi(options LogOptions, ui *cli.BasicUi) (cli.Ui, func(), error) {
+	level, err := parseLogLevel(options.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logUi := &loggingUi{
+		Ui: newColoredUi(ui),
+		UiFormat: LOG_FORMAT_TEXT,
+		Level: level,
+		Now: time.Now,
+	}
+
+	if options.File == "" {
+		if options.Format != LOG_FORMAT_TEXT {
+			logUi.Ui = ui
+			logUi.UiFormat = options.Format
+		}
+		return logUi, func() {}, nil
+	}
+
+	file, err := openRotatingFile(options.File, int64(options.MaxSizeMb)*1024*1024, options.MaxBackups)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: Could not open the log file '%s': %s", options.File, err.Error())
+	}
+	logUi.File = file
+	logUi.FileFormat = options.Format
+	return logUi, func() { file.Close() }, nil
+}
+
+// The colored output for interactive use: errors in red, warnings in yellow and successes in green
+func newColoredUi(ui cli.Ui) cli.Ui {
+	return &cli.ColoredUi{
+		Ui: ui,
+		OutputColor: cli.UiColorNone,
+		ErrorColor:  cli.UiColorRed,
+		WarnColor:   cli.UiColorYellow,
+		InfoColor:   cli.UiColorGreen,
+	}
+}
+
+// A key and value to add to a log record
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+// A Ui that filters messages by level and writes them as log records. Messages are shown on the wrapped Ui unchanged
+// when UiFormat is text, and as records in UiFormat otherwise. If File is set, every message is also appended to it as
+// a record in FileFormat. Safe to use from several goroutines.
+type loggingUi struct {
+	Ui         cli.Ui
+	UiFormat   string
+	File       io.Writer
+	FileFormat string
+	Level      logLevel
+	Now        func() time.Time
+
+	mutex sync.Mutex
+}
+
+func (u *loggingUi) Ask(query string) (string, error) {
+	return u.Ui.Ask(query)
+}
+
+func (u *loggingUi) AskSecret(query string) (string, error) {
+	return u.Ui.AskSecret(query)
+}
+
+func (u *loggingUi) Output(message string) {
+	u.log(logLevelInfo, message, nil, u.Ui.Output)
+}
+
+func (u *loggingUi) Info(message string) {
+	u.log(logLevelInfo, message, nil, u.Ui.Info)
+}
+
+func (u *loggingUi) Warn(message string) {
+	u.log(logLevelWarn, message, nil, u.Ui.Warn)
+}
+
+func (u *loggingUi) Error(message string) {
+	u.log(logLevelError, message, nil, u.Ui.Error)
+}
+
+// Log a message that is only shown at --log-level=debug, with the given fields
+func (u *loggingUi) Debug(message string, fields ...logField) {
+	u.log(logLevelDebug, message, fields, u.Ui.Output)
+}
+
+// Show the result of a command unchanged, whatever the level and format, since it is the output the command was run for
+// rather than a log message. It isn't written to the log file.
+func (u *loggingUi) Result(message string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.Ui.Output(message)
+}
+
+func (u *loggingUi) log(level logLevel, message string, fields []logField, show func(string)) {
+	if level < u.Level {
+		return
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := u.Now()
+	if u.UiFormat == LOG_FORMAT_TEXT {
+		show(formatLogText(message, fields))
+	} else {
+		show(formatLogRecord(u.UiFormat, now, level, message, fields))
+	}
+
+	if u.File != nil {
+		fmt.Fprintln(u.File, formatLogRecord(u.FileFormat, now, level, message, fields))
+	}
+}
+
+// Return the Ui that logs the messages of the given Ui, which may wrap it to add colors, prefixes or locking, or nil if
+// there is none, e.g. in tests
+func findLoggingUi(ui cli.Ui) *loggingUi {
+	for {
+		switch wrapper := ui.(type) {
+		case *loggingUi:
+			return wrapper
+		case *cli.ConcurrentUi:
+			ui = wrapper.Ui
+		case *cli.PrefixedUi:
+			ui = wrapper.Ui
+		case *bufferedUi:
+			ui = wrapper.Ui
+		case *cli.ColoredUi:
+			ui = wrapper.Ui
+		default:
+			return nil
+		}
+	}
+}
+
+// Show the result of a command, e.g. the status line of check or the policy of iam-policy, on the given Ui. Unlike
+// Output, it is neither filtered by '--log-level' nor formatted by '--log-format', so scripts and monitoring systems
+// can always read it.
+func outputResult(ui cli.Ui, message string) {
+	if logUi := findLoggingUi(ui); logUi != nil {
+		logUi.Result(message)
+		return
+	}
+	ui.Output(message)
+}
+
+// The message of a record is the message shown in the colored output, without the "==> " that marks every step
+func logRecordMessage(message string) string {
+	return strings.TrimSpace(strings.Replace(message, "==> ", "", 1))
+}
+
+func formatLogText(message string, fields []logField) string {
+	if len(fields) == 0 {
+		return message
+	}
+	return message + " " + formatLogfmtFields(fields)
+}
+
+// Format a log record as a single line of JSON or logfmt. The text format is meant for log files, where each record
+// needs a timestamp and level too.
+func formatLogRecord(format string, now time.Time, level logLevel, message string, fields []logField) string {
+	header := []logField{
+		{"time", now.Format(LOG_TIME_FORMAT)},
+		{"level", level.String()},
+		{"msg", logRecordMessage(message)},
+	}
+
+	switch format {
+	case LOG_FORMAT_JSON:
+		var line strings.Builder
+		line.WriteString("{")
+		for i, field := range append(header, fields...) {
+			if i > 0 {
+				line.WriteString(",")
+			}
+			key, _ := json.Marshal(field.Key)
+			value, err := json.Marshal(field.Value)
+			if err != nil {
+				value, _ = json.Marshal(fmt.Sprint(field.Value))
+			}
+			line.Write(key)
+			line.WriteString(":")
+			line.Write(value)
+		}
+		line.WriteString("}")
+		return line.String()
+	case LOG_FORMAT_LOGFMT:
+		return formatLogfmtFields(append(header, fields...))
+	}
+
+	return fmt.Sprintf("%s %-5s %s", now.Format(LOG_TIME_FORMAT), strings.ToUpper(level.String()), formatLogText(logRecordMessage(message), fields))
+}
+
+func formatLogfmtFields(fields []logField) string {
+	pairs := []string{}
+	for _, field := range fields {
+		var value string
+		switch typed := field.Value.(type) {
+		case []string:
+			value = strings.Join(typed, ",")
+		default:
+			value = fmt.Sprint(typed)
+		}
+		if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+			value = strconv.Quote(value)
+		}
+		pairs = append(pairs, field.Key+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Log every AWS API call made with the given session's handlers to the given Ui at debug level, with its request id,
+// the ids of the resources it acts on, how long it took including retries, and its error code if it failed
+func logAwsCalls(handlers *request.Handlers, ui cli.Ui) {
+	logUi := findLoggingUi(ui)
+	if logUi == nil || logUi.Level > logLevelDebug {
+		return
+	}
+
+	handlers.Complete.PushBack(func(r *request.Request) {
+		fields := []logField{
+			{"service", r.ClientInfo.ServiceName},
+			{"operation", r.Operation.Name},
+			{"region", aws.StringValue(r.Config.Region)},
+			{"request_id", r.RequestID},
+			{"resource_ids", awsResourceIds(r.Params)},
+			{"duration_ms", time.Since(r.Time).Nanoseconds() / int64(time.Millisecond)},
+			{"retries", r.RetryCount},
+		}
+		if r.Error != nil {
+			code := r.Error.Error()
+			if awsErr, ok := r.Error.(awserr.Error); ok {
+				code = awsErr.Code()
+			}
+			fields = append(fields, logField{"error", code})
+		}
+		logUi.Debug("==> AWS API call", fields...)
+	})
+}
+
+// Return the ids of the resources the params of an AWS API call refer to, such as InstanceId, ImageIds, SnapshotId or
+// the Resources to tag, sorted
+func awsResourceIds(params interface{}) []string {
+	ids := []string{}
+
+	value := reflect.Indirect(reflect.ValueOf(params))
+	if value.Kind() != reflect.Struct {
+		return ids
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" || !(strings.HasSuffix(field.Name, "Id") || strings.HasSuffix(field.Name, "Ids") || field.Name == "Resources") {
+			continue
+		}
+
+		switch typed := value.Field(i).Interface().(type) {
+		case *string:
+			if typed != nil {
+				ids = append(ids, *typed)
+			}
+		case []*string:
+			ids = append(ids, aws.StringValueSlice(typed)...)
+		}
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// A log file that is rotated once it reaches maxSize bytes: the file is renamed to <path>.1, any <path>.1 to <path>.2,
+// and so on, keeping at most maxBackups of them, and a new file is started
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rotating := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	return rotating, rotating.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.maxBackups == 0 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
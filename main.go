@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"github.com/mitchellh/cli"
@@ -14,42 +15,77 @@ func main() {
 		ErrorWriter: os.Stderr,
 	}
 
-	// CLI stuff
+	// CLI stuff. The commands get commandUi once the log args are known.
+	var commandUi cli.Ui
 	c := cli.NewCLI("ec2-snapper", "0.5.2")
-	c.Args = os.Args[1:]
+	c.HelpFunc = func(commands map[string]cli.CommandFactory) string {
+		return cli.BasicHelpFunc("ec2-snapper")(commands) + "\n\nLog options, accepted by every command:" + logArgsHelp()
+	}
 
 	c.Commands = map[string]cli.CommandFactory{
+		"alarm": func() (cli.Command, error) {
+			return &AlarmCommand{
+				Ui: commandUi,
+			}, nil
+		},
+		"audit": func() (cli.Command, error) {
+			return &AuditCommand{
+				Ui: commandUi,
+			}, nil
+		},
+		"check": func() (cli.Command, error) {
+			return &CheckCommand{
+				Ui: commandUi,
+			}, nil
+		},
+		"cost": func() (cli.Command, error) {
+			return &CostCommand{
+				Ui: commandUi,
+			}, nil
+		},
 		"create": func() (cli.Command, error) {
 			return &CreateCommand{
-				Ui:	&cli.ColoredUi{
-					Ui:	ui,
-					OutputColor: cli.UiColorNone,
-					ErrorColor:  cli.UiColorRed,
-					WarnColor:   cli.UiColorYellow,
-					InfoColor:   cli.UiColorGreen,
-				},
+				Ui: commandUi,
 			}, nil
 		},
 		"delete": func() (cli.Command, error) {
 			return &DeleteCommand{
-				Ui: &cli.ColoredUi{
-					Ui: ui,
-					OutputColor: cli.UiColorNone,
-					ErrorColor:  cli.UiColorRed,
-					WarnColor:   cli.UiColorYellow,
-					InfoColor:   cli.UiColorGreen,
-				},
+				Ui: commandUi,
+			}, nil
+		},
+		"doctor": func() (cli.Command, error) {
+			return &DoctorCommand{
+				Ui: commandUi,
+			}, nil
+		},
+		"exporter": func() (cli.Command, error) {
+			return &ExporterCommand{
+				Ui: commandUi,
+			}, nil
+		},
+		"iam-policy": func() (cli.Command, error) {
+			return &IamPolicyCommand{
+				Ui: commandUi,
 			}, nil
 		},
 		"report": func() (cli.Command, error) {
 			return &ReportCommand{
-				Ui: &cli.ColoredUi{
-					Ui: ui,
-					OutputColor: cli.UiColorNone,
-					ErrorColor:  cli.UiColorRed,
-					WarnColor:   cli.UiColorYellow,
-					InfoColor:   cli.UiColorGreen,
-				},
+				Ui: commandUi,
+			}, nil
+		},
+		"simulate": func() (cli.Command, error) {
+			return &SimulateCommand{
+				Ui: commandUi,
+			}, nil
+		},
+		"snapshot": func() (cli.Command, error) {
+			return &SnapshotCommand{
+				Ui: commandUi,
+			}, nil
+		},
+		"undelete": func() (cli.Command, error) {
+			return &UndeleteCommand{
+				Ui: commandUi,
 			}, nil
 		},
 		"version": func() (cli.Command, error) {
@@ -59,11 +95,35 @@ func main() {
 		},
 	}
 
+	// The log args work with every command, so they are taken out before the command parses its own args
+	logOptions, args, err := extractLogFlags(os.Args[1:], func(name string) *flag.FlagSet {
+		if factory, ok := c.Commands[name]; ok {
+			if command, err := factory(); err == nil {
+				if command, ok := command.(flagsCommand); ok {
+					return command.flags()
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ui.Error(err.Error())
+		os.Exit(1)
+	}
+
+	commandUi, closeLog, err := newCommandUi(logOptions, ui)
+	if err != nil {
+		ui.Error(err.Error())
+		os.Exit(1)
+	}
+	c.Args = args
+
 	exitStatus, err := c.Run()
 	if err != nil {
 		fmt.Println(os.Stderr, err.Error())
 	}
 
+	closeLog()
 	os.Exit(exitStatus)
 
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// Limits of the CloudWatch PutMetricData API. See metrics.MAX_METRIC_DATA_PER_REQUEST for the limit of datums.
+const MAX_METRIC_DIMENSIONS = 30
+const MAX_METRIC_TIMESTAMP_AGE = 14 * 24 * time.Hour
+const MAX_METRIC_TIMESTAMP_AHEAD = 2 * time.Hour
+
+const STANDARD_STORAGE_RESOLUTION = 60
+const HIGH_STORAGE_RESOLUTION = 1
+
+// A repeatable --dimension Name=Value arg
+type dimensionsFlag []string
+
+func (f *dimensionsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *dimensionsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// A single metric datum as read from a --from-file, or as given on the command line. Fields that are not set are
+// taken from the command line args.
+type metricDatumRecord struct {
+	Name              string
+	Value             *float64
+	Unit              string
+	Timestamp         string
+	StorageResolution int64
+	Dimensions        map[string]string
+}
+
+// Parse Name=Value pairs into a map of dimensions
+func parseDimensions(pairs []string) (map[string]string, error) {
+	dimensions := map[string]string{}
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("ERROR: The dimension '%s' is not formatted properly. Use the format Name=Value.", pair)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		if _, ok := dimensions[name]; ok {
+			return nil, fmt.Errorf("ERROR: The dimension '%s' is given more than once.", name)
+		}
+		dimensions[name] = strings.TrimSpace(parts[1])
+	}
+
+	return dimensions, nil
+}
+
+func validateMetricUnit(unit string) error {
+	if containsString(cloudwatch.StandardUnit_Values(), unit) {
+		return nil
+	}
+	return fmt.Errorf("ERROR: '%s' is not a valid CloudWatch unit. Valid units are: %s.", unit, strings.Join(cloudwatch.StandardUnit_Values(), ", "))
+}
+
+func validateStorageResolution(storageResolution int64) error {
+	if storageResolution != STANDARD_STORAGE_RESOLUTION && storageResolution != HIGH_STORAGE_RESOLUTION {
+		return fmt.Errorf("ERROR: The storage resolution must be %d (standard) or %d (high resolution), but was %d.", STANDARD_STORAGE_RESOLUTION, HIGH_STORAGE_RESOLUTION, storageResolution)
+	}
+	return nil
+}
+
+// Parse a timestamp given either in RFC 3339 format (e.g. 2016-09-14T08:00:00Z) or as seconds since the Unix epoch
+func parseMetricTimestamp(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return timestamp, fmt.Errorf("ERROR: The timestamp '%s' is not formatted properly. Use RFC 3339 (e.g. 2016-09-14T08:00:00Z) or seconds since the Unix epoch.", value)
+	}
+	return timestamp, nil
+}
+
+// Turn the given record into a datum, taking every field the record doesn't set from defaults. The dimensions of the
+// record are added to those of defaults, overriding any with the same name.
+func buildMetricDatum(record metricDatumRecord, defaults metricDatumRecord, now time.Time) (*cloudwatch.MetricDatum, error) {
+	name := record.Name
+	if name == "" {
+		name = defaults.Name
+	}
+	if name == "" {
+		return nil, errors.New("ERROR: The metric name is missing.")
+	}
+
+	value := record.Value
+	if value == nil {
+		value = defaults.Value
+	}
+	if value == nil {
+		return nil, fmt.Errorf("ERROR: The value of metric %s is missing.", name)
+	}
+	if math.IsNaN(*value) || math.IsInf(*value, 0) {
+		return nil, fmt.Errorf("ERROR: The value of metric %s must be a finite number.", name)
+	}
+
+	unit := record.Unit
+	if unit == "" {
+		unit = defaults.Unit
+	}
+	if err := validateMetricUnit(unit); err != nil {
+		return nil, err
+	}
+
+	storageResolution := record.StorageResolution
+	if storageResolution == 0 {
+		storageResolution = defaults.StorageResolution
+	}
+	if err := validateStorageResolution(storageResolution); err != nil {
+		return nil, err
+	}
+
+	datum := &cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Value: value,
+		Unit: aws.String(unit),
+		StorageResolution: aws.Int64(storageResolution),
+	}
+
+	timestamp := record.Timestamp
+	if timestamp == "" {
+		timestamp = defaults.Timestamp
+	}
+	if timestamp != "" {
+		parsed, err := parseMetricTimestamp(timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if now.Sub(parsed) > MAX_METRIC_TIMESTAMP_AGE || parsed.Sub(now) > MAX_METRIC_TIMESTAMP_AHEAD {
+			return nil, fmt.Errorf("ERROR: The timestamp %s of metric %s is not accepted by CloudWatch. It must be at most two weeks in the past and two hours in the future.", timestamp, name)
+		}
+		datum.Timestamp = aws.Time(parsed)
+	}
+
+	dimensions := map[string]string{}
+	for dimensionName, dimensionValue := range defaults.Dimensions {
+		dimensions[dimensionName] = dimensionValue
+	}
+	for dimensionName, dimensionValue := range record.Dimensions {
+		dimensions[dimensionName] = dimensionValue
+	}
+	if len(dimensions) > MAX_METRIC_DIMENSIONS {
+		return nil, fmt.Errorf("ERROR: Metric %s has %d dimensions, but CloudWatch accepts at most %d.", name, len(dimensions), MAX_METRIC_DIMENSIONS)
+	}
+
+	datum.Dimensions = toCloudWatchDimensions(dimensions)
+
+	return datum, nil
+}
+
+// Convert a map of dimensions to CloudWatch dimensions, sorted by name
+func toCloudWatchDimensions(dimensions map[string]string) []*cloudwatch.Dimension {
+	var names []string
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var cloudWatchDimensions []*cloudwatch.Dimension
+	for _, name := range names {
+		cloudWatchDimensions = append(cloudWatchDimensions, &cloudwatch.Dimension{
+			Name: aws.String(name),
+			Value: aws.String(dimensions[name]),
+		})
+	}
+	return cloudWatchDimensions
+}
+
+// Read the metric data records from a JSON or CSV file, depending on its extension
+func readMetricDatumRecords(path string) ([]metricDatumRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Could not open '%s': %s", path, err.Error())
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return parseJsonMetricDatumRecords(file)
+	case ".csv":
+		return parseCsvMetricDatumRecords(file)
+	}
+	return nil, fmt.Errorf("ERROR: Could not tell the format of '%s'. The file name must end in .json or .csv.", path)
+}
+
+// Parse a JSON array of objects with the fields of metricDatumRecord, e.g.
+// [{"Name": "BackupSize", "Value": 42, "Unit": "Gigabytes", "Dimensions": {"InstanceName": "web-1"}}]
+func parseJsonMetricDatumRecords(reader io.Reader) ([]metricDatumRecord, error) {
+	var records []metricDatumRecord
+	if err := json.NewDecoder(reader).Decode(&records); err != nil {
+		return nil, fmt.Errorf("ERROR: Could not parse the metric data as JSON: %s", err.Error())
+	}
+	return records, nil
+}
+
+// Parse CSV with a header row. The columns name and value are required; unit, timestamp, storage-resolution and
+// dimensions (as Name=Value pairs separated by semicolons) are optional.
+func parseCsvMetricDatumRecords(reader io.Reader) ([]metricDatumRecord, error) {
+	rows, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Could not parse the metric data as CSV: %s", err.Error())
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("ERROR: The CSV metric data has no header row.")
+	}
+
+	columns := map[string]int{}
+	for i, column := range rows[0] {
+		column = strings.ToLower(strings.TrimSpace(column))
+		switch column {
+		case "name", "value", "unit", "timestamp", "storage-resolution", "dimensions":
+			columns[column] = i
+		default:
+			return nil, fmt.Errorf("ERROR: Unknown CSV column '%s'. Valid columns are: name, value, unit, timestamp, storage-resolution, dimensions.", column)
+		}
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("ERROR: The CSV metric data must have a 'name' column.")
+	}
+	if _, ok := columns["value"]; !ok {
+		return nil, errors.New("ERROR: The CSV metric data must have a 'value' column.")
+	}
+
+	cell := func(row []string, column string) string {
+		if i, ok := columns[column]; ok {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var records []metricDatumRecord
+	for rowNum, row := range rows[1:] {
+		record := metricDatumRecord{
+			Name: cell(row, "name"),
+			Unit: cell(row, "unit"),
+			Timestamp: cell(row, "timestamp"),
+		}
+
+		value, err := strconv.ParseFloat(cell(row, "value"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: The value '%s' in CSV row %d is not a number.", cell(row, "value"), rowNum + 2)
+		}
+		record.Value = aws.Float64(value)
+
+		if storageResolution := cell(row, "storage-resolution"); storageResolution != "" {
+			if record.StorageResolution, err = strconv.ParseInt(storageResolution, 10, 64); err != nil {
+				return nil, fmt.Errorf("ERROR: The storage resolution '%s' in CSV row %d is not a number.", storageResolution, rowNum + 2)
+			}
+		}
+
+		if dimensions := cell(row, "dimensions"); dimensions != "" {
+			if record.Dimensions, err = parseDimensions(strings.Split(dimensions, ";")); err != nil {
+				return nil, err
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
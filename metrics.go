@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/metrics"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+// Metrics are published even if the command was interrupted or timed out, since that's when they matter most, but for
+// at most this long
+const PUBLISH_METRICS_TIMEOUT = 30 * time.Second
+
+// descriptions for args
+var dscrMetricNamespace = "If set, publish CloudWatch metrics about the outcome for every instance to this namespace (e.g. Ec2Snapper). The metrics have only an InstanceId dimension, not InstanceName, so alarms should match on InstanceId. Dry runs publish nothing."
+var dscrPushgatewayUrl = "If set, push the results of the run to the Prometheus Pushgateway at this URL (e.g. http://pushgateway:9091)."
+
+// Record the outcome of running create or delete against an instance and the age of its newest AMI, and publish all
+// recorded metrics with the dimensions of the instance. Returns cmdErr, or if that is nil, the error of publishing.
+func publishInstanceMetrics(recorder *metrics.Recorder, instanceId string, instanceName string, cmdErr error, session *session.Session, ui cli.Ui) error {
+	if recorder == nil {
+		return cmdErr
+	}
+
+	recorder.RecordOutcome(cmdErr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PUBLISH_METRICS_TIMEOUT)
+	defer cancel()
+
+	if instanceId != "" {
+		images, err := snapper.FindImages(ctx, instanceId, ec2.New(session))
+		if err == nil {
+			err = recorder.RecordNewestAmiAge(images, time.Now())
+		}
+		if err != nil {
+			ui.Warn("WARNING: Could not determine the age of the newest AMI: " + err.Error())
+		}
+	}
+
+	ui.Output("==> Publishing " + strconv.Itoa(len(recorder.Data())) + " metric(s) to " + recorder.Destination())
+	if err := recorder.Publish(ctx, instanceId, instanceName, session); err != nil {
+		if cmdErr != nil {
+			ui.Error(err.Error())
+			return cmdErr
+		}
+		return err
+	}
+
+	return cmdErr
+}
+
+// A Pushgateway URL must be absolute, e.g. http://pushgateway:9091
+func validatePushgatewayUrl(value string) error {
+	return validateEndpointUrl("pushgateway-url", value)
+}
@@ -0,0 +1,204 @@
+// Package metrics publishes the outcome of creating and deleting AMIs to CloudWatch and to a Prometheus Pushgateway, and
+// renders metrics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/retention"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+)
+
+// The metrics create and delete publish for every instance
+const METRIC_NAME_SUCCESS = "Success"
+const METRIC_NAME_FAILURE = "Failure"
+const METRIC_NAME_AMI_CREATION_DURATION = "AmiCreationDuration"
+const METRIC_NAME_AMIS_DELETED = "AmisDeleted"
+const METRIC_NAME_GIB_RECLAIMED = "GiBReclaimed"
+const METRIC_NAME_NEWEST_AMI_AGE = "NewestAmiAge"
+
+const METRIC_DIMENSION_INSTANCE_ID = "InstanceId"
+const METRIC_DIMENSION_INSTANCE_NAME = "InstanceName"
+
+// A PutMetricData request is limited to 1000 datums. It is also limited to 1 MB, which 1000 datums of typical size stay
+// well below.
+const MAX_METRIC_DATA_PER_REQUEST = 1000
+
+// Collects the metrics of running a command against a single instance until they are published to CloudWatch, a
+// Pushgateway or both. A nil recorder records nothing, so code that records metrics doesn't have to check whether
+// metrics are enabled.
+type Recorder struct {
+	command        string
+	namespace      string
+	pushgatewayUrl string
+	data           []*cloudwatch.MetricDatum
+}
+
+// Return a recorder that publishes to the given namespace and Pushgateway, or nil if neither is given or this is a
+// dry run
+func NewRecorder(command string, namespace string, pushgatewayUrl string, dryRun bool) *Recorder {
+	if (namespace == "" && pushgatewayUrl == "") || dryRun {
+		return nil
+	}
+	return &Recorder{command: command, namespace: namespace, pushgatewayUrl: pushgatewayUrl}
+}
+
+func (r *Recorder) Record(name string, value float64, unit string) {
+	if r == nil {
+		return
+	}
+	r.data = append(r.data, &cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Value: aws.Float64(value),
+		Unit: aws.String(unit),
+	})
+}
+
+// Return the metrics recorded so far
+func (r *Recorder) Data() []*cloudwatch.MetricDatum {
+	if r == nil {
+		return nil
+	}
+	return r.data
+}
+
+// Record a Success and a Failure count, one of which is 1 and the other 0, so alarms can use either metric
+func (r *Recorder) RecordOutcome(err error) {
+	if err == nil {
+		r.Record(METRIC_NAME_SUCCESS, 1, cloudwatch.StandardUnitCount)
+		r.Record(METRIC_NAME_FAILURE, 0, cloudwatch.StandardUnitCount)
+	} else {
+		r.Record(METRIC_NAME_SUCCESS, 0, cloudwatch.StandardUnitCount)
+		r.Record(METRIC_NAME_FAILURE, 1, cloudwatch.StandardUnitCount)
+	}
+}
+
+// Record the age of the newest pending or available AMI. Nothing is recorded if there is no such AMI, so an alarm on
+// this metric should treat missing data as breaching.
+func (r *Recorder) RecordNewestAmiAge(images []*ec2.Image, now time.Time) error {
+	if r == nil {
+		return nil
+	}
+
+	newestImage, err := retention.NewestImageWithinHours(images, math.Inf(1), now)
+	if err != nil || newestImage == nil {
+		return err
+	}
+
+	creationDate, err := time.Parse(time.RFC3339Nano, *newestImage.CreationDate)
+	if err != nil {
+		return err
+	}
+
+	r.Record(METRIC_NAME_NEWEST_AMI_AGE, now.Sub(creationDate).Seconds(), cloudwatch.StandardUnitSeconds)
+	return nil
+}
+
+// Record how many AMIs were deleted completely and how many GiB of snapshots were deleted. Snapshots are incremental,
+// so the GiB are the size of the volumes the snapshots were taken of, which is an upper bound of the storage reclaimed.
+func (r *Recorder) RecordImageDeletions(results []snapper.ImageDeletion) {
+	numDeleted, _ := snapper.CountDeletions(results)
+
+	var gibDeleted int64
+	for _, result := range results {
+		gibDeleted += result.GiBDeleted
+	}
+
+	r.Record(METRIC_NAME_AMIS_DELETED, float64(numDeleted), cloudwatch.StandardUnitCount)
+	r.Record(METRIC_NAME_GIB_RECLAIMED, float64(gibDeleted), cloudwatch.StandardUnitGigabytes)
+}
+
+// Describe where the recorded metrics will be published, for the output of a command
+func (r *Recorder) Destination() string {
+	var destinations []string
+	if r.namespace != "" {
+		destinations = append(destinations, "CloudWatch namespace " + r.namespace)
+	}
+	if r.pushgatewayUrl != "" {
+		destinations = append(destinations, "Pushgateway " + r.pushgatewayUrl)
+	}
+	return strings.Join(destinations, " and ")
+}
+
+// Publish the recorded metrics with the dimensions of the given instance. On the Pushgateway, the metrics are grouped
+// by command, region and instance, so each push only replaces the metrics of the previous run against the same
+// instance.
+func (r *Recorder) Publish(ctx context.Context, instanceId string, instanceName string, session *session.Session) error {
+	if r == nil || len(r.data) == 0 {
+		return nil
+	}
+
+	dimensions := InstanceDimensions(instanceId)
+	for _, datum := range r.data {
+		datum.Dimensions = dimensions
+	}
+
+	if r.namespace != "" {
+		// CloudWatch doesn't allow empty dimension values
+		if instanceId == "" {
+			return fmt.Errorf("ERROR: Could not publish metrics to CloudWatch, since the id of instance %s is unknown.", instanceName)
+		}
+		if err := PutMetricData(ctx, r.namespace, r.data, cloudwatch.New(session)); err != nil {
+			return fmt.Errorf("ERROR: Failed to publish metrics to CloudWatch: %s", err.Error())
+		}
+	}
+
+	if r.pushgatewayUrl != "" {
+		grouping := []PushgatewayLabel{
+			PushgatewayLabel{Name: "command", Value: r.command},
+			PushgatewayLabel{Name: "region", Value: aws.StringValue(session.Config.Region)},
+			PushgatewayLabel{Name: "instance_id", Value: instanceId},
+		}
+		if instanceId == "" {
+			grouping[2] = PushgatewayLabel{Name: "instance_name", Value: instanceName}
+		}
+		if err := PushToGateway(ctx, r.pushgatewayUrl, grouping, CloudWatchToPrometheus(r.data)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The dimensions of the metrics of an instance. A CloudWatch alarm only matches a metric with exactly its dimensions, so
+// every run publishes the same set, however the instance was given.
+func InstanceDimensions(instanceId string) []*cloudwatch.Dimension {
+	return []*cloudwatch.Dimension{
+		&cloudwatch.Dimension{Name: aws.String(METRIC_DIMENSION_INSTANCE_ID), Value: aws.String(instanceId)},
+	}
+}
+
+// Send the given data to CloudWatch, in as many requests as the limits of PutMetricData require
+func PutMetricData(ctx context.Context, namespace string, data []*cloudwatch.MetricDatum, svc *cloudwatch.CloudWatch) error {
+	for _, chunk := range ChunkMetricData(data, MAX_METRIC_DATA_PER_REQUEST) {
+		_, err := svc.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace: aws.String(namespace),
+			MetricData: chunk,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Split the given data into chunks that each fit into a single PutMetricData request
+func ChunkMetricData(data []*cloudwatch.MetricDatum, chunkSize int) [][]*cloudwatch.MetricDatum {
+	var chunks [][]*cloudwatch.MetricDatum
+	for len(data) > chunkSize {
+		chunks = append(chunks, data[:chunkSize])
+		data = data[chunkSize:]
+	}
+	if len(data) > 0 {
+		chunks = append(chunks, data)
+	}
+	return chunks
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// The job label of everything ec2-snapper pushes to a Pushgateway
+const PUSHGATEWAY_JOB = "ec2-snapper"
+const PUSHGATEWAY_TIMEOUT = 30 * time.Second
+
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// The Prometheus names of the metrics create, delete and check publish. Any other CloudWatch metric name, e.g. one given
+// to report, is converted by sanitizePrometheusName.
+var prometheusMetricNames = map[string]string{
+	METRIC_NAME_SUCCESS: "ec2_snapper_success",
+	METRIC_NAME_FAILURE: "ec2_snapper_failure",
+	METRIC_NAME_AMI_CREATION_DURATION: "ec2_snapper_ami_creation_duration_seconds",
+	METRIC_NAME_AMIS_DELETED: "ec2_snapper_amis_deleted",
+	METRIC_NAME_GIB_RECLAIMED: "ec2_snapper_reclaimed_gibibytes",
+	METRIC_NAME_NEWEST_AMI_AGE: "ec2_snapper_newest_ami_age_seconds",
+}
+
+// The Prometheus label names of the dimensions create, delete and check publish. Any other dimension name is converted
+// by sanitizePrometheusName.
+var prometheusLabelNames = map[string]string{
+	METRIC_DIMENSION_INSTANCE_ID: "instance_id",
+	METRIC_DIMENSION_INSTANCE_NAME: "instance_name",
+}
+
+// A metric family in the Prometheus text exposition format
+type PrometheusMetric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []PrometheusSample
+}
+
+type PrometheusSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// A single grouping label of a push, e.g. command=create. The order of the labels is the order of the URL path.
+type PushgatewayLabel struct {
+	Name  string
+	Value string
+}
+
+var invalidPrometheusNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// Turn an arbitrary metric or label name into a valid Prometheus name
+func sanitizePrometheusName(name string) string {
+	name = invalidPrometheusNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// Convert CloudWatch metric data to gauges, with the dimensions of each datum as its labels. The unit and timestamp of a
+// datum are dropped, since the Pushgateway records the time of each push itself.
+func CloudWatchToPrometheus(data []*cloudwatch.MetricDatum) []PrometheusMetric {
+	var metrics []PrometheusMetric
+	indexByName := map[string]int{}
+
+	for _, datum := range data {
+		name, ok := prometheusMetricNames[*datum.MetricName]
+		if !ok {
+			name = sanitizePrometheusName(*datum.MetricName)
+		}
+
+		labels := map[string]string{}
+		for _, dimension := range datum.Dimensions {
+			labelName, ok := prometheusLabelNames[*dimension.Name]
+			if !ok {
+				labelName = sanitizePrometheusName(*dimension.Name)
+			}
+			labels[labelName] = *dimension.Value
+		}
+
+		if _, ok := indexByName[name]; !ok {
+			indexByName[name] = len(metrics)
+			metrics = append(metrics, PrometheusMetric{Name: name, Help: "The " + *datum.MetricName + " metric of ec2-snapper.", Type: "gauge"})
+		}
+		metrics[indexByName[name]].Samples = append(metrics[indexByName[name]].Samples, PrometheusSample{Labels: labels, Value: *datum.Value})
+	}
+
+	return metrics
+}
+
+// Render the given metrics in the Prometheus text exposition format
+func FormatPrometheus(metrics []PrometheusMetric) string {
+	var out bytes.Buffer
+
+	for _, metric := range metrics {
+		fmt.Fprintf(&out, "# HELP %s %s\n", metric.Name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(metric.Help))
+		fmt.Fprintf(&out, "# TYPE %s %s\n", metric.Name, metric.Type)
+
+		for _, sample := range metric.Samples {
+			out.WriteString(metric.Name)
+
+			var labelNames []string
+			for labelName := range sample.Labels {
+				labelNames = append(labelNames, labelName)
+			}
+			sort.Strings(labelNames)
+
+			if len(labelNames) > 0 {
+				var labels []string
+				for _, labelName := range labelNames {
+					labels = append(labels, labelName + `="` + escapePrometheusLabelValue(sample.Labels[labelName]) + `"`)
+				}
+				out.WriteString("{" + strings.Join(labels, ",") + "}")
+			}
+
+			out.WriteString(" " + strconv.FormatFloat(sample.Value, 'g', -1, 64) + "\n")
+		}
+	}
+
+	return out.String()
+}
+
+func escapePrometheusLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Push the given metrics to the Pushgateway, replacing all metrics previously pushed with the same grouping labels. The
+// push is aborted after PUSHGATEWAY_TIMEOUT or once ctx is done, whichever comes first.
+func PushToGateway(ctx context.Context, gatewayUrl string, grouping []PushgatewayLabel, metrics []PrometheusMetric) error {
+	pushUrl := strings.TrimRight(gatewayUrl, "/") + "/metrics/job/" + url.PathEscape(PUSHGATEWAY_JOB)
+	for _, label := range grouping {
+		// The Pushgateway doesn't accept empty path segments
+		if label.Value != "" {
+			pushUrl += "/" + label.Name + "/" + url.PathEscape(label.Value)
+		}
+	}
+
+	request, err := http.NewRequest(http.MethodPut, pushUrl, strings.NewReader(FormatPrometheus(metrics)))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+
+	client := &http.Client{Timeout: PUSHGATEWAY_TIMEOUT}
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to push metrics to the Pushgateway: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("ERROR: Failed to push metrics to the Pushgateway: %s %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
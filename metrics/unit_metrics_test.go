@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+)
+
+func TestNewRecorderDisabled(t *testing.T) {
+	t.Parallel()
+
+	if recorder := NewRecorder("create", "", "", false); recorder != nil {
+		t.Fatal("Expected no recorder without a namespace or Pushgateway")
+	}
+	if recorder := NewRecorder("create", "Ec2Snapper", "", true); recorder != nil {
+		t.Fatal("Expected no recorder for a dry run")
+	}
+
+	// Recording into a nil recorder must be a no-op
+	var recorder *Recorder
+	recorder.RecordOutcome(nil)
+	recorder.RecordImageDeletions([]snapper.ImageDeletion{snapper.ImageDeletion{ImageId: "ami-1", GiBDeleted: 8}})
+}
+
+func TestRecorderRecordsOutcome(t *testing.T) {
+	t.Parallel()
+
+	recorder := NewRecorder("create", "Ec2Snapper", "", false)
+	recorder.RecordOutcome(errors.New("failed"))
+
+	assertRecordedMetric(t, recorder, METRIC_NAME_SUCCESS, 0)
+	assertRecordedMetric(t, recorder, METRIC_NAME_FAILURE, 1)
+}
+
+func TestRecorderRecordsImageDeletions(t *testing.T) {
+	t.Parallel()
+
+	recorder := NewRecorder("create", "Ec2Snapper", "", false)
+	recorder.RecordImageDeletions([]snapper.ImageDeletion{
+		snapper.ImageDeletion{ImageId: "ami-1", Deregistered: true, GiBDeleted: 8},
+		snapper.ImageDeletion{ImageId: "ami-2", Deregistered: true, GiBDeleted: 30, Err: errors.New("snapshot in use")},
+		snapper.ImageDeletion{ImageId: "ami-3", Deregistered: true, GiBDeleted: 8},
+	})
+
+	assertRecordedMetric(t, recorder, METRIC_NAME_AMIS_DELETED, 2)
+	assertRecordedMetric(t, recorder, METRIC_NAME_GIB_RECLAIMED, 46)
+}
+
+func TestRecorderRecordsNewestAmiAge(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	images := []*ec2.Image{
+		createTestImage("ami-old", ec2.ImageStateAvailable, now.Add(-48 * time.Hour)),
+		createTestImage("ami-new", ec2.ImageStateAvailable, now.Add(-2 * time.Hour)),
+		createTestImage("ami-failed", ec2.ImageStateFailed, now.Add(-1 * time.Hour)),
+	}
+
+	recorder := NewRecorder("create", "Ec2Snapper", "", false)
+	if err := recorder.RecordNewestAmiAge(images, now); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRecordedMetric(t, recorder, METRIC_NAME_NEWEST_AMI_AGE, (2 * time.Hour).Seconds())
+}
+
+func TestRecorderDestination(t *testing.T) {
+	t.Parallel()
+
+	recorder := NewRecorder("delete", "Ec2Snapper", "http://pushgateway:9091", false)
+	if destination := recorder.Destination(); destination != "CloudWatch namespace Ec2Snapper and Pushgateway http://pushgateway:9091" {
+		t.Fatalf("Unexpected destination: %s", destination)
+	}
+}
+
+func TestInstanceDimensionsOnlyHaveInstanceId(t *testing.T) {
+	t.Parallel()
+
+	dimensions := InstanceDimensions("i-c1234567")
+	if len(dimensions) != 1 || *dimensions[0].Name != METRIC_DIMENSION_INSTANCE_ID || *dimensions[0].Value != "i-c1234567" {
+		t.Fatalf("Expected only the InstanceId dimension, but got %v", dimensions)
+	}
+}
+
+func assertRecordedMetric(t *testing.T, recorder *Recorder, name string, expectedValue float64) {
+	for _, datum := range recorder.data {
+		if *datum.MetricName == name {
+			if *datum.Value != expectedValue {
+				t.Fatalf("Expected metric %s to be %f, but got %f", name, expectedValue, *datum.Value)
+			}
+			return
+		}
+	}
+	t.Fatalf("Expected metric %s to be recorded, but it was not. Recorded: %v", name, recorder.data)
+}
+
+func TestChunkMetricData(t *testing.T) {
+	t.Parallel()
+
+	data := make([]*cloudwatch.MetricDatum, 45)
+	chunks := ChunkMetricData(data, 20)
+
+	if len(chunks) != 3 || len(chunks[0]) != 20 || len(chunks[2]) != 5 {
+		t.Fatalf("Expected chunks of 20, 20 and 5 datums, but got %d chunks", len(chunks))
+	}
+}
+
+func createTestImage(imageId string, state string, creationDate time.Time) *ec2.Image {
+	return &ec2.Image{
+		ImageId: aws.String(imageId),
+		Name: aws.String(imageId),
+		State: aws.String(state),
+		CreationDate: aws.String(creationDate.UTC().Format(time.RFC3339Nano)),
+	}
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestFormatPrometheus(t *testing.T) {
+	t.Parallel()
+
+	metrics := []PrometheusMetric{
+		PrometheusMetric{Name: "ec2_snapper_amis", Help: "The number of AMIs.", Type: "gauge", Samples: []PrometheusSample{
+			PrometheusSample{Labels: map[string]string{"instance_name": `web "1"`, "instance_id": "i-1"}, Value: 3},
+		}},
+		PrometheusMetric{Name: "ec2_snapper_refresh_errors_total", Help: "Errors.", Type: "counter", Samples: []PrometheusSample{
+			PrometheusSample{Value: 0.5},
+		}},
+	}
+
+	expected := `# HELP ec2_snapper_amis The number of AMIs.
+# TYPE ec2_snapper_amis gauge
+ec2_snapper_amis{instance_id="i-1",instance_name="web \"1\""} 3
+# HELP ec2_snapper_refresh_errors_total Errors.
+# TYPE ec2_snapper_refresh_errors_total counter
+ec2_snapper_refresh_errors_total 0.5
+`
+	if output := FormatPrometheus(metrics); output != expected {
+		t.Fatalf("Expected\n%s\nbut got\n%s", expected, output)
+	}
+}
+
+func TestCloudWatchToPrometheus(t *testing.T) {
+	t.Parallel()
+
+	data := []*cloudwatch.MetricDatum{
+		&cloudwatch.MetricDatum{MetricName: aws.String(METRIC_NAME_SUCCESS), Value: aws.Float64(1), Dimensions: InstanceDimensions("i-1")},
+		&cloudwatch.MetricDatum{MetricName: aws.String("My Backup"), Value: aws.Float64(2), Dimensions: []*cloudwatch.Dimension{
+			&cloudwatch.Dimension{Name: aws.String("Host-Name"), Value: aws.String("db")},
+		}},
+	}
+
+	output := FormatPrometheus(CloudWatchToPrometheus(data))
+	for _, expected := range []string{`ec2_snapper_success{instance_id="i-1"} 1`, `My_Backup{Host_Name="db"} 2`} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("Expected the output to contain %s, but got\n%s", expected, output)
+		}
+	}
+}
+
+func TestPushToGateway(t *testing.T) {
+	t.Parallel()
+
+	var method, path, contentType, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, contentType = r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type")
+		bytes, _ := ioutil.ReadAll(r.Body)
+		body = string(bytes)
+	}))
+	defer gateway.Close()
+
+	grouping := []PushgatewayLabel{
+		PushgatewayLabel{Name: "command", Value: "create"},
+		PushgatewayLabel{Name: "instance_name", Value: "web/1"},
+		PushgatewayLabel{Name: "instance_id", Value: ""},
+	}
+	metrics := []PrometheusMetric{PrometheusMetric{Name: "ec2_snapper_success", Type: "gauge", Samples: []PrometheusSample{PrometheusSample{Value: 1}}}}
+
+	if err := PushToGateway(context.Background(), gateway.URL + "/", grouping, metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPut || path != "/metrics/job/ec2-snapper/command/create/instance_name/web%2F1" {
+		t.Fatalf("Unexpected push: %s %s", method, path)
+	}
+	if contentType != PROMETHEUS_CONTENT_TYPE || !strings.Contains(body, "ec2_snapper_success 1\n") {
+		t.Fatalf("Unexpected body of type %s:\n%s", contentType, body)
+	}
+}
+
+func TestPushToGatewayFails(t *testing.T) {
+	t.Parallel()
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "inconsistent labels", http.StatusBadRequest)
+	}))
+	defer gateway.Close()
+
+	err := PushToGateway(context.Background(), gateway.URL, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "inconsistent labels") {
+		t.Fatalf("Expected an error with the response of the Pushgateway, but got %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/cli"
+)
+
+// The exit code of a command that did some of its work, but failed for the rest
+const EXIT_CODE_PARTIAL_FAILURE = 2
+
+// descriptions for args
+var dscrParallelism = "The maximum number of instances to process concurrently. Defaults to 1."
+
+// An EC2 instance given on the command line, either by id or by name
+type instanceRef struct {
+	Id   string
+	Name string
+}
+
+func (r instanceRef) String() string {
+	if r.Id != "" {
+		return r.Id
+	}
+	return r.Name
+}
+
+// The outcome of running a command against a single instance
+type instanceResult struct {
+	Target   awsTarget
+	Instance instanceRef
+	// The AMIs the command created or deleted for the instance
+	AmiIds []string
+	Err    error
+}
+
+// Returned when a command succeeded for some of the resources of an instance, but failed for others
+type partialFailureError struct {
+	NumSucceeded int
+	NumFailed    int
+}
+
+func (err *partialFailureError) Error() string {
+	return fmt.Sprintf("ERROR: Partial failure. %d succeeded and %d failed; see above for details.", err.NumSucceeded, err.NumFailed)
+}
+
+// Parse the comma-separated --instance-id and --instance-name args into a list of instances. Only one of the two args
+// may be set, which validateCreateArgs and validateDeleteArgs check.
+func parseInstanceRefs(instanceIds string, instanceNames string) []instanceRef {
+	var refs []instanceRef
+
+	for _, id := range splitList(instanceIds) {
+		refs = append(refs, instanceRef{Id: id})
+	}
+	for _, name := range splitList(instanceNames) {
+		refs = append(refs, instanceRef{Name: name})
+	}
+
+	return refs
+}
+
+func validateParallelism(parallelism int) error {
+	if parallelism < 1 {
+		return errors.New("ERROR: The argument '--parallelism' must be at least 1.")
+	}
+	return nil
+}
+
+// Split a comma-separated list, ignoring whitespace and empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Call fn for every instance on a pool of at most parallelism workers. When there is more than one instance, each call
+// gets a Ui that prefixes every line with the instance. When instances run concurrently, the output of each instance is
+// held back until it is done and then shown in one piece, so the output of different instances isn't interleaved. An
+// error for one instance does not stop the others. fn returns the AMIs it created or deleted. Once ctx is done, fn
+// isn't called for any further instance, and the result of those instances is the reason ctx is done. Returns one
+// result per instance, in the order the instances were given.
+func forEachInstance(ctx context.Context, refs []instanceRef, parallelism int, ui cli.Ui, fn func(ref instanceRef, ui cli.Ui) ([]string, error)) []instanceResult {
+	results := make([]instanceResult, len(refs))
+	concurrentUi := &cli.ConcurrentUi{Ui: ui}
+	var flushMutex sync.Mutex
+
+	runInParallel(len(refs), parallelism, func(i int) {
+		if err := cancellationError(ctx); err != nil {
+			results[i] = instanceResult{Instance: refs[i], Err: err}
+			return
+		}
+
+		var instanceUi cli.Ui = concurrentUi
+		var buffer *bufferedUi
+		if parallelism > 1 && len(refs) > 1 {
+			buffer = &bufferedUi{Ui: concurrentUi}
+			instanceUi = buffer
+		}
+		if len(refs) > 1 {
+			prefix := "[" + refs[i].String() + "] "
+			instanceUi = &cli.PrefixedUi{
+				AskPrefix:       prefix,
+				AskSecretPrefix: prefix,
+				OutputPrefix:    prefix,
+				InfoPrefix:      prefix,
+				ErrorPrefix:     prefix,
+				WarnPrefix:      prefix,
+				Ui:              instanceUi,
+			}
+		}
+
+		amiIds, err := fn(refs[i], instanceUi)
+		if err != nil {
+			err = explainCancellation(ctx, explainAwsError(err))
+			instanceUi.Error(err.Error())
+		}
+		results[i] = instanceResult{Instance: refs[i], AmiIds: amiIds, Err: err}
+
+		if buffer != nil {
+			flushMutex.Lock()
+			buffer.flush()
+			flushMutex.Unlock()
+		}
+	})
+
+	return results
+}
+
+// A Ui that holds back the messages of one instance until flush shows them on the wrapped Ui, in order. Questions are
+// asked right away, since they wait for an answer. Safe to use from several goroutines.
+type bufferedUi struct {
+	Ui cli.Ui
+
+	mutex    sync.Mutex
+	messages []func(ui cli.Ui)
+}
+
+func (u *bufferedUi) Ask(query string) (string, error) {
+	return u.Ui.Ask(query)
+}
+
+func (u *bufferedUi) AskSecret(query string) (string, error) {
+	return u.Ui.AskSecret(query)
+}
+
+func (u *bufferedUi) Output(message string) {
+	u.hold(func(ui cli.Ui) { ui.Output(message) })
+}
+
+func (u *bufferedUi) Info(message string) {
+	u.hold(func(ui cli.Ui) { ui.Info(message) })
+}
+
+func (u *bufferedUi) Warn(message string) {
+	u.hold(func(ui cli.Ui) { ui.Warn(message) })
+}
+
+func (u *bufferedUi) Error(message string) {
+	u.hold(func(ui cli.Ui) { ui.Error(message) })
+}
+
+func (u *bufferedUi) hold(show func(ui cli.Ui)) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.messages = append(u.messages, show)
+}
+
+// Show the messages held back so far on the wrapped Ui
+func (u *bufferedUi) flush() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for _, show := range u.messages {
+		show(u.Ui)
+	}
+	u.messages = nil
+}
+
+// Print an aggregated summary of the given results if there was more than one instance or the command was interrupted,
+// and return the exit code of the command: 0 if every instance succeeded, EXIT_CODE_INTERRUPTED if the command was
+// interrupted, EXIT_CODE_PARTIAL_FAILURE if every failure was a partial failure, and 1 otherwise
+func summarizeInstanceResults(results []instanceResult, ui cli.Ui) int {
+	var failed []instanceResult
+	var interrupted *interruptedError
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+		if err, ok := result.Err.(*interruptedError); ok {
+			interrupted = err
+		}
+	}
+
+	if len(results) > 1 {
+		ui.Output("")
+		ui.Output("==> Summary: " + strconv.Itoa(len(results) - len(failed)) + " of " + strconv.Itoa(len(results)) + " instance(s) succeeded.")
+
+		// Group the results by account and region, in the order the targets were processed
+		var targets []awsTarget
+		resultsByTarget := map[awsTarget][]instanceResult{}
+		for _, result := range results {
+			if _, ok := resultsByTarget[result.Target]; !ok {
+				targets = append(targets, result.Target)
+			}
+			resultsByTarget[result.Target] = append(resultsByTarget[result.Target], result)
+		}
+
+		for _, target := range targets {
+			prefix := ""
+			if len(targets) > 1 {
+				prefix = target.String() + ": "
+				numFailed := 0
+				for _, result := range resultsByTarget[target] {
+					if result.Err != nil {
+						numFailed++
+					}
+				}
+				ui.Output(fmt.Sprintf("%s%d of %d instance(s) succeeded.", prefix, len(resultsByTarget[target]) - numFailed, len(resultsByTarget[target])))
+			}
+			for _, result := range resultsByTarget[target] {
+				if result.Err != nil {
+					ui.Error(fmt.Sprintf("%s%s: %s", prefix, result.Instance, result.Err.Error()))
+				}
+			}
+		}
+	}
+
+	if interrupted != nil {
+		ui.Output("")
+		ui.Error(fmt.Sprintf("==> Interrupted by %s. %d of %d instance(s) succeeded, and no work was started after the interrupt.", signalName(interrupted.Signal), len(results) - len(failed), len(results)))
+		return EXIT_CODE_INTERRUPTED
+	}
+
+	for _, result := range failed {
+		if _, ok := result.Err.(*partialFailureError); !ok {
+			return 1
+		}
+	}
+
+	if len(failed) > 0 {
+		return EXIT_CODE_PARTIAL_FAILURE
+	}
+	return 0
+}
+
+// Call fn with every index from 0 to numItems - 1 on a pool of at most parallelism goroutines and wait for all of them
+// to finish
+func runInParallel(numItems int, parallelism int, fn func(i int)) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	indexes := make(chan int)
+	var waitGroup sync.WaitGroup
+
+	for worker := 0; worker < parallelism && worker < numItems; worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < numItems; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	waitGroup.Wait()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/josh-padnick/ec2-snapper/snapper"
+)
+
+// The IAM actions needed by each feature of ec2-snapper. This is the single source of truth for both the iam-policy
+// and the doctor command, so update it whenever a command starts making a new AWS API call.
+var featurePermissions = map[string][]string{
+	"alarm": []string{
+		"cloudwatch:DeleteAlarms",
+		"cloudwatch:DescribeAlarms",
+		"cloudwatch:PutMetricAlarm",
+	},
+	// delete with --archive-older-than
+	"archive": []string{
+		"ec2:DescribeImages",
+		"ec2:DescribeSnapshotTierStatus",
+		"ec2:DescribeSnapshots",
+		"ec2:ModifySnapshotTier",
+	},
+	// create and delete with --audit-cloudwatch-log-group or --audit-s3-uri. The audit log also needs the caller
+	// identity, but sts:GetCallerIdentity is always allowed.
+	"audit": []string{
+		"logs:CreateLogStream",
+		"logs:PutLogEvents",
+		"s3:PutObject",
+	},
+	// create and delete with --role-arn, for the credentials the command starts with. The roles' trust policies must
+	// allow them too.
+	"assume-role": []string{
+		"sts:AssumeRole",
+	},
+	"check": []string{
+		"ec2:DescribeImages",
+		"ec2:DescribeInstances",
+	},
+	// cost with --incremental also needs the ebs actions
+	"cost": []string{
+		"ebs:ListChangedBlocks",
+		"ebs:ListSnapshotBlocks",
+		"ec2:DescribeImages",
+		"ec2:DescribeInstances",
+		"ec2:DescribeSnapshots",
+	},
+	"create": []string{
+		"ec2:CreateImage",
+		"ec2:CreateTags",
+		"ec2:DescribeImages",
+		"ec2:DescribeInstances",
+	},
+	// delete with --soft-delete. The rbin actions check for, and with --recycle-bin-retention-days create, the Recycle
+	// Bin rules that retain the deleted AMIs and snapshots.
+	"soft-delete": []string{
+		"ec2:CreateTags",
+		"ec2:DeleteTags",
+		"ec2:DisableImageDeprecation",
+		"ec2:EnableImageDeprecation",
+		"ec2:ModifyImageAttribute",
+		"rbin:CreateRule",
+		"rbin:GetRule",
+		"rbin:ListRules",
+	},
+	"undelete": []string{
+		"ec2:DeleteTags",
+		"ec2:DescribeImages",
+		"ec2:DisableImageDeprecation",
+		"ec2:ListImagesInRecycleBin",
+		"ec2:ListSnapshotsInRecycleBin",
+		"ec2:ModifyImageAttribute",
+		"ec2:RestoreImageFromRecycleBin",
+		"ec2:RestoreSnapshotFromRecycleBin",
+	},
+	// simulate with --instance-id or --instance-name
+	"simulate": []string{
+		"ec2:DescribeImages",
+		"ec2:DescribeInstances",
+	},
+	"snapshot": []string{
+		"ec2:CreateSnapshots",
+		"ec2:CreateTags",
+		"ec2:DescribeInstances",
+	},
+	// delete checks the tier status of the snapshots, so it doesn't delete AMIs that were archived recently
+	"delete": []string{
+		"ec2:DeleteSnapshot",
+		"ec2:DeregisterImage",
+		"ec2:DescribeImages",
+		"ec2:DescribeInstances",
+		"ec2:DescribeSnapshotTierStatus",
+		"ec2:DescribeSnapshots",
+	},
+	// create with --kms-key-id. The KMS actions are those EBS needs to encrypt snapshots with a customer-managed key.
+	"encrypt": []string{
+		"ec2:CopyImage",
+		"ec2:CreateTags",
+		"ec2:DeleteSnapshot",
+		"ec2:DeregisterImage",
+		"ec2:DescribeImages",
+		"kms:CreateGrant",
+		"kms:Decrypt",
+		"kms:DescribeKey",
+		"kms:GenerateDataKeyWithoutPlaintext",
+		"kms:ReEncryptFrom",
+		"kms:ReEncryptTo",
+	},
+	// create and delete with --organizational-unit, for the credentials of the organization's management account,
+	// which list the accounts of the OU and assume --role-name in each
+	"organizational-unit": []string{
+		"organizations:ListAccountsForParent",
+		"organizations:ListOrganizationalUnitsForParent",
+		"sts:AssumeRole",
+	},
+	"exporter": []string{
+		"ec2:DescribeImages",
+		"ec2:DescribeInstances",
+	},
+	"report": []string{
+		"cloudwatch:PutMetricData",
+	},
+	// create and delete with --notify=sns:<topic arn>
+	"notify": []string{
+		"sns:Publish",
+	},
+	// create, delete and check with --metric-namespace
+	"metrics": []string{
+		"cloudwatch:PutMetricData",
+		"ec2:DescribeImages",
+	},
+}
+
+// Actions that delete existing backups. When a policy is scoped by tag, these are only allowed on resources that carry
+// the tag ec2-snapper puts on everything it creates.
+var destructiveActions = map[string]bool{
+	"ec2:DeleteSnapshot":  true,
+	"ec2:DeregisterImage": true,
+}
+
+// Return the names of all features, sorted
+func allFeatures() []string {
+	var features []string
+	for feature := range featurePermissions {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Parse a comma-separated list of features, where an empty list means all features
+func parseFeatures(list string) ([]string, error) {
+	features := splitList(list)
+	if len(features) == 0 {
+		return allFeatures(), nil
+	}
+
+	for _, feature := range features {
+		if _, ok := featurePermissions[feature]; !ok {
+			return nil, fmt.Errorf("ERROR: Unknown feature '%s'. Valid features are: %s.", feature, strings.Join(allFeatures(), ", "))
+		}
+	}
+	return features, nil
+}
+
+// Return the sorted, de-duplicated IAM actions needed by the given features
+func actionsForFeatures(features []string) []string {
+	seen := map[string]bool{}
+	var actions []string
+
+	for _, feature := range features {
+		for _, action := range featurePermissions[feature] {
+			if !seen[action] {
+				seen[action] = true
+				actions = append(actions, action)
+			}
+		}
+	}
+
+	sort.Strings(actions)
+	return actions
+}
+
+type iamPolicy struct {
+	Version   string
+	Statement []iamPolicyStatement
+}
+
+type iamPolicyStatement struct {
+	Sid       string
+	Effect    string
+	Action    []string
+	Resource  []string
+	Condition map[string]map[string]string `json:",omitempty"`
+}
+
+// Build the least-privilege IAM policy for the given features. If scopeByTag is set, the actions that delete backups
+// are only allowed on AMIs and snapshots tagged with snapper.INSTANCE_ID_TAG.
+func buildIamPolicy(features []string, scopeByTag bool) iamPolicy {
+	var unscopedActions []string
+	var scopedActions []string
+
+	for _, action := range actionsForFeatures(features) {
+		if scopeByTag && destructiveActions[action] {
+			scopedActions = append(scopedActions, action)
+		} else {
+			unscopedActions = append(unscopedActions, action)
+		}
+	}
+
+	policy := iamPolicy{Version: "2012-10-17"}
+
+	if len(unscopedActions) > 0 {
+		policy.Statement = append(policy.Statement, iamPolicyStatement{
+			Sid: "Ec2Snapper",
+			Effect: "Allow",
+			Action: unscopedActions,
+			Resource: []string{"*"},
+		})
+	}
+
+	if len(scopedActions) > 0 {
+		policy.Statement = append(policy.Statement, iamPolicyStatement{
+			Sid: "Ec2SnapperDeleteTaggedBackups",
+			Effect: "Allow",
+			Action: scopedActions,
+			Resource: []string{"*"},
+			Condition: map[string]map[string]string{
+				"Null": map[string]string{
+					"ec2:ResourceTag/" + snapper.INSTANCE_ID_TAG: "false",
+				},
+			},
+		})
+	}
+
+	return policy
+}
+
+// Render the given IAM policy as indented JSON
+func formatIamPolicy(policy iamPolicy) (string, error) {
+	bytes, err := json.MarshalIndent(policy, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
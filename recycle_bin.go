@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/recyclebin"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+// Recycle Bin retention periods are whole days between 1 and 365
+const MAX_RECYCLE_BIN_RETENTION_DAYS = 365
+
+var recycleBinRuleDescription = "Created by ec2-snapper to retain the AMIs and snapshots deleted with --soft-delete"
+
+// The resource types that must be retained by a Recycle Bin rule for a soft-deleted AMI to be restorable
+var recycleBinResourceTypes = []string{recyclebin.ResourceTypeEc2Image, recyclebin.ResourceTypeEbsSnapshot}
+
+// Return true if the given Recycle Bin rule retains the AMIs and snapshots ec2-snapper creates for the given instance.
+// A rule without resource tags retains every resource of its type in the region.
+func recycleBinRuleCovers(rule *recyclebin.GetRuleOutput, instanceId string) bool {
+	if aws.StringValue(rule.Status) != recyclebin.RuleStatusAvailable {
+		return false
+	}
+	if len(rule.ResourceTags) == 0 {
+		return true
+	}
+
+	for _, tag := range rule.ResourceTags {
+		if aws.StringValue(tag.ResourceTagKey) != snapper.INSTANCE_ID_TAG {
+			continue
+		}
+		if value := aws.StringValue(tag.ResourceTagValue); value == "" || value == instanceId {
+			return true
+		}
+	}
+	return false
+}
+
+// Find a Recycle Bin rule of the given resource type that retains the backups of the given instance, and return its
+// id, or "" if there is none
+func findRecycleBinRule(ctx context.Context, resourceType string, instanceId string, svc *recyclebin.RecycleBin) (string, error) {
+	var ruleIds []string
+	err := svc.ListRulesPagesWithContext(ctx, &recyclebin.ListRulesInput{ResourceType: aws.String(resourceType)}, func(page *recyclebin.ListRulesOutput, lastPage bool) bool {
+		for _, rule := range page.Rules {
+			ruleIds = append(ruleIds, aws.StringValue(rule.Identifier))
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The rule summaries don't include the resource tags
+	for _, ruleId := range ruleIds {
+		rule, err := svc.GetRuleWithContext(ctx, &recyclebin.GetRuleInput{Identifier: aws.String(ruleId)})
+		if err != nil {
+			return "", err
+		}
+		if recycleBinRuleCovers(rule, instanceId) {
+			return ruleId, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Make sure that Recycle Bin rules retain the deregistered AMIs and deleted snapshots of the given instance, so that
+// undelete can restore them. Missing rules are created with the given retention period, or are an error if it is 0.
+// A dry run only reports the rules it would create.
+func ensureRecycleBinRules(ctx context.Context, instanceId string, retentionDays int64, dryRun bool, svc *recyclebin.RecycleBin, ui cli.Ui) error {
+	for _, resourceType := range recycleBinResourceTypes {
+		ruleId, err := findRecycleBinRule(ctx, resourceType, instanceId, svc)
+		if err != nil {
+			return err
+		}
+		if ruleId != "" {
+			ui.Output("==> Recycle Bin rule " + ruleId + " retains resources of type " + resourceType + ".")
+			continue
+		}
+
+		if retentionDays == 0 {
+			return fmt.Errorf("ERROR: '--soft-delete' is set, but no Recycle Bin rule retains resources of type %s tagged %s=%s, so deleted backups could not be restored. Create one, or set '--recycle-bin-retention-days' to have ec2-snapper create it.", resourceType, snapper.INSTANCE_ID_TAG, instanceId)
+		}
+
+		if dryRun {
+			ui.Output(fmt.Sprintf("==> Would create a Recycle Bin rule that retains resources of type %s tagged %s for %d days.", resourceType, snapper.INSTANCE_ID_TAG, retentionDays))
+			continue
+		}
+
+		ui.Output(fmt.Sprintf("==> Creating a Recycle Bin rule that retains resources of type %s tagged %s for %d days...", resourceType, snapper.INSTANCE_ID_TAG, retentionDays))
+		resp, err := svc.CreateRuleWithContext(ctx, &recyclebin.CreateRuleInput{
+			ResourceType: aws.String(resourceType),
+			Description: aws.String(recycleBinRuleDescription),
+			RetentionPeriod: &recyclebin.RetentionPeriod{
+				RetentionPeriodUnit: aws.String(recyclebin.RetentionPeriodUnitDays),
+				RetentionPeriodValue: aws.Int64(retentionDays),
+			},
+			// Without a value, the rule retains the backups of every instance, not just this one
+			ResourceTags: []*recyclebin.ResourceTag{
+				&recyclebin.ResourceTag{ResourceTagKey: aws.String(snapper.INSTANCE_ID_TAG)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		ui.Output("==> Created Recycle Bin rule " + aws.StringValue(resp.Identifier) + ".")
+	}
+
+	return nil
+}
+
+// Return true if the given description was set by --soft-delete for the given instance
+func isSoftDeletedFrom(description string, instanceId string) bool {
+	prefix := strings.SplitN(snapper.SOFT_DELETE_DESCRIPTION_FORMAT, "%s", 2)[0]
+	return strings.HasPrefix(description, prefix + instanceId + " ")
+}
+
+func validateRecycleBinRetentionDays(retentionDays int64) error {
+	if retentionDays < 0 || retentionDays > MAX_RECYCLE_BIN_RETENTION_DAYS {
+		return fmt.Errorf("ERROR: The argument '--recycle-bin-retention-days' must be between 1 and %d.", MAX_RECYCLE_BIN_RETENTION_DAYS)
+	}
+	return nil
+}
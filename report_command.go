@@ -1,11 +1,14 @@
 package main
 
 import (
+	"github.com/josh-padnick/ec2-snapper/metrics"
 	"github.com/mitchellh/cli"
+	"context"
 	"flag"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"strings"
+	"time"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 )
@@ -20,6 +23,12 @@ type ReportCommand struct {
 	MetricName 		string
 	MetricValue 		float64
 	MetricUnit 		string
+	Dimensions		dimensionsFlag
+	Timestamp		string
+	StorageResolution	int64
+	FromFile		string
+	PushgatewayUrl		string
+	Aws			AwsOptions
 }
 
 // descriptions for args
@@ -27,28 +36,37 @@ var reportDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
 var reportDscrNamespace = "The CloudWatch namespace for this metric (e.g. MyCustomMetrics)."
 var reportDscrMetricName = "The name of the metric (e.g. MyEC2Backup)."
 var reportDscrMetricValue = fmt.Sprintf("The value of the metric (e.g. 1). Defaults to %d.", DEFAULT_METRIC_VALUE)
-var reportDscrMetricUnit = fmt.Sprintf("The unit of the metric (e.g. Count). Defaults to %s.", DEFAULT_METRIC_UNIT)
+var reportDscrMetricUnit = fmt.Sprintf("The unit of the metric (e.g. Count). Defaults to %s. Valid units are: %s.", DEFAULT_METRIC_UNIT, strings.Join(cloudwatch.StandardUnit_Values(), ", "))
+var reportDscrDimension = "A dimension of the metric in the format Name=Value (e.g. InstanceName=web-1). Repeat to add several dimensions."
+var reportDscrTimestamp = "The time of the metric, in RFC 3339 format (e.g. 2016-09-14T08:00:00Z) or seconds since the Unix epoch. Must be at most two weeks in the past. Defaults to the time CloudWatch receives it."
+var reportDscrStorageResolution = fmt.Sprintf("Store the metric with a resolution of %d second (high resolution) or %d seconds. Defaults to %d.", HIGH_STORAGE_RESOLUTION, STANDARD_STORAGE_RESOLUTION, STANDARD_STORAGE_RESOLUTION)
+var reportDscrPushgatewayUrl = "If set, also push the metrics to the Prometheus Pushgateway at this URL (e.g. http://pushgateway:9091), as gauges labeled with their dimensions and grouped by namespace."
+var reportDscrFromFile = "Report the metrics in this JSON or CSV file instead of a single metric given by '--name' and '--value'. The other args apply to every metric that doesn't set them itself."
 
 func (c *ReportCommand) Help() string {
 	return `ec2-snapper report <args> [--help]
 
-Report a metric to CloudWatch.
+Report a metric, or a batch of metrics from a file, to CloudWatch.
 
 Available args are:
 --region      		` + reportDscrAwsRegion + `
 --namespace      	` + reportDscrNamespace + `
 --name      		` + reportDscrMetricName + `
 --value    		` + reportDscrMetricValue + `
---unit    		` + reportDscrMetricUnit
+--unit    		` + reportDscrMetricUnit + `
+--dimension    		` + reportDscrDimension + `
+--timestamp    		` + reportDscrTimestamp + `
+--storage-resolution	` + reportDscrStorageResolution + `
+--from-file    		` + reportDscrFromFile + `
+--pushgateway-url	` + reportDscrPushgatewayUrl + awsArgsHelp()
 }
 
 func (c *ReportCommand) Synopsis() string {
 	return "Report a metric to CloudWatch"
 }
 
-func (c *ReportCommand) Run(args []string) int {
-
-	// Handle the command-line args
+// Define the args of the report command
+func (c *ReportCommand) flags() *flag.FlagSet {
 	cmdFlags := flag.NewFlagSet("report", flag.ExitOnError)
 	cmdFlags.Usage = func() {
 		c.Ui.Output(c.Help())
@@ -59,45 +77,122 @@ func (c *ReportCommand) Run(args []string) int {
 	cmdFlags.StringVar(&c.MetricName, "name", "", reportDscrMetricName)
 	cmdFlags.Float64Var(&c.MetricValue, "value", DEFAULT_METRIC_VALUE, reportDscrMetricValue)
 	cmdFlags.StringVar(&c.MetricUnit, "unit", DEFAULT_METRIC_UNIT, reportDscrMetricUnit)
+	cmdFlags.Var(&c.Dimensions, "dimension", reportDscrDimension)
+	cmdFlags.StringVar(&c.Timestamp, "timestamp", "", reportDscrTimestamp)
+	cmdFlags.Int64Var(&c.StorageResolution, "storage-resolution", STANDARD_STORAGE_RESOLUTION, reportDscrStorageResolution)
+	cmdFlags.StringVar(&c.FromFile, "from-file", "", reportDscrFromFile)
+	cmdFlags.StringVar(&c.PushgatewayUrl, "pushgateway-url", "", reportDscrPushgatewayUrl)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *ReportCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	if err := report(*c); err != nil {
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+
+	if err := report(ctx, *c); err != nil {
+		err = explainCancellation(ctx, explainAwsError(err))
 		c.Ui.Error(err.Error())
-		return 1
+		return failureExitCode(err)
 	}
 
 	return 0
 }
 
-func report(c ReportCommand) error {
+func report(ctx context.Context, c ReportCommand) error {
 	if err := validateReportArgs(c); err != nil {
 		return err
 	}
 
-	session := session.New(&aws.Config{Region: &c.AwsRegion})
+	metricData, err := buildReportMetricData(c, time.Now())
+	if err != nil {
+		return err
+	}
+
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return err
+	}
 	svc := cloudwatch.New(session)
 
-	return createMetric(c, svc)
+	if err := createMetric(ctx, c, metricData, svc); err != nil {
+		return err
+	}
+
+	if c.PushgatewayUrl != "" {
+		c.Ui.Output(fmt.Sprintf("Pushing %d metric(s) to the Pushgateway at %s...", len(metricData), c.PushgatewayUrl))
+		grouping := []metrics.PushgatewayLabel{
+			metrics.PushgatewayLabel{Name: "command", Value: "report"},
+			metrics.PushgatewayLabel{Name: "namespace", Value: c.Namespace},
+		}
+		return metrics.PushToGateway(ctx, c.PushgatewayUrl, grouping, metrics.CloudWatchToPrometheus(metricData))
+	}
+
+	return nil
 }
 
-func createMetric(c ReportCommand, svc *cloudwatch.CloudWatch) error {
+// Build the metric data to report: the single metric given on the command line or, with --from-file, every metric in
+// the file, with the command line args as defaults
+func buildReportMetricData(c ReportCommand, now time.Time) ([]*cloudwatch.MetricDatum, error) {
+	dimensions, err := parseDimensions(c.Dimensions)
+	if err != nil {
+		return nil, err
+	}
 
-	metricData := &cloudwatch.MetricDatum{
-		MetricName: aws.String(c.MetricName),
-		Value: aws.Float64(c.MetricValue),
-		Unit: aws.String(c.MetricUnit),
+	defaults := metricDatumRecord{
+		Unit: c.MetricUnit,
+		Timestamp: c.Timestamp,
+		StorageResolution: c.StorageResolution,
+		Dimensions: dimensions,
 	}
-	metricInput := &cloudwatch.PutMetricDataInput{
-		Namespace: aws.String(c.Namespace),
-		MetricData: []*cloudwatch.MetricDatum{metricData},
+
+	if c.FromFile == "" {
+		defaults.Name = c.MetricName
+		defaults.Value = aws.Float64(c.MetricValue)
+
+		datum, err := buildMetricDatum(defaults, metricDatumRecord{}, now)
+		if err != nil {
+			return nil, err
+		}
+		return []*cloudwatch.MetricDatum{datum}, nil
 	}
 
-	c.Ui.Output(fmt.Sprintf("Writing metric data to CloudWatch:\n%s", metricInput.String()))
-	_, err := svc.PutMetricData(metricInput)
-	return err
+	records, err := readMetricDatumRecords(c.FromFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("ERROR: There are no metrics in '%s'.", c.FromFile)
+	}
+
+	var metricData []*cloudwatch.MetricDatum
+	for i, record := range records {
+		datum, err := buildMetricDatum(record, defaults, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s (metric %d of '%s')", err.Error(), i + 1, c.FromFile)
+		}
+		metricData = append(metricData, datum)
+	}
+	return metricData, nil
+}
+
+func createMetric(ctx context.Context, c ReportCommand, metricData []*cloudwatch.MetricDatum, svc *cloudwatch.CloudWatch) error {
+	if len(metricData) == 1 {
+		c.Ui.Output(fmt.Sprintf("Writing metric data to CloudWatch namespace %s:\n%s", c.Namespace, metricData[0].String()))
+	} else {
+		c.Ui.Output(fmt.Sprintf("Writing %d metrics to CloudWatch namespace %s...", len(metricData), c.Namespace))
+	}
+
+	return metrics.PutMetricData(ctx, c.Namespace, metricData, svc)
 }
 
 func validateReportArgs(c ReportCommand) error {
@@ -109,10 +204,30 @@ func validateReportArgs(c ReportCommand) error {
 		return errors.New("ERROR: The argument '--namespace' is required.")
 	}
 
-	if c.MetricName == "" {
-		return errors.New("ERROR: The argument '--name' is required.")
+	if c.MetricName == "" && c.FromFile == "" {
+		return errors.New("ERROR: You must specify either '--name' or '--from-file'.")
 	}
 
-	return nil
+	if c.MetricName != "" && c.FromFile != "" {
+		return errors.New("ERROR: The arguments '--name' and '--from-file' cannot be used together.")
+	}
+
+	if err := validateMetricUnit(c.MetricUnit); err != nil {
+		return err
+	}
+
+	if err := validateStorageResolution(c.StorageResolution); err != nil {
+		return err
+	}
+
+	if err := validatePushgatewayUrl(c.PushgatewayUrl); err != nil {
+		return err
+	}
+
+	if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+		return err
+	}
+
+	return validateAwsOptions(c.Aws)
 }
 
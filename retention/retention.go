@@ -0,0 +1,154 @@
+// Package retention decides which AMIs a retention policy keeps. It makes the same decisions as the create and delete
+// commands of ec2-snapper, without calling AWS, so the decisions can be previewed, simulated or reused by other tools.
+package retention
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The format of the creation dates of AMIs returned by EC2
+const IMAGE_CREATION_DATE_LAYOUT = "2006-01-02T15:04:05.000Z"
+
+// The retention policy of the delete command: delete the AMIs older than OlderThanHours, but always keep at least
+// RequireAtLeast AMIs
+type Policy struct {
+	OlderThanHours float64
+	RequireAtLeast int
+}
+
+// Parse an age like "30d", "24h" or "15m" into hours
+// TODO: convert this to use Go's time.ParseDuration
+func ParseHours(olderThan string) (float64, error) {
+	var minutes float64
+	var hours float64
+
+	// Parse our date range
+	match, _ := regexp.MatchString("^[0-9]*(h|d|m)$", olderThan)
+	if ! match {
+		return hours, errors.New("The --older-than value of \"" + olderThan + "\" is not formatted properly.  Use formats like 30d or 24h")
+	}
+
+	// We were given a time like "12h"
+	if match, _ := regexp.MatchString("^[0-9]*(h)$", olderThan); match {
+		hours, _ = strconv.ParseFloat(olderThan[0:len(olderThan)-1], 64)
+	}
+
+	// We were given a time like "15d"
+	if match, _ := regexp.MatchString("^[0-9]*(d)$", olderThan); match {
+		hours, _ = strconv.ParseFloat(olderThan[0:len(olderThan)-1], 64)
+		hours *= 24
+	}
+
+	// We were given a time like "5m"
+	if match, _ := regexp.MatchString("^[0-9]*(m)$", olderThan); match {
+		minutes, _ = strconv.ParseFloat(olderThan[0:len(olderThan)-1], 64)
+		hours = minutes/60
+	}
+
+	return hours, nil
+}
+
+// Return the given AMIs that are more than olderThanHours old at the given time, in the order given
+func FilterOlderThan(images []*ec2.Image, olderThanHours float64, now time.Time) ([]*ec2.Image, error) {
+	var filteredAmis[]*ec2.Image
+
+	for i := 0; i < len(images); i++ {
+		creationDate, err := time.Parse(time.RFC3339Nano, *images[i].CreationDate)
+		if err != nil {
+			return filteredAmis, err
+		}
+
+		duration := now.Sub(creationDate)
+
+		if duration.Hours() > olderThanHours {
+			filteredAmis = append(filteredAmis, images[i])
+		}
+	}
+
+	return filteredAmis, nil
+}
+
+// Compute how many of the numOld backups marked for deletion must be kept so that at least requireAtLeast of the
+// numTotal backups remain
+func NumToKeep(numTotal int, numOld int, requireAtLeast int) int {
+	var numToRemainAfterDelete = numTotal - numOld
+	return int(math.Max(0.0, float64(requireAtLeast - numToRemainAfterDelete)))
+}
+
+// Return the AMIs the delete command would remove from the given AMIs of an instance at the given time, oldest first.
+// Like the delete command, the newest of the old AMIs are kept to honor RequireAtLeast.
+func ImagesToDelete(images []*ec2.Image, policy Policy, now time.Time) ([]*ec2.Image, error) {
+	if len(images) <= policy.RequireAtLeast {
+		return nil, nil
+	}
+
+	oldImages, err := FilterOlderThan(SortOldestFirst(images), policy.OlderThanHours, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return oldImages[:len(oldImages) - NumToKeep(len(images), len(oldImages), policy.RequireAtLeast)], nil
+}
+
+// Return the newest pending or available image that is at most the given number of hours old, or nil if there is none
+func NewestImageWithinHours(images []*ec2.Image, hours float64, now time.Time) (*ec2.Image, error) {
+	var newestImage *ec2.Image
+	var newestCreationDate time.Time
+
+	for _, image := range images {
+		if *image.State != ec2.ImageStateAvailable && *image.State != ec2.ImageStatePending {
+			continue
+		}
+
+		creationDate, err := time.Parse(time.RFC3339Nano, *image.CreationDate)
+		if err != nil {
+			return nil, err
+		}
+
+		if now.Sub(creationDate).Hours() > hours {
+			continue
+		}
+
+		if newestImage == nil || creationDate.After(newestCreationDate) {
+			newestImage = image
+			newestCreationDate = creationDate
+		}
+	}
+
+	return newestImage, nil
+}
+
+// Return a copy of the given AMIs sorted by creation date, oldest first
+func SortOldestFirst(images []*ec2.Image) []*ec2.Image {
+	sorted := append([]*ec2.Image{}, images...)
+	// EC2 formats every creation date the same way, so they sort as strings
+	sort.Slice(sorted, func(i, j int) bool { return aws.StringValue(sorted[i].CreationDate) < aws.StringValue(sorted[j].CreationDate) })
+	return sorted
+}
+
+// Return the total size of the EBS volumes of the given AMI
+func ImageSizeGiB(image *ec2.Image) int64 {
+	var sizeGiB int64
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping != nil && mapping.Ebs != nil {
+			sizeGiB += aws.Int64Value(mapping.Ebs.VolumeSize)
+		}
+	}
+	return sizeGiB
+}
+
+func ImageIds(images []*ec2.Image) []string {
+	var ids []string
+	for _, image := range images {
+		ids = append(ids, *image.ImageId)
+	}
+	return ids
+}
@@ -0,0 +1,119 @@
+package retention
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The size of the AMIs a simulation creates when there are no real AMIs to take the size from
+const DEFAULT_SIMULATED_AMI_GIB = 8
+
+// The settings of a retention simulation
+type Simulation struct {
+	Policy Policy
+	Start  time.Time
+	Days   int
+	// How often a new AMI is created, or 0 to only age the existing AMIs
+	Interval  time.Duration
+	NewAmiGiB int64
+}
+
+// The AMIs that exist at the end of a simulated day, and what happened to them that day
+type Day struct {
+	Date    time.Time
+	Created []string
+	Deleted []string
+	// Oldest first
+	Amis []string
+	GiB  int64
+}
+
+// Simulate the given retention policy day by day, starting from the given AMIs. A new AMI is created every interval,
+// followed by a delete run, like a cron job running create and then delete. Without new AMIs, delete runs at the end of
+// every day.
+func Simulate(images []*ec2.Image, simulation Simulation) ([]Day, error) {
+	current := SortOldestFirst(images)
+	var days []Day
+	nextCreation := simulation.Start
+	numCreated := 0
+
+	for i := 0; i < simulation.Days; i++ {
+		day := Day{Date: simulation.Start.Add(time.Duration(i) * 24 * time.Hour)}
+		dayEnd := day.Date.Add(24 * time.Hour)
+
+		runDelete := func(now time.Time) error {
+			deleted, err := ImagesToDelete(current, simulation.Policy, now)
+			if err != nil {
+				return err
+			}
+			current = removeImages(current, deleted)
+			day.Deleted = append(day.Deleted, ImageIds(deleted)...)
+			return nil
+		}
+
+		if simulation.Interval == 0 {
+			if err := runDelete(dayEnd); err != nil {
+				return nil, err
+			}
+		}
+		for ; simulation.Interval > 0 && nextCreation.Before(dayEnd); nextCreation = nextCreation.Add(simulation.Interval) {
+			numCreated++
+			image := simulatedImage(fmt.Sprintf("new-%d", numCreated), nextCreation, simulation.NewAmiGiB)
+			current = append(current, image)
+			day.Created = append(day.Created, *image.ImageId)
+
+			if err := runDelete(nextCreation); err != nil {
+				return nil, err
+			}
+		}
+
+		day.Amis = ImageIds(current)
+		for _, image := range current {
+			day.GiB += ImageSizeGiB(image)
+		}
+		days = append(days, day)
+	}
+
+	return days, nil
+}
+
+// Return the average size of the given AMIs, or DEFAULT_SIMULATED_AMI_GIB if there are none
+func AverageImageSizeGiB(images []*ec2.Image) int64 {
+	if len(images) == 0 {
+		return DEFAULT_SIMULATED_AMI_GIB
+	}
+
+	var totalGiB int64
+	for _, image := range images {
+		totalGiB += ImageSizeGiB(image)
+	}
+	return totalGiB / int64(len(images))
+}
+
+func simulatedImage(imageId string, creationDate time.Time, sizeGiB int64) *ec2.Image {
+	return &ec2.Image{
+		ImageId: aws.String(imageId),
+		CreationDate: aws.String(creationDate.UTC().Format(IMAGE_CREATION_DATE_LAYOUT)),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+			&ec2.BlockDeviceMapping{Ebs: &ec2.EbsBlockDevice{VolumeSize: aws.Int64(sizeGiB)}},
+		},
+	}
+}
+
+func removeImages(images []*ec2.Image, removed []*ec2.Image) []*ec2.Image {
+	removedIds := map[string]bool{}
+	for _, image := range removed {
+		removedIds[*image.ImageId] = true
+	}
+
+	var remaining []*ec2.Image
+	for _, image := range images {
+		if !removedIds[*image.ImageId] {
+			remaining = append(remaining, image)
+		}
+	}
+	return remaining
+}
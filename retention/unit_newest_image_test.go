@@ -0,0 +1,57 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestNewestImageWithinHoursFindsNewestImage(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	images := []*ec2.Image{
+		createTestImage("ami-old", ec2.ImageStateAvailable, now.Add(-5 * time.Hour)),
+		createTestImage("ami-new", ec2.ImageStatePending, now.Add(-1 * time.Hour)),
+		createTestImage("ami-too-old", ec2.ImageStateAvailable, now.Add(-10 * time.Hour)),
+	}
+
+	image, err := NewestImageWithinHours(images, 6, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image == nil || *image.ImageId != "ami-new" {
+		t.Fatalf("Expected to find ami-new but got %v", image)
+	}
+}
+
+func TestNewestImageWithinHoursIgnoresFailedImages(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	images := []*ec2.Image{
+		createTestImage("ami-failed", ec2.ImageStateFailed, now.Add(-1 * time.Hour)),
+		createTestImage("ami-too-old", ec2.ImageStateAvailable, now.Add(-10 * time.Hour)),
+	}
+
+	image, err := NewestImageWithinHours(images, 6, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image != nil {
+		t.Fatalf("Expected to find no image but got %s", *image.ImageId)
+	}
+}
+
+func createTestImage(imageId string, state string, creationDate time.Time) *ec2.Image {
+	return &ec2.Image{
+		ImageId: aws.String(imageId),
+		Name: aws.String(imageId),
+		State: aws.String(state),
+		CreationDate: aws.String(creationDate.UTC().Format(time.RFC3339Nano)),
+	}
+}
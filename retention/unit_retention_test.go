@@ -0,0 +1,70 @@
+package retention
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestImagesToDelete(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	images := []*ec2.Image{
+		simulatedImage("ami-1", now.Add(-10 * 24 * time.Hour), 8),
+		simulatedImage("ami-2", now.Add(-5 * 24 * time.Hour), 8),
+		simulatedImage("ami-3", now.Add(-time.Hour), 8),
+	}
+
+	deleted, err := ImagesToDelete(images, Policy{OlderThanHours: 24}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ImageIds(deleted), ",") != "ami-1,ami-2" {
+		t.Fatalf("Expected ami-1 and ami-2 to be deleted, but got %v", ImageIds(deleted))
+	}
+
+	deleted, _ = ImagesToDelete(images, Policy{OlderThanHours: 24, RequireAtLeast: 2}, now)
+	if strings.Join(ImageIds(deleted), ",") != "ami-1" {
+		t.Fatalf("Expected only ami-1 to be deleted to keep 2 AMIs, but got %v", ImageIds(deleted))
+	}
+
+	deleted, _ = ImagesToDelete(images, Policy{OlderThanHours: 24, RequireAtLeast: 3}, now)
+	if len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted, but got %v", ImageIds(deleted))
+	}
+}
+
+func TestImagesToDeleteKeepsNewestOfUnsortedImages(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	images := []*ec2.Image{
+		simulatedImage("ami-3", now.Add(-3 * 24 * time.Hour), 8),
+		simulatedImage("ami-1", now.Add(-9 * 24 * time.Hour), 8),
+		simulatedImage("ami-4", now.Add(-2 * 24 * time.Hour), 8),
+		simulatedImage("ami-2", now.Add(-5 * 24 * time.Hour), 8),
+	}
+
+	deleted, err := ImagesToDelete(images, Policy{OlderThanHours: 24, RequireAtLeast: 2}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ImageIds(deleted), ",") != "ami-1,ami-2" {
+		t.Fatalf("Expected the oldest AMIs ami-1 and ami-2 to be deleted, but got %v", ImageIds(deleted))
+	}
+}
+
+func TestNumToKeepHonorsRequireAtLeast(t *testing.T) {
+	t.Parallel()
+
+	if numToKeep := NumToKeep(5, 4, 3); numToKeep != 2 {
+		t.Fatalf("Expected to keep 2 of the 4 filtered backups so 3 remain, but got %d", numToKeep)
+	}
+
+	if numToKeep := NumToKeep(5, 2, 3); numToKeep != 0 {
+		t.Fatalf("Expected to keep none of the 2 filtered backups since 3 remain anyway, but got %d", numToKeep)
+	}
+}
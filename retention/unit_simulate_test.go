@@ -0,0 +1,59 @@
+package retention
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestSimulateWithDailyAmis(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	days, err := Simulate(nil, Simulation{
+		Policy: Policy{OlderThanHours: 3 * 24},
+		Start: start,
+		Days: 6,
+		Interval: 24 * time.Hour,
+		NewAmiGiB: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(days) != 6 || len(days[0].Amis) != 1 || days[0].GiB != 10 {
+		t.Fatalf("Expected 6 days starting with one AMI, but got %+v", days)
+	}
+	// An AMI exactly as old as --older-than is kept, so 4 AMIs exist once the policy applies
+	if strings.Join(days[4].Deleted, ",") != "new-1" || strings.Join(days[4].Amis, ",") != "new-2,new-3,new-4,new-5" || days[4].GiB != 40 {
+		t.Fatalf("Unexpected day 5: %+v", days[4])
+	}
+	if len(days[5].Amis) != 4 || strings.Join(days[5].Created, ",") != "new-6" {
+		t.Fatalf("Unexpected day 6: %+v", days[5])
+	}
+}
+
+func TestSimulateAgesExistingAmis(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	images := []*ec2.Image{
+		simulatedImage("ami-3", start.Add(-24 * time.Hour), 8),
+		simulatedImage("ami-1", start.Add(-10 * 24 * time.Hour), 8),
+		simulatedImage("ami-2", start.Add(-2 * 24 * time.Hour), 8),
+	}
+
+	days, err := Simulate(images, Simulation{Policy: Policy{OlderThanHours: 3 * 24, RequireAtLeast: 1}, Start: start, Days: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ami-2,ami-3", "ami-3", "ami-3", "ami-3"}
+	for i, day := range days {
+		if strings.Join(day.Amis, ",") != expected[i] || len(day.Created) != 0 {
+			t.Fatalf("Expected %s on day %d, but got %+v", expected[i], i + 1, day)
+		}
+	}
+}
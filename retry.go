@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const DEFAULT_RETRY_MAX_ATTEMPTS = 8
+const DEFAULT_RETRY_BASE_DELAY = 500 * time.Millisecond
+const DEFAULT_RETRY_JITTER = 0.5
+const MAX_RETRY_DELAY = 30 * time.Second
+
+// How failed AWS API calls are retried. Throttling errors (e.g. RequestLimitExceeded) and transient server errors are
+// always retryable; see snapper.WithRetryableErrorCodes for errors that are only retryable for specific calls.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	Jitter      float64
+
+	// Whether the policy was set from the command line, where every field has a default and 0 is an explicit value
+	fromFlags bool
+}
+
+// descriptions for args
+var retryDscrMaxAttempts = fmt.Sprintf("The maximum number of attempts for each AWS API call, including the first one. Defaults to %d.", DEFAULT_RETRY_MAX_ATTEMPTS)
+var retryDscrBaseDelay = fmt.Sprintf("The delay before the first retry of a failed AWS API call; it doubles with every further retry, up to %s. Defaults to %s.", MAX_RETRY_DELAY, DEFAULT_RETRY_BASE_DELAY)
+var retryDscrJitter = fmt.Sprintf("The fraction (0 to 1) of each retry delay that is randomized so concurrent runs don't retry in lockstep. Defaults to %s.", strconv.FormatFloat(DEFAULT_RETRY_JITTER, 'f', -1, 64))
+
+// The help text for the retry args, to be appended to the help text of every command that calls AWS
+func retryArgsHelp() string {
+	return `
+--retry-max-attempts	` + retryDscrMaxAttempts + `
+--retry-base-delay	` + retryDscrBaseDelay + `
+--retry-jitter		` + retryDscrJitter
+}
+
+func addRetryFlags(cmdFlags *flag.FlagSet, policy *RetryPolicy) {
+	cmdFlags.IntVar(&policy.MaxAttempts, "retry-max-attempts", DEFAULT_RETRY_MAX_ATTEMPTS, retryDscrMaxAttempts)
+	cmdFlags.DurationVar(&policy.BaseDelay, "retry-base-delay", DEFAULT_RETRY_BASE_DELAY, retryDscrBaseDelay)
+	cmdFlags.Float64Var(&policy.Jitter, "retry-jitter", DEFAULT_RETRY_JITTER, retryDscrJitter)
+	policy.fromFlags = true
+}
+
+func validateRetryPolicy(policy RetryPolicy) error {
+	if policy.withDefaults().MaxAttempts < 1 {
+		return errors.New("ERROR: The argument '--retry-max-attempts' must be a positive integer.")
+	}
+
+	if policy.BaseDelay < 0 {
+		return errors.New("ERROR: The argument '--retry-base-delay' must not be negative.")
+	}
+
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return errors.New("ERROR: The argument '--retry-jitter' must be between 0 and 1.")
+	}
+
+	return nil
+}
+
+// Fill in the defaults for a policy that was not set from the command line, e.g. when a command is run from a test
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	if policy.fromFlags {
+		return policy
+	}
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = DEFAULT_RETRY_MAX_ATTEMPTS
+	}
+	if policy.BaseDelay == 0 {
+		policy.BaseDelay = DEFAULT_RETRY_BASE_DELAY
+	}
+	return policy
+}
+
+// A retryer that uses the retryable errors of the SDK's default retryer, but our own exponential backoff with jitter
+type backoffRetryer struct {
+	client.DefaultRetryer
+	policy RetryPolicy
+}
+
+func newBackoffRetryer(policy RetryPolicy) backoffRetryer {
+	return backoffRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: policy.MaxAttempts - 1},
+		policy: policy,
+	}
+}
+
+func (r backoffRetryer) RetryRules(req *request.Request) time.Duration {
+	return computeRetryDelay(r.policy, req.RetryCount, rand.Float64())
+}
+
+// Compute the delay before the given retry: the base delay doubled for every previous retry, capped at MAX_RETRY_DELAY,
+// minus a random fraction (random must be in [0, 1)) of up to policy.Jitter of that delay
+func computeRetryDelay(policy RetryPolicy, retryCount int, random float64) time.Duration {
+	// Compare before shifting, as shifting a large base delay overflows
+	delay := MAX_RETRY_DELAY
+	if retryCount < 32 && policy.BaseDelay <= MAX_RETRY_DELAY >> uint(retryCount) {
+		delay = policy.BaseDelay << uint(retryCount)
+	}
+
+	return delay - time.Duration(policy.Jitter * random * float64(delay))
+}
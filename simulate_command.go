@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/retention"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+const DEFAULT_SIMULATION_DAYS = 30
+
+type SimulateCommand struct {
+	Ui             cli.Ui
+	AwsRegion      string
+	InstanceId     string
+	InstanceName   string
+	OlderThan      string
+	RequireAtLeast int
+	Days           int
+	Interval       string
+	AmiSize        int64
+	Aws            AwsOptions
+}
+
+// descriptions for args
+var simulateDscrAwsRegion = "The AWS region to use (e.g. us-west-2). Only needed with '--instance-id' or '--instance-name'."
+var simulateDscrInstanceId = "The id of the instance whose current AMIs to start the simulation from. Without it or '--instance-name', the simulation starts without AMIs."
+var simulateDscrInstanceName = "The name (from tags) of the instance whose current AMIs to start the simulation from."
+var simulateDscrOlderThan = "The '--older-than' of the delete command to simulate; accepts formats like '30d' or '4h'."
+var simulateDscrRequireAtLeast = "The '--require-at-least' of the delete command to simulate."
+var simulateDscrDays = fmt.Sprintf("The number of days to simulate. Defaults to %d.", DEFAULT_SIMULATION_DAYS)
+var simulateDscrInterval = "How often a new AMI is created, each followed by a delete run; accepts formats like '1d' or '12h'. Use '0h' to only age the existing AMIs, with a delete run at the end of every day. Defaults to " + DEFAULT_BACKUP_INTERVAL + "."
+var simulateDscrAmiSize = fmt.Sprintf("The size in GiB of every new AMI. Defaults to the average size of the current AMIs, or %d GiB without any.", retention.DEFAULT_SIMULATED_AMI_GIB)
+
+func (c *SimulateCommand) Help() string {
+	return `ec2-snapper simulate <args> [--help]
+
+Simulate a retention policy of the delete command day by day, starting from
+the current AMIs of an instance or from none, and print which AMIs would exist
+at the end of every day, with their count and total volume size. Nothing is
+created or deleted.
+
+Available args are:
+--region      		` + simulateDscrAwsRegion + `
+--instance-id      	` + simulateDscrInstanceId + `
+--instance-name      	` + simulateDscrInstanceName + `
+--older-than    	` + simulateDscrOlderThan + `
+--require-at-least      ` + simulateDscrRequireAtLeast + `
+--days      		` + simulateDscrDays + `
+--interval      	` + simulateDscrInterval + `
+--ami-size      	` + simulateDscrAmiSize + awsArgsHelp()
+}
+
+func (c *SimulateCommand) Synopsis() string {
+	return "Simulate which AMIs a retention policy keeps over time"
+}
+
+// Define the args of the simulate command
+func (c *SimulateCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.AwsRegion, "region", "", simulateDscrAwsRegion)
+	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", simulateDscrInstanceId)
+	cmdFlags.StringVar(&c.InstanceName, "instance-name", "", simulateDscrInstanceName)
+	cmdFlags.StringVar(&c.OlderThan, "older-than", "", simulateDscrOlderThan)
+	cmdFlags.IntVar(&c.RequireAtLeast, "require-at-least", 0, simulateDscrRequireAtLeast)
+	cmdFlags.IntVar(&c.Days, "days", DEFAULT_SIMULATION_DAYS, simulateDscrDays)
+	cmdFlags.StringVar(&c.Interval, "interval", DEFAULT_BACKUP_INTERVAL, simulateDscrInterval)
+	cmdFlags.Int64Var(&c.AmiSize, "ami-size", 0, simulateDscrAmiSize)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *SimulateCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+
+	if err := simulate(ctx, *c); err != nil {
+		err = explainCancellation(ctx, explainAwsError(err))
+		c.Ui.Error(err.Error())
+		return failureExitCode(err)
+	}
+
+	return 0
+}
+
+func simulate(ctx context.Context, c SimulateCommand) error {
+	if err := validateSimulateArgs(c); err != nil {
+		return err
+	}
+
+	olderThanHours, _ := retention.ParseHours(c.OlderThan)
+	intervalHours, _ := retention.ParseHours(c.Interval)
+
+	var images []*ec2.Image
+	if c.InstanceId != "" || c.InstanceName != "" {
+		var err error
+		if images, err = findCurrentImages(ctx, c); err != nil {
+			return err
+		}
+		c.Ui.Output("==> Starting from the " + strconv.Itoa(len(images)) + " current AMI(s) of the instance.")
+	}
+
+	simulation := retention.Simulation{
+		Policy: retention.Policy{OlderThanHours: olderThanHours, RequireAtLeast: c.RequireAtLeast},
+		Start: time.Now(),
+		Days: c.Days,
+		Interval: time.Duration(intervalHours * float64(time.Hour)),
+		NewAmiGiB: c.AmiSize,
+	}
+	if simulation.NewAmiGiB == 0 {
+		simulation.NewAmiGiB = retention.AverageImageSizeGiB(images)
+	}
+
+	days, err := retention.Simulate(images, simulation)
+	if err != nil {
+		return err
+	}
+
+	printSimulatedDays(days, c.Ui)
+	return nil
+}
+
+// Return the AMIs of the instance the way delete finds them
+func findCurrentImages(ctx context.Context, c SimulateCommand) ([]*ec2.Image, error) {
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return nil, err
+	}
+	svc := ec2.New(session)
+
+	instanceId := c.InstanceId
+	if instanceId == "" {
+		if instanceId, err = snapper.FindInstanceIdByName(ctx, c.InstanceName, svc, c.Ui); err != nil {
+			return nil, err
+		}
+	}
+
+	return snapper.FindImages(ctx, instanceId, svc)
+}
+
+func printSimulatedDays(days []retention.Day, ui cli.Ui) {
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "DAY\tAMIS\tGIB\tCREATED\tDELETED\tEXISTING")
+
+	maxAmis := 0
+	var maxGiB int64
+	for _, day := range days {
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%s\t%s\t%s\n", day.Date.Format("2006-01-02"), len(day.Amis), day.GiB, formatSimulatedIds(day.Created), formatSimulatedIds(day.Deleted), formatSimulatedIds(day.Amis))
+		if len(day.Amis) > maxAmis {
+			maxAmis = len(day.Amis)
+		}
+		if day.GiB > maxGiB {
+			maxGiB = day.GiB
+		}
+	}
+	writer.Flush()
+
+	outputResult(ui, "")
+	outputResult(ui, strings.TrimRight(out.String(), "\n"))
+	outputResult(ui, fmt.Sprintf("==> At most %d AMI(s) and %d GiB of volumes on any day.", maxAmis, maxGiB))
+}
+
+func formatSimulatedIds(ids []string) string {
+	if len(ids) == 0 {
+		return "-"
+	}
+	return strings.Join(ids, ",")
+}
+
+// Check for required command-line args
+func validateSimulateArgs(c SimulateCommand) error {
+	if c.InstanceId != "" && c.InstanceName != "" {
+		return errors.New("ERROR: You must specify at most one of '--instance-id' or '--instance-name'.")
+	}
+
+	if c.InstanceId != "" || c.InstanceName != "" {
+		if c.AwsRegion == "" {
+			return errors.New("ERROR: The argument '--region' is required with '--instance-id' or '--instance-name'.")
+		}
+		if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+			return err
+		}
+	}
+
+	if c.OlderThan == "" {
+		return errors.New("ERROR: The argument '--older-than' is required.")
+	}
+
+	if _, err := retention.ParseHours(c.OlderThan); err != nil {
+		return err
+	}
+
+	if _, err := retention.ParseHours(c.Interval); err != nil {
+		return err
+	}
+
+	if c.RequireAtLeast < 0 {
+		return errors.New("ERROR: The argument '--require-at-least' must be a positive integer.")
+	}
+
+	if c.Days <= 0 {
+		return errors.New("ERROR: The argument '--days' must be a positive integer.")
+	}
+
+	if c.AmiSize < 0 {
+		return errors.New("ERROR: The argument '--ami-size' must not be negative.")
+	}
+
+	return validateAwsOptions(c.Aws)
+}
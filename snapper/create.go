@@ -0,0 +1,189 @@
+package snapper
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The format of the timestamp that is appended to the name of every AMI
+const IMAGE_NAME_DATE_LAYOUT = "2006-01-02 at 15_04_05 (MST)"
+
+// How often to check whether a new AMI is available (every 15s, so 1 hour)
+const AMI_AVAILABLE_MAX_ATTEMPTS = 240
+
+// A request to create an AMI of an instance
+type ImageRequest struct {
+	InstanceId string
+	// The name the AMI and its snapshots are tagged with, e.g. the name of the instance
+	AmiName string
+	// The name of the AMI itself, which must be unique. Create defaults it to AmiName with a timestamp.
+	Name     string
+	NoReboot bool
+	DryRun   bool
+	// Tag the snapshots on creation too, rather than only once the AMI is visible, e.g. when the AMI is only an
+	// intermediate that may fail to be copied
+	TagSnapshots bool
+	// Called with the id of the AMI once it was started, to replace it with another AMI, e.g. a copy with encryption.
+	// Returns the id of the AMI that is tagged and returned instead.
+	Replace func(imageId string) (string, error)
+	// Called with the AMI before its snapshots are tagged, e.g. to check that it is encrypted
+	Check func(ami *ec2.Image) error
+	// Called with the id of the AMI once it and its snapshots are tagged, e.g. to wait for it to become available
+	Created func(imageId string) error
+}
+
+// The outcome of creating an AMI
+type ImageCreation struct {
+	ImageId     string
+	Name        string
+	SnapshotIds []string
+}
+
+// Return the name of an AMI created at the given time
+func ImageName(amiName string, now time.Time) string {
+	return amiName + " - " + now.Format(IMAGE_NAME_DATE_LAYOUT)
+}
+
+// The tags of an AMI of the given instance. FindImages finds AMIs by these tags.
+func ImageTags(instanceId string, amiName string) []*ec2.Tag {
+	return []*ec2.Tag{
+		&ec2.Tag{ Key: aws.String(INSTANCE_ID_TAG), Value: aws.String(instanceId) },
+		&ec2.Tag{ Key: aws.String("Name"), Value: aws.String(amiName) },
+	}
+}
+
+// Create an AMI of an instance and tag it and its snapshots, without waiting for it to become available unless the
+// Created hook does. For a dry run, EC2 only checks the permissions to create and tag the AMI, and the returned
+// creation has no ImageId. Once the AMI was started, the returned creation has the id of the AMI even on error.
+//
+// The hooks don't get ctx, since an AMI that was started must still be tagged when the caller is interrupted, while
+// waiting for it need not be. Callers pass a ctx that is only done once they must stop anyway.
+func Create(ctx context.Context, imageRequest ImageRequest, svc *ec2.EC2, logger Logger) (ImageCreation, error) {
+	if imageRequest.Name == "" {
+		imageRequest.Name = ImageName(imageRequest.AmiName, time.Now())
+	}
+	creation := ImageCreation{Name: imageRequest.Name}
+
+	output(logger, "==> Creating AMI for " + imageRequest.InstanceId + "...")
+	imageId, err := StartImage(ctx, imageRequest, svc)
+	if err != nil || imageRequest.DryRun {
+		return creation, err
+	}
+	creation.ImageId = imageId
+
+	if imageRequest.Replace != nil {
+		imageId, err = imageRequest.Replace(imageId)
+		creation.ImageId = imageId
+		if err != nil {
+			return creation, err
+		}
+	}
+
+	image, err := DescribeNewImage(ctx, imageId, svc)
+	if err != nil {
+		return creation, err
+	}
+
+	if imageRequest.Check != nil {
+		if err := imageRequest.Check(image); err != nil {
+			return creation, err
+		}
+	}
+
+	creation.SnapshotIds, err = TagSnapshots(ctx, image, imageRequest.InstanceId, imageRequest.AmiName, svc, logger)
+	if err != nil || imageRequest.Created == nil {
+		return creation, err
+	}
+	return creation, imageRequest.Created(imageId)
+}
+
+// Start creating the requested AMI. Tagging on creation means that a dry run checks that we have permission to tag the
+// AMI too. CreateImage takes no ClientToken, so a retried call creates another AMI; callers guard against that by
+// checking for a recent AMI first. Returns the id of the new AMI, or an empty id for a dry run.
+func StartImage(ctx context.Context, imageRequest ImageRequest, svc *ec2.EC2) (string, error) {
+	tags := ImageTags(imageRequest.InstanceId, imageRequest.AmiName)
+	input := &ec2.CreateImageInput{
+		Name: aws.String(imageRequest.Name),
+		InstanceId: aws.String(imageRequest.InstanceId),
+		DryRun: aws.Bool(imageRequest.DryRun),
+		NoReboot: aws.Bool(imageRequest.NoReboot),
+		TagSpecifications: []*ec2.TagSpecification{
+			&ec2.TagSpecification{ResourceType: aws.String(ec2.ResourceTypeImage), Tags: tags},
+		},
+	}
+	if imageRequest.TagSnapshots {
+		input.TagSpecifications = append(input.TagSpecifications, &ec2.TagSpecification{ResourceType: aws.String(ec2.ResourceTypeSnapshot), Tags: tags})
+	}
+
+	resp, err := svc.CreateImageWithContext(ctx, input)
+	if err := CheckDryRunError(err, imageRequest.DryRun, "ec2:CreateImage and ec2:CreateTags"); err != nil {
+		return "", err
+	}
+
+	if imageRequest.DryRun {
+		return "", nil
+	}
+	return *resp.ImageId, nil
+}
+
+// Return the AMI with the given id that was just created. The AMI may not be visible to other API calls for a few
+// seconds, so we retry until it is found. Returns an error if creating the AMI failed.
+func DescribeNewImage(ctx context.Context, imageId string, svc *ec2.EC2) (*ec2.Image, error) {
+	respDscrImages, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{&imageId},
+	}, WithRetryableErrorCodes("InvalidAMIID.NotFound"))
+	if err != nil {
+		return nil, err
+	}
+
+	// If no AMI at all was found, throw an error
+	if len(respDscrImages.Images) == 0 {
+		return nil, errors.New("ERROR: Could not find the AMI just created.")
+	}
+
+	ami := respDscrImages.Images[0]
+
+	// If the AMI's status is failed throw an error
+	if *ami.State == ec2.ImageStateFailed {
+		return ami, errors.New("ERROR: AMI was created but entered a state of 'failed'. This is an AWS issue. Please re-run this command.  Note that you will need to manually de-register the AMI in the AWS console or via the API.")
+	}
+
+	return ami, nil
+}
+
+// Tag each EBS volume snapshot of the given AMI so we can find them later. Returns the ids of the tagged snapshots.
+func TagSnapshots(ctx context.Context, ami *ec2.Image, instanceId string, amiName string, svc *ec2.EC2, logger Logger) ([]string, error) {
+	var snapshotIds []string
+
+	for _, blockDeviceMapping := range ami.BlockDeviceMappings {
+		if blockDeviceMapping != nil && blockDeviceMapping.Ebs != nil {
+			output(logger, "==> Adding tags to EBS Volume Snapshot " + *blockDeviceMapping.Ebs.SnapshotId + " (" + *blockDeviceMapping.DeviceName + ") of AMI " + *ami.Name + "...")
+			_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+				Resources: []*string{blockDeviceMapping.Ebs.SnapshotId},
+				Tags: []*ec2.Tag{
+					&ec2.Tag{ Key: aws.String(INSTANCE_ID_TAG), Value: aws.String(instanceId) },
+					&ec2.Tag{ Key: aws.String("Name"), Value: aws.String(amiName + "-" + *blockDeviceMapping.DeviceName) },
+				},
+			}, WithRetryableErrorCodes("InvalidSnapshot.NotFound"))
+
+			if err != nil {
+				return snapshotIds, err
+			}
+			snapshotIds = append(snapshotIds, *blockDeviceMapping.Ebs.SnapshotId)
+		}
+	}
+
+	return snapshotIds, nil
+}
+
+// Wait until the given AMI is available, for at most AMI_AVAILABLE_MAX_ATTEMPTS checks or until ctx is done
+func WaitUntilImageAvailable(ctx context.Context, imageId string, svc *ec2.EC2) error {
+	return svc.WaitUntilImageAvailableWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(imageId)},
+	}, request.WithWaiterMaxAttempts(AMI_AVAILABLE_MAX_ATTEMPTS))
+}
@@ -0,0 +1,264 @@
+package snapper
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The description a soft-deleted AMI gets before it is deregistered. ListImagesInRecycleBin returns neither tags nor the
+// instance an AMI was created from, so undelete finds the AMIs of an instance by this description.
+const SOFT_DELETE_DESCRIPTION_FORMAT = "Soft-deleted by ec2-snapper for instance %s at %s"
+
+// The tag that keeps the original description of a soft-deleted AMI, so undelete can restore it. Tags stay on an AMI in
+// the Recycle Bin.
+const ORIGINAL_DESCRIPTION_TAG = "ec2-snapper-original-description"
+
+// The outcome of deleting a single AMI and its snapshots
+type ImageDeletion struct {
+	ImageId          string
+	Name             string
+	Deregistered     bool
+	SnapshotsFound   int
+	SnapshotsDeleted int
+	GiBDeleted       int64
+	Err              error
+}
+
+// Deregister a single AMI and delete its snapshots, which are found among the given snapshots. If a snapshot can't be
+// deleted, we still try to delete the others. With softDelete, the AMI is deprecated first, and the AMI and snapshots
+// end up in the Recycle Bin.
+//
+// DeleteImage doesn't stop between deregistering the AMI and deleting its snapshots on its own, but every call uses
+// ctx, so if ctx is done in between, the snapshots are left behind. To finish an AMI that was started when the caller
+// is interrupted, pass a context that the interrupt doesn't cancel.
+func DeleteImage(ctx context.Context, ami *ec2.Image, snapshots []*ec2.Snapshot, dryRun bool, softDelete bool, svc *ec2.EC2, logger Logger) ImageDeletion {
+	result := ImageDeletion{ImageId: *ami.ImageId, Name: *ami.Name}
+
+	if softDelete {
+		output(logger, *ami.ImageId + ": Deprecating AMI before moving it to the Recycle Bin...")
+		if err := DeprecateImage(ctx, ami, dryRun, svc, time.Now()); err != nil {
+			result.Err = fmt.Errorf("Failed to deprecate AMI: %s", err.Error())
+			return result
+		}
+	}
+
+	// Step 1: De-register the AMI
+	if dryRun {
+		output(logger, *ami.ImageId + ": Would de-register AMI named \"" + *ami.Name + "\"")
+	} else {
+		output(logger, *ami.ImageId + ": De-registering AMI named \"" + *ami.Name + "\"...")
+	}
+	_, err := svc.DeregisterImageWithContext(ctx, &ec2.DeregisterImageInput{
+		DryRun: &dryRun,
+		ImageId: ami.ImageId,
+	})
+	if err := CheckDryRunError(err, dryRun, "ec2:DeregisterImage"); err != nil {
+		// The snapshots are still in use by the AMI, so there is no point in trying to delete them
+		result.Err = fmt.Errorf("Failed to de-register AMI: %s", err.Error())
+
+		// The AMI stays, so it mustn't stay deprecated and described as soft-deleted either
+		if softDelete && !dryRun {
+			output(logger, *ami.ImageId + ": Restoring the description and deprecation of the AMI...")
+			if restoreErr := RestoreDeprecation(ctx, ami, svc, time.Now()); restoreErr != nil {
+				result.Err = fmt.Errorf("%s. Also failed to restore the description and deprecation of the AMI: %s", result.Err.Error(), restoreErr.Error())
+			}
+		}
+		return result
+	}
+	result.Deregistered = true
+
+	// Step 2: Delete the corresponding AMI snapshot
+	// Look at the "description" for each Snapshot to see if it contains our AMI id
+	amiSnapshots := SnapshotsOfImage(*ami.ImageId, snapshots)
+	result.SnapshotsFound = len(amiSnapshots)
+
+	// Delete all snapshots that were found
+	output(logger, *ami.ImageId + ": Found " + strconv.Itoa(len(amiSnapshots)) + " snapshot(s) to delete")
+	var failedSnapshotIds []string
+	var lastErr error
+	for _, snapshot := range amiSnapshots {
+		snapshotId := *snapshot.SnapshotId
+		if dryRun {
+			output(logger, *ami.ImageId + ": Would delete snapshot " + snapshotId)
+		} else {
+			output(logger, *ami.ImageId + ": Deleting snapshot " + snapshotId + "...")
+		}
+		_, deleteErr := svc.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{
+			DryRun: &dryRun,
+			SnapshotId: aws.String(snapshotId),
+		})
+
+		if deleteErr = CheckDryRunError(deleteErr, dryRun, "ec2:DeleteSnapshot"); deleteErr != nil {
+			logError(logger, *ami.ImageId + ": Failed to delete snapshot " + snapshotId + ": " + deleteErr.Error())
+			failedSnapshotIds = append(failedSnapshotIds, snapshotId)
+			lastErr = deleteErr
+		} else {
+			result.SnapshotsDeleted++
+			result.GiBDeleted += aws.Int64Value(snapshot.VolumeSize)
+		}
+	}
+
+	if len(failedSnapshotIds) > 0 {
+		result.Err = fmt.Errorf("Failed to delete snapshot(s) %s: %s", strings.Join(failedSnapshotIds, ", "), lastErr.Error())
+		return result
+	}
+
+	if !dryRun {
+		output(logger, *ami.ImageId + ": Done!")
+	}
+	return result
+}
+
+// Return the number of AMIs that were deleted completely and the number of AMIs for which something failed
+func CountDeletions(results []ImageDeletion) (int, int) {
+	numDeleted := 0
+	numFailed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			numFailed++
+		} else {
+			numDeleted++
+		}
+	}
+	return numDeleted, numFailed
+}
+
+// Return the ids of the AMIs that were deregistered, even if deleting some of their snapshots failed. A dry run
+// deregisters nothing.
+func DeregisteredImageIds(results []ImageDeletion, dryRun bool) []string {
+	var amiIds []string
+	if dryRun {
+		return amiIds
+	}
+	for _, result := range results {
+		if result.Deregistered {
+			amiIds = append(amiIds, result.ImageId)
+		}
+	}
+	return amiIds
+}
+
+// Mark the given AMI as deprecated and record the instance it belongs to in its description before it is deregistered
+// into the Recycle Bin. The original description is kept in a tag. A restored AMI stays deprecated until undelete
+// re-enables it.
+func DeprecateImage(ctx context.Context, ami *ec2.Image, dryRun bool, svc *ec2.EC2, now time.Time) error {
+	// The deprecation time must be in the future and EC2 rounds it to the minute
+	_, err := svc.EnableImageDeprecationWithContext(ctx, &ec2.EnableImageDeprecationInput{
+		ImageId: ami.ImageId,
+		DeprecateAt: aws.Time(now.Add(2 * time.Minute).Truncate(time.Minute)),
+		DryRun: aws.Bool(dryRun),
+	})
+	if err := CheckDryRunError(err, dryRun, "ec2:EnableImageDeprecation"); err != nil {
+		return err
+	}
+
+	_, err = svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{ami.ImageId},
+		Tags: []*ec2.Tag{&ec2.Tag{Key: aws.String(ORIGINAL_DESCRIPTION_TAG), Value: aws.String(aws.StringValue(ami.Description))}},
+		DryRun: aws.Bool(dryRun),
+	})
+	if err := CheckDryRunError(err, dryRun, "ec2:CreateTags"); err != nil {
+		return err
+	}
+
+	_, err = svc.ModifyImageAttributeWithContext(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId: ami.ImageId,
+		Description: &ec2.AttributeValue{Value: aws.String(SoftDeleteDescription(imageTagValue(ami, INSTANCE_ID_TAG), now))},
+		DryRun: aws.Bool(dryRun),
+	})
+	return CheckDryRunError(err, dryRun, "ec2:ModifyImageAttribute")
+}
+
+// Undo DeprecateImage for an AMI that could not be deregistered: restore its original description and deprecation
+// time, or disable its deprecation if it had none. An AMI that was deprecated already stays deprecated.
+func RestoreDeprecation(ctx context.Context, ami *ec2.Image, svc *ec2.EC2, now time.Time) error {
+	_, err := svc.ModifyImageAttributeWithContext(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId: ami.ImageId,
+		Description: &ec2.AttributeValue{Value: aws.String(aws.StringValue(ami.Description))},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := deleteOriginalDescriptionTag(ctx, ami.ImageId, svc); err != nil {
+		return err
+	}
+
+	if aws.StringValue(ami.DeprecationTime) == "" {
+		_, err = svc.DisableImageDeprecationWithContext(ctx, &ec2.DisableImageDeprecationInput{ImageId: ami.ImageId})
+		return err
+	}
+
+	deprecateAt, err := time.Parse(time.RFC3339, aws.StringValue(ami.DeprecationTime))
+	if err != nil || !deprecateAt.After(now) {
+		return err
+	}
+	_, err = svc.EnableImageDeprecationWithContext(ctx, &ec2.EnableImageDeprecationInput{
+		ImageId: ami.ImageId,
+		DeprecateAt: aws.Time(deprecateAt),
+	})
+	return err
+}
+
+// Give an AMI restored from the Recycle Bin back the description it had before it was soft-deleted, and remove the tag
+// that kept it. An AMI without that tag, e.g. one soft-deleted by an older version, keeps its current description.
+func RestoreOriginalDescription(ctx context.Context, imageId string, svc *ec2.EC2) error {
+	output, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: []*string{aws.String(imageId)}})
+	if err != nil {
+		return err
+	}
+	if len(output.Images) == 0 {
+		return fmt.Errorf("AMI %s not found", imageId)
+	}
+
+	ami := output.Images[0]
+	if !hasImageTag(ami, ORIGINAL_DESCRIPTION_TAG) {
+		return nil
+	}
+
+	_, err = svc.ModifyImageAttributeWithContext(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId: ami.ImageId,
+		Description: &ec2.AttributeValue{Value: aws.String(imageTagValue(ami, ORIGINAL_DESCRIPTION_TAG))},
+	})
+	if err != nil {
+		return err
+	}
+
+	return deleteOriginalDescriptionTag(ctx, ami.ImageId, svc)
+}
+
+func deleteOriginalDescriptionTag(ctx context.Context, imageId *string, svc *ec2.EC2) error {
+	_, err := svc.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: []*string{imageId},
+		Tags: []*ec2.Tag{&ec2.Tag{Key: aws.String(ORIGINAL_DESCRIPTION_TAG)}},
+	})
+	return err
+}
+
+func SoftDeleteDescription(instanceId string, now time.Time) string {
+	return fmt.Sprintf(SOFT_DELETE_DESCRIPTION_FORMAT, instanceId, now.UTC().Format(time.RFC3339))
+}
+
+func imageTagValue(ami *ec2.Image, key string) string {
+	for _, tag := range ami.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+func hasImageTag(ami *ec2.Image, key string) bool {
+	for _, tag := range ami.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return true
+		}
+	}
+	return false
+}
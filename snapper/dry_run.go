@@ -0,0 +1,32 @@
+package snapper
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// EC2 never performs a call that has DryRun set. Instead, it checks whether we have the IAM permissions for the call
+// and returns a DryRunOperation error if we do, or an UnauthorizedOperation error if we don't.
+const DRY_RUN_OPERATION_ERROR_CODE = "DryRunOperation"
+const UNAUTHORIZED_OPERATION_ERROR_CODE = "UnauthorizedOperation"
+
+// Interpret the error of a mutating EC2 call that was made with the given DryRun setting. For a dry run, returns nil
+// if the call would have succeeded. For any call, a missing IAM permission for the given action (e.g.
+// "ec2:CreateImage") is reported explicitly. All other errors are returned unchanged.
+func CheckDryRunError(err error, dryRun bool, action string) error {
+	if err == nil {
+		return nil
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		if dryRun && awsErr.Code() == DRY_RUN_OPERATION_ERROR_CODE {
+			return nil
+		}
+		if awsErr.Code() == UNAUTHORIZED_OPERATION_ERROR_CODE {
+			return fmt.Errorf("ERROR: Missing IAM permission %s. %s", action, awsErr.Message())
+		}
+	}
+
+	return err
+}
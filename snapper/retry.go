@@ -0,0 +1,23 @@
+package snapper
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// A request option that makes the given error codes retryable for a single API call. EC2 is eventually consistent, so
+// e.g. an AMI that was just created may be reported as InvalidAMIID.NotFound for a few seconds.
+func WithRetryableErrorCodes(codes ...string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Retry.PushBack(func(r *request.Request) {
+			if awsErr, ok := r.Error.(awserr.Error); ok {
+				for _, code := range codes {
+					if awsErr.Code() == code {
+						r.Retryable = aws.Bool(true)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Package snapper creates, lists and deletes the AMIs ec2-snapper manages. Every AMI it creates, and every snapshot of
+// such an AMI, is tagged with INSTANCE_ID_TAG, which is how the AMIs of an instance are found again.
+//
+// The functions of this package don't print anything. They return their outcome as structured results and report
+// their progress to an optional Logger, which a cli.Ui satisfies. Which AMIs to delete is decided by the retention
+// package.
+//
+// Every function that calls AWS takes a context and stops as soon as it is done, e.g. once a timeout expires.
+package snapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The tag ec2-snapper puts on every AMI and snapshot it creates, with the id of the instance as its value
+const INSTANCE_ID_TAG = "ec2-snapper-instance-id"
+
+// Receives the progress messages of an operation, e.g. a cli.Ui. A nil Logger discards them.
+type Logger interface {
+	Output(message string)
+	Error(message string)
+}
+
+func output(logger Logger, message string) {
+	if logger != nil {
+		logger.Output(message)
+	}
+}
+
+func logError(logger Logger, message string) {
+	if logger != nil {
+		logger.Error(message)
+	}
+}
+
+// Get a list of the existing AMIs that were created for the given EC2 instance
+func FindImages(ctx context.Context, instanceId string, svc *ec2.EC2) ([]*ec2.Image, error) {
+	var noImages []*ec2.Image
+
+	// Get a list of the existing AMIs that were created for the given EC2 instance
+	resp, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name: aws.String(fmt.Sprintf("tag:%s", INSTANCE_ID_TAG)),
+				Values: []*string{&instanceId},
+			},
+		},
+	})
+	if err != nil {
+		return noImages, err
+	}
+
+	return resp.Images, nil
+}
+
+// Get a list of every single snapshot owned by the given AWS account
+// (I wasn't able to find a better way to filter these, but suggestions welcome!)
+func FindSnapshots(ctx context.Context, awsAccountId string, svc *ec2.EC2) ([]*ec2.Snapshot, error) {
+	var noSnapshots []*ec2.Snapshot
+
+	respDscrSnapshots, err := svc.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{&awsAccountId},
+	})
+	if err != nil {
+		return noSnapshots, err
+	}
+
+	return respDscrSnapshots.Snapshots, nil
+}
+
+// Return the snapshots of the given AMI. EC2 puts the id of the AMI in the description of every snapshot CreateImage
+// and CopyImage create for it.
+func SnapshotsOfImage(imageId string, snapshots []*ec2.Snapshot) []*ec2.Snapshot {
+	var amiSnapshots []*ec2.Snapshot
+	for _, snapshot := range snapshots {
+		if strings.Contains(aws.StringValue(snapshot.Description), imageId) {
+			amiSnapshots = append(amiSnapshots, snapshot)
+		}
+	}
+	return amiSnapshots
+}
+
+// Return the id of the only instance with the given Name tag
+func FindInstanceIdByName(ctx context.Context, instanceName string, svc *ec2.EC2, logger Logger) (string, error) {
+	output(logger, fmt.Sprintf("Looking up id for instance named %s", instanceName))
+
+	nameTagFilter := ec2.Filter{
+		Name: aws.String("tag:Name"),
+		Values: []*string{aws.String(instanceName)},
+	}
+
+	result, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{Filters: []*ec2.Filter{&nameTagFilter}})
+	if err != nil {
+		return "", err
+	}
+
+	if len(result.Reservations) != 1 {
+		return "", errors.New(fmt.Sprintf("Expected to find one result for instance name %s, but found %d", instanceName, len(result.Reservations)))
+	}
+
+	reservation := result.Reservations[0]
+
+	if len(reservation.Instances) != 1 {
+		return "", errors.New(fmt.Sprintf("Expected to find one instance with instance name %s, but found %d", instanceName, len(reservation.Instances)))
+	}
+
+	instance := reservation.Instances[0]
+	output(logger, fmt.Sprintf("Found id %s for instance named %s", *instance.InstanceId, instanceName))
+
+	return *instance.InstanceId, nil
+}
+
+func CheckInstanceExists(ctx context.Context, instanceId string, svc *ec2.EC2) error {
+	result, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(instanceId)}})
+	if err != nil {
+		return err
+	}
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return fmt.Errorf("Could not find an instance with id %s", instanceId)
+	}
+	return nil
+}
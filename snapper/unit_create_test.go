@@ -0,0 +1,133 @@
+package snapper
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestCreateTagsImageAndSnapshots(t *testing.T) {
+	t.Parallel()
+
+	svc, calls := newFakeEc2(respondWithImages("ami-1"))
+
+	creation, err := Create(context.Background(), ImageRequest{InstanceId: "i-1", AmiName: "web-1", Name: "web-1 - now"}, svc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ImageCreation{ImageId: "ami-1", Name: "web-1 - now", SnapshotIds: []string{"snap-ami-1"}}
+	if !reflect.DeepEqual(creation, expected) {
+		t.Fatalf("Expected %+v, but got %+v", expected, creation)
+	}
+	if operations := calls.operations(); !reflect.DeepEqual(operations, []string{"CreateImage", "DescribeImages", "CreateTags"}) {
+		t.Fatalf("Unexpected calls %v", operations)
+	}
+	if len(calls.params[0].(*ec2.CreateImageInput).TagSpecifications) != 1 {
+		t.Fatalf("Expected only the AMI to be tagged on creation")
+	}
+}
+
+func TestCreateTagsReplacementImage(t *testing.T) {
+	t.Parallel()
+
+	svc, calls := newFakeEc2(respondWithImages("ami-1"))
+
+	var created string
+	imageRequest := ImageRequest{
+		InstanceId: "i-1",
+		AmiName: "web-1",
+		TagSnapshots: true,
+		Replace: func(imageId string) (string, error) { return "ami-2", nil },
+		Created: func(imageId string) error { created = imageId; return nil },
+	}
+
+	creation, err := Create(context.Background(), imageRequest, svc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if creation.ImageId != "ami-2" || created != "ami-2" {
+		t.Fatalf("Expected the replacement AMI ami-2, but got %s and %s", creation.ImageId, created)
+	}
+	if !reflect.DeepEqual(creation.SnapshotIds, []string{"snap-ami-2"}) {
+		t.Fatalf("Expected the snapshots of ami-2 to be tagged, but got %v", creation.SnapshotIds)
+	}
+	if len(calls.params[0].(*ec2.CreateImageInput).TagSpecifications) != 2 {
+		t.Fatalf("Expected the snapshots to be tagged on creation too")
+	}
+	if imageId := *calls.params[1].(*ec2.DescribeImagesInput).ImageIds[0]; imageId != "ami-2" {
+		t.Fatalf("Expected the replacement AMI to be described, but got %s", imageId)
+	}
+}
+
+func TestCreateStopsWhenCheckFails(t *testing.T) {
+	t.Parallel()
+
+	svc, calls := newFakeEc2(respondWithImages("ami-1"))
+
+	imageRequest := ImageRequest{
+		InstanceId: "i-1",
+		AmiName: "web-1",
+		Check: func(ami *ec2.Image) error { return errors.New("not encrypted") },
+		Created: func(imageId string) error { t.Fatal("Expected Created not to be called"); return nil },
+	}
+
+	creation, err := Create(context.Background(), imageRequest, svc, nil)
+	if err == nil || creation.ImageId != "ami-1" {
+		t.Fatalf("Expected an error for ami-1, but got %v for %s", err, creation.ImageId)
+	}
+	if operations := calls.operations(); !reflect.DeepEqual(operations, []string{"CreateImage", "DescribeImages"}) {
+		t.Fatalf("Unexpected calls %v", operations)
+	}
+}
+
+func TestCreateDryRunOnlyStartsImage(t *testing.T) {
+	t.Parallel()
+
+	svc, calls := newFakeEc2(func(r *request.Request) {
+		r.Error = awserr.New(DRY_RUN_OPERATION_ERROR_CODE, "Request would have succeeded", nil)
+	})
+
+	imageRequest := ImageRequest{
+		InstanceId: "i-1",
+		AmiName: "web-1",
+		DryRun: true,
+		Replace: func(imageId string) (string, error) { t.Fatal("Expected Replace not to be called"); return "", nil },
+	}
+
+	creation, err := Create(context.Background(), imageRequest, svc, nil)
+	if err != nil || creation.ImageId != "" {
+		t.Fatalf("Expected a dry run without an AMI, but got %v for %s", err, creation.ImageId)
+	}
+	if operations := calls.operations(); !reflect.DeepEqual(operations, []string{"CreateImage"}) {
+		t.Fatalf("Unexpected calls %v", operations)
+	}
+}
+
+// Respond to CreateImage with the given id, and to DescribeImages with an available AMI that has one snapshot
+func respondWithImages(imageId string) func(r *request.Request) {
+	return func(r *request.Request) {
+		switch data := r.Data.(type) {
+		case *ec2.CreateImageOutput:
+			data.ImageId = aws.String(imageId)
+		case *ec2.DescribeImagesOutput:
+			describedId := *r.Params.(*ec2.DescribeImagesInput).ImageIds[0]
+			data.Images = []*ec2.Image{&ec2.Image{
+				ImageId: aws.String(describedId),
+				Name: aws.String("web-1"),
+				State: aws.String(ec2.ImageStateAvailable),
+				BlockDeviceMappings: []*ec2.BlockDeviceMapping{&ec2.BlockDeviceMapping{
+					DeviceName: aws.String("/dev/sda1"),
+					Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-" + describedId)},
+				}},
+			}}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package snapper
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestCountDeletions(t *testing.T) {
+	t.Parallel()
+
+	results := []ImageDeletion{
+		ImageDeletion{ImageId: "ami-1", Deregistered: true},
+		ImageDeletion{ImageId: "ami-2", Deregistered: true, Err: errors.New("snapshot in use")},
+		ImageDeletion{ImageId: "ami-3", Deregistered: true},
+	}
+
+	numDeleted, numFailed := CountDeletions(results)
+	if numDeleted != 2 || numFailed != 1 {
+		t.Fatalf("Expected 2 deleted and 1 failed AMI, but got %d deleted and %d failed", numDeleted, numFailed)
+	}
+}
+
+func TestSoftDeleteDescription(t *testing.T) {
+	t.Parallel()
+
+	description := SoftDeleteDescription("i-1", time.Date(2026, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600)))
+	if description != "Soft-deleted by ec2-snapper for instance i-1 at 2026-01-01T11:00:00Z" {
+		t.Fatalf("Unexpected description: %s", description)
+	}
+}
+
+func TestImageNameHasTimestamp(t *testing.T) {
+	t.Parallel()
+
+	name := ImageName("web-1", time.Date(2026, 1, 1, 12, 30, 15, 0, time.UTC))
+	if name != "web-1 - 2026-01-01 at 12_30_15 (UTC)" {
+		t.Fatalf("Unexpected name: %s", name)
+	}
+}
+
+func TestDeleteImageRestoresDeprecationWhenDeregisterFails(t *testing.T) {
+	t.Parallel()
+
+	svc, calls := newFakeEc2(func(r *request.Request) {
+		if r.Operation.Name == "DeregisterImage" {
+			r.Error = awserr.New("InvalidAMIID.Unavailable", "The AMI is in use", nil)
+		}
+	})
+
+	ami := &ec2.Image{ImageId: aws.String("ami-1"), Name: aws.String("web-1"), Description: aws.String("Nightly backup")}
+	result := DeleteImage(context.Background(), ami, nil, false, true, svc, nil)
+
+	if result.Err == nil || result.Deregistered {
+		t.Fatalf("Expected the AMI not to be deregistered, but got %+v", result)
+	}
+
+	expected := []string{"EnableImageDeprecation", "CreateTags", "ModifyImageAttribute", "DeregisterImage", "ModifyImageAttribute", "DeleteTags", "DisableImageDeprecation"}
+	if !reflect.DeepEqual(calls.operations(), expected) {
+		t.Fatalf("Expected the calls %v, but got %v", expected, calls.operations())
+	}
+	if tag := calls.params[1].(*ec2.CreateTagsInput).Tags[0]; *tag.Key != ORIGINAL_DESCRIPTION_TAG || *tag.Value != "Nightly backup" {
+		t.Fatalf("Expected the original description to be kept in a tag, but got %s=%s", *tag.Key, *tag.Value)
+	}
+	if description := calls.params[4].(*ec2.ModifyImageAttributeInput).Description.Value; *description != "Nightly backup" {
+		t.Fatalf("Expected the original description to be restored, but got %s", *description)
+	}
+}
+
+func TestRestoreOriginalDescriptionFromTag(t *testing.T) {
+	t.Parallel()
+
+	svc, calls := newFakeEc2(func(r *request.Request) {
+		if data, ok := r.Data.(*ec2.DescribeImagesOutput); ok {
+			data.Images = []*ec2.Image{&ec2.Image{
+				ImageId: aws.String("ami-1"),
+				Description: aws.String(SoftDeleteDescription("i-1", time.Now())),
+				Tags: []*ec2.Tag{&ec2.Tag{Key: aws.String(ORIGINAL_DESCRIPTION_TAG), Value: aws.String("Nightly backup")}},
+			}}
+		}
+	})
+
+	if err := RestoreOriginalDescription(context.Background(), "ami-1", svc); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(calls.operations(), []string{"DescribeImages", "ModifyImageAttribute", "DeleteTags"}) {
+		t.Fatalf("Unexpected calls %v", calls.operations())
+	}
+	if description := calls.params[1].(*ec2.ModifyImageAttributeInput).Description.Value; *description != "Nightly backup" {
+		t.Fatalf("Expected the original description to be restored, but got %s", *description)
+	}
+	if key := calls.params[2].(*ec2.DeleteTagsInput).Tags[0].Key; *key != ORIGINAL_DESCRIPTION_TAG {
+		t.Fatalf("Expected the tag with the original description to be removed, but got %s", *key)
+	}
+}
+
+func TestRestoreOriginalDescriptionWithoutTag(t *testing.T) {
+	t.Parallel()
+
+	svc, calls := newFakeEc2(func(r *request.Request) {
+		if data, ok := r.Data.(*ec2.DescribeImagesOutput); ok {
+			data.Images = []*ec2.Image{&ec2.Image{ImageId: aws.String("ami-1")}}
+		}
+	})
+
+	if err := RestoreOriginalDescription(context.Background(), "ami-1", svc); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(calls.operations(), []string{"DescribeImages"}) {
+		t.Fatalf("Expected the description to be left alone, but got the calls %v", calls.operations())
+	}
+}
+
+func TestRestoreDeprecationKeepsOriginalDeprecationTime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	svc, calls := newFakeEc2(nil)
+
+	ami := &ec2.Image{ImageId: aws.String("ami-1"), DeprecationTime: aws.String("2026-06-01T00:00:00.000Z")}
+	if err := RestoreDeprecation(context.Background(), ami, svc, now); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(calls.operations(), []string{"ModifyImageAttribute", "DeleteTags", "EnableImageDeprecation"}) {
+		t.Fatalf("Expected the original deprecation time to be enabled again, but got the calls %v", calls.operations())
+	}
+	if deprecateAt := calls.params[2].(*ec2.EnableImageDeprecationInput).DeprecateAt; !deprecateAt.Equal(time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the original deprecation time, but got %s", deprecateAt)
+	}
+}
+
+// The calls a fake EC2 client received, in order
+type fakeEc2Calls struct {
+	mutex  sync.Mutex
+	names  []string
+	params []interface{}
+}
+
+func (c *fakeEc2Calls) operations() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.names...)
+}
+
+// Return an EC2 client that sends no requests, but records every call and lets respond fill in the output or error.
+// A nil respond makes every call succeed with an empty output.
+func newFakeEc2(respond func(r *request.Request)) (*ec2.EC2, *fakeEc2Calls) {
+	calls := &fakeEc2Calls{}
+	svc := ec2.New(session.Must(session.NewSession(&aws.Config{
+		Region: aws.String("us-east-1"),
+		Credentials: credentials.AnonymousCredentials,
+		MaxRetries: aws.Int(0),
+	})))
+
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Unmarshal.Clear()
+	svc.Handlers.UnmarshalMeta.Clear()
+	svc.Handlers.UnmarshalError.Clear()
+	svc.Handlers.ValidateResponse.Clear()
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		calls.mutex.Lock()
+		calls.names = append(calls.names, r.Operation.Name)
+		calls.params = append(calls.params, r.Params)
+		calls.mutex.Unlock()
+
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}
+		if respond != nil {
+			respond(r)
+		}
+	})
+	return svc, calls
+}
@@ -0,0 +1,46 @@
+package snapper
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestCheckDryRunErrorDryRunOperationIsSuccess(t *testing.T) {
+	t.Parallel()
+
+	err := awserr.New(DRY_RUN_OPERATION_ERROR_CODE, "Request would have succeeded, but DryRun flag is set.", nil)
+	if checkedErr := CheckDryRunError(err, true, "ec2:DeregisterImage"); checkedErr != nil {
+		t.Fatalf("Expected a DryRunOperation error of a dry run to be a success, but got %s", checkedErr.Error())
+	}
+}
+
+func TestCheckDryRunErrorDryRunOperationOfRealCallIsError(t *testing.T) {
+	t.Parallel()
+
+	err := awserr.New(DRY_RUN_OPERATION_ERROR_CODE, "Request would have succeeded, but DryRun flag is set.", nil)
+	if checkedErr := CheckDryRunError(err, false, "ec2:DeregisterImage"); checkedErr == nil {
+		t.Fatal("Expected a DryRunOperation error of a real call to be an error, but got nil")
+	}
+}
+
+func TestCheckDryRunErrorReportsMissingPermission(t *testing.T) {
+	t.Parallel()
+
+	err := awserr.New(UNAUTHORIZED_OPERATION_ERROR_CODE, "You are not authorized to perform this operation.", nil)
+	checkedErr := CheckDryRunError(err, true, "ec2:DeleteSnapshot")
+	if checkedErr == nil || !strings.Contains(checkedErr.Error(), "ec2:DeleteSnapshot") {
+		t.Fatalf("Expected an error naming the missing permission, but got %v", checkedErr)
+	}
+}
+
+func TestCheckDryRunErrorPassesThroughOtherErrors(t *testing.T) {
+	t.Parallel()
+
+	err := errors.New("some other error")
+	if checkedErr := CheckDryRunError(err, true, "ec2:CreateImage"); checkedErr != err {
+		t.Fatalf("Expected other errors to be returned unchanged, but got %v", checkedErr)
+	}
+}
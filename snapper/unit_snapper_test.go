@@ -0,0 +1,31 @@
+package snapper
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestSnapshotsOfImage(t *testing.T) {
+	t.Parallel()
+
+	snapshots := []*ec2.Snapshot{
+		createTestSnapshot("snap-1", "Created by CreateImage(i-1) for ami-1 from vol-1"),
+		createTestSnapshot("snap-2", "Created by CreateImage(i-1) for ami-2 from vol-1"),
+		&ec2.Snapshot{SnapshotId: aws.String("snap-3")},
+	}
+
+	amiSnapshots := SnapshotsOfImage("ami-1", snapshots)
+	if len(amiSnapshots) != 1 || *amiSnapshots[0].SnapshotId != "snap-1" {
+		t.Fatalf("Expected only snap-1, but got %v", amiSnapshots)
+	}
+}
+
+func createTestSnapshot(snapshotId string, description string) *ec2.Snapshot {
+	return &ec2.Snapshot{
+		SnapshotId: aws.String(snapshotId),
+		Description: aws.String(description),
+		State: aws.String(ec2.SnapshotStateCompleted),
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+type SnapshotCommand struct {
+	Ui                cli.Ui
+	AwsRegion         string
+	InstanceId        string
+	InstanceName      string
+	SnapshotName      string
+	ExcludeBootVolume bool
+	DryRun            bool
+	Aws               AwsOptions
+}
+
+const EC2_SNAPPER_DEVICE_NAME_TAG = "ec2-snapper-device-name"
+const EC2_SNAPPER_BATCH_ID_TAG = "ec2-snapper-batch-id"
+
+// descriptions for args
+var snapshotDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
+var snapshotDscrInstanceId = "The id of the instance whose EBS volumes should be snapshotted"
+var snapshotDscrInstanceName = "The name (from tags) of the instance whose EBS volumes should be snapshotted"
+var snapshotDscrSnapshotName = "The name of the snapshot set; the current timestamp will be automatically appended"
+var snapshotDscrExcludeBootVolume = "If true, do not snapshot the root (boot) volume of the instance"
+var snapshotDscrDryRun = "Execute a simulated run"
+
+func (c *SnapshotCommand) Help() string {
+	return `ec2-snapper snapshot <args> [--help]
+
+Create a crash-consistent set of EBS snapshots of all the volumes attached to
+the given EC2 instance, without creating an AMI.
+
+Available args are:
+--region      		` + snapshotDscrAwsRegion + `
+--instance-id   	` + snapshotDscrInstanceId + `
+--instance-name 	` + snapshotDscrInstanceName + `
+--snapshot-name 	` + snapshotDscrSnapshotName + `
+--exclude-boot-volume	` + snapshotDscrExcludeBootVolume + `
+--dry-run       	` + snapshotDscrDryRun + awsArgsHelp()
+}
+
+func (c *SnapshotCommand) Synopsis() string {
+	return "Create EBS snapshots of the given EC2 instance without an AMI"
+}
+
+// Define the args of the snapshot command
+func (c *SnapshotCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.AwsRegion, "region", "", snapshotDscrAwsRegion)
+	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", snapshotDscrInstanceId)
+	cmdFlags.StringVar(&c.InstanceName, "instance-name", "", snapshotDscrInstanceName)
+	cmdFlags.StringVar(&c.SnapshotName, "snapshot-name", "", snapshotDscrSnapshotName)
+	cmdFlags.BoolVar(&c.ExcludeBootVolume, "exclude-boot-volume", false, snapshotDscrExcludeBootVolume)
+	cmdFlags.BoolVar(&c.DryRun, "dry-run", false, snapshotDscrDryRun)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *SnapshotCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+
+	if _, err := snapshot(ctx, *c); err != nil {
+		err = explainCancellation(ctx, explainAwsError(err))
+		c.Ui.Error(err.Error())
+		return failureExitCode(err)
+	}
+
+	return 0
+}
+
+// Snapshot all the EBS volumes of an instance in a single multi-volume CreateSnapshots call and return the batch id
+// that was used to tag every snapshot in the set. Once CreateSnapshots was called, the snapshots are tagged even if the
+// command is interrupted.
+func snapshot(ctx context.Context, c SnapshotCommand) (string, error) {
+	batchId := ""
+
+	if err := validateSnapshotArgs(c); err != nil {
+		return batchId, err
+	}
+
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return batchId, err
+	}
+	svc := ec2.New(session)
+
+	if c.InstanceId == "" {
+		instanceId, err := snapper.FindInstanceIdByName(ctx, c.InstanceName, svc, c.Ui)
+		if err != nil {
+			return batchId, err
+		}
+		c.InstanceId = instanceId
+	}
+
+	// We need the block device mappings of the instance to know which device each snapshotted volume was attached as
+	result, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(c.InstanceId)}})
+	if err != nil {
+		return batchId, err
+	}
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return batchId, fmt.Errorf("Could not find an instance with id %s", c.InstanceId)
+	}
+
+	deviceNames := map[string]string{}
+	for _, blockDeviceMapping := range result.Reservations[0].Instances[0].BlockDeviceMappings {
+		if blockDeviceMapping != nil && blockDeviceMapping.Ebs != nil {
+			deviceNames[*blockDeviceMapping.Ebs.VolumeId] = *blockDeviceMapping.DeviceName
+		}
+	}
+
+	// Generate a nicely formatted timestamp for right now
+	const dateLayoutForSnapshotName = "2006-01-02 at 15_04_05 (MST)"
+	const dateLayoutForBatchId = "20060102T150405Z"
+	t := time.Now()
+
+	name := c.SnapshotName + " - " + t.Format(dateLayoutForSnapshotName)
+	batchId = t.UTC().Format(dateLayoutForBatchId) + "-" + UniqueId()
+
+	if err := cancellationError(ctx); err != nil {
+		return batchId, err
+	}
+
+	c.Ui.Output("==> Creating EBS snapshots for " + c.InstanceId + " with batch id " + batchId + "...")
+
+	// Tagging as part of the CreateSnapshots call guarantees that every snapshot in the set can be found later, even
+	// if one of the per-device CreateTags calls below fails
+	resp, err := svc.CreateSnapshotsWithContext(uninterruptible(ctx), &ec2.CreateSnapshotsInput{
+		Description: &name,
+		DryRun: &c.DryRun,
+		InstanceSpecification: &ec2.InstanceSpecification{
+			InstanceId: &c.InstanceId,
+			ExcludeBootVolume: &c.ExcludeBootVolume,
+		},
+		TagSpecifications: []*ec2.TagSpecification{
+			&ec2.TagSpecification{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags: []*ec2.Tag{
+					&ec2.Tag{ Key: aws.String(snapper.INSTANCE_ID_TAG), Value: &c.InstanceId },
+					&ec2.Tag{ Key: aws.String(EC2_SNAPPER_BATCH_ID_TAG), Value: &batchId },
+					&ec2.Tag{ Key: aws.String("Name"), Value: &c.SnapshotName },
+				},
+			},
+		},
+	})
+	if err := snapper.CheckDryRunError(err, c.DryRun, "ec2:CreateSnapshots and ec2:CreateTags"); err != nil {
+		return batchId, err
+	}
+
+	if c.DryRun {
+		c.Ui.Info("==> DRY RUN. Would create EBS snapshots named \"" + name + "\" of the volumes of instance " + c.InstanceId + " in batch " + batchId + ".")
+		return batchId, nil
+	}
+
+	// Tag each snapshot with the device it was attached as so individual volumes can be restored
+	for _, snapshotInfo := range resp.Snapshots {
+		deviceName, ok := deviceNames[*snapshotInfo.VolumeId]
+		if !ok {
+			c.Ui.Warn("WARNING: Could not find the device name of volume " + *snapshotInfo.VolumeId + " for snapshot " + *snapshotInfo.SnapshotId + ".")
+			continue
+		}
+
+		c.Ui.Output("==> Adding tags to EBS Volume Snapshot " + *snapshotInfo.SnapshotId + " (" + deviceName + ")...")
+		_, err := svc.CreateTagsWithContext(uninterruptible(ctx), &ec2.CreateTagsInput{
+			Resources: []*string{snapshotInfo.SnapshotId},
+			Tags: []*ec2.Tag{
+				&ec2.Tag{ Key: aws.String(EC2_SNAPPER_DEVICE_NAME_TAG), Value: aws.String(deviceName) },
+				&ec2.Tag{ Key: aws.String("Name"), Value: aws.String(c.SnapshotName + "-" + deviceName) },
+			},
+		}, snapper.WithRetryableErrorCodes("InvalidSnapshot.NotFound"))
+
+		if err != nil {
+			return batchId, err
+		}
+	}
+
+	// Announce success
+	c.Ui.Info("==> Success! Created " + strconv.Itoa(len(resp.Snapshots)) + " EBS snapshot(s) in batch " + batchId + " named \"" + name + "\"")
+	return batchId, nil
+}
+
+func validateSnapshotArgs(c SnapshotCommand) error {
+	if c.AwsRegion == "" {
+		return errors.New("ERROR: The argument '--region' is required.")
+	}
+
+	if (c.InstanceId == "" && c.InstanceName == "") || (c.InstanceId != "" && c.InstanceName != "") {
+		return errors.New("ERROR: You must specify exactly one of '--instance-id' or '--instance-name'.")
+	}
+
+	if c.SnapshotName == "" {
+		return errors.New("ERROR: The argument '--snapshot-name' is required.")
+	}
+
+	if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+		return err
+	}
+
+	return validateAwsOptions(c.Aws)
+}
+
+// A set of EBS snapshots that were created together by a single run of the snapshot command
+type snapshotSet struct {
+	BatchId   string
+	StartTime time.Time
+	Snapshots []*ec2.Snapshot
+}
+
+// Get the standalone snapshot sets that were created for the given EC2 instance, sorted from oldest to newest
+func findSnapshotSets(ctx context.Context, instanceId string, svc *ec2.EC2) ([]*snapshotSet, error) {
+	var snapshots []*ec2.Snapshot
+
+	// Only snapshots with a batch id tag were created by the snapshot command. Snapshots that back an AMI carry the
+	// instance id tag too, but they must only be deleted together with their AMI.
+	err := svc.DescribeSnapshotsPagesWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name: aws.String(fmt.Sprintf("tag:%s", snapper.INSTANCE_ID_TAG)),
+				Values: []*string{&instanceId},
+			},
+			&ec2.Filter{
+				Name: aws.String("tag-key"),
+				Values: []*string{aws.String(EC2_SNAPPER_BATCH_ID_TAG)},
+			},
+		},
+	}, func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		snapshots = append(snapshots, page.Snapshots...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groupSnapshotsIntoSets(snapshots), nil
+}
+
+// Group the given snapshots by their batch id tag. The start time of a set is the start time of its oldest snapshot.
+func groupSnapshotsIntoSets(snapshots []*ec2.Snapshot) []*snapshotSet {
+	var sets []*snapshotSet
+	setsByBatchId := map[string]*snapshotSet{}
+
+	for _, snapshot := range snapshots {
+		batchId := getTagValue(snapshot.Tags, EC2_SNAPPER_BATCH_ID_TAG)
+		if batchId == "" {
+			continue
+		}
+
+		set, ok := setsByBatchId[batchId]
+		if !ok {
+			set = &snapshotSet{BatchId: batchId, StartTime: *snapshot.StartTime}
+			setsByBatchId[batchId] = set
+			sets = append(sets, set)
+		}
+
+		if snapshot.StartTime.Before(set.StartTime) {
+			set.StartTime = *snapshot.StartTime
+		}
+		set.Snapshots = append(set.Snapshots, snapshot)
+	}
+
+	sort.Slice(sets, func(i, j int) bool { return sets[i].StartTime.Before(sets[j].StartTime) })
+
+	return sets
+}
+
+// Filter the snapshot sets to only include those older than the given number of hours
+func filterSnapshotSetsByDateRange(sets []*snapshotSet, olderThanHours float64) []*snapshotSet {
+	var filteredSets []*snapshotSet
+
+	now := time.Now()
+	for _, set := range sets {
+		if now.Sub(set.StartTime).Hours() > olderThanHours {
+			filteredSets = append(filteredSets, set)
+		}
+	}
+
+	return filteredSets
+}
+
+// Return the value of the tag with the given key, or an empty string if there is no such tag
+func getTagValue(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if tag != nil && tag.Key != nil && *tag.Key == key && tag.Value != nil {
+			return *tag.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/mitchellh/cli"
+)
+
+// An AWS account and region to run a command in
+type awsTarget struct {
+	Region string
+	// The role to assume in the account, or empty to use the credentials ec2-snapper runs with
+	RoleArn string
+}
+
+func (t awsTarget) String() string {
+	account := "current account"
+	if matches := roleArnRegex.FindStringSubmatch(t.RoleArn); matches != nil {
+		account = "account " + matches[1]
+	} else if t.RoleArn != "" {
+		account = t.RoleArn
+	}
+	return account + " / " + t.Region
+}
+
+var roleArnRegex = regexp.MustCompile(`^arn:[^:]+:iam::([0-9]+):role/.+$`)
+
+// descriptions for args
+var targetDscrOrganizationalUnit = "The id of an AWS Organizations OU (e.g. ou-ab12-cd34ef56). Runs in every active account in it and its child OUs by assuming '--role-name' in each. Requires credentials of the management account."
+var targetDscrRoleName = "The name of the role to assume in every account of '--organizational-unit'."
+
+// The help text for the target args
+func targetArgsHelp() string {
+	return `
+--organizational-unit	` + targetDscrOrganizationalUnit + `
+--role-name      	` + targetDscrRoleName
+}
+
+// Add the args that make a command run in every account of an OU. Only create and delete fan out across accounts.
+func addTargetFlags(cmdFlags *flag.FlagSet, options *AwsOptions) {
+	cmdFlags.StringVar(&options.OrganizationalUnit, "organizational-unit", "", targetDscrOrganizationalUnit)
+	cmdFlags.StringVar(&options.RoleName, "role-name", "", targetDscrRoleName)
+}
+
+func validateTargetOptions(options AwsOptions) error {
+	if (options.OrganizationalUnit == "") != (options.RoleName == "") {
+		return errors.New("ERROR: The arguments '--organizational-unit' and '--role-name' must be used together.")
+	}
+	return nil
+}
+
+// Commands that don't fan out across accounts and regions only accept a single region and role, which is checked here
+func validateSingleTarget(region string, options AwsOptions) error {
+	if len(splitList(region)) > 1 {
+		return errors.New("ERROR: This command only accepts a single '--region'.")
+	}
+	if len(splitList(options.RoleArn)) > 1 {
+		return errors.New("ERROR: This command only accepts a single '--role-arn'.")
+	}
+	return nil
+}
+
+// Return every combination of account and region to run in: the comma-separated regions times the comma-separated role
+// ARNs plus the accounts of the organizational unit. Without any role, the only account is the current one.
+func resolveTargets(ctx context.Context, regions string, options AwsOptions, sessions *awsSessions, ui cli.Ui) ([]awsTarget, error) {
+	regionList := splitList(regions)
+	roleArns := splitList(options.RoleArn)
+
+	if options.OrganizationalUnit != "" {
+		// Listing the accounts of the organization needs the credentials of the management account itself
+		managementOptions := options
+		managementOptions.RoleArn = ""
+
+		session, err := sessions.get(regionList[0], managementOptions, ui)
+		if err != nil {
+			return nil, err
+		}
+
+		accountIds, err := findAccountsInOrganizationalUnit(ctx, options.OrganizationalUnit, organizations.New(session))
+		if err != nil {
+			return nil, err
+		}
+		ui.Output(fmt.Sprintf("==> Found %d active account(s) in %s", len(accountIds), options.OrganizationalUnit))
+
+		partition := "aws"
+		if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), regionList[0]); ok {
+			partition = p.ID()
+		}
+		for _, accountId := range accountIds {
+			roleArns = append(roleArns, fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, accountId, options.RoleName))
+		}
+	}
+
+	if len(roleArns) == 0 {
+		roleArns = []string{""}
+	}
+
+	var targets []awsTarget
+	for _, roleArn := range roleArns {
+		for _, region := range regionList {
+			targets = append(targets, awsTarget{Region: region, RoleArn: roleArn})
+		}
+	}
+	return targets, nil
+}
+
+// Return the ids of the active accounts in the given OU and, recursively, in its child OUs
+func findAccountsInOrganizationalUnit(ctx context.Context, ouId string, svc *organizations.Organizations) ([]string, error) {
+	var accountIds []string
+
+	err := svc.ListAccountsForParentPagesWithContext(ctx, &organizations.ListAccountsForParentInput{ParentId: aws.String(ouId)},
+		func(page *organizations.ListAccountsForParentOutput, lastPage bool) bool {
+			for _, account := range page.Accounts {
+				if *account.Status == organizations.AccountStatusActive {
+					accountIds = append(accountIds, *account.Id)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var childOuIds []string
+	err = svc.ListOrganizationalUnitsForParentPagesWithContext(ctx, &organizations.ListOrganizationalUnitsForParentInput{ParentId: aws.String(ouId)},
+		func(page *organizations.ListOrganizationalUnitsForParentOutput, lastPage bool) bool {
+			for _, ou := range page.OrganizationalUnits {
+				childOuIds = append(childOuIds, *ou.Id)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, childOuId := range childOuIds {
+		childAccountIds, err := findAccountsInOrganizationalUnit(ctx, childOuId, svc)
+		if err != nil {
+			return nil, err
+		}
+		accountIds = append(accountIds, childAccountIds...)
+	}
+
+	return accountIds, nil
+}
+
+// Call fn for every target, one after the other so the output stays grouped by account and region, and return all
+// the results tagged with the target they belong to
+func forEachTarget(targets []awsTarget, ui cli.Ui, fn func(target awsTarget) []instanceResult) []instanceResult {
+	var results []instanceResult
+
+	for _, target := range targets {
+		if len(targets) > 1 {
+			ui.Output("")
+			ui.Info("==> Running in " + target.String())
+		}
+
+		for _, result := range fn(target) {
+			result.Target = target
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
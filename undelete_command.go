@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+type UndeleteCommand struct {
+	Ui            cli.Ui
+	AwsRegion     string
+	InstanceId    string
+	DeletedAfter  string
+	DeletedBefore string
+	DryRun        bool
+	Aws           AwsOptions
+}
+
+// descriptions for args
+var undeleteDscrAwsRegion = "The AWS region to use (e.g. us-west-2)"
+var undeleteDscrInstanceId = "The id of the EC2 instance whose soft-deleted AMIs to restore. The instance may since have been terminated."
+var undeleteDscrDeletedAfter = "Only restore AMIs deleted at or after this time, in RFC 3339 format (e.g. 2016-09-14T08:00:00Z) or as seconds since the Unix epoch."
+var undeleteDscrDeletedBefore = "Only restore AMIs deleted before this time, in the same format as '--deleted-after'."
+var undeleteDscrDryRun = "Execute a simulated run. Lists the AMIs and snapshots that would be restored and checks that you have permission to restore them, but does not restore them."
+
+func (c *UndeleteCommand) Help() string {
+	return `ec2-snapper undelete <args> [--help]
+
+Restore the AMIs of the given instance that 'delete --soft-delete' moved to the
+Recycle Bin, together with their snapshots. Restored AMIs are no longer
+deprecated and get their original description back.
+
+Available args are:
+--region      		` + undeleteDscrAwsRegion + `
+--instance-id      	` + undeleteDscrInstanceId + `
+--deleted-after      	` + undeleteDscrDeletedAfter + `
+--deleted-before      	` + undeleteDscrDeletedBefore + `
+--dry-run       	` + undeleteDscrDryRun + awsArgsHelp()
+}
+
+func (c *UndeleteCommand) Synopsis() string {
+	return "Restore soft-deleted AMIs and their snapshots from the Recycle Bin"
+}
+
+// Define the args of the undelete command
+func (c *UndeleteCommand) flags() *flag.FlagSet {
+	cmdFlags := flag.NewFlagSet("undelete", flag.ExitOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+
+	cmdFlags.StringVar(&c.AwsRegion, "region", "", undeleteDscrAwsRegion)
+	cmdFlags.StringVar(&c.InstanceId, "instance-id", "", undeleteDscrInstanceId)
+	cmdFlags.StringVar(&c.DeletedAfter, "deleted-after", "", undeleteDscrDeletedAfter)
+	cmdFlags.StringVar(&c.DeletedBefore, "deleted-before", "", undeleteDscrDeletedBefore)
+	cmdFlags.BoolVar(&c.DryRun, "dry-run", false, undeleteDscrDryRun)
+	addAwsFlags(cmdFlags, &c.Aws)
+
+	return cmdFlags
+}
+
+func (c *UndeleteCommand) Run(args []string) int {
+
+	// Handle the command-line args
+	cmdFlags := c.flags()
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, stop := newCommandContext(c.Aws.Timeout, c.Ui)
+	defer stop()
+
+	if err := undelete(ctx, *c); err != nil {
+		err = explainCancellation(ctx, explainAwsError(err))
+		c.Ui.Error(err.Error())
+		return failureExitCode(err)
+	}
+
+	return 0
+}
+
+// The outcome of restoring a single AMI and its snapshots
+type amiRestoreResult struct {
+	ImageId           string
+	Name              string
+	DeletedAt         time.Time
+	SnapshotsFound    int
+	SnapshotsRestored int
+	Restored          bool
+	Err               error
+}
+
+func undelete(ctx context.Context, c UndeleteCommand) error {
+	if err := validateUndeleteArgs(c); err != nil {
+		return err
+	}
+
+	deletedAfter, deletedBefore, err := parseDeletionTimeRange(c.DeletedAfter, c.DeletedBefore)
+	if err != nil {
+		return err
+	}
+
+	if c.DryRun {
+		c.Ui.Warn("WARNING: This is a dry run. Nothing will be restored, but EC2 will check that you have permission to restore each AMI and snapshot.")
+	}
+
+	session, err := newSession(c.AwsRegion, c.Aws, c.Ui)
+	if err != nil {
+		return err
+	}
+	svc := ec2.New(session)
+
+	images, err := listImagesInRecycleBin(ctx, svc)
+	if err != nil {
+		return err
+	}
+	images = selectSoftDeletedImages(images, c.InstanceId, deletedAfter, deletedBefore)
+	c.Ui.Output("==> Found " + strconv.Itoa(len(images)) + " soft-deleted AMI(s) of instance " + c.InstanceId + " in the Recycle Bin.")
+
+	if len(images) == 0 {
+		c.Ui.Info("NO ACTION TAKEN. There are no AMIs to restore.")
+		return nil
+	}
+
+	snapshots, err := listSnapshotsInRecycleBin(ctx, svc)
+	if err != nil {
+		return err
+	}
+
+	// Once the command is interrupted, no further AMI is started, but the AMI in progress is restored completely
+	var results []amiRestoreResult
+	numFailed := 0
+	for _, image := range images {
+		if err := cancellationError(ctx); err != nil {
+			printAmiRestoreResults(results, c.Ui)
+			c.Ui.Error(fmt.Sprintf("==> Stopped early: %d of %d AMI(s) done, %d failed and %d not started.", len(results) - numFailed, len(images), numFailed, len(images) - len(results)))
+			return err
+		}
+
+		result := restoreImage(uninterruptible(ctx), image, recycleBinSnapshotsOfAmi(*image.ImageId, snapshots), svc, c.DryRun, c.Ui)
+		if result.Err != nil {
+			c.Ui.Error(result.ImageId + ": " + result.Err.Error())
+			numFailed++
+		}
+		results = append(results, result)
+	}
+	printAmiRestoreResults(results, c.Ui)
+
+	if numFailed > 0 {
+		return fmt.Errorf("ERROR: Failed to restore %d of %d AMI(s).", numFailed, len(results))
+	}
+
+	if c.DryRun {
+		c.Ui.Info("==> DRY RUN. Had this not been a dry run, " + strconv.Itoa(len(results)) + " AMI(s) and their snapshots would have been restored.")
+	} else {
+		c.Ui.Info("==> Success! Restored " + strconv.Itoa(len(results)) + " AMI(s) and their snapshots.")
+	}
+	return nil
+}
+
+// Restore the snapshots of the given AMI, then the AMI itself, since EC2 can't restore an AMI whose snapshots are
+// still in the Recycle Bin, and finally stop deprecating it and restore its original description
+func restoreImage(ctx context.Context, image *ec2.ImageRecycleBinInfo, snapshots []*ec2.SnapshotRecycleBinInfo, svc *ec2.EC2, dryRun bool, ui cli.Ui) amiRestoreResult {
+	result := amiRestoreResult{
+		ImageId: *image.ImageId,
+		Name: aws.StringValue(image.Name),
+		DeletedAt: aws.TimeValue(image.RecycleBinEnterTime),
+		SnapshotsFound: len(snapshots),
+	}
+
+	for _, snapshot := range snapshots {
+		if dryRun {
+			ui.Output(result.ImageId + ": Would restore snapshot " + *snapshot.SnapshotId)
+		} else {
+			ui.Output(result.ImageId + ": Restoring snapshot " + *snapshot.SnapshotId + "...")
+		}
+		_, err := svc.RestoreSnapshotFromRecycleBinWithContext(ctx, &ec2.RestoreSnapshotFromRecycleBinInput{
+			SnapshotId: snapshot.SnapshotId,
+			DryRun: aws.Bool(dryRun),
+		})
+		if err := snapper.CheckDryRunError(err, dryRun, "ec2:RestoreSnapshotFromRecycleBin"); err != nil {
+			result.Err = fmt.Errorf("Failed to restore snapshot %s: %s", *snapshot.SnapshotId, err.Error())
+			return result
+		}
+		result.SnapshotsRestored++
+	}
+
+	if dryRun {
+		ui.Output(result.ImageId + ": Would restore AMI named \"" + result.Name + "\"")
+	} else {
+		ui.Output(result.ImageId + ": Restoring AMI named \"" + result.Name + "\"...")
+	}
+	_, err := svc.RestoreImageFromRecycleBinWithContext(ctx, &ec2.RestoreImageFromRecycleBinInput{
+		ImageId: image.ImageId,
+		DryRun: aws.Bool(dryRun),
+	})
+	if err := snapper.CheckDryRunError(err, dryRun, "ec2:RestoreImageFromRecycleBin"); err != nil {
+		result.Err = fmt.Errorf("Failed to restore AMI: %s", err.Error())
+		return result
+	}
+	result.Restored = true
+
+	// A dry run can't check these permissions, since the AMI is still in the Recycle Bin
+	if !dryRun {
+		_, err = svc.DisableImageDeprecationWithContext(ctx, &ec2.DisableImageDeprecationInput{ImageId: image.ImageId})
+		if err != nil {
+			result.Err = fmt.Errorf("Restored the AMI, but failed to stop deprecating it: %s", err.Error())
+			return result
+		}
+
+		if err := snapper.RestoreOriginalDescription(ctx, *image.ImageId, svc); err != nil {
+			result.Err = fmt.Errorf("Restored the AMI, but failed to restore its original description: %s", err.Error())
+		}
+	}
+
+	return result
+}
+
+func listImagesInRecycleBin(ctx context.Context, svc *ec2.EC2) ([]*ec2.ImageRecycleBinInfo, error) {
+	var images []*ec2.ImageRecycleBinInfo
+	err := svc.ListImagesInRecycleBinPagesWithContext(ctx, &ec2.ListImagesInRecycleBinInput{}, func(page *ec2.ListImagesInRecycleBinOutput, lastPage bool) bool {
+		images = append(images, page.Images...)
+		return true
+	})
+	return images, err
+}
+
+func listSnapshotsInRecycleBin(ctx context.Context, svc *ec2.EC2) ([]*ec2.SnapshotRecycleBinInfo, error) {
+	var snapshots []*ec2.SnapshotRecycleBinInfo
+	err := svc.ListSnapshotsInRecycleBinPagesWithContext(ctx, &ec2.ListSnapshotsInRecycleBinInput{}, func(page *ec2.ListSnapshotsInRecycleBinOutput, lastPage bool) bool {
+		snapshots = append(snapshots, page.Snapshots...)
+		return true
+	})
+	return snapshots, err
+}
+
+// Return the AMIs in the Recycle Bin that were soft-deleted for the given instance within the given time range, oldest
+// deletion first. A zero time leaves that end of the range open.
+func selectSoftDeletedImages(images []*ec2.ImageRecycleBinInfo, instanceId string, deletedAfter time.Time, deletedBefore time.Time) []*ec2.ImageRecycleBinInfo {
+	var selected []*ec2.ImageRecycleBinInfo
+	for _, image := range images {
+		if !isSoftDeletedFrom(aws.StringValue(image.Description), instanceId) {
+			continue
+		}
+
+		deletedAt := aws.TimeValue(image.RecycleBinEnterTime)
+		if !deletedAfter.IsZero() && deletedAt.Before(deletedAfter) {
+			continue
+		}
+		if !deletedBefore.IsZero() && !deletedAt.Before(deletedBefore) {
+			continue
+		}
+		selected = append(selected, image)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return aws.TimeValue(selected[i].RecycleBinEnterTime).Before(aws.TimeValue(selected[j].RecycleBinEnterTime))
+	})
+	return selected
+}
+
+// Return the snapshots in the Recycle Bin that belong to the given AMI, found by their description like snapshotsOfAmi
+func recycleBinSnapshotsOfAmi(imageId string, snapshots []*ec2.SnapshotRecycleBinInfo) []*ec2.SnapshotRecycleBinInfo {
+	var amiSnapshots []*ec2.SnapshotRecycleBinInfo
+	for _, snapshot := range snapshots {
+		if strings.Contains(aws.StringValue(snapshot.Description), imageId) {
+			amiSnapshots = append(amiSnapshots, snapshot)
+		}
+	}
+	return amiSnapshots
+}
+
+// Print a table with the outcome for every AMI. For a dry run, the table shows what would have been restored.
+func printAmiRestoreResults(results []amiRestoreResult, ui cli.Ui) {
+	var out bytes.Buffer
+	writer := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "AMI\tNAME\tDELETED AT\tSNAPSHOTS RESTORED\tRESULT")
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = "FAILED: " + result.Err.Error()
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d/%d\t%s\n", result.ImageId, result.Name, result.DeletedAt.Format(time.RFC3339), result.SnapshotsRestored, result.SnapshotsFound, status)
+	}
+	writer.Flush()
+
+	ui.Output("")
+	ui.Output(strings.TrimRight(out.String(), "\n"))
+}
+
+// Parse the optional --deleted-after and --deleted-before into a time range, where a zero time means unbounded
+func parseDeletionTimeRange(deletedAfter string, deletedBefore string) (time.Time, time.Time, error) {
+	var after, before time.Time
+	var err error
+
+	if deletedAfter != "" {
+		if after, err = parseMetricTimestamp(deletedAfter); err != nil {
+			return after, before, err
+		}
+	}
+	if deletedBefore != "" {
+		if before, err = parseMetricTimestamp(deletedBefore); err != nil {
+			return after, before, err
+		}
+	}
+
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		return after, before, errors.New("ERROR: The argument '--deleted-after' must be before '--deleted-before'.")
+	}
+	return after, before, nil
+}
+
+// Check for required command-line args
+func validateUndeleteArgs(c UndeleteCommand) error {
+	if c.AwsRegion == "" {
+		return errors.New("ERROR: The argument '--region' is required.")
+	}
+
+	if c.InstanceId == "" {
+		return errors.New("ERROR: The argument '--instance-id' is required.")
+	}
+
+	if err := validateSingleTarget(c.AwsRegion, c.Aws); err != nil {
+		return err
+	}
+
+	return validateAwsOptions(c.Aws)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func createTestAlarmCommand() AlarmCommand {
+	return AlarmCommand{
+		AwsRegion: "us-west-2",
+		AlarmName: "MyEc2BackupMissed",
+		Namespace: "MyCustomMetrics",
+		MetricName: "MyEc2Backup",
+		Dimensions: dimensionsFlag{"InstanceName=web-1"},
+		Statistic: DEFAULT_ALARM_STATISTIC,
+		Period: DEFAULT_ALARM_PERIOD,
+		EvaluationPeriods: DEFAULT_ALARM_EVALUATION_PERIODS,
+		Threshold: DEFAULT_ALARM_THRESHOLD,
+		ComparisonOperator: DEFAULT_ALARM_COMPARISON_OPERATOR,
+		TreatMissingData: DEFAULT_ALARM_TREAT_MISSING_DATA,
+		SnsTopicArns: "arn:aws:sns:us-west-2:123456789012:backups",
+	}
+}
+
+func TestBuildMetricAlarmInput(t *testing.T) {
+	t.Parallel()
+
+	input, err := buildMetricAlarmInput(createTestAlarmCommand())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *input.Period != 86400 || *input.TreatMissingData != "breaching" || *input.ComparisonOperator != cloudwatch.ComparisonOperatorLessThanThreshold {
+		t.Fatalf("Unexpected alarm: %s", input.String())
+	}
+	if len(input.Dimensions) != 1 || *input.Dimensions[0].Value != "web-1" {
+		t.Fatalf("Expected the InstanceName dimension, but got %s", input.String())
+	}
+	if len(input.AlarmActions) != 1 || len(input.OKActions) != 0 {
+		t.Fatalf("Expected only an alarm action, but got %s", input.String())
+	}
+}
+
+func TestValidateAlarmArgs(t *testing.T) {
+	t.Parallel()
+
+	if err := validateAlarmArgs(createTestAlarmCommand()); err != nil {
+		t.Fatalf("Unexpected error for valid args: %s", err.Error())
+	}
+
+	invalidTopic := createTestAlarmCommand()
+	invalidTopic.SnsTopicArns = "backups"
+	if err := validateAlarmArgs(invalidTopic); err == nil {
+		t.Fatal("Expected to get an error for an invalid SNS topic ARN, but got nil")
+	}
+
+	invalidStatistic := createTestAlarmCommand()
+	invalidStatistic.Statistic = "Median"
+	if err := validateAlarmArgs(invalidStatistic); err == nil {
+		t.Fatal("Expected to get an error for an invalid statistic, but got nil")
+	}
+
+	// Deleting only needs the name of the alarm
+	deleteOnly := AlarmCommand{AwsRegion: "us-west-2", AlarmName: "MyEc2BackupMissed", Delete: true}
+	if err := validateAlarmArgs(deleteOnly); err != nil {
+		t.Fatalf("Unexpected error for deleting an alarm: %s", err.Error())
+	}
+}
+
+func TestValidateAlarmPeriod(t *testing.T) {
+	t.Parallel()
+
+	valid := map[time.Duration]int64{10 * time.Second: 1, time.Minute: 1440, time.Hour: 168}
+	for period, evaluationPeriods := range valid {
+		if err := validateAlarmPeriod(period, evaluationPeriods); err != nil {
+			t.Fatalf("Unexpected error for %d period(s) of %s: %s", evaluationPeriods, period, err.Error())
+		}
+	}
+
+	invalid := map[time.Duration]int64{45 * time.Second: 1, time.Minute: 1441, 24 * time.Hour: 8}
+	for period, evaluationPeriods := range invalid {
+		if err := validateAlarmPeriod(period, evaluationPeriods); err == nil {
+			t.Fatalf("Expected to get an error for %d period(s) of %s, but got nil", evaluationPeriods, period)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestArchivalTime(t *testing.T) {
+	t.Parallel()
+
+	archivedAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	startedAt := archivedAt.Add(-48 * time.Hour)
+
+	if !archivalTime(nil).IsZero() {
+		t.Fatal("Expected the zero time without a status")
+	}
+	if !archivalTime(&ec2.SnapshotTierStatus{StorageTier: aws.String(ec2.StorageTierStandard), LastTieringStartTime: &startedAt}).IsZero() {
+		t.Fatal("Expected the zero time for a standard snapshot")
+	}
+	if got := archivalTime(&ec2.SnapshotTierStatus{StorageTier: aws.String(ec2.StorageTierArchive), LastTieringStartTime: &startedAt, ArchivalCompleteTime: &archivedAt}); !got.Equal(archivedAt) {
+		t.Fatalf("Expected %s, but got %s", archivedAt, got)
+	}
+	if got := archivalTime(&ec2.SnapshotTierStatus{StorageTier: aws.String(ec2.StorageTierArchive), LastTieringStartTime: &startedAt}); !got.Equal(startedAt) {
+		t.Fatalf("Expected %s, but got %s", startedAt, got)
+	}
+}
+
+func TestFilterRecentlyArchivedAmis(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	recently := now.Add(-30 * 24 * time.Hour)
+	longAgo := now.Add(-120 * 24 * time.Hour)
+
+	amis := []*ec2.Image{
+		&ec2.Image{ImageId: aws.String("ami-1")},
+		&ec2.Image{ImageId: aws.String("ami-2")},
+		&ec2.Image{ImageId: aws.String("ami-3")},
+	}
+	snapshots := []*ec2.Snapshot{
+		createTestAmiSnapshot("snap-1", "Created by CreateImage(i-1) for ami-1 from vol-1", ec2.StorageTierArchive),
+		createTestAmiSnapshot("snap-2", "Created by CreateImage(i-1) for ami-2 from vol-1", ec2.StorageTierArchive),
+		createTestAmiSnapshot("snap-3", "Created by CreateImage(i-1) for ami-3 from vol-1", ec2.StorageTierStandard),
+	}
+	statuses := map[string]*ec2.SnapshotTierStatus{
+		"snap-1": &ec2.SnapshotTierStatus{StorageTier: aws.String(ec2.StorageTierArchive), ArchivalCompleteTime: &recently},
+		"snap-2": &ec2.SnapshotTierStatus{StorageTier: aws.String(ec2.StorageTierArchive), ArchivalCompleteTime: &longAgo},
+	}
+
+	_, ui := createLoggerAndUi(t.Name())
+	deletable := filterRecentlyArchivedAmis(amis, snapshots, statuses, now, ui)
+
+	if len(deletable) != 2 || *deletable[0].ImageId != "ami-2" || *deletable[1].ImageId != "ami-3" {
+		t.Fatalf("Expected ami-2 and ami-3 to be deletable, but got %v", deletable)
+	}
+}
+
+func TestArchiveAction(t *testing.T) {
+	t.Parallel()
+
+	standard := createTestAmiSnapshot("snap-1", "", ec2.StorageTierStandard)
+	pending := createTestAmiSnapshot("snap-2", "", ec2.StorageTierStandard)
+	pending.State = aws.String(ec2.SnapshotStatePending)
+
+	testCases := []struct {
+		snapshot *ec2.Snapshot
+		status   *ec2.SnapshotTierStatus
+		expected string
+	}{
+		{standard, nil, "archive"},
+		{createTestAmiSnapshot("snap-3", "", ec2.StorageTierArchive), nil, "already archived"},
+		{pending, nil, "skipped: not completed"},
+		{standard, &ec2.SnapshotTierStatus{LastTieringOperationStatus: aws.String(ec2.TieringOperationStatusArchivalInProgress)}, "archival in progress"},
+		{standard, &ec2.SnapshotTierStatus{LastTieringOperationStatus: aws.String(ec2.TieringOperationStatusPermanentRestoreCompleted)}, "skipped: restored"},
+		{standard, &ec2.SnapshotTierStatus{LastTieringOperationStatus: aws.String(ec2.TieringOperationStatusArchivalFailed)}, "archive"},
+	}
+
+	for _, testCase := range testCases {
+		if action := archiveAction(testCase.snapshot, testCase.status); action != testCase.expected {
+			t.Fatalf("Expected %s for %s with status %v, but got %s", testCase.expected, *testCase.snapshot.SnapshotId, testCase.status, action)
+		}
+	}
+}
+
+func TestValidateArchiveOlderThan(t *testing.T) {
+	t.Parallel()
+
+	if err := validateArchiveOlderThan("30d", "365d", false); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := validateArchiveOlderThan("30d", "30d", false); err == nil {
+		t.Fatal("Expected to get an error when archiving at the same age as deleting, but got nil")
+	}
+	if err := validateArchiveOlderThan("thirty", "365d", false); err == nil {
+		t.Fatal("Expected to get an error for an invalid value, but got nil")
+	}
+	if err := validateArchiveOlderThan("30d", "365d", true); err == nil {
+		t.Fatal("Expected to get an error with --snapshot-sets, but got nil")
+	}
+}
+
+func createTestAmiSnapshot(snapshotId string, description string, tier string) *ec2.Snapshot {
+	return &ec2.Snapshot{
+		SnapshotId: aws.String(snapshotId),
+		Description: aws.String(description),
+		StorageTier: aws.String(tier),
+		State: aws.String(ec2.SnapshotStateCompleted),
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+var auditTestTime = time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// Return an auditor that writes to a file in a new temporary directory, which the returned function removes
+func newTestAuditor(t *testing.T) (*auditor, func()) {
+	dir, err := ioutil.TempDir("", "ec2-snapper-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAuditor("delete", AuditOptions{File: filepath.Join(dir, "audit.jsonl")}, "us-east-1,us-west-2", AwsOptions{}, nil, cli.NewMockUi())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return auditTestTime }
+	a.callers[""] = &sts.GetCallerIdentityOutput{Account: aws.String("123456789012"), Arn: aws.String("arn:aws:iam::123456789012:user/backup")}
+
+	return a, func() { os.RemoveAll(dir) }
+}
+
+// Simulate an EC2 API call that was made with the given context and completed with the given error
+func completeEc2Call(ctx context.Context, operation string, params interface{}, err error) {
+	r := &request.Request{
+		Config: aws.Config{Region: aws.String("us-east-1")},
+		ClientInfo: metadata.ClientInfo{ServiceName: ec2.ServiceName},
+		Operation: &request.Operation{Name: operation},
+		HTTPRequest: &http.Request{},
+		Params: params,
+		RequestID: "request-" + operation,
+		Error: err,
+	}
+	r.SetContext(ctx)
+	auditAwsCall(r)
+}
+
+// Return an EC2 client that sends no requests, but lets respond fill in the output of every call, so the handlers that
+// complete a call run as for a real one
+func newTestEc2(respond func(r *request.Request)) *ec2.EC2 {
+	svc := ec2.New(session.Must(session.NewSession(&aws.Config{
+		Region: aws.String("us-east-1"),
+		Credentials: credentials.AnonymousCredentials,
+		MaxRetries: aws.Int(0),
+	})))
+
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Unmarshal.Clear()
+	svc.Handlers.UnmarshalMeta.Clear()
+	svc.Handlers.UnmarshalError.Clear()
+	svc.Handlers.ValidateResponse.Clear()
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}
+		respond(r)
+	})
+	return svc
+}
+
+func TestAuditAwsCallRecordsMutatingCalls(t *testing.T) {
+	t.Parallel()
+
+	a, cleanup := newTestAuditor(t)
+	defer cleanup()
+
+	ctx, err := auditInstance(withAuditor(context.Background(), a), "i-123", "delete --older-than=30d --require-at-least=3", "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	completeEc2Call(ctx, "DescribeImages", &ec2.DescribeImagesInput{ImageIds: aws.StringSlice([]string{"ami-1"})}, nil)
+	completeEc2Call(ctx, "DeregisterImage", &ec2.DeregisterImageInput{ImageId: aws.String("ami-1")}, nil)
+	completeEc2Call(withAuditRule(ctx, "some other rule"), "DeleteSnapshot", &ec2.DeleteSnapshotInput{SnapshotId: aws.String("snap-1"), DryRun: aws.Bool(true)}, awserr.New("DryRunOperation", "Request would have succeeded", nil))
+	completeEc2Call(ctx, "DeleteSnapshot", &ec2.DeleteSnapshotInput{SnapshotId: aws.String("snap-2")}, awserr.New("InvalidSnapshot.InUse", "The snapshot is in use", nil))
+	completeEc2Call(context.Background(), "DeleteSnapshot", &ec2.DeleteSnapshotInput{SnapshotId: aws.String("snap-3")}, nil)
+
+	if err := a.close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	records, err := readAuditLog(a.file.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []auditRecord{
+		{Time: auditTestTime, Command: "delete", Action: "ec2:DeregisterImage", Region: "us-east-1", AccountId: "123456789012", Caller: "arn:aws:iam::123456789012:user/backup", InstanceId: "i-123", ResourceIds: []string{"ami-1"}, Rule: "delete --older-than=30d --require-at-least=3", Result: AUDIT_RESULT_SUCCESS, RequestId: "request-DeregisterImage"},
+		{Time: auditTestTime, Command: "delete", Action: "ec2:DeleteSnapshot", DryRun: true, Region: "us-east-1", AccountId: "123456789012", Caller: "arn:aws:iam::123456789012:user/backup", InstanceId: "i-123", ResourceIds: []string{"snap-1"}, Rule: "some other rule", Result: AUDIT_RESULT_DRY_RUN, RequestId: "request-DeleteSnapshot"},
+		{Time: auditTestTime, Command: "delete", Action: "ec2:DeleteSnapshot", Region: "us-east-1", AccountId: "123456789012", Caller: "arn:aws:iam::123456789012:user/backup", InstanceId: "i-123", ResourceIds: []string{"snap-2"}, Rule: "delete --older-than=30d --require-at-least=3", Result: AUDIT_RESULT_FAILURE, Error: "InvalidSnapshot.InUse: The snapshot is in use", RequestId: "request-DeleteSnapshot"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Expected the audit records\n%+v\nbut got\n%+v", expected, records)
+	}
+}
+
+func TestAuditScopeSurvivesInterrupt(t *testing.T) {
+	t.Parallel()
+
+	a, cleanup := newTestAuditor(t)
+	defer cleanup()
+
+	commandCtx, stop := newCommandContext(0, cli.NewMockUi())
+	defer stop()
+
+	ctx, err := auditInstance(withAuditor(commandCtx, a), "i-123", "create --ami-name=MyBackup", "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// The AMI in progress is finished with the uninterruptible context, and must still be audited
+	completeEc2Call(uninterruptible(ctx), "CreateTags", &ec2.CreateTagsInput{Resources: aws.StringSlice([]string{"snap-1"})}, nil)
+
+	if len(a.records) != 1 || a.records[0].Rule != "create --ami-name=MyBackup" {
+		t.Fatalf("Expected the call to be audited with the rule of the instance, but got %+v", a.records)
+	}
+}
+
+func TestAuditAwsCallRecordsEncryptedCopy(t *testing.T) {
+	t.Parallel()
+
+	a, cleanup := newTestAuditor(t)
+	defer cleanup()
+	a.command = "create"
+
+	svc := newTestEc2(func(r *request.Request) {
+		switch data := r.Data.(type) {
+		case *ec2.CopyImageOutput:
+			data.ImageId = aws.String("ami-2")
+		case *ec2.DescribeImagesOutput:
+			imageId := *r.Params.(*ec2.DescribeImagesInput).ImageIds[0]
+			data.Images = []*ec2.Image{&ec2.Image{
+				ImageId: aws.String(imageId),
+				State: aws.String(ec2.ImageStateAvailable),
+				BlockDeviceMappings: []*ec2.BlockDeviceMapping{&ec2.BlockDeviceMapping{Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-" + imageId)}}},
+			}}
+		}
+	})
+	svc.Handlers.Complete.PushBack(auditAwsCall)
+
+	ctx, err := auditInstance(withAuditor(context.Background(), a), "i-123", "create --ami-name=MyBackup --kms-key-id=key-1", "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	imageId, err := copyImageEncrypted(ctx, "ami-1", "MyBackup", "us-east-1", "key-1", snapper.ImageTags("i-123", "MyBackup"), svc, cli.NewMockUi())
+	if err != nil || imageId != "ami-2" {
+		t.Fatalf("Expected the encrypted copy ami-2, but got %s and %v", imageId, err)
+	}
+
+	intermediateRule := "create --kms-key-id=key-1: the unencrypted AMI was replaced by its encrypted copy ami-2"
+	expected := []struct {
+		Action      string
+		ResourceIds []string
+		Rule        string
+	}{
+		{"ec2:CopyImage", []string{"ami-1", "key-1"}, "create --ami-name=MyBackup --kms-key-id=key-1"},
+		{"ec2:CreateTags", []string{"ami-2"}, "create --ami-name=MyBackup --kms-key-id=key-1"},
+		{"ec2:DeregisterImage", []string{"ami-1"}, intermediateRule},
+		{"ec2:DeleteSnapshot", []string{"snap-ami-1"}, intermediateRule},
+	}
+	if len(a.records) != len(expected) {
+		t.Fatalf("Expected %d audit records, but got %+v", len(expected), a.records)
+	}
+	for i, record := range a.records {
+		if record.Action != expected[i].Action || !reflect.DeepEqual(record.ResourceIds, expected[i].ResourceIds) || record.Rule != expected[i].Rule || record.Result != AUDIT_RESULT_SUCCESS {
+			t.Fatalf("Expected the audit record %d to be %+v, but got %+v", i, expected[i], record)
+		}
+	}
+}
+
+func TestBatchAuditLogEvents(t *testing.T) {
+	t.Parallel()
+
+	event := func(message string, at time.Time) *cloudwatchlogs.InputLogEvent {
+		return &cloudwatchlogs.InputLogEvent{Message: aws.String(message), Timestamp: aws.Int64(at.UnixNano() / int64(time.Millisecond))}
+	}
+	batchSizes := func(events []*cloudwatchlogs.InputLogEvent) []int {
+		sizes := []int{}
+		for _, batch := range batchAuditLogEvents(events) {
+			sizes = append(sizes, len(batch))
+		}
+		return sizes
+	}
+
+	// By count
+	many := []*cloudwatchlogs.InputLogEvent{}
+	for i := 0; i < MAX_AUDIT_LOG_EVENTS_PER_CALL + 5; i++ {
+		many = append(many, event("{}", auditTestTime))
+	}
+	if sizes := batchSizes(many); !reflect.DeepEqual(sizes, []int{MAX_AUDIT_LOG_EVENTS_PER_CALL, 5}) {
+		t.Fatalf("Expected batches of %d and 5 events, but got %v", MAX_AUDIT_LOG_EVENTS_PER_CALL, sizes)
+	}
+
+	// By size, counting the overhead of each event: two of these fit exactly, a third doesn't
+	large := strings.Repeat("x", MAX_AUDIT_LOG_BYTES_PER_CALL / 2 - AUDIT_LOG_EVENT_OVERHEAD_BYTES)
+	if sizes := batchSizes([]*cloudwatchlogs.InputLogEvent{event(large, auditTestTime), event(large, auditTestTime), event(large, auditTestTime)}); !reflect.DeepEqual(sizes, []int{2, 1}) {
+		t.Fatalf("Expected batches of 2 and 1 events, but got %v", sizes)
+	}
+
+	// By span
+	spread := []*cloudwatchlogs.InputLogEvent{
+		event("{}", auditTestTime),
+		event("{}", auditTestTime.Add(MAX_AUDIT_LOG_SPAN_PER_CALL)),
+		event("{}", auditTestTime.Add(MAX_AUDIT_LOG_SPAN_PER_CALL + time.Millisecond)),
+	}
+	if sizes := batchSizes(spread); !reflect.DeepEqual(sizes, []int{2, 1}) {
+		t.Fatalf("Expected batches of 2 and 1 events, but got %v", sizes)
+	}
+
+	if sizes := batchSizes(nil); len(sizes) != 0 {
+		t.Fatalf("Expected no batches, but got %v", sizes)
+	}
+}
+
+func TestAuditInstanceWithoutAuditor(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	auditCtx, err := auditInstance(ctx, "i-123", "create --ami-name=MyBackup", "", nil)
+	if err != nil || auditCtx != ctx {
+		t.Fatalf("Expected the context to be returned unchanged when auditing is disabled, but got %v, %v", auditCtx, err)
+	}
+}
+
+func TestValidateAuditOptions(t *testing.T) {
+	t.Parallel()
+
+	valid := []AuditOptions{
+		{},
+		{File: "audit.jsonl"},
+		{File: "audit.jsonl", CloudWatchLogGroup: "ec2-snapper", CloudWatchLogStream: "backups", S3Uri: "s3://my-bucket/audit/"},
+	}
+	for _, options := range valid {
+		if err := validateAuditOptions(options); err != nil {
+			t.Fatalf("Unexpected error for %+v: %s", options, err.Error())
+		}
+	}
+
+	invalid := []AuditOptions{
+		{CloudWatchLogGroup: "ec2-snapper"},
+		{File: "audit.jsonl", CloudWatchLogStream: "backups"},
+		{File: "audit.jsonl", S3Uri: "https://my-bucket.s3.amazonaws.com/audit/"},
+	}
+	for _, options := range invalid {
+		if err := validateAuditOptions(options); err == nil {
+			t.Fatalf("Expected to get an error for %+v, but got nil", options)
+		}
+	}
+}
+
+func TestParseS3Uri(t *testing.T) {
+	t.Parallel()
+
+	bucket, prefix, err := parseS3Uri("s3://my-bucket/audit/ec2-snapper/")
+	if err != nil || bucket != "my-bucket" || prefix != "audit/ec2-snapper/" {
+		t.Fatalf("Expected bucket my-bucket and prefix audit/ec2-snapper/, but got %s, %s, %v", bucket, prefix, err)
+	}
+
+	if key := auditObjectKey("audit", "delete", auditTestTime); len(key) != len("audit/ec2-snapper-delete-20170102T030405Z-123456.jsonl") {
+		t.Fatalf("Unexpected object key %s", key)
+	}
+}
+
+func TestParseAuditTime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2017, 1, 31, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		value    string
+		endOfDay bool
+		expected time.Time
+	}{
+		{"", false, time.Time{}},
+		{"2017-01-02", false, time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"2017-01-02", true, time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"2017-01-02T03:04:05Z", true, time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"7d", false, time.Date(2017, 1, 24, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, testCase := range testCases {
+		actual, err := parseAuditTime(testCase.value, now, testCase.endOfDay)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", testCase.value, err.Error())
+		}
+		if !actual.Equal(testCase.expected) {
+			t.Fatalf("Expected %s to be parsed as %s, but got %s", testCase.value, testCase.expected, actual)
+		}
+	}
+
+	if _, err := parseAuditTime("last tuesday", now, false); err == nil {
+		t.Fatal("Expected to get an error for an invalid time, but got nil")
+	}
+}
+
+func TestFilterAuditRecords(t *testing.T) {
+	t.Parallel()
+
+	records := []auditRecord{
+		{Time: time.Date(2017, 1, 1, 23, 0, 0, 0, time.UTC), InstanceId: "i-1", Action: "ec2:CreateImage"},
+		{Time: time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC), InstanceId: "i-2", Action: "ec2:CreateImage"},
+		{Time: time.Date(2017, 1, 2, 12, 0, 0, 0, time.UTC), InstanceId: "i-1", Action: "ec2:DeregisterImage"},
+		{Time: time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC), InstanceId: "i-1", Action: "ec2:DeleteSnapshot"},
+	}
+
+	since := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	filtered := filterAuditRecords(records, []string{"i-1"}, since, until)
+	if len(filtered) != 1 || filtered[0].Action != "ec2:DeregisterImage" {
+		t.Fatalf("Expected only the DeregisterImage record of i-1 on 2017-01-02, but got %+v", filtered)
+	}
+
+	if all := filterAuditRecords(records, nil, time.Time{}, time.Time{}); len(all) != len(records) {
+		t.Fatalf("Expected every record without filters, but got %+v", all)
+	}
+}
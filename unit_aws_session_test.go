@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/mitchellh/cli"
+)
+
+func TestExplainAwsErrorNoCredentials(t *testing.T) {
+	t.Parallel()
+
+	err := explainAwsError(awserr.New("NoCredentialProviders", "no valid providers in chain", nil))
+	if err.Error() != NO_CREDENTIALS_MESSAGE {
+		t.Fatalf("Expected the no credentials message, but got %s", err.Error())
+	}
+}
+
+func TestExplainAwsErrorExpiredToken(t *testing.T) {
+	t.Parallel()
+
+	err := explainAwsError(awserr.New("ExpiredToken", "The security token included in the request is expired", nil))
+	if !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("Expected an explanation of the expired credentials, but got %s", err.Error())
+	}
+}
+
+func TestExplainAwsErrorPassesThroughOtherErrors(t *testing.T) {
+	t.Parallel()
+
+	original := errors.New("some other error")
+	if err := explainAwsError(original); err != original {
+		t.Fatalf("Expected other errors to be returned unchanged, but got %v", err)
+	}
+}
+
+func TestValidateAwsOptionsRequiresRoleArn(t *testing.T) {
+	t.Parallel()
+
+	if err := validateAwsOptions(AwsOptions{ExternalId: "my-id"}); err == nil {
+		t.Fatal("Expected to get an error for '--external-id' without '--role-arn', but got nil")
+	}
+
+	if err := validateAwsOptions(AwsOptions{RoleArn: "arn:aws:iam::123456789012:role/backup", ExternalId: "my-id"}); err != nil {
+		t.Fatalf("Unexpected error for valid options: %s", err.Error())
+	}
+}
+
+func TestValidateAwsOptionsEndpointUrls(t *testing.T) {
+	t.Parallel()
+
+	if err := validateAwsOptions(AwsOptions{EndpointUrl: "http://localhost:4566", Ec2EndpointUrl: "https://vpce-0123-abcd.ec2.us-east-1.vpce.amazonaws.com"}); err != nil {
+		t.Fatalf("Unexpected error for valid endpoint URLs: %s", err.Error())
+	}
+
+	if err := validateAwsOptions(AwsOptions{CloudWatchEndpointUrl: "localhost:4566"}); err == nil {
+		t.Fatal("Expected to get an error for an endpoint URL without a scheme, but got nil")
+	}
+}
+
+func TestEndpointResolverOverridesPerService(t *testing.T) {
+	t.Parallel()
+
+	resolver := newEndpointResolver(AwsOptions{EndpointUrl: "http://localhost:4566", Ec2EndpointUrl: "https://vpce-ec2.example.com"})
+
+	expected := map[string]string{
+		"ec2": "https://vpce-ec2.example.com",
+		"monitoring": "http://localhost:4566",
+		"sts": "http://localhost:4566",
+	}
+	for service, expectedUrl := range expected {
+		endpoint, err := resolver.EndpointFor(service, "us-east-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint.URL != expectedUrl {
+			t.Fatalf("Expected endpoint %s for %s, but got %s", expectedUrl, service, endpoint.URL)
+		}
+	}
+}
+
+func TestEndpointResolverDefaultsToAws(t *testing.T) {
+	t.Parallel()
+
+	endpoint, err := newEndpointResolver(AwsOptions{}).EndpointFor("ec2", "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.URL != "https://ec2.us-east-1.amazonaws.com" {
+		t.Fatalf("Expected the public EC2 endpoint, but got %s", endpoint.URL)
+	}
+}
+
+func TestAwsSessionsShareCredentials(t *testing.T) {
+	t.Parallel()
+
+	sessions := newAwsSessions(AwsOptions{RoleArn: "arn:aws:iam::111111111111:role/backup,arn:aws:iam::222222222222:role/backup"})
+	ui := cli.NewMockUi()
+
+	first, err := sessions.get("us-east-1", AwsOptions{RoleArn: "arn:aws:iam::111111111111:role/backup"}, ui)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	sameRole, _ := sessions.get("us-west-2", AwsOptions{RoleArn: "arn:aws:iam::111111111111:role/backup"}, ui)
+	otherRole, _ := sessions.get("us-west-2", AwsOptions{RoleArn: "arn:aws:iam::222222222222:role/backup"}, ui)
+	noRole, _ := sessions.get("us-west-2", AwsOptions{}, ui)
+
+	if aws.StringValue(sameRole.Config.Region) != "us-west-2" {
+		t.Fatalf("Expected the session to be for us-west-2, but got %s", aws.StringValue(sameRole.Config.Region))
+	}
+	if first.Config.Credentials != sameRole.Config.Credentials {
+		t.Fatal("Expected the sessions of the same role to share its credentials")
+	}
+	if first.Config.Credentials == otherRole.Config.Credentials || first.Config.Credentials == noRole.Config.Credentials {
+		t.Fatal("Expected the sessions of different roles to have different credentials")
+	}
+	if noRole.Config.Credentials != sessions.base.Config.Credentials {
+		t.Fatal("Expected the session without a role to use the credentials the command starts with")
+	}
+}
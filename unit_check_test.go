@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestEvaluateFreshnessIgnoresUnavailableImages(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	images := []*ec2.Image{
+		createTestImage("ami-old", ec2.ImageStateAvailable, now.Add(-30 * time.Hour)),
+		createTestImage("ami-pending", ec2.ImageStatePending, now.Add(-1 * time.Hour)),
+	}
+
+	result := evaluateFreshness(instanceRef{Name: "web-1"}, images, 26, 25, now)
+	if result.Status != NAGIOS_CRITICAL || result.Age != 30 * time.Hour {
+		t.Fatalf("Expected CRITICAL for an available AMI that is 30h old, but got %v", result)
+	}
+}
+
+func TestEvaluateFreshnessThresholds(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	expectedStatuses := map[time.Duration]int{
+		1 * time.Hour: NAGIOS_OK,
+		25 * time.Hour + 30 * time.Minute: NAGIOS_WARNING,
+		27 * time.Hour: NAGIOS_CRITICAL,
+	}
+
+	for age, expectedStatus := range expectedStatuses {
+		images := []*ec2.Image{createTestImage("ami-1", ec2.ImageStateAvailable, now.Add(-age))}
+		result := evaluateFreshness(instanceRef{Id: "i-1"}, images, 26, 25, now)
+		if result.Status != expectedStatus {
+			t.Fatalf("Expected status %d for an AMI that is %s old, but got %d", expectedStatus, age, result.Status)
+		}
+	}
+
+	if result := evaluateFreshness(instanceRef{Id: "i-1"}, nil, 26, 25, now); result.Status != NAGIOS_CRITICAL {
+		t.Fatalf("Expected CRITICAL without any AMI, but got %d", result.Status)
+	}
+}
+
+func TestWorstNagiosStatus(t *testing.T) {
+	t.Parallel()
+
+	results := []freshnessResult{
+		freshnessResult{Status: NAGIOS_OK},
+		freshnessResult{Status: NAGIOS_UNKNOWN},
+		freshnessResult{Status: NAGIOS_WARNING},
+	}
+	if status := worstNagiosStatus(results); status != NAGIOS_WARNING {
+		t.Fatalf("Expected WARNING, but got %d", status)
+	}
+}
+
+func TestFormatCheckOutput(t *testing.T) {
+	t.Parallel()
+
+	results := []freshnessResult{
+		freshnessResult{Instance: instanceRef{Name: "web-1"}, Age: time.Hour, Status: NAGIOS_OK, Message: "newest AMI ami-1 is 1.0h old"},
+		freshnessResult{Instance: instanceRef{Name: "web-2"}, Age: -1, Status: NAGIOS_CRITICAL, Message: "no available AMI"},
+	}
+
+	output := formatCheckOutput(NAGIOS_CRITICAL, results, 26, 25)
+	expected := "EC2-SNAPPER CRITICAL - web-1: newest AMI ami-1 is 1.0h old; web-2: no available AMI | 'web-1'=3600s;90000;93600;0;"
+	if output != expected {
+		t.Fatalf("Expected output\n%s\nbut got\n%s", expected, output)
+	}
+
+	if !strings.HasSuffix(formatCheckOutput(NAGIOS_OK, results[:1], 26, math.Inf(1)), "'web-1'=3600s;;93600;0;") {
+		t.Fatal("Expected no warning threshold in the perfdata without '--warning-age'")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const FLOATING_POINT_THRESHOLD = 0.000001
+
+func TestPreviousSnapshotOfVolume(t *testing.T) {
+	t.Parallel()
+
+	day := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	snapshots := []*ec2.Snapshot{
+		createTestVolumeSnapshot("snap-1", "vol-1", day.Add(-48 * time.Hour)),
+		createTestVolumeSnapshot("snap-2", "vol-1", day.Add(-24 * time.Hour)),
+		createTestVolumeSnapshot("snap-3", "vol-1", day),
+		createTestVolumeSnapshot("snap-4", "vol-2", day.Add(-time.Hour)),
+		createTestVolumeSnapshot("snap-5", "vol-ffffffff", day.Add(-time.Hour)),
+		createTestVolumeSnapshot("snap-6", "vol-ffffffff", day),
+	}
+
+	if previous := previousSnapshotOfVolume(snapshots[2], snapshots); previous == nil || *previous.SnapshotId != "snap-2" {
+		t.Fatalf("Expected snap-2, but got %v", previous)
+	}
+	if previous := previousSnapshotOfVolume(snapshots[0], snapshots); previous != nil {
+		t.Fatalf("Expected no previous snapshot of the first snapshot, but got %v", previous)
+	}
+	if previous := previousSnapshotOfVolume(snapshots[5], snapshots); previous != nil {
+		t.Fatalf("Expected no previous snapshot of a copy, but got %v", previous)
+	}
+}
+
+func TestAddUpInstanceCost(t *testing.T) {
+	t.Parallel()
+
+	prices := snapshotPrices{Standard: 0.05, Archive: 0.0125}
+	amis := []amiCost{
+		amiCost{ImageId: "ami-1", ArchiveGiB: 100},
+		amiCost{ImageId: "ami-2", StandardGiB: 100, IncrementalGiB: aws.Float64(10)},
+	}
+	for i := range amis {
+		amis[i].MonthlyCost = amiMonthlyCost(amis[i], prices)
+	}
+
+	result := instanceCost{Amis: amis}
+	addUpInstanceCost(&result)
+
+	if !floatEquals(amis[0].MonthlyCost, 1.25) || !floatEquals(amis[1].MonthlyCost, 0.5) {
+		t.Fatalf("Expected 1.25 for the archived AMI and 0.5 for the changed blocks, but got %v", amis)
+	}
+	if result.StandardGiB != 100 || result.ArchiveGiB != 100 || !floatEquals(result.MonthlyCost, 1.75) {
+		t.Fatalf("Unexpected totals: %+v", result)
+	}
+	if result.IncrementalGiB != nil {
+		t.Fatalf("Expected no incremental total when only some AMIs were measured, but got %f", *result.IncrementalGiB)
+	}
+}
+
+func TestProjectNumAmis(t *testing.T) {
+	t.Parallel()
+
+	if numAmis := projectNumAmis(costPolicy{OlderThanHours: 30 * 24, IntervalHours: 24}); numAmis != 30 {
+		t.Fatalf("Expected 30 daily AMIs, but got %d", numAmis)
+	}
+	if numAmis := projectNumAmis(costPolicy{OlderThanHours: 3 * 24, IntervalHours: 24, RequireAtLeast: 5}); numAmis != 5 {
+		t.Fatalf("Expected --require-at-least to keep 5 AMIs, but got %d", numAmis)
+	}
+}
+
+func TestProjectCost(t *testing.T) {
+	t.Parallel()
+
+	prices := snapshotPrices{Standard: 0.05, Archive: 0.0125}
+	current := instanceCost{Amis: []amiCost{
+		amiCost{StandardGiB: 100, IncrementalGiB: aws.Float64(60)},
+		amiCost{StandardGiB: 100, IncrementalGiB: aws.Float64(2)},
+		amiCost{StandardGiB: 100, IncrementalGiB: aws.Float64(4)},
+	}}
+
+	projected := projectCost(current, costPolicy{OlderThanHours: 30 * 24, IntervalHours: 24, ArchiveOlderThanHours: 10 * 24}, prices)
+
+	if projected.Amis != 30 || projected.StandardAmis != 10 || projected.ArchivedAmis != 20 {
+		t.Fatalf("Expected 10 standard and 20 archived AMIs, but got %+v", projected)
+	}
+	// One full copy plus 9 times the average change of 3 GiB, and 20 full copies in the archive tier
+	if !floatEquals(projected.StandardGiB, 127) || !floatEquals(projected.ArchiveGiB, 2000) || !floatEquals(projected.MonthlyCost, 127 * 0.05 + 2000 * 0.0125) {
+		t.Fatalf("Unexpected projection: %+v", projected)
+	}
+
+	if projectCost(instanceCost{}, costPolicy{OlderThanHours: 24, IntervalHours: 24}, prices) != nil {
+		t.Fatal("Expected no projection for an instance without AMIs")
+	}
+}
+
+func TestFormatCostCsv(t *testing.T) {
+	t.Parallel()
+
+	report := costReport{Instances: []instanceCost{
+		instanceCost{InstanceId: "i-1", InstanceName: "web, 1", Amis: []amiCost{amiCost{ImageId: "ami-1", CreationDate: "2017-01-02T03:04:05.000Z", Tier: ec2.StorageTierStandard, Snapshots: 1, StandardGiB: 8, MonthlyCost: 0.4}}, StandardGiB: 8, MonthlyCost: 0.4},
+	}}
+
+	output, err := formatCostCsv(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(output, "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], `ami,i-1,"web, 1",ami-1,2017-01-02T03:04:05.000Z,standard,1,8,`) || !strings.HasPrefix(lines[2], "total,i-1,") {
+		t.Fatalf("Unexpected CSV:\n%s", output)
+	}
+}
+
+func TestAmiStorageTier(t *testing.T) {
+	t.Parallel()
+
+	standard := &ec2.Snapshot{StorageTier: aws.String(ec2.StorageTierStandard)}
+	archive := &ec2.Snapshot{StorageTier: aws.String(ec2.StorageTierArchive)}
+
+	testCases := []struct {
+		snapshots []*ec2.Snapshot
+		expected  string
+	}{
+		{[]*ec2.Snapshot{standard, standard}, ec2.StorageTierStandard},
+		{[]*ec2.Snapshot{archive, archive}, ec2.StorageTierArchive},
+		{[]*ec2.Snapshot{standard, archive}, COST_TIER_MIXED},
+		{[]*ec2.Snapshot{&ec2.Snapshot{}}, ec2.StorageTierStandard},
+		{nil, ""},
+	}
+
+	for _, testCase := range testCases {
+		if actual := amiStorageTier(testCase.snapshots); actual != testCase.expected {
+			t.Fatalf("Expected the tier %s for %v, but got %s", testCase.expected, testCase.snapshots, actual)
+		}
+	}
+}
+
+func TestValidateCostArgs(t *testing.T) {
+	t.Parallel()
+
+	valid := CostCommand{AwsRegion: "us-west-2", InstanceId: "i-1", Interval: DEFAULT_BACKUP_INTERVAL, Format: COST_FORMAT_TABLE}
+	if err := validateCostArgs(valid); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	invalidFormat := valid
+	invalidFormat.Format = "xml"
+	if err := validateCostArgs(invalidFormat); err == nil {
+		t.Fatal("Expected to get an error for an unknown format, but got nil")
+	}
+
+	policyWithoutOlderThan := valid
+	policyWithoutOlderThan.RequireAtLeast = 3
+	if err := validateCostArgs(policyWithoutOlderThan); err == nil {
+		t.Fatal("Expected to get an error for '--require-at-least' without '--older-than', but got nil")
+	}
+
+	severalRegions := valid
+	severalRegions.AwsRegion = "us-east-1,us-west-2"
+	if err := validateCostArgs(severalRegions); err == nil {
+		t.Fatal("Expected to get an error for several regions, but got nil")
+	}
+}
+
+func createTestVolumeSnapshot(snapshotId string, volumeId string, startTime time.Time) *ec2.Snapshot {
+	return &ec2.Snapshot{
+		SnapshotId: aws.String(snapshotId),
+		VolumeId: aws.String(volumeId),
+		StartTime: aws.Time(startTime),
+		State: aws.String(ec2.SnapshotStateCompleted),
+		StorageTier: aws.String(ec2.StorageTierStandard),
+	}
+}
+
+func floatEquals(a float64, b float64) bool {
+	return math.Abs(a - b) < FLOATING_POINT_THRESHOLD
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+	"github.com/mitchellh/cli"
+)
+
+func TestSummarizeInstanceResultsExitCodes(t *testing.T) {
+	t.Parallel()
+
+	_, ui := createLoggerAndUi("TestSummarizeInstanceResultsExitCodes")
+	ok := instanceResult{Instance: instanceRef{Id: "i-1"}}
+	partial := instanceResult{Instance: instanceRef{Id: "i-2"}, Err: &partialFailureError{NumSucceeded: 1, NumFailed: 1}}
+	failed := instanceResult{Instance: instanceRef{Id: "i-3"}, Err: errors.New("instance not found")}
+
+	testSummarizeInstanceResults([]instanceResult{ok}, 0, ui, t)
+	testSummarizeInstanceResults([]instanceResult{ok, partial}, EXIT_CODE_PARTIAL_FAILURE, ui, t)
+	testSummarizeInstanceResults([]instanceResult{ok, partial, failed}, 1, ui, t)
+
+	interrupted := instanceResult{Instance: instanceRef{Id: "i-4"}, Err: &interruptedError{Signal: os.Interrupt}}
+	testSummarizeInstanceResults([]instanceResult{ok, failed, interrupted}, EXIT_CODE_INTERRUPTED, ui, t)
+}
+
+func testSummarizeInstanceResults(results []instanceResult, expectedExitCode int, ui cli.Ui, t *testing.T) {
+	if exitCode := summarizeInstanceResults(results, ui); exitCode != expectedExitCode {
+		t.Fatalf("Expected exit code %d but got %d", expectedExitCode, exitCode)
+	}
+}
+
+func TestDeleteSnapshotSetsContinuesPastFailures(t *testing.T) {
+	t.Parallel()
+
+	started := time.Now().Add(-48 * time.Hour)
+	snapshot := func(snapshotId string, batchId string, startTime time.Time) *ec2.Snapshot {
+		return &ec2.Snapshot{
+			SnapshotId: aws.String(snapshotId),
+			StartTime: aws.Time(startTime),
+			Tags: []*ec2.Tag{&ec2.Tag{Key: aws.String(EC2_SNAPPER_BATCH_ID_TAG), Value: aws.String(batchId)}},
+		}
+	}
+
+	var deleted []string
+	svc := newTestEc2(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeSnapshots":
+			r.Data.(*ec2.DescribeSnapshotsOutput).Snapshots = []*ec2.Snapshot{snapshot("snap-1", "batch-1", started), snapshot("snap-2", "batch-1", started), snapshot("snap-3", "batch-2", started.Add(time.Hour))}
+		case "DeleteSnapshot":
+			snapshotId := *r.Params.(*ec2.DeleteSnapshotInput).SnapshotId
+			if snapshotId == "snap-1" {
+				r.Error = awserr.New("InvalidSnapshot.InUse", "The snapshot is in use", nil)
+				return
+			}
+			deleted = append(deleted, snapshotId)
+		}
+	})
+
+	ui := cli.NewMockUi()
+	c := DeleteCommand{Ui: ui, InstanceId: "i-1", OlderThan: "1d"}
+	err := deleteSnapshotSets(context.Background(), c, svc)
+
+	if partial, ok := err.(*partialFailureError); !ok || partial.NumSucceeded != 1 || partial.NumFailed != 1 {
+		t.Fatalf("Expected a partial failure with 1 set deleted and 1 failed, but got %v", err)
+	}
+	if len(deleted) != 2 || deleted[0] != "snap-2" || deleted[1] != "snap-3" {
+		t.Fatalf("Expected the other snapshots to be deleted anyway, but got %v", deleted)
+	}
+	if output := ui.OutputWriter.String(); !strings.Contains(output, "SNAPSHOT SET") || !strings.Contains(output, "FAILED: Failed to delete snapshot(s) snap-1") {
+		t.Fatalf("Expected a table with the outcome of every set, but got %q", output)
+	}
+}
+
+func TestDeleteOldAmisKeepsNewestOfUnsortedAmis(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	image := func(imageId string, age time.Duration) *ec2.Image {
+		return &ec2.Image{
+			ImageId: aws.String(imageId),
+			Name: aws.String(imageId),
+			OwnerId: aws.String("123456789012"),
+			State: aws.String(ec2.ImageStateAvailable),
+			CreationDate: aws.String(now.Add(-age).UTC().Format(time.RFC3339Nano)),
+		}
+	}
+
+	svc := newTestEc2(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DescribeImages":
+			// EC2 returns the AMIs in no particular order
+			r.Data.(*ec2.DescribeImagesOutput).Images = []*ec2.Image{
+				image("ami-3", 3 * 24 * time.Hour),
+				image("ami-1", 9 * 24 * time.Hour),
+				image("ami-4", 2 * 24 * time.Hour),
+				image("ami-2", 5 * 24 * time.Hour),
+			}
+		case "DeregisterImage":
+			r.Error = awserr.New(snapper.DRY_RUN_OPERATION_ERROR_CODE, "Request would have succeeded", nil)
+		}
+	})
+
+	c := DeleteCommand{Ui: cli.NewMockUi(), InstanceId: "i-1", OlderThan: "1d", RequireAtLeast: 2, DryRun: true, AmiParallelism: 1}
+	results, err := deleteOldAmis(context.Background(), c, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var imageIds []string
+	for _, result := range results {
+		imageIds = append(imageIds, result.ImageId)
+	}
+	if strings.Join(imageIds, ",") != "ami-1,ami-2" {
+		t.Fatalf("Expected only the oldest AMIs ami-1 and ami-2 to be deleted, but got %v", imageIds)
+	}
+}
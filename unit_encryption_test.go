@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestCheckImageEncrypted(t *testing.T) {
+	t.Parallel()
+
+	image := &ec2.Image{
+		ImageId: aws.String("ami-1"),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+			&ec2.BlockDeviceMapping{DeviceName: aws.String("/dev/xvda"), Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-1"), Encrypted: aws.Bool(true)}},
+			&ec2.BlockDeviceMapping{DeviceName: aws.String("/dev/xvdb"), VirtualName: aws.String("ephemeral0")},
+		},
+	}
+	if err := checkImageEncrypted(image); err != nil {
+		t.Fatalf("Unexpected error for an encrypted AMI: %s", err.Error())
+	}
+
+	image.BlockDeviceMappings = append(image.BlockDeviceMappings,
+		&ec2.BlockDeviceMapping{DeviceName: aws.String("/dev/xvdc"), Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-2"), Encrypted: aws.Bool(false)}},
+	)
+	err := checkImageEncrypted(image)
+	if err == nil || !strings.Contains(err.Error(), "snap-2 (/dev/xvdc)") || strings.Contains(err.Error(), "snap-1") {
+		t.Fatalf("Expected an error naming only snap-2, but got %v", err)
+	}
+}
+
+func TestImageSnapshotIds(t *testing.T) {
+	t.Parallel()
+
+	image := &ec2.Image{BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+		&ec2.BlockDeviceMapping{Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-1")}},
+		&ec2.BlockDeviceMapping{VirtualName: aws.String("ephemeral0")},
+		&ec2.BlockDeviceMapping{Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-2")}},
+	}}
+
+	if snapshotIds := imageSnapshotIds(image); strings.Join(snapshotIds, ",") != "snap-1,snap-2" {
+		t.Fatalf("Expected snap-1 and snap-2, but got %v", snapshotIds)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestAmiExporterGauges(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	available := createTestImage("ami-1", ec2.ImageStateAvailable, now.Add(-2 * time.Hour))
+	available.BlockDeviceMappings = []*ec2.BlockDeviceMapping{
+		&ec2.BlockDeviceMapping{Ebs: &ec2.EbsBlockDevice{VolumeSize: aws.Int64(8)}},
+		&ec2.BlockDeviceMapping{VirtualName: aws.String("ephemeral0")},
+	}
+	failed := createTestImage("ami-2", ec2.ImageStateFailed, now.Add(-1 * time.Hour))
+	failed.BlockDeviceMappings = []*ec2.BlockDeviceMapping{&ec2.BlockDeviceMapping{Ebs: &ec2.EbsBlockDevice{VolumeSize: aws.Int64(100)}}}
+
+	exporter := newAmiExporter()
+	exporter.update(instanceRef{Id: "i-1", Name: "web-1"}, []*ec2.Image{available, failed}, now)
+
+	instance := exporter.instances["i-1"]
+	if instance.Amis != 1 || instance.SnapshotGiB != 8 || instance.NewestAmiAge != 2 * time.Hour {
+		t.Fatalf("Unexpected gauges: %+v", instance)
+	}
+	if instance.AmisCreatedOk != 0 || instance.AmisCreatedFail != 0 || instance.AmisDeleted != 0 {
+		t.Fatalf("Expected no counts on the first refresh, but got %+v", instance)
+	}
+}
+
+func TestAmiExporterCountsChangesBetweenRefreshes(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	ref := instanceRef{Id: "i-1"}
+	exporter := newAmiExporter()
+	exporter.update(ref, []*ec2.Image{
+		createTestImage("ami-old", ec2.ImageStateAvailable, now.Add(-48 * time.Hour)),
+		createTestImage("ami-pending", ec2.ImageStatePending, now.Add(-1 * time.Minute)),
+	}, now)
+
+	exporter.update(ref, []*ec2.Image{
+		createTestImage("ami-pending", ec2.ImageStateAvailable, now.Add(-1 * time.Minute)),
+		createTestImage("ami-new", ec2.ImageStateFailed, now),
+	}, now)
+
+	instance := exporter.instances["i-1"]
+	if instance.AmisCreatedOk != 1 || instance.AmisCreatedFail != 1 || instance.AmisDeleted != 1 {
+		t.Fatalf("Expected 1 created, 1 failed and 1 deleted AMI, but got %+v", instance)
+	}
+
+	// An AMI that stays available must not be counted again
+	exporter.update(ref, []*ec2.Image{createTestImage("ami-pending", ec2.ImageStateAvailable, now.Add(-1 * time.Minute))}, now)
+	if instance.AmisCreatedOk != 1 || instance.AmisDeleted != 2 {
+		t.Fatalf("Unexpected counts after the third refresh: %+v", instance)
+	}
+}
+
+func TestAmiExporterServesMetrics(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	exporter := newAmiExporter()
+	exporter.update(instanceRef{Id: "i-1", Name: "web-1"}, nil, now)
+	exporter.update(instanceRef{Id: "i-2"}, nil, now)
+	exporter.retain([]instanceRef{instanceRef{Id: "i-1", Name: "web-1"}}, now)
+
+	recorder := httptest.NewRecorder()
+	exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, expected := range []string{
+		`ec2_snapper_amis{instance_id="i-1",instance_name="web-1"} 0`,
+		`ec2_snapper_amis_created_total{instance_id="i-1",instance_name="web-1",outcome="failure"} 0`,
+		"ec2_snapper_refresh_errors_total 0",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Expected the metrics to contain %s, but got\n%s", expected, body)
+		}
+	}
+
+	if strings.Contains(body, "i-2") {
+		t.Fatalf("Expected the metrics of an instance that is gone to be removed, but got\n%s", body)
+	}
+	if strings.Contains(body, "ec2_snapper_newest_ami_age_seconds{") {
+		t.Fatalf("Expected no AMI age for an instance without AMIs, but got\n%s", body)
+	}
+}
+
+func TestValidateExporterArgs(t *testing.T) {
+	t.Parallel()
+
+	valid := ExporterCommand{AwsRegion: "us-west-2", Tag: "Backup=nightly", ListenAddress: DEFAULT_EXPORTER_LISTEN_ADDRESS, RefreshInterval: DEFAULT_EXPORTER_REFRESH_INTERVAL}
+	if err := validateExporterArgs(valid); err != nil {
+		t.Fatalf("Unexpected error for valid args: %s", err.Error())
+	}
+
+	tooFrequent := valid
+	tooFrequent.RefreshInterval = time.Second
+	if err := validateExporterArgs(tooFrequent); err == nil {
+		t.Fatal("Expected to get an error for a refresh interval of 1s, but got nil")
+	}
+
+	twoSelectors := valid
+	twoSelectors.InstanceId = "i-1"
+	if err := validateExporterArgs(twoSelectors); err == nil {
+		t.Fatal("Expected to get an error for both '--instance-id' and '--tag', but got nil")
+	}
+}
+
+func createTestImage(imageId string, state string, creationDate time.Time) *ec2.Image {
+	return &ec2.Image{
+		ImageId: aws.String(imageId),
+		Name: aws.String(imageId),
+		State: aws.String(state),
+		CreationDate: aws.String(creationDate.UTC().Format(time.RFC3339Nano)),
+	}
+}
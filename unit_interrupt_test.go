@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+func TestCommandContextTimesOut(t *testing.T) {
+	t.Parallel()
+
+	_, ui := createLoggerAndUi("TestCommandContextTimesOut")
+	ctx, stop := newCommandContext(10 * time.Millisecond, ui)
+	defer stop()
+
+	if err := cancellationError(ctx); err != nil {
+		t.Fatalf("Expected no error before the timeout, but got %s", err.Error())
+	}
+
+	<-ctx.Done()
+	err := cancellationError(ctx)
+	if err == nil || !strings.Contains(err.Error(), "--timeout=10ms") {
+		t.Fatalf("Expected an error naming the timeout, but got %v", err)
+	}
+	if uninterruptible(ctx).Err() == nil {
+		t.Fatalf("Expected a timeout to cancel the uninterruptible work too")
+	}
+	if failureExitCode(err) != 1 {
+		t.Fatalf("Expected exit code 1 for a timeout, but got %d", failureExitCode(err))
+	}
+}
+
+func TestCommandContextInterrupted(t *testing.T) {
+	t.Parallel()
+
+	_, ui := createLoggerAndUi("TestCommandContextInterrupted")
+	ctx, stop := newCommandContext(0, ui)
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected SIGINT to cancel the context")
+	}
+
+	if uninterruptible(ctx).Err() != nil {
+		t.Fatalf("Expected the first SIGINT to leave the work in progress running")
+	}
+
+	err := cancellationError(ctx)
+	if interrupted, ok := err.(*interruptedError); !ok || interrupted.Signal != os.Interrupt {
+		t.Fatalf("Expected an interrupted error for SIGINT, but got %v", err)
+	}
+	if failureExitCode(err) != EXIT_CODE_INTERRUPTED {
+		t.Fatalf("Expected exit code %d, but got %d", EXIT_CODE_INTERRUPTED, failureExitCode(err))
+	}
+}
+
+func TestExplainCancellation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceledErr := awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled)
+	otherErr := errors.New("instance not found")
+
+	if err := explainCancellation(ctx, canceledErr); err != canceledErr {
+		t.Fatalf("Expected errors to be unchanged while the context isn't done, but got %v", err)
+	}
+
+	cancel()
+	if err := explainCancellation(ctx, canceledErr); err != context.Canceled {
+		t.Fatalf("Expected a canceled AWS call to be explained by the context, but got %v", err)
+	}
+	if err := explainCancellation(ctx, otherErr); err != otherErr {
+		t.Fatalf("Expected other errors to be unchanged, but got %v", err)
+	}
+}
+
+func TestForEachInstanceStartsNothingOnceCancelled(t *testing.T) {
+	t.Parallel()
+
+	_, ui := createLoggerAndUi("TestForEachInstanceStartsNothingOnceCancelled")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	refs := []instanceRef{instanceRef{Id: "i-1"}, instanceRef{Id: "i-2"}}
+	results := forEachInstance(ctx, refs, 2, ui, func(ref instanceRef, ui cli.Ui) ([]string, error) {
+		t.Fatalf("Expected no instance to be started, but %s was", ref)
+		return nil, nil
+	})
+
+	if len(results) != 2 || results[0].Err != context.Canceled || results[1].Err != context.Canceled {
+		t.Fatalf("Expected both instances to fail with the cancellation, but got %v", results)
+	}
+}
+
+func TestDeleteAmisStartsNothingOnceCancelled(t *testing.T) {
+	t.Parallel()
+
+	_, ui := createLoggerAndUi("TestDeleteAmisStartsNothingOnceCancelled")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	amis := []*ec2.Image{&ec2.Image{ImageId: aws.String("ami-1"), Name: aws.String("ami-1")}}
+	if results := deleteAmis(ctx, amis, nil, nil, false, false, 1, ui); len(results) != 0 {
+		t.Fatalf("Expected no AMI to be started, but got %v", results)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/mitchellh/cli"
+)
+
+func TestExtractLogFlags(t *testing.T) {
+	t.Parallel()
+
+	options, args, err := extractLogFlags([]string{"--log-level=debug", "create", "--instance-id", "i-123", "-log-format", "json", "--log-file=/var/log/ec2-snapper.log", "--dry-run"}, testCommandFlags)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expectedArgs := []string{"create", "--instance-id", "i-123", "--dry-run"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Fatalf("Expected the remaining args to be %v, but got %v", expectedArgs, args)
+	}
+
+	expected := LogOptions{Level: "debug", Format: LOG_FORMAT_JSON, File: "/var/log/ec2-snapper.log", MaxSizeMb: DEFAULT_LOG_MAX_SIZE_MB, MaxBackups: DEFAULT_LOG_MAX_BACKUPS}
+	if options != expected {
+		t.Fatalf("Expected the options %+v, but got %+v", expected, options)
+	}
+}
+
+func TestExtractLogFlagsLeavesValuesOfCommandArgs(t *testing.T) {
+	t.Parallel()
+
+	options, args, err := extractLogFlags([]string{"create", "--ami-name", "--log-level", "--dry-run", "--log-level", "warn"}, testCommandFlags)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expectedArgs := []string{"create", "--ami-name", "--log-level", "--dry-run"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Fatalf("Expected the remaining args to be %v, but got %v", expectedArgs, args)
+	}
+	if options.Level != "warn" {
+		t.Fatalf("Expected the log level warn, but got %s", options.Level)
+	}
+}
+
+func testCommandFlags(name string) *flag.FlagSet {
+	if name == "create" {
+		return (&CreateCommand{}).flags()
+	}
+	return nil
+}
+
+func TestExtractLogFlagsValidates(t *testing.T) {
+	t.Parallel()
+
+	invalidArgs := [][]string{
+		{"create", "--log-level=verbose"},
+		{"create", "--log-format=xml"},
+		{"create", "--log-max-size=-1"},
+		{"create", "--log-max-backups=many"},
+	}
+	for _, args := range invalidArgs {
+		if _, _, err := extractLogFlags(args, testCommandFlags); err == nil {
+			t.Fatalf("Expected to get an error for %v, but got nil", args)
+		}
+	}
+}
+
+func newTestLoggingUi(level logLevel, uiFormat string, file *bytes.Buffer) (*loggingUi, *bytes.Buffer) {
+	var output bytes.Buffer
+	logUi := &loggingUi{
+		Ui: &cli.BasicUi{Writer: &output, ErrorWriter: &output},
+		UiFormat: uiFormat,
+		Level: level,
+		Now: func() time.Time { return time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+	if file != nil {
+		logUi.File = file
+		logUi.FileFormat = LOG_FORMAT_JSON
+	}
+	return logUi, &output
+}
+
+func TestLoggingUiFiltersByLevel(t *testing.T) {
+	t.Parallel()
+
+	logUi, output := newTestLoggingUi(logLevelWarn, LOG_FORMAT_TEXT, nil)
+	logUi.Debug("==> AWS API call", logField{"operation", "DescribeImages"})
+	logUi.Output("==> Creating AMI for i-123...")
+	logUi.Warn("WARNING: Something looks off.")
+	logUi.Error("ERROR: Something failed.")
+
+	expected := "WARNING: Something looks off.\nERROR: Something failed.\n"
+	if output.String() != expected {
+		t.Fatalf("Expected only the warning and error to be shown, but got %q", output.String())
+	}
+}
+
+func TestLoggingUiFormats(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{LOG_FORMAT_TEXT, "==> AWS API call operation=CreateTags resource_ids=ami-123,snap-456 duration_ms=42\n"},
+		{LOG_FORMAT_LOGFMT, "time=2017-01-02T03:04:05.000Z level=debug msg=\"AWS API call\" operation=CreateTags resource_ids=ami-123,snap-456 duration_ms=42\n"},
+		{LOG_FORMAT_JSON, "{\"time\":\"2017-01-02T03:04:05.000Z\",\"level\":\"debug\",\"msg\":\"AWS API call\",\"operation\":\"CreateTags\",\"resource_ids\":[\"ami-123\",\"snap-456\"],\"duration_ms\":42}\n"},
+	}
+
+	for _, testCase := range testCases {
+		logUi, output := newTestLoggingUi(logLevelDebug, testCase.format, nil)
+		logUi.Debug("==> AWS API call", logField{"operation", "CreateTags"}, logField{"resource_ids", []string{"ami-123", "snap-456"}}, logField{"duration_ms", 42})
+		if output.String() != testCase.expected {
+			t.Fatalf("Expected the %s record %q, but got %q", testCase.format, testCase.expected, output.String())
+		}
+	}
+}
+
+func TestLoggingUiWritesFile(t *testing.T) {
+	t.Parallel()
+
+	var file bytes.Buffer
+	logUi, output := newTestLoggingUi(logLevelInfo, LOG_FORMAT_TEXT, &file)
+
+	// The instance prefix added by forEachInstance stays in the record
+	ui := &cli.PrefixedUi{InfoPrefix: "[i-123] ", Ui: &cli.ConcurrentUi{Ui: logUi}}
+	ui.Info("==> Success! Created ami-456")
+
+	if output.String() != "[i-123] ==> Success! Created ami-456\n" {
+		t.Fatalf("Expected the message to be shown unchanged, but got %q", output.String())
+	}
+
+	expected := "{\"time\":\"2017-01-02T03:04:05.000Z\",\"level\":\"info\",\"msg\":\"[i-123] Success! Created ami-456\"}\n"
+	if file.String() != expected {
+		t.Fatalf("Expected the log file to get %q, but got %q", expected, file.String())
+	}
+
+	if findLoggingUi(ui) != logUi {
+		t.Fatal("Expected to find the logging Ui under the prefixed and concurrent Uis")
+	}
+}
+
+func TestCommandResultsIgnoreLogLevelAndFormat(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+	ui, closeUi, err := newCommandUi(LogOptions{Level: "error", Format: LOG_FORMAT_JSON}, &cli.BasicUi{Writer: &output, ErrorWriter: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeUi()
+
+	// Without --region, check prints an UNKNOWN status line without calling AWS
+	checkCommand := &CheckCommand{Ui: ui}
+	if status := checkCommand.Run([]string{"--instance-id=i-1", "--max-age=1d"}); status != NAGIOS_UNKNOWN {
+		t.Fatalf("Expected check to exit with %d, but got %d", NAGIOS_UNKNOWN, status)
+	}
+	if !strings.HasPrefix(output.String(), "EC2-SNAPPER UNKNOWN - ") {
+		t.Fatalf("Expected the status line of check unchanged, but got %q", output.String())
+	}
+
+	output.Reset()
+	iamPolicyCommand := &IamPolicyCommand{Ui: ui}
+	if status := iamPolicyCommand.Run([]string{"--features=create"}); status != 0 {
+		t.Fatalf("Expected iam-policy to exit with 0, but got %d", status)
+	}
+	policy, _ := formatIamPolicy(buildIamPolicy([]string{"create"}, false))
+	if output.String() != policy + "\n" {
+		t.Fatalf("Expected the policy of iam-policy unchanged, but got %q", output.String())
+	}
+}
+
+func TestAwsResourceIds(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		params   interface{}
+		expected []string
+	}{
+		{&ec2.CreateImageInput{InstanceId: aws.String("i-123"), Name: aws.String("my-ami")}, []string{"i-123"}},
+		{&ec2.CreateTagsInput{Resources: aws.StringSlice([]string{"snap-2", "ami-1"})}, []string{"ami-1", "snap-2"}},
+		{&ec2.DescribeImagesInput{ImageIds: aws.StringSlice([]string{"ami-1"}), Owners: aws.StringSlice([]string{"self"})}, []string{"ami-1"}},
+		{&ec2.CopyImageInput{SourceImageId: aws.String("ami-1"), KmsKeyId: aws.String("alias/backups")}, []string{"alias/backups", "ami-1"}},
+		{&ec2.DescribeImagesInput{}, []string{}},
+		{nil, []string{}},
+	}
+
+	for _, testCase := range testCases {
+		actual := awsResourceIds(testCase.params)
+		if !reflect.DeepEqual(actual, testCase.expected) {
+			t.Fatalf("Expected the resource ids %v for %v, but got %v", testCase.expected, testCase.params, actual)
+		}
+	}
+}
+
+func TestRotatingFileRotates(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ec2-snapper-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ec2-snapper.log")
+	file, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, content := range expected {
+		actual, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != content {
+			t.Fatalf("Expected %s to contain %q, but got %q", name, content, string(actual))
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("Expected at most 2 rotated files to be kept")
+	}
+
+	// Appends to the existing file rather than truncating it
+	file, err = openRotatingFile(path, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("fifth\n"))
+	file.Close()
+
+	if actual, _ := ioutil.ReadFile(path); !strings.HasSuffix(string(actual), "fourth\nfifth\n") {
+		t.Fatalf("Expected the log file to be appended to, but got %q", string(actual))
+	}
+}
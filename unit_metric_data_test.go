@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestParseDimensions(t *testing.T) {
+	t.Parallel()
+
+	dimensions, err := parseDimensions([]string{"InstanceName=web-1", "Environment = prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dimensions["InstanceName"] != "web-1" || dimensions["Environment"] != "prod" {
+		t.Fatalf("Unexpected dimensions: %v", dimensions)
+	}
+
+	for _, invalid := range []string{"InstanceName", "=web-1", "InstanceName="} {
+		if _, err := parseDimensions([]string{invalid}); err == nil {
+			t.Fatalf("Expected to get an error for dimension '%s', but got nil", invalid)
+		}
+	}
+
+	if _, err := parseDimensions([]string{"Environment=prod", "Environment=stage"}); err == nil {
+		t.Fatal("Expected to get an error for a duplicate dimension, but got nil")
+	}
+}
+
+func TestValidateMetricUnit(t *testing.T) {
+	t.Parallel()
+
+	if err := validateMetricUnit(cloudwatch.StandardUnitGigabytes); err != nil {
+		t.Fatalf("Unexpected error for a valid unit: %s", err.Error())
+	}
+	if err := validateMetricUnit("Hours"); err == nil {
+		t.Fatal("Expected to get an error for an invalid unit, but got nil")
+	}
+}
+
+func TestBuildMetricDatumUsesDefaults(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	defaults := metricDatumRecord{
+		Unit: cloudwatch.StandardUnitCount,
+		StorageResolution: STANDARD_STORAGE_RESOLUTION,
+		Dimensions: map[string]string{"Environment": "prod", "InstanceName": "default"},
+	}
+	record := metricDatumRecord{
+		Name: "BackupSize",
+		Value: aws.Float64(42),
+		Unit: cloudwatch.StandardUnitGigabytes,
+		Dimensions: map[string]string{"InstanceName": "web-1"},
+	}
+
+	datum, err := buildMetricDatum(record, defaults, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *datum.Unit != cloudwatch.StandardUnitGigabytes || *datum.StorageResolution != STANDARD_STORAGE_RESOLUTION {
+		t.Fatalf("Unexpected unit or storage resolution: %s", datum.String())
+	}
+	if len(datum.Dimensions) != 2 || *datum.Dimensions[0].Name != "Environment" || *datum.Dimensions[1].Value != "web-1" {
+		t.Fatalf("Expected the dimensions of the record to be added to the defaults, but got %s", datum.String())
+	}
+	if datum.Timestamp != nil {
+		t.Fatalf("Expected no timestamp, but got %s", datum.Timestamp)
+	}
+}
+
+func TestBuildMetricDatumValidatesTimestamp(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	defaults := metricDatumRecord{Name: "Backup", Value: aws.Float64(1), Unit: cloudwatch.StandardUnitCount, StorageResolution: HIGH_STORAGE_RESOLUTION}
+
+	recent := metricDatumRecord{Timestamp: now.Add(-1 * time.Hour).Format(time.RFC3339)}
+	if _, err := buildMetricDatum(recent, defaults, now); err != nil {
+		t.Fatalf("Unexpected error for a recent timestamp: %s", err.Error())
+	}
+
+	tooOld := metricDatumRecord{Timestamp: now.Add(-15 * 24 * time.Hour).Format(time.RFC3339)}
+	if _, err := buildMetricDatum(tooOld, defaults, now); err == nil {
+		t.Fatal("Expected to get an error for a timestamp older than two weeks, but got nil")
+	}
+}
+
+func TestParseCsvMetricDatumRecords(t *testing.T) {
+	t.Parallel()
+
+	csv := "name,value,unit,dimensions\nBackupSize,42,Gigabytes,InstanceName=web-1;Environment=prod\nBackupCount,3,,\n"
+	records, err := parseCsvMetricDatumRecords(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, but got %d", len(records))
+	}
+	if records[0].Name != "BackupSize" || *records[0].Value != 42 || records[0].Dimensions["Environment"] != "prod" {
+		t.Fatalf("Unexpected first record: %v", records[0])
+	}
+	if records[1].Unit != "" || len(records[1].Dimensions) != 0 {
+		t.Fatalf("Expected the second record to leave unit and dimensions to the defaults, but got %v", records[1])
+	}
+
+	if _, err := parseCsvMetricDatumRecords(strings.NewReader("name,size\nBackupSize,42\n")); err == nil {
+		t.Fatal("Expected to get an error for an unknown column, but got nil")
+	}
+}
+
+func TestParseJsonMetricDatumRecords(t *testing.T) {
+	t.Parallel()
+
+	json := `[{"Name": "BackupSize", "Value": 42, "Dimensions": {"InstanceName": "web-1"}}, {"Name": "BackupCount"}]`
+	records, err := parseJsonMetricDatumRecords(strings.NewReader(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || *records[0].Value != 42 || records[1].Value != nil {
+		t.Fatalf("Unexpected records: %v", records)
+	}
+}
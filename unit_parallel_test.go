@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mitchellh/cli"
+)
+
+func TestParseInstanceRefsSplitsCommaSeparatedList(t *testing.T) {
+	t.Parallel()
+
+	refs := parseInstanceRefs("i-123, i-456,,i-789", "")
+
+	if len(refs) != 3 {
+		t.Fatalf("Expected 3 instances but got %d", len(refs))
+	}
+
+	if refs[1].Id != "i-456" || refs[1].Name != "" {
+		t.Fatalf("Expected the second instance to be i-456 but got %s", refs[1])
+	}
+}
+
+func TestParseInstanceRefsByName(t *testing.T) {
+	t.Parallel()
+
+	refs := parseInstanceRefs("", "web,db")
+
+	if len(refs) != 2 || refs[0].Name != "web" || refs[1].Name != "db" {
+		t.Fatalf("Expected instances named web and db but got %v", refs)
+	}
+}
+
+func TestRunInParallelCallsEveryIndexOnce(t *testing.T) {
+	t.Parallel()
+
+	const numItems = 50
+
+	var mutex sync.Mutex
+	calls := map[int]int{}
+
+	runInParallel(numItems, 8, func(i int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls[i]++
+	})
+
+	for i := 0; i < numItems; i++ {
+		if calls[i] != 1 {
+			t.Fatalf("Expected index %d to be processed once but it was processed %d times", i, calls[i])
+		}
+	}
+}
+
+func TestForEachInstanceKeepsOutputOfConcurrentInstancesTogether(t *testing.T) {
+	t.Parallel()
+
+	ui := cli.NewMockUi()
+	refs := parseInstanceRefs("i-1,i-2", "")
+
+	// Both instances print their first line before either prints its second
+	var started sync.WaitGroup
+	started.Add(len(refs))
+	forEachInstance(context.Background(), refs, 2, ui, func(ref instanceRef, instanceUi cli.Ui) ([]string, error) {
+		instanceUi.Output("first")
+		started.Done()
+		started.Wait()
+		instanceUi.Output("second")
+		return nil, nil
+	})
+
+	lines := strings.Split(strings.TrimSpace(ui.OutputWriter.String()), "\n")
+	if len(lines) != 4 || lines[0][:6] != lines[1][:6] || lines[2][:6] != lines[3][:6] {
+		t.Fatalf("Expected the output of each instance in one piece, but got %q", lines)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/josh-padnick/ec2-snapper/snapper"
+)
+
+func TestActionsForFeaturesAreDeduplicated(t *testing.T) {
+	t.Parallel()
+
+	actions := actionsForFeatures([]string{"create", "delete"})
+
+	seen := map[string]bool{}
+	for _, action := range actions {
+		if seen[action] {
+			t.Fatalf("Expected every action to appear once, but %s appeared more than once", action)
+		}
+		seen[action] = true
+	}
+
+	if !seen["ec2:CreateImage"] || !seen["ec2:DeregisterImage"] || seen["cloudwatch:PutMetricData"] {
+		t.Fatalf("Expected the actions of exactly create and delete, but got %v", actions)
+	}
+}
+
+func TestParseFeaturesRejectsUnknownFeature(t *testing.T) {
+	t.Parallel()
+
+	if _, err := parseFeatures("create,not-a-feature"); err == nil {
+		t.Fatal("Expected to get an error for an unknown feature, but got nil")
+	}
+}
+
+func TestBuildIamPolicyScopedByTag(t *testing.T) {
+	t.Parallel()
+
+	policy := buildIamPolicy([]string{"delete"}, true)
+
+	if len(policy.Statement) != 2 {
+		t.Fatalf("Expected an unscoped and a scoped statement, but got %d statement(s)", len(policy.Statement))
+	}
+
+	scoped := policy.Statement[1]
+	for _, action := range scoped.Action {
+		if !destructiveActions[action] {
+			t.Fatalf("Expected only destructive actions to be scoped by tag, but %s was", action)
+		}
+	}
+	if scoped.Condition["Null"]["ec2:ResourceTag/" + snapper.INSTANCE_ID_TAG] != "false" {
+		t.Fatalf("Expected the scoped statement to require the %s tag, but got %v", snapper.INSTANCE_ID_TAG, scoped.Condition)
+	}
+}
+
+func TestPrincipalArnForSimulationConvertsAssumedRole(t *testing.T) {
+	t.Parallel()
+
+	arn := principalArnForSimulation("arn:aws:sts::123456789012:assumed-role/backup-role/i-0abc123")
+	if arn != "arn:aws:iam::123456789012:role/backup-role" {
+		t.Fatalf("Expected the ARN of the role, but got %s", arn)
+	}
+
+	userArn := "arn:aws:iam::123456789012:user/alice"
+	if arn := principalArnForSimulation(userArn); arn != userArn {
+		t.Fatalf("Expected the ARN of a user to be unchanged, but got %s", arn)
+	}
+}
+
+func TestActionsForOrganizationalUnitFanOut(t *testing.T) {
+	t.Parallel()
+
+	actions := actionsForFeatures([]string{"organizational-unit"})
+	expected := []string{"organizations:ListAccountsForParent", "organizations:ListOrganizationalUnitsForParent", "sts:AssumeRole"}
+	if strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected the actions %v, but got %v", expected, actions)
+	}
+}
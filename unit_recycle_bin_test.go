@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/recyclebin"
+	"github.com/josh-padnick/ec2-snapper/snapper"
+)
+
+func TestRecycleBinRuleCovers(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		rule     *recyclebin.GetRuleOutput
+		expected bool
+	}{
+		{&recyclebin.GetRuleOutput{Status: aws.String(recyclebin.RuleStatusAvailable)}, true},
+		{&recyclebin.GetRuleOutput{Status: aws.String(recyclebin.RuleStatusPending)}, false},
+		{createTestRecycleBinRule(snapper.INSTANCE_ID_TAG, ""), true},
+		{createTestRecycleBinRule(snapper.INSTANCE_ID_TAG, "i-1"), true},
+		{createTestRecycleBinRule(snapper.INSTANCE_ID_TAG, "i-2"), false},
+		{createTestRecycleBinRule("Backup", "nightly"), false},
+	}
+
+	for i, testCase := range testCases {
+		if covers := recycleBinRuleCovers(testCase.rule, "i-1"); covers != testCase.expected {
+			t.Fatalf("Expected %t for rule %d, but got %t", testCase.expected, i, covers)
+		}
+	}
+}
+
+func TestIsSoftDeletedFrom(t *testing.T) {
+	t.Parallel()
+
+	description := snapper.SoftDeleteDescription("i-1", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	if !isSoftDeletedFrom(description, "i-1") {
+		t.Fatalf("Expected %s to be soft-deleted from i-1", description)
+	}
+	if isSoftDeletedFrom(description, "i-12") || isSoftDeletedFrom("", "i-1") {
+		t.Fatal("Expected only descriptions set for i-1 to match")
+	}
+}
+
+func TestSelectSoftDeletedImages(t *testing.T) {
+	t.Parallel()
+
+	day := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	images := []*ec2.ImageRecycleBinInfo{
+		createTestRecycleBinImage("ami-3", snapper.SoftDeleteDescription("i-1", day), day.Add(2 * time.Hour)),
+		createTestRecycleBinImage("ami-1", snapper.SoftDeleteDescription("i-1", day), day.Add(-time.Hour)),
+		createTestRecycleBinImage("ami-2", snapper.SoftDeleteDescription("i-1", day), day.Add(time.Hour)),
+		createTestRecycleBinImage("ami-4", snapper.SoftDeleteDescription("i-2", day), day.Add(time.Hour)),
+		createTestRecycleBinImage("ami-5", "", day.Add(time.Hour)),
+	}
+
+	selected := selectSoftDeletedImages(images, "i-1", time.Time{}, time.Time{})
+	if len(selected) != 3 || *selected[0].ImageId != "ami-1" || *selected[2].ImageId != "ami-3" {
+		t.Fatalf("Expected ami-1, ami-2 and ami-3 oldest first, but got %v", selected)
+	}
+
+	selected = selectSoftDeletedImages(images, "i-1", day, day.Add(2 * time.Hour))
+	if len(selected) != 1 || *selected[0].ImageId != "ami-2" {
+		t.Fatalf("Expected only ami-2, but got %v", selected)
+	}
+}
+
+func TestParseDeletionTimeRange(t *testing.T) {
+	t.Parallel()
+
+	after, before, err := parseDeletionTimeRange("2016-09-14T00:00:00Z", "")
+	if err != nil || after.IsZero() || !before.IsZero() {
+		t.Fatalf("Expected an open range after 2016-09-14, but got %s - %s (%v)", after, before, err)
+	}
+
+	if _, _, err := parseDeletionTimeRange("2016-09-15T00:00:00Z", "2016-09-14T00:00:00Z"); err == nil {
+		t.Fatal("Expected to get an error for an empty range, but got nil")
+	}
+}
+
+func TestValidateDeleteArgsSoftDelete(t *testing.T) {
+	t.Parallel()
+
+	c := DeleteCommand{AwsRegion: "us-west-2", InstanceId: "i-1", OlderThan: "30d", RecycleBinRetentionDays: 7}
+	if err := validateDeleteArgs(c); err == nil {
+		t.Fatal("Expected to get an error for '--recycle-bin-retention-days' without '--soft-delete', but got nil")
+	}
+
+	c.SoftDelete = true
+	if err := validateDeleteArgs(c); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	c.RecycleBinRetentionDays = 400
+	if err := validateDeleteArgs(c); err == nil {
+		t.Fatal("Expected to get an error for a retention period over a year, but got nil")
+	}
+}
+
+func createTestRecycleBinRule(key string, value string) *recyclebin.GetRuleOutput {
+	tag := &recyclebin.ResourceTag{ResourceTagKey: aws.String(key)}
+	if value != "" {
+		tag.ResourceTagValue = aws.String(value)
+	}
+	return &recyclebin.GetRuleOutput{
+		Status: aws.String(recyclebin.RuleStatusAvailable),
+		ResourceTags: []*recyclebin.ResourceTag{tag},
+	}
+}
+
+func createTestRecycleBinImage(imageId string, description string, deletedAt time.Time) *ec2.ImageRecycleBinInfo {
+	return &ec2.ImageRecycleBinInfo{
+		ImageId: aws.String(imageId),
+		Description: aws.String(description),
+		RecycleBinEnterTime: aws.Time(deletedAt),
+	}
+}
+
+func TestValidateUndeleteArgsRequiresSingleTarget(t *testing.T) {
+	t.Parallel()
+
+	if err := validateUndeleteArgs(UndeleteCommand{AwsRegion: "us-west-2", InstanceId: "i-1"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if err := validateUndeleteArgs(UndeleteCommand{AwsRegion: "us-east-1,us-west-2", InstanceId: "i-1"}); err == nil {
+		t.Fatal("Expected to get an error for several regions, but got nil")
+	}
+}
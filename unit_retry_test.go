@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestComputeRetryDelayDoublesWithEveryRetry(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, Jitter: 0}
+
+	testComputeRetryDelay(policy, 0, 0, 100 * time.Millisecond, t)
+	testComputeRetryDelay(policy, 1, 0, 200 * time.Millisecond, t)
+	testComputeRetryDelay(policy, 3, 0, 800 * time.Millisecond, t)
+}
+
+func TestComputeRetryDelayIsCapped(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{MaxAttempts: 100, BaseDelay: time.Second, Jitter: 0}
+
+	testComputeRetryDelay(policy, 10, 0, MAX_RETRY_DELAY, t)
+	testComputeRetryDelay(policy, 99, 0, MAX_RETRY_DELAY, t)
+
+	// A base delay that overflows when doubled must still be capped
+	testComputeRetryDelay(RetryPolicy{BaseDelay: time.Duration(1) << 60}, 5, 0, MAX_RETRY_DELAY, t)
+}
+
+func TestComputeRetryDelayAppliesJitter(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, Jitter: 0.5}
+
+	testComputeRetryDelay(policy, 0, 0, time.Second, t)
+	testComputeRetryDelay(policy, 0, 0.5, 750 * time.Millisecond, t)
+	testComputeRetryDelay(policy, 1, 0.5, 1500 * time.Millisecond, t)
+}
+
+func TestValidateRetryPolicyRejectsInvalidJitter(t *testing.T) {
+	t.Parallel()
+
+	if err := validateRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, Jitter: 1.5}); err == nil {
+		t.Fatal("Expected to get an error for a jitter greater than 1, but got nil")
+	}
+}
+
+func testComputeRetryDelay(policy RetryPolicy, retryCount int, random float64, expectedDelay time.Duration, t *testing.T) {
+	delay := computeRetryDelay(policy, retryCount, random)
+	if delay != expectedDelay {
+		t.Fatalf("Expected a delay of %s for retry %d but got %s", expectedDelay, retryCount, delay)
+	}
+}
+
+func TestRetryFlagsKeepExplicitZeros(t *testing.T) {
+	t.Parallel()
+
+	var policy RetryPolicy
+	cmdFlags := flag.NewFlagSet("test", flag.ContinueOnError)
+	addRetryFlags(cmdFlags, &policy)
+	if err := cmdFlags.Parse([]string{"--retry-base-delay=0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateRetryPolicy(policy); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if actual := policy.withDefaults(); actual.BaseDelay != 0 || actual.MaxAttempts != DEFAULT_RETRY_MAX_ATTEMPTS {
+		t.Fatalf("Expected an explicit base delay of 0 to be kept, but got %+v", actual)
+	}
+
+	if err := cmdFlags.Parse([]string{"--retry-max-attempts=0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateRetryPolicy(policy); err == nil {
+		t.Fatal("Expected to get an error for 0 max attempts, but got nil")
+	}
+}
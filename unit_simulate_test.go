@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateSimulateArgs(t *testing.T) {
+	t.Parallel()
+
+	valid := SimulateCommand{OlderThan: "30d", Interval: DEFAULT_BACKUP_INTERVAL, Days: DEFAULT_SIMULATION_DAYS}
+	if err := validateSimulateArgs(valid); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	withoutRegion := valid
+	withoutRegion.InstanceId = "i-1"
+	if err := validateSimulateArgs(withoutRegion); err == nil {
+		t.Fatal("Expected to get an error for an instance without a region, but got nil")
+	}
+
+	severalRegions := withoutRegion
+	severalRegions.AwsRegion = "us-east-1,us-west-2"
+	if err := validateSimulateArgs(severalRegions); err == nil {
+		t.Fatal("Expected to get an error for an instance in several regions, but got nil")
+	}
+
+	invalidInterval := valid
+	invalidInterval.Interval = "daily"
+	if err := validateSimulateArgs(invalidInterval); err == nil {
+		t.Fatal("Expected to get an error for an invalid interval, but got nil")
+	}
+}
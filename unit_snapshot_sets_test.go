@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestGroupSnapshotsIntoSetsGroupsByBatchId(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	snapshots := []*ec2.Snapshot{
+		createTestSnapshot("snap-1", "batch-new", now.Add(-1 * time.Hour)),
+		createTestSnapshot("snap-2", "batch-old", now.Add(-48 * time.Hour)),
+		createTestSnapshot("snap-3", "batch-new", now.Add(-2 * time.Hour)),
+		createTestSnapshot("snap-4", "", now.Add(-72 * time.Hour)),
+	}
+
+	sets := groupSnapshotsIntoSets(snapshots)
+
+	if len(sets) != 2 {
+		t.Fatalf("Expected 2 snapshot sets but got %d", len(sets))
+	}
+
+	if sets[0].BatchId != "batch-old" || len(sets[0].Snapshots) != 1 {
+		t.Fatalf("Expected the oldest set to be batch-old with 1 snapshot, but got %s with %d", sets[0].BatchId, len(sets[0].Snapshots))
+	}
+
+	if sets[1].BatchId != "batch-new" || len(sets[1].Snapshots) != 2 {
+		t.Fatalf("Expected the newest set to be batch-new with 2 snapshots, but got %s with %d", sets[1].BatchId, len(sets[1].Snapshots))
+	}
+
+	if !sets[1].StartTime.Equal(now.Add(-2 * time.Hour)) {
+		t.Fatalf("Expected the start time of batch-new to be the start time of its oldest snapshot, but got %s", sets[1].StartTime)
+	}
+}
+
+func TestFilterSnapshotSetsByDateRange(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	sets := []*snapshotSet{
+		&snapshotSet{BatchId: "batch-old", StartTime: now.Add(-48 * time.Hour)},
+		&snapshotSet{BatchId: "batch-new", StartTime: now.Add(-1 * time.Hour)},
+	}
+
+	filteredSets := filterSnapshotSetsByDateRange(sets, 24)
+
+	if len(filteredSets) != 1 || filteredSets[0].BatchId != "batch-old" {
+		t.Fatalf("Expected only batch-old to be older than 24 hours, but got %d sets", len(filteredSets))
+	}
+}
+
+func createTestSnapshot(snapshotId string, batchId string, startTime time.Time) *ec2.Snapshot {
+	snapshot := &ec2.Snapshot{
+		SnapshotId: aws.String(snapshotId),
+		StartTime: aws.Time(startTime),
+	}
+
+	if batchId != "" {
+		snapshot.Tags = []*ec2.Tag{
+			&ec2.Tag{ Key: aws.String(EC2_SNAPPER_BATCH_ID_TAG), Value: aws.String(batchId) },
+		}
+	}
+
+	return snapshot
+}
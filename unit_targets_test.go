@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResolveTargetsCombinesRolesAndRegions(t *testing.T) {
+	t.Parallel()
+
+	_, ui := createLoggerAndUi("TestResolveTargetsCombinesRolesAndRegions")
+	options := AwsOptions{RoleArn: "arn:aws:iam::111111111111:role/backup,arn:aws:iam::222222222222:role/backup"}
+
+	targets, err := resolveTargets(context.Background(), "us-east-1,us-west-2", options, nil, ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(targets) != 4 {
+		t.Fatalf("Expected 4 combinations of account and region, but got %d", len(targets))
+	}
+
+	if targets[1].String() != "account 111111111111 / us-west-2" {
+		t.Fatalf("Expected the second target to be account 111111111111 in us-west-2, but got %s", targets[1])
+	}
+}
+
+func TestResolveTargetsWithoutRoleUsesCurrentAccount(t *testing.T) {
+	t.Parallel()
+
+	_, ui := createLoggerAndUi("TestResolveTargetsWithoutRoleUsesCurrentAccount")
+
+	targets, err := resolveTargets(context.Background(), "us-east-1", AwsOptions{}, nil, ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(targets) != 1 || targets[0].RoleArn != "" || targets[0].Region != "us-east-1" {
+		t.Fatalf("Expected only the current account in us-east-1, but got %v", targets)
+	}
+}
+
+func TestValidateTargetOptionsRequiresRoleName(t *testing.T) {
+	t.Parallel()
+
+	if err := validateTargetOptions(AwsOptions{OrganizationalUnit: "ou-ab12-cd34ef56"}); err == nil {
+		t.Fatal("Expected to get an error for '--organizational-unit' without '--role-name', but got nil")
+	}
+}
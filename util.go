@@ -22,4 +22,14 @@ func UniqueId() string {
 
 	return out.String()
 
-}
\ No newline at end of file
+}
+
+// Return true if the given values contain the given value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}